@@ -10,9 +10,12 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	database "github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
 )
 
-var InvalidAccountsError = errors.New("invalid transfer, account ids are not found")
+var InvalidAccountsError = problem.New(problem.AccountNotFound, "invalid transfer, account ids are not found")
 
 type FundsError struct {
 	balance string
@@ -22,6 +25,10 @@ func (fe *FundsError) Error() string {
 	return fmt.Sprintf("insufficient funds, balance: %s", fe.balance)
 }
 
+func (fe *FundsError) ErrorCode() problem.Code {
+	return problem.InsufficientFunds
+}
+
 type InvalidTransferError struct {
 	MissingAccountID int
 }
@@ -30,30 +37,42 @@ func (te *InvalidTransferError) Error() string {
 	return fmt.Sprintf("invalid transfer, account id %d not found", te.MissingAccountID)
 }
 
+func (te *InvalidTransferError) ErrorCode() problem.Code {
+	return problem.AccountNotFound
+}
+
+// VersionMismatchError is returned by conditional writes when the account is no longer at the expected version.
+type VersionMismatchError struct {
+	AccountID int
+	Version   int
+}
+
+func (ve *VersionMismatchError) Error() string {
+	return fmt.Sprintf("account id %d is not at version %d", ve.AccountID, ve.Version)
+}
+
+func (ve *VersionMismatchError) ErrorCode() problem.Code {
+	return problem.VersionMismatch
+}
+
 type Account struct {
 	ID               int       `json:"id" db:"id"`
 	CustomerID       int       `json:"customerId" db:"customer_id"`
 	BalanceInDecimal int64     `json:"balanceInDecimal" db:"balance_in_decimal"`
 	Currency         string    `json:"currency,omitempty" db:"currency"`
+	Product          string    `json:"product" db:"product"`
 	CreatedAt        time.Time `json:"createdAt" db:"created_at"`
 	ModifiedAt       time.Time `json:"modifiedAt" db:"modified_at"`
 	Frozen           bool      `json:"frozen" db:"frozen"`
+	// Version is incremented on every write of the account
+	Version  int               `json:"version" db:"version"`
+	Metadata metadata.Metadata `json:"metadata" db:"metadata"`
 }
 
-func SelectAll(db *sqlx.DB) (*[]Account, error) {
-	accounts := make([]Account, 0)
-
-	if err := db.Select(&accounts, selectAll); err != nil {
-		return nil, err
-	}
-
-	return &accounts, nil
-}
-
-func SelectById(db *sqlx.DB, id int) (*Account, error) {
+func SelectById(ctx context.Context, db *sqlx.DB, id int) (*Account, error) {
 	var acc Account
 
-	stmt, err := db.Preparex(selectById)
+	stmt, err := db.PreparexContext(ctx, selectById)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +83,7 @@ func SelectById(db *sqlx.DB, id int) (*Account, error) {
 		}
 	}()
 
-	row := stmt.QueryRowx(id)
+	row := stmt.QueryRowxContext(ctx, id)
 
 	if err := row.StructScan(&acc); err != nil {
 		return nil, err
@@ -73,30 +92,38 @@ func SelectById(db *sqlx.DB, id int) (*Account, error) {
 	return &acc, nil
 }
 
-func Create(db *sqlx.DB, customerId int, ar AccCreationRequest) (*Account, error) {
-	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+func Create(ctx context.Context, db *sqlx.DB, customerId int, ar AccCreationRequest) (*Account, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return nil, err
 	}
 
 	m := money.New(ar.InitialBalance, ar.Currency)
 
+	product := ar.Product
+	if product == "" {
+		product = BasicProduct
+	}
+
 	acc := &Account{
 		CustomerID:       customerId,
 		BalanceInDecimal: m.Amount(),
 		Currency:         m.Currency().Code,
+		Product:          product,
 		CreatedAt:        time.Now().UTC(),
 		ModifiedAt:       time.Now().UTC(),
 		Frozen:           false,
+		Version:          1,
+		Metadata:         ar.Metadata,
 	}
 
-	stmt, err := tx.Prepare(insert)
+	stmt, err := tx.PrepareContext(ctx, insert)
 	if err != nil {
 		_ = tx.Rollback()
 		return nil, err
 	}
 
-	row := stmt.QueryRow(acc.CustomerID, acc.BalanceInDecimal, acc.Currency, acc.CreatedAt, acc.ModifiedAt)
+	row := stmt.QueryRowContext(ctx, acc.CustomerID, acc.BalanceInDecimal, acc.Currency, acc.Product, acc.CreatedAt, acc.ModifiedAt, acc.Metadata)
 
 	if err = row.Scan(&acc.ID); err != nil {
 		_ = tx.Rollback()
@@ -113,53 +140,79 @@ func Create(db *sqlx.DB, customerId int, ar AccCreationRequest) (*Account, error
 	return acc, nil
 }
 
-func Delete(db *sqlx.DB, id int) error {
-	if _, err := SelectById(db, id); errors.Cause(err) == sql.ErrNoRows {
-		return sql.ErrNoRows
+// Delete removes the account and returns it as it was before the deletion. A non-zero version makes the
+// deletion conditional, it fails with VersionMismatchError if the account is at another version.
+func Delete(ctx context.Context, db *sqlx.DB, id int, version int) (*Account, error) {
+	acc, err := SelectById(ctx, db, id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
 	}
 
-	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err = tx.Exec(deleteById, id); err != nil {
+	res, err := tx.ExecContext(ctx, deleteById, id, version)
+	if err != nil {
 		_ = tx.Rollback()
 		log.Warnf("account deletion for id %d was rolled back, error: %v", id, err)
-		return err
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	// the account was changed or deleted since it was selected
+	if n == 0 {
+		_ = tx.Rollback()
+		return nil, notAtVersion(id, version)
 	}
 
 	if err = tx.Commit(); err != nil {
 		log.Errorf("failed to commit account deletion for account id %d, error: %v", id, err)
-		return err
+		return nil, err
 	}
 
 	log.Infof("successfully deleted account with id %d", id)
 
-	return nil
+	return acc, nil
 }
 
-func Freeze(db *sqlx.DB, id int) (*Account, error) {
-	acc, err := SelectById(db, id)
+// Freeze sets the frozen flag of the account and increments its version. A non-zero version makes the freeze
+// conditional, it fails with VersionMismatchError if the account is at another version.
+func Freeze(ctx context.Context, db *sqlx.DB, id int, version int) (*Account, error) {
+	acc, err := SelectById(ctx, db, id)
 	if errors.Cause(err) == sql.ErrNoRows {
 		return nil, sql.ErrNoRows
+	} else if err != nil {
+		return nil, err
 	}
 
-	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return nil, err
 	}
 
 	modifiedAt := time.Now().UTC()
 
-	stmt, err := tx.Prepare(freezeById)
+	stmt, err := tx.PrepareContext(ctx, freezeById)
 	if err != nil {
 		_ = tx.Rollback()
 		return nil, err
 	}
 
-	if _, err = stmt.Exec(modifiedAt, id); err != nil {
+	if err = stmt.QueryRowContext(ctx, modifiedAt, id, version).Scan(&acc.Version); err != nil {
 		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, notAtVersion(id, version)
+		}
 		log.Warnf("freeze account for id %d was rolled back, error: %v", id, err)
 		return nil, err
 	}
@@ -177,18 +230,83 @@ func Freeze(db *sqlx.DB, id int) (*Account, error) {
 	return acc, nil
 }
 
-func Deposit(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
-	defer cancelFunc()
+// Update applies the patch to the account, which is locked until the update is committed. A non-zero version makes
+// the update conditional, it fails with VersionMismatchError if the account is at another version.
+func Update(ctx context.Context, db *sqlx.DB, id int, version int, p Patch) (*Account, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+
+	var acc Account
+	if err = tx.QueryRowxContext(ctx, selectByIdForUpdate, id).StructScan(&acc); err != nil {
+		_ = tx.Rollback()
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if version != 0 && acc.Version != version {
+		_ = tx.Rollback()
+		return nil, &VersionMismatchError{AccountID: id, Version: version}
+	}
+
+	if err = p.apply(&acc); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	acc.ModifiedAt = time.Now().UTC()
+
+	if err = tx.QueryRowContext(ctx, updateAccount, acc.Product, acc.Metadata, acc.ModifiedAt, id).Scan(&acc.Version); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("update of account id %d was rolled back, error: %v", id, err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("failed to commit update of account id %d, error: %v", id, err)
+		return nil, err
+	}
+
+	log.Infof("successfully updated account with id %d", id)
+
+	return &acc, nil
+}
+
+// notAtVersion is the error of a conditional write that didn't find the account, without an expected version
+// the account was deleted concurrently.
+func notAtVersion(id int, version int) error {
+	if version == 0 {
+		return sql.ErrNoRows
+	}
+
+	return &VersionMismatchError{AccountID: id, Version: version}
+}
+
+// Deposit adds the amount to the balance of the account. The account is locked until the deposit is committed,
+// the deposit is run again if it fails due to a concurrent transaction.
+func Deposit(ctx context.Context, db *sqlx.DB, id int, amount int64) (*money.Money, error) {
+	var balance *money.Money
+	err := database.Retry(ctx, fmt.Sprintf("deposit to account id %d", id), func() error {
+		var err error
+		balance, err = deposit(ctx, db, id, amount)
+		return err
+	})
+
+	return balance, err
+}
+
+func deposit(ctx context.Context, db *sqlx.DB, id int, amount int64) (*money.Money, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return nil, err
 	}
 
 	var acc Account
 
-	row := tx.QueryRowx(selectById, id)
+	row := tx.QueryRowxContext(ctx, selectByIdForUpdate, id)
 
 	err = row.StructScan(&acc)
 	if errors.Cause(err) == sql.ErrNoRows {
@@ -207,12 +325,13 @@ func Deposit(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
 		return nil, err
 	}
 
-	stmt, err := tx.Prepare(updateBalance)
+	stmt, err := tx.PrepareContext(ctx, updateBalance)
 	if err != nil {
+		_ = tx.Rollback()
 		return nil, err
 	}
 
-	if _, err = stmt.Exec(newBalance.Amount(), time.Now().UTC(), id); err != nil {
+	if _, err = stmt.ExecContext(ctx, newBalance.Amount(), time.Now().UTC(), id); err != nil {
 		_ = tx.Rollback()
 		log.Warnf("deposit for account id %d was rolled back, error: %v", id, err)
 		return nil, err
@@ -228,18 +347,28 @@ func Deposit(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
 	return newBalance, nil
 }
 
-func Withdraw(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
-	defer cancelFunc()
+// Withdraw subtracts the amount from the balance of the account. The account is locked until the withdraw is
+// committed, the withdraw is run again if it fails due to a concurrent transaction.
+func Withdraw(ctx context.Context, db *sqlx.DB, id int, amount int64) (*money.Money, error) {
+	var balance *money.Money
+	err := database.Retry(ctx, fmt.Sprintf("withdraw from account id %d", id), func() error {
+		var err error
+		balance, err = withdraw(ctx, db, id, amount)
+		return err
+	})
+
+	return balance, err
+}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+func withdraw(ctx context.Context, db *sqlx.DB, id int, amount int64) (*money.Money, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return nil, err
 	}
 
 	var acc Account
 
-	row := tx.QueryRowx(selectById, id)
+	row := tx.QueryRowxContext(ctx, selectByIdForUpdate, id)
 
 	err = row.StructScan(&acc)
 	if errors.Cause(err) == sql.ErrNoRows {
@@ -266,13 +395,13 @@ func Withdraw(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
 		return nil, err
 	}
 
-	stmt, err := tx.Prepare(updateBalance)
+	stmt, err := tx.PrepareContext(ctx, updateBalance)
 	if err != nil {
 		_ = tx.Rollback()
 		return nil, err
 	}
 
-	if _, err = stmt.Exec(newBalance.Amount(), time.Now().UTC(), id); err != nil {
+	if _, err = stmt.ExecContext(ctx, newBalance.Amount(), time.Now().UTC(), id); err != nil {
 		_ = tx.Rollback()
 		log.Warnf("withdraw from account id %d was rolled back, error: %v", id, err)
 		return nil, err
@@ -288,17 +417,28 @@ func Withdraw(db *sqlx.DB, id int, amount int64) (*money.Money, error) {
 	return newBalance, nil
 }
 
-func Transfer(db *sqlx.DB, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second)
-	defer cancelFunc()
+// Transfer moves the amount between the accounts. Both accounts are locked until the transfer is committed, the
+// one with the lower id first so concurrent transfers between the same accounts can't deadlock. The transfer is
+// run again if it fails due to a concurrent transaction.
+func Transfer(ctx context.Context, db *sqlx.DB, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
+	var fromBalance, toBalance *money.Money
+	err := database.Retry(ctx, fmt.Sprintf("transfer from account id %d to account id %d", fromId, toId), func() error {
+		var err error
+		fromBalance, toBalance, err = transfer(ctx, db, fromId, toId, amount)
+		return err
+	})
+
+	return fromBalance, toBalance, err
+}
 
-	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+func transfer(ctx context.Context, db *sqlx.DB, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 	if err != nil {
 		return nil, nil, err
 	}
 
 	accounts := make([]Account, 0)
-	if err = tx.Select(&accounts, selectTwoById, fromId, toId); err != nil {
+	if err = tx.SelectContext(ctx, &accounts, selectTwoByIdForUpdate, fromId, toId); err != nil {
 		_ = tx.Rollback()
 		return nil, nil, err
 	}
@@ -342,13 +482,13 @@ func Transfer(db *sqlx.DB, fromId int, toId int, amount int64) (*money.Money, *m
 
 	modifiedAt := time.Now().UTC()
 
-	stmt, err := tx.Prepare(updateBalances)
+	stmt, err := tx.PrepareContext(ctx, updateBalances)
 	if err != nil {
 		_ = tx.Rollback()
 		return nil, nil, err
 	}
 
-	if _, err = stmt.Exec(from.ID, fromNewBalance.Amount(), modifiedAt, to.ID, toNewBalance.Amount(), modifiedAt); err != nil {
+	if _, err = stmt.ExecContext(ctx, from.ID, fromNewBalance.Amount(), modifiedAt, to.ID, toNewBalance.Amount(), modifiedAt); err != nil {
 		_ = tx.Rollback()
 		log.Warnf("transfer from account id %d to account id %d was rolled back, error: %v", fromId, toId, err)
 		return nil, nil, err
@@ -1,65 +1,28 @@
 package account
 
 import (
+	"context"
 	"database/sql"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
 )
 
 var customerId = 22
 
-func TestSelectAll(t *testing.T) {
-	db, mock := NewMockDb()
-	defer db.Close()
-
-	query := "SELECT \\* FROM accounts;"
-
-	utc := time.Now().UTC()
-	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "created_at", "modified_at", "frozen"}).
-		AddRow(11, 22, 99900, "EUR", utc, utc, false)
-
-	mock.ExpectQuery(query).WillReturnRows(rows)
-
-	accounts, err := SelectAll(db)
-
-	assert.NoError(t, err)
-	assert.Len(t, *accounts, 1)
-
-	actualAcc := (*accounts)[0]
-	assert.Equal(t, 11, actualAcc.ID)
-	assert.Equal(t, 22, actualAcc.CustomerID)
-	assert.Equal(t, int64(99900), actualAcc.BalanceInDecimal)
-	assert.Equal(t, "EUR", actualAcc.Currency)
-	assert.NotNil(t, actualAcc.CreatedAt)
-	assert.NotNil(t, actualAcc.ModifiedAt)
-	assert.False(t, actualAcc.Frozen)
-}
-
-func TestSelectAllError(t *testing.T) {
-	db, mock := NewMockDb()
-	defer db.Close()
-
-	query := "SELECT \\* FROM accounts;"
-
-	mock.ExpectQuery(query).WillReturnError(errors.New("sql: statement is closed"))
-
-	accounts, err := SelectAll(db)
-
-	assert.Nil(t, accounts)
-	assert.Error(t, err)
-}
-
 func TestSelectById(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	query := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -69,7 +32,7 @@ func TestSelectById(t *testing.T) {
 
 	mock.ExpectPrepare(query).ExpectQuery().WithArgs(1).WillReturnRows(rows)
 
-	actualAcc, err := SelectById(db, accId)
+	actualAcc, err := SelectById(context.Background(), db, accId)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, actualAcc)
@@ -86,11 +49,11 @@ func TestSelectByIdError(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	query := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	mock.ExpectPrepare(query).ExpectQuery().WithArgs(1).WillReturnError(sql.ErrNoRows)
 
-	_, err := SelectById(db, 1)
+	_, err := SelectById(context.Background(), db, 1)
 
 	assert.Error(t, err)
 }
@@ -99,7 +62,7 @@ func TestCreate(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "INSERT INTO accounts\\(customer_id, balance_in_decimal, currency, created_at, modified_at\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5\\) RETURNING id;"
+	query := "INSERT INTO accounts\\(customer_id, balance_in_decimal, currency, product, created_at, modified_at, metadata\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6,\\$7\\) RETURNING id;"
 
 	rows := sqlmock.NewRows([]string{"id"}).AddRow(11)
 
@@ -112,11 +75,11 @@ func TestCreate(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectPrepare(query).ExpectQuery().WithArgs(customerId, request.InitialBalance, request.Currency, sqlmock.AnyArg(), sqlmock.AnyArg()).
+	mock.ExpectPrepare(query).ExpectQuery().WithArgs(customerId, request.InitialBalance, request.Currency, BasicProduct, sqlmock.AnyArg(), sqlmock.AnyArg(), "{}").
 		WillReturnRows(rows)
 	mock.ExpectCommit()
 
-	actualAcc, err := Create(db, customerId, request)
+	actualAcc, err := Create(context.Background(), db, customerId, request)
 
 	if err != nil {
 		t.Errorf("account creation test failed err expected nil but got: %v:", err)
@@ -136,7 +99,7 @@ func TestCreateError(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "INSERT INTO accounts\\(customer_id, balance_in_decimal, currency, created_at, modified_at\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5\\) RETURNING id;"
+	query := "INSERT INTO accounts\\(customer_id, balance_in_decimal, currency, product, created_at, modified_at, metadata\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6,\\$7\\) RETURNING id;"
 
 	request := AccCreationRequest{
 		FirstName:      "first",
@@ -148,12 +111,12 @@ func TestCreateError(t *testing.T) {
 
 	mock.ExpectBegin()
 
-	mock.ExpectPrepare(query).ExpectQuery().WithArgs(customerId, request.InitialBalance, request.Currency, sqlmock.AnyArg(), sqlmock.AnyArg()).
+	mock.ExpectPrepare(query).ExpectQuery().WithArgs(customerId, request.InitialBalance, request.Currency, BasicProduct, sqlmock.AnyArg(), sqlmock.AnyArg(), "{}").
 		WillReturnError(sql.ErrTxDone)
 
 	mock.ExpectRollback()
 
-	_, err := Create(db, customerId, request)
+	_, err := Create(context.Background(), db, customerId, request)
 
 	assert.Error(t, err)
 }
@@ -162,7 +125,7 @@ func TestDelete(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -172,30 +135,56 @@ func TestDelete(t *testing.T) {
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
 
-	deleteQuery := "DELETE FROM accounts WHERE id=\\$1;"
+	deleteQuery := "DELETE FROM accounts WHERE id=\\$1 AND \\(\\$2 = 0 OR version=\\$2\\);"
 
 	mock.ExpectBegin()
-	mock.ExpectExec(deleteQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(deleteQuery).WithArgs(1, 0).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err := Delete(db, accId)
+	acc, err := Delete(context.Background(), db, accId, 0)
 
 	if err != nil {
 		t.Errorf("account deletion test failed err expected nil but got: %v:", err)
 	}
+	if acc.ID != accId || acc.CustomerID != 11 {
+		t.Errorf("account deletion test failed, deleted account id %d of customer 11 expected but got: %v", accId, acc)
+	}
+}
+
+func TestDeleteVersionMismatch(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
+
+	utc := time.Now().UTC()
+
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "created_at", "modified_at", "frozen", "version"}).
+		AddRow(1, 11, 232400, "GBP", utc, utc, true, 3)
+
+	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM accounts").WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Delete(context.Background(), db, 1, 2)
+
+	assert.Equal(t, &VersionMismatchError{AccountID: 1, Version: 2}, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestDeleteErrorInSelect(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnError(sql.ErrNoRows)
 
-	err := Delete(db, accId)
+	_, err := Delete(context.Background(), db, accId, 0)
 
 	if err != sql.ErrNoRows {
 		t.Errorf("account deletion test failed err expected sql.ErrNoRows but got: %v:", err)
@@ -206,7 +195,7 @@ func TestDeleteErrorInDelete(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -216,13 +205,13 @@ func TestDeleteErrorInDelete(t *testing.T) {
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
 
-	deleteQuery := "DELETE FROM accounts WHERE id=\\$1;"
+	deleteQuery := "DELETE FROM accounts WHERE id=\\$1 AND \\(\\$2 = 0 OR version=\\$2\\);"
 
 	mock.ExpectBegin()
-	mock.ExpectExec(deleteQuery).WithArgs(1).WillReturnError(sql.ErrConnDone)
+	mock.ExpectExec(deleteQuery).WithArgs(1, 0).WillReturnError(sql.ErrConnDone)
 	mock.ExpectRollback()
 
-	err := Delete(db, accId)
+	_, err := Delete(context.Background(), db, accId, 0)
 
 	if errors.Cause(err) != sql.ErrConnDone {
 		t.Errorf("account deletion test failed err expected sql.ErrConnDone but got: %v:", err)
@@ -233,7 +222,7 @@ func TestFreeze(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -243,31 +232,58 @@ func TestFreeze(t *testing.T) {
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
 
-	updateQuery := "UPDATE accounts SET frozen = TRUE, modified_at=\\$1 WHERE id=\\$2;"
+	updateQuery := "UPDATE accounts SET frozen = TRUE, modified_at=\\$1, version = version \\+ 1 WHERE id=\\$2 AND \\(\\$3 = 0 OR version=\\$3\\) RETURNING version;"
 
 	mock.ExpectBegin()
-	mock.ExpectPrepare(updateQuery).ExpectExec().WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(updateQuery).ExpectQuery().WithArgs(sqlmock.AnyArg(), 1, 0).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
 	mock.ExpectCommit()
 
-	actualAcc, err := Freeze(db, accId)
+	actualAcc, err := Freeze(context.Background(), db, accId, 0)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, actualAcc)
 	assert.True(t, actualAcc.Frozen)
 	assert.NotNil(t, actualAcc.ModifiedAt)
+	assert.Equal(t, 4, actualAcc.Version)
+}
+
+func TestFreezeVersionMismatch(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
+
+	utc := time.Now().UTC()
+
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "created_at", "modified_at", "frozen", "version"}).
+		AddRow(1, 11, 23240, "GBP", utc, utc, false, 3)
+
+	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
+
+	updateQuery := "UPDATE accounts SET frozen = TRUE"
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(updateQuery).ExpectQuery().WithArgs(sqlmock.AnyArg(), 1, 2).WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectRollback()
+
+	_, err := Freeze(context.Background(), db, 1, 2)
+
+	assert.Equal(t, &VersionMismatchError{AccountID: 1, Version: 2}, err)
+	assert.Equal(t, problem.VersionMismatch, problem.CodeOf(err))
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestFreezeErrorInSelect(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnError(sql.ErrNoRows)
 
-	_, err := Freeze(db, accId)
+	_, err := Freeze(context.Background(), db, accId, 0)
 
 	if err != sql.ErrNoRows {
 		t.Errorf("account freeze test failed err expected sql.ErrNoRows but got: %v:", err)
@@ -278,7 +294,7 @@ func TestFreezeErrorInUpdate(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -288,24 +304,71 @@ func TestFreezeErrorInUpdate(t *testing.T) {
 
 	mock.ExpectPrepare(selectQuery).ExpectQuery().WithArgs(1).WillReturnRows(rows)
 
-	updateQuery := "UPDATE accounts SET frozen = TRUE, modified_at=\\$1 WHERE id=\\$2;"
+	updateQuery := "UPDATE accounts SET frozen = TRUE, modified_at=\\$1, version = version \\+ 1 WHERE id=\\$2 AND \\(\\$3 = 0 OR version=\\$3\\) RETURNING version;"
 
 	mock.ExpectBegin()
-	mock.ExpectPrepare(updateQuery).ExpectExec().WithArgs(sqlmock.AnyArg(), 1).WillReturnError(sql.ErrTxDone)
+	mock.ExpectPrepare(updateQuery).ExpectQuery().WithArgs(sqlmock.AnyArg(), 1, 0).WillReturnError(sql.ErrTxDone)
 	mock.ExpectRollback()
 
-	_, err := Freeze(db, accId)
+	_, err := Freeze(context.Background(), db, accId, 0)
 
 	if errors.Cause(err) != sql.ErrTxDone {
 		t.Errorf("account deletion test failed err expected sql.ErrTxDone but got: %v:", err)
 	}
 }
 
+func TestUpdate(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
+	updateQuery := "UPDATE accounts SET product=\\$1, metadata=\\$2, modified_at=\\$3, version = version \\+ 1 WHERE id=\\$4 RETURNING version;"
+
+	utc := time.Now().UTC()
+
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "product", "created_at", "modified_at", "frozen", "version", "metadata"}).
+		AddRow(1, 11, 23240, "GBP", BasicProduct, utc, utc, false, 3, []byte(`{"nickname": "savings", "costCenter": "41"}`))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectQuery(updateQuery).WithArgs(BasicProduct, `{"costCenter":"42"}`, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
+	mock.ExpectCommit()
+
+	costCenter := "42"
+	acc, err := Update(context.Background(), db, 1, 3, Patch{Metadata: metadata.Patch{Values: map[string]*string{"nickname": nil, "costCenter": &costCenter}}})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, metadata.Metadata{"costCenter": "42"}, acc.Metadata)
+		assert.Equal(t, 4, acc.Version)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateVersionMismatch(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "product", "created_at", "modified_at", "frozen", "version", "metadata"}).
+		AddRow(1, 11, 23240, "GBP", BasicProduct, utc, utc, false, 3, []byte(`{}`))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, customer_id").WithArgs(1).WillReturnRows(rows)
+	mock.ExpectRollback()
+
+	_, err := Update(context.Background(), db, 1, 2, Patch{})
+
+	assert.Equal(t, &VersionMismatchError{AccountID: 1, Version: 2}, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestDeposit(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -316,12 +379,12 @@ func TestDeposit(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectPrepare(balanceQuery).ExpectExec().WithArgs(23765, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	balance, err := Deposit(db, accId, 525)
+	balance, err := Deposit(context.Background(), db, accId, 525)
 
 	assert.NoError(t, err)
 	assert.Equal(t, int64(23765), balance.Amount())
@@ -332,7 +395,7 @@ func TestDepositError(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -343,12 +406,12 @@ func TestDepositError(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectPrepare(balanceQuery).ExpectExec().WithArgs(23765, sqlmock.AnyArg(), 1).WillReturnError(sql.ErrConnDone)
 	mock.ExpectRollback()
 
-	balance, err := Deposit(db, accId, 525)
+	balance, err := Deposit(context.Background(), db, accId, 525)
 
 	if errors.Cause(err) != sql.ErrConnDone {
 		t.Errorf("account deposit test failed err expected sql.ErrConnDone but got: %v:", err)
@@ -356,11 +419,38 @@ func TestDepositError(t *testing.T) {
 	assert.Nil(t, balance)
 }
 
+func TestDepositRetriedAfterSerializationFailure(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
+
+	utc := time.Now().UTC()
+
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "created_at", "modified_at", "frozen"}).
+		AddRow(1, 11, 23240, "GBP", utc, utc, false)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
+	mock.ExpectPrepare(balanceQuery).ExpectExec().WithArgs(23765, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	balance, err := Deposit(context.Background(), db, 1, 525)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(23765), balance.Amount())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestWithdraw(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -371,12 +461,12 @@ func TestWithdraw(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectPrepare(balanceQuery).ExpectExec().WithArgs(23000, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	balance, err := Withdraw(db, accId, 240)
+	balance, err := Withdraw(context.Background(), db, accId, 240)
 
 	assert.NoError(t, err)
 	assert.Equal(t, int64(23000), balance.Amount())
@@ -387,7 +477,7 @@ func TestWithdrawInsufficientFundsError(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -398,12 +488,12 @@ func TestWithdrawInsufficientFundsError(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(rows)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectPrepare(balanceQuery).ExpectQuery().WithArgs(100000, sqlmock.AnyArg(), 1).WillReturnRows()
 	mock.ExpectRollback()
 
-	balance, err := Withdraw(db, accId, 100000)
+	balance, err := Withdraw(context.Background(), db, accId, 100000)
 
 	err, ok := err.(*FundsError)
 	if !ok {
@@ -416,7 +506,7 @@ func TestTransfer(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal", "currency"}).
 		AddRow(1, 23050, "GBP").AddRow(2, 1560, "GBP")
@@ -424,7 +514,7 @@ func TestTransfer(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(1, 2).WillReturnRows(rows)
 
-	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at FROM " +
+	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at, version = a.version \\+ 1 FROM " +
 		"\\(values \\(\\$1::integer, \\$2::decimal, \\$3::timestamp\\), \\(\\$4::integer, \\$5::decimal, \\$6::timestamp\\)\\) " +
 		"as a2\\(id, balance_in_decimal, modified_at\\) WHERE a2.id = a.id;"
 
@@ -432,7 +522,7 @@ func TestTransfer(t *testing.T) {
 		WillReturnResult(sqlmock.NewResult(2, 2))
 	mock.ExpectCommit()
 
-	fromBalance, toBalance, err := Transfer(db, 1, 2, 500)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, 1, 2, 500)
 
 	if err != nil {
 		t.Errorf("transfer test failed, expected nil error got: %v", err)
@@ -447,14 +537,14 @@ func TestTransferErrorAccountsNotFound(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal"})
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(1, 2).WillReturnRows(rows)
 	mock.ExpectRollback()
 
-	fromBalance, toBalance, err := Transfer(db, 1, 2, 500)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, 1, 2, 500)
 
 	assert.Error(t, err)
 	assert.True(t, errors.Cause(err) == InvalidAccountsError)
@@ -469,14 +559,14 @@ func TestTransferErrorFromAccountNotFound(t *testing.T) {
 	fromId := 1
 	toId := 2
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal"}).AddRow(toId, 2450)
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(fromId, toId).WillReturnRows(rows)
 	mock.ExpectRollback()
 
-	fromBalance, toBalance, err := Transfer(db, fromId, toId, 500)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, fromId, toId, 500)
 
 	assert.Error(t, err)
 	assert.Equal(t, "invalid transfer, account id 1 not found", err.Error())
@@ -491,14 +581,14 @@ func TestTransferErrorToAccountNotFound(t *testing.T) {
 	fromId := 1
 	toId := 2
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal"}).AddRow(fromId, 2405)
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(fromId, toId).WillReturnRows(rows)
 	mock.ExpectRollback()
 
-	fromBalance, toBalance, err := Transfer(db, fromId, toId, 500)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, fromId, toId, 500)
 
 	assert.Error(t, err)
 	assert.Equal(t, "invalid transfer, account id 2 not found", err.Error())
@@ -513,14 +603,14 @@ func TestTransferErrorInsufficientFunds(t *testing.T) {
 	fromId := 1
 	toId := 2
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal"}).AddRow(fromId, 2450).AddRow(toId, 500)
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(fromId, toId).WillReturnRows(rows)
 	mock.ExpectRollback()
 
-	fromBalance, toBalance, err := Transfer(db, fromId, toId, 1222500)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, fromId, toId, 1222500)
 
 	assert.Error(t, err)
 	assert.Equal(t, "insufficient funds, balance: 24.50", err.Error())
@@ -535,13 +625,13 @@ func TestTransferExecError(t *testing.T) {
 	fromId := 1
 	toId := 2
 
-	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	query := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 	rows := sqlmock.NewRows([]string{"id", "balance_in_decimal"}).AddRow(fromId, 2405).AddRow(toId, 500)
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(query).WithArgs(fromId, toId).WillReturnRows(rows)
 
-	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at FROM " +
+	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at, version = a.version \\+ 1 FROM " +
 		"\\(values \\(\\$1::integer, \\$2::decimal, \\$3::timestamp\\), \\(\\$4::integer, \\$5::decimal, \\$6::timestamp\\)\\) " +
 		"as a2\\(id, balance_in_decimal, modified_at\\) WHERE a2.id = a.id;"
 
@@ -549,7 +639,7 @@ func TestTransferExecError(t *testing.T) {
 		WillReturnError(sql.ErrConnDone)
 	mock.ExpectRollback()
 
-	fromBalance, toBalance, err := Transfer(db, 1, 2, 400)
+	fromBalance, toBalance, err := Transfer(context.Background(), db, 1, 2, 400)
 
 	assert.Error(t, err)
 	assert.Nil(t, fromBalance)
@@ -0,0 +1,306 @@
+package account
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// sortColumns maps the sort fields of the API to columns, every other value is rejected.
+var sortColumns = map[string]string{
+	"id":        "id",
+	"createdAt": "created_at",
+	"balance":   "balance_in_decimal",
+}
+
+var InvalidCursorError = problem.New(problem.InvalidCursor, "invalid cursor")
+
+func ValidSort(field string) bool {
+	_, ok := sortColumns[field]
+	return ok
+}
+
+type ListFilter struct {
+	CustomerID  *int
+	Currency    string
+	Frozen      *bool
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	MinBalance  *int64
+	MaxBalance  *int64
+	// Metadata matches the accounts having every key with the same value
+	Metadata metadata.Metadata
+}
+
+type ListRequest struct {
+	Filter ListFilter
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor *Cursor
+	Count  bool
+}
+
+// Cursor points after the last account of a page. It carries the sort order, so it can't be
+// used with a different one.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidCursorError
+	}
+
+	var c Cursor
+	if err = json.Unmarshal(b, &c); err != nil || !ValidSort(c.Sort) {
+		return nil, InvalidCursorError
+	}
+
+	return &c, nil
+}
+
+type Page struct {
+	Accounts []Account
+	Next     *Cursor
+	// Total is only counted on request, it is the number of accounts matching the filter on every page.
+	Total *int
+}
+
+// List returns a page of accounts with keyset pagination, ties of the sort field are ordered by id.
+func List(ctx context.Context, db *sqlx.DB, r ListRequest) (*Page, error) {
+	if err := r.prepare(); err != nil {
+		return nil, err
+	}
+
+	column := sortColumns[r.Sort]
+
+	conditions, args := r.Filter.conditions()
+
+	page := Page{Accounts: make([]Account, 0)}
+
+	if r.Count {
+		var total int
+		if err := db.GetContext(ctx, &total, countAccounts+where(conditions), args...); err != nil {
+			return nil, err
+		}
+		page.Total = &total
+	}
+
+	direction, comparison := "ASC", ">"
+	if r.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if r.Cursor != nil {
+		value, err := cursorValue(r.Sort, r.Cursor.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, value, r.Cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, comparison, len(args)-1, len(args)))
+	}
+
+	// one more than the limit, to know whether there is a next page
+	args = append(args, r.Limit+1)
+	query := fmt.Sprintf("%s%s ORDER BY %s %s, id %s LIMIT $%d;", listAccounts, where(conditions), column, direction, direction, len(args))
+
+	if err := db.SelectContext(ctx, &page.Accounts, query, args...); err != nil {
+		return nil, err
+	}
+
+	page.truncate(r)
+
+	return &page, nil
+}
+
+// truncate cuts the one extra account off the page and points the next cursor after the last one.
+func (p *Page) truncate(r ListRequest) {
+	if len(p.Accounts) > r.Limit {
+		p.Accounts = p.Accounts[:r.Limit]
+		last := p.Accounts[r.Limit-1]
+		p.Next = &Cursor{Sort: r.Sort, Desc: r.Desc, Value: sortValue(r.Sort, last), ID: last.ID}
+	}
+}
+
+// prepare applies the defaults of the request and checks that the cursor belongs to its sort order.
+func (r *ListRequest) prepare() error {
+	if r.Sort == "" {
+		r.Sort = "id"
+	}
+	if r.Limit <= 0 || r.Limit > MaxPageSize {
+		r.Limit = DefaultPageSize
+	}
+
+	if !ValidSort(r.Sort) {
+		return fmt.Errorf("unknown sort field %s", r.Sort)
+	}
+	if r.Cursor != nil && (r.Cursor.Sort != r.Sort || r.Cursor.Desc != r.Desc) {
+		return errors.Wrap(InvalidCursorError, "cursor belongs to another sort order")
+	}
+
+	return nil
+}
+
+func (f ListFilter) conditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.CustomerID != nil {
+		add("customer_id = $%d", *f.CustomerID)
+	}
+	if f.Currency != "" {
+		add("currency = $%d", f.Currency)
+	}
+	if f.Frozen != nil {
+		add("frozen = $%d", *f.Frozen)
+	}
+	if f.CreatedFrom != nil {
+		add("created_at >= $%d", *f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		add("created_at < $%d", *f.CreatedTo)
+	}
+	if f.MinBalance != nil {
+		add("balance_in_decimal >= $%d", *f.MinBalance)
+	}
+	if f.MaxBalance != nil {
+		add("balance_in_decimal <= $%d", *f.MaxBalance)
+	}
+	if len(f.Metadata) > 0 {
+		add("metadata @> $%d::jsonb", f.Metadata)
+	}
+
+	return conditions, args
+}
+
+// matches is the in-memory counterpart of the conditions of the filter.
+func (f ListFilter) matches(acc Account) bool {
+	switch {
+	case f.CustomerID != nil && acc.CustomerID != *f.CustomerID:
+		return false
+	case f.Currency != "" && acc.Currency != f.Currency:
+		return false
+	case f.Frozen != nil && acc.Frozen != *f.Frozen:
+		return false
+	case f.CreatedFrom != nil && acc.CreatedAt.Before(*f.CreatedFrom):
+		return false
+	case f.CreatedTo != nil && !acc.CreatedAt.Before(*f.CreatedTo):
+		return false
+	case f.MinBalance != nil && acc.BalanceInDecimal < *f.MinBalance:
+		return false
+	case f.MaxBalance != nil && acc.BalanceInDecimal > *f.MaxBalance:
+		return false
+	case !acc.Metadata.Contains(f.Metadata):
+		return false
+	}
+
+	return true
+}
+
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func sortValue(sort string, acc Account) string {
+	switch sort {
+	case "createdAt":
+		return acc.CreatedAt.Format(time.RFC3339Nano)
+	case "balance":
+		return strconv.FormatInt(acc.BalanceInDecimal, 10)
+	}
+
+	return strconv.Itoa(acc.ID)
+}
+
+func cursorValue(sort, value string) (interface{}, error) {
+	switch sort {
+	case "createdAt":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, InvalidCursorError
+		}
+		return t, nil
+	default:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, InvalidCursorError
+		}
+		return n, nil
+	}
+}
+
+// sortKey is the value of the sort field of the account, in the form cursorValue returns it.
+func sortKey(sort string, acc Account) interface{} {
+	switch sort {
+	case "createdAt":
+		return acc.CreatedAt
+	case "balance":
+		return acc.BalanceInDecimal
+	}
+
+	return int64(acc.ID)
+}
+
+// compareKey compares the account to the sort value and id of another account or a cursor, like the row
+// comparison of the query does.
+func compareKey(sort string, acc Account, value interface{}, id int) int {
+	var c int
+	switch v := value.(type) {
+	case time.Time:
+		if acc.CreatedAt.Before(v) {
+			c = -1
+		} else if acc.CreatedAt.After(v) {
+			c = 1
+		}
+	case int64:
+		if n := sortKey(sort, acc).(int64); n < v {
+			c = -1
+		} else if n > v {
+			c = 1
+		}
+	}
+
+	if c == 0 {
+		if acc.ID < id {
+			c = -1
+		} else if acc.ID > id {
+			c = 1
+		}
+	}
+
+	return c
+}
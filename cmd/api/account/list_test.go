@@ -0,0 +1,120 @@
+package account
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+)
+
+const listQuery = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts"
+
+func TestList(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	mock.ExpectQuery(listQuery + " ORDER BY id ASC, id ASC LIMIT \\$1;").WithArgs(DefaultPageSize + 1).
+		WillReturnRows(accountRows(utc, 11))
+
+	page, err := List(context.Background(), db, ListRequest{})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Accounts, 1)
+	assert.Nil(t, page.Next)
+	assert.Nil(t, page.Total)
+
+	actualAcc := page.Accounts[0]
+	assert.Equal(t, 11, actualAcc.ID)
+	assert.Equal(t, 22, actualAcc.CustomerID)
+	assert.Equal(t, int64(99900), actualAcc.BalanceInDecimal)
+	assert.Equal(t, "EUR", actualAcc.Currency)
+	assert.False(t, actualAcc.Frozen)
+}
+
+func TestListWithFiltersAndNextPage(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+	frozen := false
+	minBalance := int64(100)
+
+	filter := ListFilter{CustomerID: &customerId, Currency: "EUR", Frozen: &frozen, CreatedFrom: &utc, MinBalance: &minBalance}
+	where := " WHERE customer_id = \\$1 AND currency = \\$2 AND frozen = \\$3 AND created_at >= \\$4 AND balance_in_decimal >= \\$5"
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM accounts"+where).
+		WithArgs(customerId, "EUR", false, utc, minBalance).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(listQuery+where+" ORDER BY balance_in_decimal DESC, id DESC LIMIT \\$6;").
+		WithArgs(customerId, "EUR", false, utc, minBalance, 3).
+		WillReturnRows(accountRows(utc, 13, 12, 11))
+
+	page, err := List(context.Background(), db, ListRequest{Filter: filter, Sort: "balance", Desc: true, Limit: 2, Count: true})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Accounts, 2)
+	assert.Equal(t, 3, *page.Total)
+	assert.Equal(t, &Cursor{Sort: "balance", Desc: true, Value: "99900", ID: 12}, page.Next)
+
+	cursor, err := DecodeCursor(page.Next.Encode())
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(listQuery+where+" AND \\(balance_in_decimal, id\\) < \\(\\$6, \\$7\\) ORDER BY balance_in_decimal DESC, id DESC LIMIT \\$8;").
+		WithArgs(customerId, "EUR", false, utc, minBalance, int64(99900), 12, 3).
+		WillReturnRows(accountRows(utc, 11))
+
+	page, err = List(context.Background(), db, ListRequest{Filter: filter, Sort: "balance", Desc: true, Limit: 2, Cursor: cursor})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Accounts, 1)
+	assert.Nil(t, page.Next)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListWithMetadataFilter(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	mock.ExpectQuery(listQuery+" WHERE metadata @> \\$1::jsonb ORDER BY id ASC, id ASC LIMIT \\$2;").
+		WithArgs(`{"costCenter":"42"}`, DefaultPageSize+1).
+		WillReturnRows(accountRows(utc, 11))
+
+	page, err := List(context.Background(), db, ListRequest{Filter: ListFilter{Metadata: metadata.Metadata{"costCenter": "42"}}})
+
+	assert.NoError(t, err)
+	assert.Len(t, page.Accounts, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListInvalidCursor(t *testing.T) {
+	db, _ := NewMockDb()
+	defer db.Close()
+
+	_, err := DecodeCursor("not a cursor")
+	assert.Equal(t, InvalidCursorError, err)
+
+	cursor := &Cursor{Sort: "createdAt", Value: "2021-01-01T00:00:00Z", ID: 1}
+	_, err = List(context.Background(), db, ListRequest{Sort: "balance", Cursor: cursor})
+	assert.True(t, errors.Cause(err) == InvalidCursorError)
+
+	cursor = &Cursor{Sort: "createdAt", Value: "yesterday", ID: 1}
+	_, err = List(context.Background(), db, ListRequest{Sort: "createdAt", Cursor: cursor})
+	assert.Equal(t, InvalidCursorError, err)
+}
+
+func accountRows(utc time.Time, ids ...int) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "product", "created_at", "modified_at", "frozen"})
+	for _, id := range ids {
+		rows.AddRow(id, 22, 99900, "EUR", BasicProduct, utc, utc, false)
+	}
+
+	return rows
+}
@@ -0,0 +1,16 @@
+package account
+
+const (
+	BasicProduct    = "basic"
+	StandardProduct = "standard"
+)
+
+// ValidProduct reports whether p is a known account product. An empty product falls back to basic.
+func ValidProduct(p string) bool {
+	return p == "" || p == BasicProduct || p == StandardProduct
+}
+
+// RequiresKYC reports whether opening an account with product p needs a verified customer.
+func RequiresKYC(p string) bool {
+	return p == StandardProduct
+}
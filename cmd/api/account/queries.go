@@ -1,16 +1,24 @@
 package account
 
 const (
-	selectById = "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen " +
+	selectById = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata " +
 		"FROM accounts WHERE id=$1;"
-	selectTwoById = "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=$1 OR id=$2"
-	selectAll     = "SELECT * FROM accounts;"
-	insert        = "INSERT INTO accounts(customer_id, balance_in_decimal, currency, created_at, modified_at)" +
-		" VALUES($1,$2,$3,$4,$5) RETURNING id;"
-	deleteById     = "DELETE FROM accounts WHERE id=$1;"
-	freezeById     = "UPDATE accounts SET frozen = TRUE, modified_at=$1 WHERE id=$2;"
-	updateBalance  = "UPDATE accounts SET balance_in_decimal=$1, modified_at=$2 WHERE id=$3;"
-	updateBalances = "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at " +
+	selectByIdForUpdate = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata " +
+		"FROM accounts WHERE id=$1 FOR UPDATE;"
+	selectTwoByIdForUpdate = "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=$1 OR id=$2 " +
+		"ORDER BY id FOR UPDATE;"
+	listAccounts  = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts"
+	countAccounts = "SELECT COUNT(*) FROM accounts"
+	insert        = "INSERT INTO accounts(customer_id, balance_in_decimal, currency, product, created_at, modified_at, metadata)" +
+		" VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id;"
+	deleteById = "DELETE FROM accounts WHERE id=$1 AND ($2 = 0 OR version=$2);"
+	freezeById = "UPDATE accounts SET frozen = TRUE, modified_at=$1, version = version + 1 " +
+		"WHERE id=$2 AND ($3 = 0 OR version=$3) RETURNING version;"
+	updateAccount = "UPDATE accounts SET product=$1, metadata=$2, modified_at=$3, version = version + 1 WHERE id=$4 " +
+		"RETURNING version;"
+	updateBalance  = "UPDATE accounts SET balance_in_decimal=$1, modified_at=$2, version = version + 1 WHERE id=$3;"
+	updateBalances = "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at, " +
+		"version = a.version + 1 " +
 		"FROM (values ($1::integer, $2::decimal, $3::timestamp), ($4::integer, $5::decimal, $6::timestamp)) " +
 		"as a2(id, balance_in_decimal, modified_at) WHERE a2.id = a.id;"
 )
@@ -0,0 +1,309 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Rhymond/go-money"
+	"github.com/jmoiron/sqlx"
+)
+
+// PostgresRepository stores the accounts in the db.
+type PostgresRepository struct {
+	DB *sqlx.DB
+}
+
+func (r *PostgresRepository) SelectById(ctx context.Context, id int) (*Account, error) {
+	return SelectById(ctx, r.DB, id)
+}
+
+func (r *PostgresRepository) List(ctx context.Context, lr ListRequest) (*Page, error) {
+	return List(ctx, r.DB, lr)
+}
+
+func (r *PostgresRepository) Create(ctx context.Context, customerId int, ar AccCreationRequest) (*Account, error) {
+	return Create(ctx, r.DB, customerId, ar)
+}
+
+func (r *PostgresRepository) Delete(ctx context.Context, id int, version int) (*Account, error) {
+	return Delete(ctx, r.DB, id, version)
+}
+
+func (r *PostgresRepository) Freeze(ctx context.Context, id int, version int) (*Account, error) {
+	return Freeze(ctx, r.DB, id, version)
+}
+
+func (r *PostgresRepository) Update(ctx context.Context, id int, version int, p Patch) (*Account, error) {
+	return Update(ctx, r.DB, id, version, p)
+}
+
+func (r *PostgresRepository) Deposit(ctx context.Context, id int, amount int64) (*money.Money, error) {
+	return Deposit(ctx, r.DB, id, amount)
+}
+
+func (r *PostgresRepository) Withdraw(ctx context.Context, id int, amount int64) (*money.Money, error) {
+	return Withdraw(ctx, r.DB, id, amount)
+}
+
+func (r *PostgresRepository) Transfer(ctx context.Context, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
+	return Transfer(ctx, r.DB, fromId, toId, amount)
+}
+
+// MemoryRepository keeps the accounts in memory with the same errors as the db, it is meant for tests.
+type MemoryRepository struct {
+	mu       sync.Mutex
+	accounts map[int]Account
+	lastId   int
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{accounts: make(map[int]Account)}
+}
+
+// Owner returns the customer of the account.
+func (r *MemoryRepository) Owner(id int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	return acc.CustomerID, ok
+}
+
+func (r *MemoryRepository) SelectById(_ context.Context, id int) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &acc, nil
+}
+
+func (r *MemoryRepository) List(_ context.Context, lr ListRequest) (*Page, error) {
+	if err := lr.prepare(); err != nil {
+		return nil, err
+	}
+
+	var after interface{}
+	if lr.Cursor != nil {
+		value, err := cursorValue(lr.Sort, lr.Cursor.Value)
+		if err != nil {
+			return nil, err
+		}
+		after = value
+	}
+
+	r.mu.Lock()
+	matching := make([]Account, 0)
+	for _, acc := range r.accounts {
+		if lr.Filter.matches(acc) {
+			matching = append(matching, acc)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(matching, func(i, j int) bool {
+		c := compareKey(lr.Sort, matching[i], sortKey(lr.Sort, matching[j]), matching[j].ID)
+		if lr.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	page := Page{Accounts: make([]Account, 0)}
+	if lr.Count {
+		total := len(matching)
+		page.Total = &total
+	}
+
+	for _, acc := range matching {
+		if after != nil {
+			c := compareKey(lr.Sort, acc, after, lr.Cursor.ID)
+			if (!lr.Desc && c <= 0) || (lr.Desc && c >= 0) {
+				continue
+			}
+		}
+
+		page.Accounts = append(page.Accounts, acc)
+		if len(page.Accounts) > lr.Limit {
+			break
+		}
+	}
+
+	page.truncate(lr)
+
+	return &page, nil
+}
+
+func (r *MemoryRepository) Create(_ context.Context, customerId int, ar AccCreationRequest) (*Account, error) {
+	m := money.New(ar.InitialBalance, ar.Currency)
+
+	product := ar.Product
+	if product == "" {
+		product = BasicProduct
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastId++
+	acc := Account{
+		ID:               r.lastId,
+		CustomerID:       customerId,
+		BalanceInDecimal: m.Amount(),
+		Currency:         m.Currency().Code,
+		Product:          product,
+		CreatedAt:        time.Now().UTC(),
+		ModifiedAt:       time.Now().UTC(),
+		Version:          1,
+		Metadata:         ar.Metadata,
+	}
+	r.accounts[acc.ID] = acc
+
+	return &acc, nil
+}
+
+func (r *MemoryRepository) Delete(_ context.Context, id int, version int) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if version != 0 && acc.Version != version {
+		return nil, &VersionMismatchError{AccountID: id, Version: version}
+	}
+	delete(r.accounts, id)
+
+	return &acc, nil
+}
+
+func (r *MemoryRepository) Freeze(_ context.Context, id int, version int) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if version != 0 && acc.Version != version {
+		return nil, &VersionMismatchError{AccountID: id, Version: version}
+	}
+
+	acc.Frozen = true
+	acc.ModifiedAt = time.Now().UTC()
+	acc.Version++
+	r.accounts[id] = acc
+
+	return &acc, nil
+}
+
+func (r *MemoryRepository) Update(_ context.Context, id int, version int, p Patch) (*Account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if version != 0 && acc.Version != version {
+		return nil, &VersionMismatchError{AccountID: id, Version: version}
+	}
+
+	if err := p.apply(&acc); err != nil {
+		return nil, err
+	}
+	acc.ModifiedAt = time.Now().UTC()
+	acc.Version++
+	r.accounts[id] = acc
+
+	return &acc, nil
+}
+
+func (r *MemoryRepository) Deposit(_ context.Context, id int, amount int64) (*money.Money, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	newBalance, err := money.New(acc.BalanceInDecimal, acc.Currency).Add(money.New(amount, acc.Currency))
+	if err != nil {
+		return nil, err
+	}
+
+	r.setBalance(acc, newBalance)
+
+	return newBalance, nil
+}
+
+func (r *MemoryRepository) Withdraw(_ context.Context, id int, amount int64) (*money.Money, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	acc, ok := r.accounts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	balance := money.New(acc.BalanceInDecimal, acc.Currency)
+	withdraw := money.New(amount, acc.Currency)
+	if less, _ := balance.LessThan(withdraw); less {
+		return nil, &FundsError{balance: balance.Display()}
+	}
+
+	newBalance, err := balance.Subtract(withdraw)
+	if err != nil {
+		return nil, err
+	}
+
+	r.setBalance(acc, newBalance)
+
+	return newBalance, nil
+}
+
+func (r *MemoryRepository) Transfer(_ context.Context, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	from, fromFound := r.accounts[fromId]
+	to, toFound := r.accounts[toId]
+	switch {
+	case !fromFound && !toFound:
+		return nil, nil, InvalidAccountsError
+	case !fromFound:
+		return nil, nil, &InvalidTransferError{MissingAccountID: fromId}
+	case !toFound || fromId == toId:
+		// the db finds a single account for a transfer to the same account as well
+		return nil, nil, &InvalidTransferError{MissingAccountID: toId}
+	}
+
+	balance := money.New(from.BalanceInDecimal, from.Currency)
+	transfer := money.New(amount, from.Currency)
+	if less, _ := balance.LessThan(transfer); less {
+		return nil, nil, &FundsError{balance: balance.Display()}
+	}
+
+	fromNewBalance, _ := balance.Subtract(transfer)
+	toNewBalance, _ := money.New(to.BalanceInDecimal, to.Currency).Add(transfer)
+
+	r.setBalance(from, fromNewBalance)
+	r.setBalance(to, toNewBalance)
+
+	return fromNewBalance, toNewBalance, nil
+}
+
+func (r *MemoryRepository) setBalance(acc Account, balance *money.Money) {
+	acc.BalanceInDecimal = balance.Amount()
+	acc.ModifiedAt = time.Now().UTC()
+	acc.Version++
+	r.accounts[acc.ID] = acc
+}
@@ -0,0 +1,125 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+func TestMemoryRepositoryBalanceOperations(t *testing.T) {
+	r := NewMemoryRepository()
+	ctx := context.Background()
+
+	from, _ := r.Create(ctx, 1, AccCreationRequest{InitialBalance: 100, Currency: "EUR"})
+	to, _ := r.Create(ctx, 2, AccCreationRequest{InitialBalance: 0, Currency: "EUR"})
+
+	balance, err := r.Deposit(ctx, from.ID, 50)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(150), balance.Amount())
+	}
+
+	_, err = r.Withdraw(ctx, from.ID, 200)
+	assert.Equal(t, problem.InsufficientFunds, problem.CodeOf(err))
+
+	fromBalance, toBalance, err := r.Transfer(ctx, from.ID, to.ID, 30)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(120), fromBalance.Amount())
+		assert.Equal(t, int64(30), toBalance.Amount())
+	}
+
+	_, _, err = r.Transfer(ctx, from.ID, 99, 30)
+	assert.Equal(t, &InvalidTransferError{MissingAccountID: 99}, err)
+
+	_, err = r.Freeze(ctx, to.ID, 1)
+	assert.Equal(t, &VersionMismatchError{AccountID: to.ID, Version: 1}, err)
+	frozen, err := r.Freeze(ctx, to.ID, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, frozen.Version)
+	}
+
+	_, err = r.Delete(ctx, to.ID, 0)
+	assert.NoError(t, err)
+	_, err = r.SelectById(ctx, to.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestMemoryRepositoryList(t *testing.T) {
+	r := NewMemoryRepository()
+	ctx := context.Background()
+
+	for _, balance := range []int64{300, 100, 200, 100} {
+		_, _ = r.Create(ctx, 1, AccCreationRequest{InitialBalance: balance, Currency: "EUR"})
+	}
+	_, _ = r.Create(ctx, 2, AccCreationRequest{InitialBalance: 500, Currency: "EUR"})
+
+	filter := ListFilter{CustomerID: &customerOne}
+	page, err := r.List(ctx, ListRequest{Filter: filter, Sort: "balance", Desc: true, Limit: 3, Count: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{1, 3, 4}, ids(page.Accounts))
+		assert.Equal(t, 4, *page.Total)
+		assert.Equal(t, &Cursor{Sort: "balance", Desc: true, Value: "100", ID: 4}, page.Next)
+	}
+
+	page, err = r.List(ctx, ListRequest{Filter: filter, Sort: "balance", Desc: true, Limit: 3, Cursor: page.Next})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{2}, ids(page.Accounts))
+		assert.Nil(t, page.Next)
+	}
+
+	_, err = r.List(ctx, ListRequest{Sort: "id", Cursor: page.Next})
+	assert.NoError(t, err)
+
+	_, err = r.List(ctx, ListRequest{Sort: "id", Cursor: &Cursor{Sort: "balance", Value: "100", ID: 2}})
+	assert.Equal(t, InvalidCursorError, errors.Cause(err))
+}
+
+func TestMemoryRepositoryUpdate(t *testing.T) {
+	r := NewMemoryRepository()
+	ctx := context.Background()
+
+	acc, _ := r.Create(ctx, 1, AccCreationRequest{Currency: "EUR", Metadata: metadata.Metadata{"nickname": "savings"}})
+	_, _ = r.Create(ctx, 1, AccCreationRequest{Currency: "EUR"})
+
+	costCenter, product := "42", StandardProduct
+	updated, err := r.Update(ctx, acc.ID, 1, Patch{Product: &product, Metadata: metadata.Patch{Values: map[string]*string{"costCenter": &costCenter}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, StandardProduct, updated.Product)
+		assert.Equal(t, metadata.Metadata{"nickname": "savings", "costCenter": "42"}, updated.Metadata)
+		assert.Equal(t, 2, updated.Version)
+	}
+
+	_, err = r.Update(ctx, acc.ID, 1, Patch{})
+	assert.Equal(t, &VersionMismatchError{AccountID: acc.ID, Version: 1}, err)
+
+	empty := ""
+	_, err = r.Update(ctx, acc.ID, 0, Patch{Product: &empty})
+	assert.Equal(t, problem.ValidationFailed, problem.CodeOf(err))
+
+	// a null product would remove it
+	var removal Patch
+	assert.NoError(t, json.Unmarshal([]byte(`{"product": null}`), &removal))
+	_, err = r.Update(ctx, acc.ID, 0, removal)
+	assert.EqualError(t, err, "product: can't be removed")
+
+	page, err := r.List(ctx, ListRequest{Filter: ListFilter{Metadata: metadata.Metadata{"costCenter": "42"}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{acc.ID}, ids(page.Accounts))
+	}
+}
+
+var customerOne = 1
+
+func ids(accounts []Account) []int {
+	ids := make([]int, len(accounts))
+	for i, acc := range accounts {
+		ids[i] = acc.ID
+	}
+
+	return ids
+}
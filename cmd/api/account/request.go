@@ -1,9 +1,66 @@
 package account
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
 type AccCreationRequest struct {
 	FirstName      string `json:"firstName"`
 	LastName       string `json:"lastName"`
 	Email          string `json:"email"`
 	InitialBalance int64  `json:"balance"`
 	Currency       string `json:"currency"`
+	Product        string `json:"product,omitempty"`
+	// Metadata is attached to the account
+	Metadata metadata.Metadata `json:"metadata,omitempty"`
+}
+
+// Patch is a JSON merge patch (RFC 7396) of the mutable fields of an account, the absent fields are not changed.
+type Patch struct {
+	Product  *string        `json:"product"`
+	Metadata metadata.Patch `json:"metadata"`
+	// removesProduct is set by a null product, which would remove it
+	removesProduct bool
+}
+
+func (p *Patch) UnmarshalJSON(b []byte) error {
+	type patch Patch
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	*p = Patch{}
+	if err := json.Unmarshal(b, (*patch)(p)); err != nil {
+		return err
+	}
+	if v, ok := fields["product"]; ok && bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+		p.removesProduct = true
+	}
+
+	return nil
+}
+
+// apply changes the account and validates the result.
+func (p Patch) apply(acc *Account) error {
+	var fields []problem.FieldError
+	if p.removesProduct {
+		fields = append(fields, problem.Field("product", "can't be removed"))
+	}
+	if p.Product != nil {
+		if *p.Product == "" || !ValidProduct(*p.Product) {
+			fields = append(fields, problem.Field("product", fmt.Sprintf("unknown account product %s", *p.Product)))
+		}
+		acc.Product = *p.Product
+	}
+
+	acc.Metadata = acc.Metadata.Apply(p.Metadata)
+	fields = append(fields, acc.Metadata.Validate("metadata")...)
+
+	return problem.Validation(fields...)
 }
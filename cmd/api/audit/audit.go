@@ -8,7 +8,6 @@ import (
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
-	"github.com/tamasbrandstadter/payments-api/internal/mq"
 )
 
 type TransactionType int
@@ -32,10 +31,22 @@ type TxRecord struct {
 	createdAt     time.Time `db:"created_at"`
 }
 
-func SaveAuditRecord(db *sqlx.DB, fromId, toId int, tt TransactionType, conn *mq.Conn) error {
-	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelDefault})
+// Transaction is an audit record as it is returned to clients.
+type Transaction struct {
+	ID        int       `db:"id"`
+	FromID    int       `db:"from_id"`
+	ToID      int       `db:"to_id"`
+	Type      string    `db:"transaction_type"`
+	Ack       bool      `db:"ack"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// SaveAuditRecord stores the transaction and returns its id, the notification is published in the trace
+// of the context.
+func SaveAuditRecord(ctx context.Context, db *sqlx.DB, fromId, toId int, tt TransactionType, conn notification.Publisher) (int, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelDefault})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	audit := TxRecord{
@@ -46,27 +57,38 @@ func SaveAuditRecord(db *sqlx.DB, fromId, toId int, tt TransactionType, conn *mq
 		createdAt: time.Now().UTC(),
 	}
 
-	stmt, err := tx.Prepare(insert)
+	stmt, err := tx.PrepareContext(ctx, insert)
 	if err != nil {
 		_ = tx.Rollback()
-		return err
+		return 0, err
 	}
 
-	row := stmt.QueryRow(audit.fromId, audit.toId, audit.tt, audit.ack, audit.createdAt)
+	row := stmt.QueryRowContext(ctx, audit.fromId, audit.toId, audit.tt, audit.ack, audit.createdAt)
 
 	if err = row.Scan(&audit.transactionId); err != nil {
 		_ = tx.Rollback()
 		log.Warnf("audit tx record creation was rolled back, error: %v", err)
-		return err
+		return 0, err
 	}
 	if err = tx.Commit(); err != nil {
 		log.Errorf("failed to commit audit tx record creation, error: %v", err)
-		return err
+		return 0, err
 	}
 
 	log.Infof("successfully saved audit record with tx id %d", audit.transactionId)
 
-	notification.PublishSuccessfulTxNotification(conn, audit.transactionId, audit.createdAt)
+	notification.PublishSuccessfulTxNotification(ctx, conn, audit.transactionId, audit.createdAt)
+
+	return audit.transactionId, nil
+}
+
+// SelectByAccountId returns the transactions of the account newest first, only the ones older than beforeId
+// unless it is 0.
+func SelectByAccountId(ctx context.Context, db *sqlx.DB, accountId, beforeId, limit int) ([]Transaction, error) {
+	txs := make([]Transaction, 0)
+	if err := db.SelectContext(ctx, &txs, selectByAccountId, accountId, beforeId, limit); err != nil {
+		return nil, err
+	}
 
-	return nil
+	return txs, nil
 }
@@ -1,6 +1,7 @@
 package audit
 
 import (
+	"context"
 	"database/sql"
 	"testing"
 
@@ -24,10 +25,11 @@ func TestSaveAuditRecord(t *testing.T) {
 	mock.ExpectPrepare(query).ExpectQuery().WithArgs(1, 2, "transfer", true, sqlmock.AnyArg()).WillReturnRows(rows)
 	mock.ExpectCommit()
 
-	err := SaveAuditRecord(db, 1, 2, 2, NewConn())
+	id, err := SaveAuditRecord(context.Background(), db, 1, 2, 2, NewConn())
 	if err != nil {
 		t.Errorf("test save audit record failed, expected err nil, got: %v", err)
 	}
+	assert.Equal(t, 11, id)
 }
 
 func TestSaveAuditRecordError(t *testing.T) {
@@ -40,7 +42,7 @@ func TestSaveAuditRecordError(t *testing.T) {
 	mock.ExpectPrepare(query).ExpectQuery().WithArgs(1, 2, "transfer", true, sqlmock.AnyArg()).WillReturnError(sql.ErrConnDone)
 	mock.ExpectRollback()
 
-	err := SaveAuditRecord(db, 1, 2, 2, NewConn())
+	_, err := SaveAuditRecord(context.Background(), db, 1, 2, 2, NewConn())
 
 	assert.Error(t, err)
 }
@@ -2,4 +2,7 @@ package audit
 
 const (
 	insert = "INSERT INTO transactions(from_id, to_id, transaction_type, ack, created_at) VALUES($1,$2,$3,$4,$5) RETURNING id;"
+
+	selectByAccountId = "SELECT id, COALESCE(from_id, 0) AS from_id, COALESCE(to_id, 0) AS to_id, transaction_type, ack, created_at " +
+		"FROM transactions WHERE (from_id = $1 OR to_id = $1) AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3;"
 )
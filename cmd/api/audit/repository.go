@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+)
+
+// PostgresRepository stores the transactions in the db and notifies about them through the connection.
+type PostgresRepository struct {
+	DB *sqlx.DB
+	MQ *mq.Conn
+}
+
+func (r *PostgresRepository) Save(ctx context.Context, fromId, toId int, tt TransactionType) (int, error) {
+	return SaveAuditRecord(ctx, r.DB, fromId, toId, tt, r.MQ)
+}
+
+func (r *PostgresRepository) SelectByAccountId(ctx context.Context, accountId, beforeId, limit int) ([]Transaction, error) {
+	return SelectByAccountId(ctx, r.DB, accountId, beforeId, limit)
+}
+
+// MemoryRepository keeps the transactions in memory, it is meant for tests.
+type MemoryRepository struct {
+	mu           sync.Mutex
+	transactions []Transaction
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{}
+}
+
+func (r *MemoryRepository) Save(_ context.Context, fromId, toId int, tt TransactionType) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := Transaction{
+		ID:        len(r.transactions) + 1,
+		FromID:    fromId,
+		ToID:      toId,
+		Type:      tt.String(),
+		Ack:       true,
+		CreatedAt: time.Now().UTC(),
+	}
+	r.transactions = append(r.transactions, tx)
+
+	return tx.ID, nil
+}
+
+func (r *MemoryRepository) SelectByAccountId(_ context.Context, accountId, beforeId, limit int) ([]Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	txs := make([]Transaction, 0)
+	for _, tx := range r.transactions {
+		if (tx.FromID == accountId || tx.ToID == accountId) && (beforeId == 0 || tx.ID < beforeId) {
+			txs = append(txs, tx)
+		}
+	}
+
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID > txs[j].ID })
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+
+	return txs, nil
+}
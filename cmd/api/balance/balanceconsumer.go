@@ -1,26 +1,23 @@
 package balance
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
-	"fmt"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/Rhymond/go-money"
 	"github.com/avast/retry-go"
-	"github.com/go-redis/cache/v8"
-	"github.com/jmoiron/sqlx"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
-	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/audit"
-	c "github.com/tamasbrandstadter/payments-api/internal/cache"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
 )
 
 const (
@@ -29,289 +26,307 @@ const (
 	transferConsumer = "transfer-consumer"
 )
 
-type fn func(d amqp.Delivery, db *sqlx.DB, conn *mq.Conn, c *c.Redis) (bool, error)
+// postCommitTimeout bounds the audit record, the events and the webhooks of a committed operation.
+const postCommitTimeout = 5 * time.Second
+
+var invalidPayloadError = problem.New(problem.MalformedRequest, "invalid message payload, unable to parse")
+
+type fn func(tc *TransactionConsumer, ctx context.Context, d amqp.Delivery) (bool, error)
+
+// Broker consumes the balance operations, dead letters the ones which can never be processed and publishes the
+// notifications about them. It is implemented by mq.Conn.
+type Broker interface {
+	notification.Publisher
+	Consume(queue, tag string, concurrency int, partition mq.Partition, handle mq.Handler) error
+	DeadLetter(d amqp.Delivery, code, detail string) error
+}
+
+// EventPublisher streams the events of an account to its subscribers.
+type EventPublisher interface {
+	Publish(ctx context.Context, accountId int, eventType string, data interface{}) error
+}
 
 type TransactionConsumer struct {
-	Deposit     *amqp.Queue
-	Withdraw    *amqp.Queue
-	Transfer    *amqp.Queue
 	Concurrency int
+	Service     *service.Service
+	Broker      Broker
+	// Events is nil without Redis, the events are not streamed then
+	Events EventPublisher
+	// Timeout cancels the processing of a delivery, the message is requeued
+	Timeout time.Duration
 }
 
-func (tc *TransactionConsumer) StartConsuming(conn *mq.Conn, db *sqlx.DB, cache *c.Redis) {
-	forever := make(chan bool)
-
-	err := tc.consumeDeposits(conn, db, cache)
-	if err != nil {
-		log.Errorf("error starting deposit consumer: %v", err)
-		attempt := 1
-		err = retry.Do(
+// StartConsuming starts the consumers of the balance operations on their own channels, the connection
+// restarts them after it is re-established. The messages of a queue are sharded by account among the workers of
+// the replica, so it doesn't process two of them for the same account at once. There is no order between queues,
+// replicas or requeued messages, the balances are kept consistent by the database.
+func (tc *TransactionConsumer) StartConsuming() error {
+	for _, q := range []struct {
+		queue string
+		tag   string
+		f     fn
+	}{
+		{mq.DepositQueueName, depositConsumer, (*TransactionConsumer).deposit},
+		{mq.WithdrawQueueName, withdrawConsumer, (*TransactionConsumer).withdraw},
+		{mq.TransferQueueName, transferConsumer, (*TransactionConsumer).transfer},
+	} {
+		q := q
+		handle := func(d amqp.Delivery) { tc.handleMessage(d, q.f) }
+
+		err := retry.Do(
 			func() error {
-				log.Infof("retrying to consume from deposits, attempt %b", attempt)
-				err = tc.consumeDeposits(conn, db, cache)
-				if err != nil {
-					return err
-				}
-				return nil
+				return tc.Broker.Consume(q.queue, q.tag, tc.Concurrency, accountKey, handle)
 			},
 			retry.Attempts(10), retry.Delay(3*time.Second),
+			retry.OnRetry(func(n uint, err error) {
+				log.Errorf("error starting consumer of %s, attempt %d: %v", q.queue, n+1, err)
+			}),
 		)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = tc.consumeWithdraws(conn, db, cache)
-	if err != nil {
-		log.Errorf("error starting withdraw consumer: %v", err)
-		attempt := 1
-		err = retry.Do(
-			func() error {
-				log.Infof("retrying to consume from withdraws, attempt %b", attempt)
-				err = tc.consumeWithdraws(conn, db, cache)
-				if err != nil {
-					return err
-				}
-				return nil
-			},
-			retry.Attempts(10), retry.Delay(3*time.Second),
-		)
+	return nil
+}
+
+func (tc *TransactionConsumer) handleMessage(m amqp.Delivery, f fn) {
+	ctx := deliveryContext(m)
+	if tc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tc.Timeout)
+		defer cancel()
 	}
 
-	err = tc.consumeTransfers(conn, db, cache)
+	ok, err := f(tc, ctx, m)
 	if err != nil {
-		log.Errorf("error starting transfer consumer: %v", err)
-		attempt := 1
-		err = retry.Do(
-			func() error {
-				log.Infof("retrying to consume from transfers, attempt %b", attempt)
-				err = tc.consumeTransfers(conn, db, cache)
-				if err != nil {
-					return err
-				}
-				return nil
-			},
-			retry.Attempts(10), retry.Delay(3*time.Second),
-		)
+		tc.reject(ctx, m, err)
+	} else if !ok {
+		_ = m.Nack(false, true)
+	} else {
+		_ = m.Ack(false)
 	}
-
-	<-forever
 }
 
-func (tc *TransactionConsumer) ClosedConnectionListener(cfg mq.Config, db *sqlx.DB, closed <-chan *amqp.Error, redis *c.Redis) {
-	err := <-closed
-	if err != nil {
-		log.Errorf("closed mq connection: %v", err)
-
-		var i int
-
-		for i = 0; i < cfg.MaxReconnect; i++ {
-			log.Info("attempting to reconnect to mq")
-
-			if conn, err := mq.NewConnection(cfg); err == nil {
-				log.Info("reconnected to mq")
-				tc.StartConsuming(conn, db, redis)
-			}
-
-			time.Sleep(1 * time.Second)
-		}
+// reject dead letters a message which can never be processed and notifies about the failure with
+// the same error code the REST API uses. The message is dropped if it can't be dead lettered.
+func (tc *TransactionConsumer) reject(ctx context.Context, d amqp.Delivery, err error) {
+	code := problem.CodeOf(err)
+	log.Warnf("rejected message id %s from %s, code: %s, error: %v", d.MessageId, d.RoutingKey, code, err)
 
-		if i == cfg.MaxReconnect {
-			log.Error("reached max attempts, unable to reconnect to mq")
-			return
-		}
-	} else {
-		log.Info("mq connection closed normally, will not reconnect")
-		os.Exit(0)
+	if dlErr := tc.Broker.DeadLetter(d, string(code), err.Error()); dlErr != nil {
+		log.Errorf("error dead lettering message id %s: %v", d.MessageId, dlErr)
+		_ = d.Nack(false, false)
+		return
 	}
+	_ = d.Ack(false)
+
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+
+	ids := accountIdsOf(d)
+	notification.PublishFailedTxNotification(ctx, tc.Broker, d.MessageId, string(code), err.Error())
+	notification.PublishTransactionRejected(ctx, tc.Broker, d.MessageId, notification.RejectedData{
+		Operation: operationOf(d.RoutingKey),
+		Code:      string(code),
+		Detail:    publicDetail(err),
+	}, ids...)
+	tc.enqueueWebhook(ctx, webhook.TransactionRejected, RejectedEvent{MessageID: d.MessageId, Code: string(code), Detail: publicDetail(err)}, ids...)
 }
 
-func (tc *TransactionConsumer) consumeDeposits(conn *mq.Conn, db *sqlx.DB, cache *c.Redis) error {
-	deposits, err := conn.Channel.Consume(tc.Deposit.Name, depositConsumer, false, false,
-		false, false, nil,
-	)
-	if err != nil {
-		return err
+// publicDetail is the detail of the error sent to partners and customers, internal errors are only described by
+// their title like in the REST responses.
+func publicDetail(err error) string {
+	if code := problem.CodeOf(err); code == problem.Internal {
+		return code.Title()
 	}
 
-	tc.handleMessage(conn, db, cache, deposits, deposit)
-
-	return nil
+	return err.Error()
 }
 
-func (tc *TransactionConsumer) consumeWithdraws(conn *mq.Conn, db *sqlx.DB, cache *c.Redis) error {
-	withdraws, err := conn.Channel.Consume(tc.Withdraw.Name, withdrawConsumer, false, false,
-		false, false, nil,
-	)
-	if err != nil {
-		return err
+// operationOf returns the balance operation of the routing key.
+func operationOf(routeKey string) string {
+	switch routeKey {
+	case mq.DepositRouteKey:
+		return "deposit"
+	case mq.WithdrawRouteKey:
+		return "withdraw"
+	case mq.TransferRouteKey:
+		return "transfer"
 	}
 
-	tc.handleMessage(conn, db, cache, withdraws, withdraw)
-
-	return nil
+	return "unknown"
 }
 
-func (tc *TransactionConsumer) consumeTransfers(conn *mq.Conn, db *sqlx.DB, cache *c.Redis) error {
-	transfers, err := conn.Channel.Consume(tc.Transfer.Name, transferConsumer, false, false,
-		false, false, nil,
-	)
-	if err != nil {
-		return err
+// deliveryContext carries the trace context of the delivery, so the events published while processing it
+// belong to the same trace. A new trace is started for messages without one.
+func deliveryContext(d amqp.Delivery) context.Context {
+	if e, _, err := cloudevents.Decode(d); err == nil {
+		if t, ok := tracecontext.Parse(e.TraceParent, e.TraceState); ok {
+			return tracecontext.NewContext(context.Background(), t)
+		}
 	}
 
-	tc.handleMessage(conn, db, cache, transfers, transfer)
-
-	return nil
+	return tracecontext.NewContext(context.Background(), tracecontext.New())
 }
 
-func (tc *TransactionConsumer) handleMessage(conn *mq.Conn, db *sqlx.DB, cache *c.Redis, msgs <-chan amqp.Delivery, f fn) {
-	for i := 0; i < tc.Concurrency; i++ {
-		go func() {
-			for m := range msgs {
-				ok, err := f(m, db, conn, cache)
-				if err != nil {
-					_ = m.Nack(false, false)
-				} else if !ok {
-					_ = m.Nack(false, true)
-				} else {
-					_ = m.Ack(false)
-				}
-			}
-		}()
+// afterCommit returns the context of the writes following a balance operation or a rejection. They get their own
+// deadline, the one of the delivery may be almost over once the operation is committed.
+func afterCommit(ctx context.Context) (context.Context, context.CancelFunc) {
+	t, ok := tracecontext.FromContext(ctx)
+	if !ok {
+		t = tracecontext.New()
 	}
+
+	return context.WithTimeout(tracecontext.NewContext(context.Background(), t), postCommitTimeout)
 }
 
-func transfer(d amqp.Delivery, db *sqlx.DB, conn *mq.Conn, c *c.Redis) (bool, error) {
-	var payload TransferMessage
+// accountKey partitions the messages of a queue by the account they are debiting, or crediting in case of deposits.
+// Every queue is sharded on its own, so a withdrawal and a transfer from the same account may still run at the same
+// time, they are serialized by the row locks of the database.
+func accountKey(d amqp.Delivery) string {
+	ids := accountIdsOf(d)
+	if len(ids) == 0 {
+		return ""
+	}
 
-	r := bytes.NewReader(d.Body)
-	err := json.NewDecoder(r).Decode(&payload)
+	return strconv.Itoa(ids[0])
+}
+
+// accountIdsOf returns the accounts of a rejected message, as far as its payload can be parsed.
+func accountIdsOf(d amqp.Delivery) []int {
+	_, data, err := cloudevents.Decode(d)
 	if err != nil {
-		return false, errors.New("invalid message payload, unable to parse")
+		return nil
 	}
 
-	err = validateAmount(payload.Amount)
-	if err != nil {
-		return false, err
+	var ids struct {
+		AccountID int `json:"id"`
+		FromID    int `json:"from"`
+		ToID      int `json:"to"`
+	}
+	if err = json.Unmarshal(data, &ids); err != nil {
+		return nil
 	}
 
-	fromBalance, toBalance, err := account.Transfer(db, payload.FromID, payload.ToID, payload.Amount)
-	if err != nil {
-		if errors.Cause(err) == account.InvalidAccountsError {
-			return false, err
+	accountIds := make([]int, 0, 2)
+	for _, id := range []int{ids.AccountID, ids.FromID, ids.ToID} {
+		if id > 0 {
+			accountIds = append(accountIds, id)
 		}
+	}
 
-		if te, ok := err.(*account.InvalidTransferError); ok {
-			return false, te
-		}
+	return accountIds
+}
 
-		if fe, ok := err.(*account.FundsError); ok {
-			return false, fe
-		}
+func (tc *TransactionConsumer) transfer(ctx context.Context, d amqp.Delivery) (bool, error) {
+	var payload TransferMessage
+	if err := decode(d, transferSchemas, &payload); err != nil {
+		return false, err
+	}
 
-		return false, nil
+	fromBalance, toBalance, err := tc.Service.Transfer(ctx, payload.FromID, payload.ToID, payload.Amount)
+	if err != nil {
+		return permanent(err)
 	}
 
-	updateBalanceCache(fromBalance, c, payload.FromID)
-	updateBalanceCache(toBalance, c, payload.ToID)
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
+
+	tx := TransactionEvent{MessageID: d.MessageId, Type: "transfer", FromID: payload.FromID, ToID: payload.ToID, Amount: payload.Amount}
+	tc.publishEvents(ctx, payload.FromID, fromBalance, tx)
+	tc.publishEvents(ctx, payload.ToID, toBalance, tx)
 
-	if err = audit.SaveAuditRecord(db, payload.FromID, payload.ToID, audit.Transfer, conn); err != nil {
+	txId, err := tc.Service.SaveTransaction(ctx, payload.FromID, payload.ToID, audit.Transfer)
+	if err != nil {
 		log.Errorf("error saving audit record: %v", err)
 	}
 
+	notification.PublishTransferCompleted(ctx, tc.Broker, d.MessageId, notification.TransferData{
+		TransactionID: txId,
+		FromID:        payload.FromID,
+		ToID:          payload.ToID,
+		Amount:        payload.Amount,
+		Currency:      fromBalance.Currency().Code,
+		FromBalance:   fromBalance.Amount(),
+		ToBalance:     toBalance.Amount(),
+	})
+	tc.enqueueWebhook(ctx, webhook.TransferCompleted, tx, payload.FromID, payload.ToID)
+
 	return true, nil
 }
 
-func deposit(d amqp.Delivery, db *sqlx.DB, conn *mq.Conn, c *c.Redis) (bool, error) {
-	payload, err := decodeMessage(d)
-	if err != nil {
+func (tc *TransactionConsumer) deposit(ctx context.Context, d amqp.Delivery) (bool, error) {
+	var payload BalanceMessage
+	if err := decode(d, balanceSchemas, &payload); err != nil {
 		return false, err
 	}
 
-	err = validateAmount(payload.Amount)
+	balance, err := tc.Service.Deposit(ctx, payload.AccountID, payload.Amount)
 	if err != nil {
-		return false, err
+		return permanent(err)
 	}
 
-	balance, err := account.Deposit(db, payload.AccountID, payload.Amount)
-	if err != nil {
-		if errors.Cause(err) == sql.ErrNoRows {
-			return false, errors.New(fmt.Sprintf("account id %d is not found", payload.AccountID))
-		}
-		return false, nil
-	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
 
-	updateBalanceCache(balance, c, payload.AccountID)
+	tx := TransactionEvent{MessageID: d.MessageId, Type: "deposit", ToID: payload.AccountID, Amount: payload.Amount}
+	tc.publishEvents(ctx, payload.AccountID, balance, tx)
 
-	if err = audit.SaveAuditRecord(db, payload.AccountID, 0, audit.Deposit, conn); err != nil {
+	txId, err := tc.Service.SaveTransaction(ctx, payload.AccountID, 0, audit.Deposit)
+	if err != nil {
 		log.Errorf("error saving audit record: %v", err)
 	}
 
+	notification.PublishFundsEvent(ctx, tc.Broker, notification.FundsDeposited, d.MessageId, fundsData(payload, txId, balance))
+	tc.enqueueWebhook(ctx, webhook.DepositCompleted, tx, payload.AccountID)
+
 	return true, nil
 }
 
-func withdraw(d amqp.Delivery, db *sqlx.DB, conn *mq.Conn, c *c.Redis) (bool, error) {
-	payload, err := decodeMessage(d)
-	if err != nil {
+func (tc *TransactionConsumer) withdraw(ctx context.Context, d amqp.Delivery) (bool, error) {
+	var payload BalanceMessage
+	if err := decode(d, balanceSchemas, &payload); err != nil {
 		return false, err
 	}
 
-	err = validateAmount(payload.Amount)
+	balance, err := tc.Service.Withdraw(ctx, payload.AccountID, payload.Amount)
 	if err != nil {
-		return false, err
+		return permanent(err)
 	}
 
-	balance, err := account.Withdraw(db, payload.AccountID, payload.Amount)
-	if err != nil {
-		if errors.Cause(err) == sql.ErrNoRows {
-			return false, errors.New(fmt.Sprintf("account id %d is not found", payload.AccountID))
-		}
-
-		fe, ok := err.(*account.FundsError)
-		if ok {
-			return false, fe
-		}
-
-		return false, nil
-	}
+	ctx, cancel := afterCommit(ctx)
+	defer cancel()
 
-	updateBalanceCache(balance, c, payload.AccountID)
+	tx := TransactionEvent{MessageID: d.MessageId, Type: "withdraw", FromID: payload.AccountID, Amount: payload.Amount}
+	tc.publishEvents(ctx, payload.AccountID, balance, tx)
 
-	if err = audit.SaveAuditRecord(db, payload.AccountID, 0, audit.Withdraw, conn); err != nil {
+	txId, err := tc.Service.SaveTransaction(ctx, payload.AccountID, 0, audit.Withdraw)
+	if err != nil {
 		log.Errorf("error saving audit record: %v", err)
 	}
 
+	notification.PublishFundsEvent(ctx, tc.Broker, notification.FundsWithdrawn, d.MessageId, fundsData(payload, txId, balance))
+	tc.enqueueWebhook(ctx, webhook.WithdrawCompleted, tx, payload.AccountID)
+
 	return true, nil
 }
 
-func decodeMessage(d amqp.Delivery) (*BalanceMessage, error) {
-	var payload BalanceMessage
-
-	r := bytes.NewReader(d.Body)
-	if err := json.NewDecoder(r).Decode(&payload); err != nil {
-		return nil, errors.New("invalid message payload, unable to parse")
+// permanent rejects the message on errors with a code, everything else is retried.
+func permanent(err error) (bool, error) {
+	if problem.CodeOf(err) != problem.Internal {
+		return false, err
 	}
 
-	return &payload, nil
+	return false, nil
 }
 
-func validateAmount(amount int64) error {
-	if amount < 0 {
-		return errors.New("balance operation amount can't be negative")
-	}
-	return nil
-}
-
-func updateBalanceCache(balance *money.Money, c *c.Redis, id int) {
-	value, err := balance.MarshalJSON()
-	if err == nil {
-		if err = c.Balances.Set(&cache.Item{
-			Ctx:   context.Background(),
-			Key:   strconv.Itoa(id),
-			Value: value,
-			TTL:   time.Hour,
-		}); err != nil {
-			log.Errorf("error setting new balance in cache for account id %d, error: %v", id, err)
-		}
-	} else {
-		log.Warnf("failed to marshal balance error: %v", err)
+func fundsData(payload BalanceMessage, txId int, balance *money.Money) notification.FundsData {
+	return notification.FundsData{
+		AccountID:     payload.AccountID,
+		TransactionID: txId,
+		Amount:        payload.Amount,
+		Currency:      balance.Currency().Code,
+		Balance:       balance.Amount(),
 	}
 }
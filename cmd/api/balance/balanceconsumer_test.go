@@ -14,12 +14,18 @@ import (
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
 	"github.com/tamasbrandstadter/payments-api/internal/cache"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
 	"github.com/tamasbrandstadter/payments-api/internal/testcache"
 	"github.com/tamasbrandstadter/payments-api/internal/testmq"
 )
 
+const kycThreshold = 100000
+
 func TestDeposit(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
@@ -31,7 +37,7 @@ func TestDeposit(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -42,7 +48,7 @@ func TestDeposit(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnRows(rows)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectPrepare(balanceQuery).ExpectExec().WithArgs(165, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
@@ -55,7 +61,11 @@ func TestDeposit(t *testing.T) {
 	mock.ExpectPrepare(auditQuery).ExpectQuery().WithArgs(accId, 0, "deposit", true, sqlmock.AnyArg()).WillReturnRows(row)
 	mock.ExpectCommit()
 
-	ok, err := deposit(d, db, NewConn(), NewCache())
+	webhookQuery := "INSERT INTO webhook_deliveries\\(webhook_id, event_id, event_type, payload, next_attempt_at, created_at\\) SELECT"
+	mock.ExpectExec(webhookQuery).WithArgs(sqlmock.AnyArg(), "deposit.completed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
 
 	if !ok || err != nil {
 		t.Errorf("test handle deposit failed, ok true and err nil were expected got: %v and %v", ok, err)
@@ -73,7 +83,7 @@ func TestDepositPayloadError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := deposit(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
@@ -91,11 +101,12 @@ func TestDepositAmountError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := deposit(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
-	assert.Equal(t, "balance operation amount can't be negative", err.Error())
+	assert.Equal(t, "amount: must be greater than or equal to 1", err.Error())
+	assert.Equal(t, problem.ValidationFailed, problem.CodeOf(err))
 }
 
 func TestDepositNotFoundError(t *testing.T) {
@@ -109,7 +120,7 @@ func TestDepositNotFoundError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 
@@ -117,11 +128,12 @@ func TestDepositNotFoundError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnError(sql.ErrNoRows)
 	mock.ExpectRollback()
 
-	ok, err := deposit(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
 	assert.Equal(t, "account id 1 is not found", err.Error())
+	assert.Equal(t, problem.AccountNotFound, problem.CodeOf(err))
 }
 
 func TestDepositServerError(t *testing.T) {
@@ -135,7 +147,7 @@ func TestDepositServerError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 
@@ -143,12 +155,42 @@ func TestDepositServerError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnError(errors.New("test"))
 	mock.ExpectRollback()
 
-	ok, err := deposit(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Nil(t, err)
 }
 
+func TestDepositKYCRequiredError(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	msg := []byte("{\"id\":1,\"amount\":100001}")
+
+	d := amqp.Delivery{
+		ContentType: "application/json",
+		Body:        msg,
+	}
+
+	customerQuery := "SELECT c.id, c.kyc_status, c.kyc_expires_at FROM customers c JOIN accounts a ON a.customer_id = c.id WHERE a.id=\\$1;"
+
+	rows := sqlmock.NewRows([]string{"id", "kyc_status", "kyc_expires_at"}).AddRow(11, "pending", nil)
+
+	mock.ExpectQuery(customerQuery).WithArgs(1).WillReturnRows(rows)
+
+	ok, err := handle((*TransactionConsumer).deposit, d, db, NewCache())
+
+	assert.False(t, ok)
+	assert.Error(t, err)
+	assert.Equal(t, "customer id 11 has no valid kyc verification", err.Error())
+	assert.Equal(t, problem.KYCRequired, problem.CodeOf(err))
+}
+
+func TestPublicDetail(t *testing.T) {
+	assert.Equal(t, "Internal server error", publicDetail(errors.New("pq: connection refused")))
+	assert.Equal(t, "customer id 11 has no valid kyc verification", publicDetail(&customer.KYCRequiredError{CustomerID: 11}))
+}
+
 func TestWithdraw(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
@@ -160,7 +202,7 @@ func TestWithdraw(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 	utc := time.Now().UTC()
@@ -168,7 +210,7 @@ func TestWithdraw(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "created_at", "modified_at", "frozen"}).
 		AddRow(1, 11, 155, "GBP", utc, utc, false)
 
-	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+	balanceQuery := "UPDATE accounts SET balance_in_decimal=\\$1, modified_at=\\$2, version = version \\+ 1 WHERE id=\\$3;"
 
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnRows(rows)
@@ -183,7 +225,11 @@ func TestWithdraw(t *testing.T) {
 	mock.ExpectPrepare(auditQuery).ExpectQuery().WithArgs(accId, 0, "withdraw", true, sqlmock.AnyArg()).WillReturnRows(row)
 	mock.ExpectCommit()
 
-	ok, err := withdraw(d, db, NewConn(), NewCache())
+	webhookQuery := "INSERT INTO webhook_deliveries\\(webhook_id, event_id, event_type, payload, next_attempt_at, created_at\\) SELECT"
+	mock.ExpectExec(webhookQuery).WithArgs(sqlmock.AnyArg(), "withdraw.completed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ok, err := handle((*TransactionConsumer).withdraw, d, db, NewCache())
 
 	if !ok || err != nil {
 		t.Errorf("test handle withdraw failed, ok true and err nil were expected got: %v and %v", ok, err)
@@ -201,7 +247,7 @@ func TestWithdrawPayloadError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := withdraw(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).withdraw, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
@@ -219,11 +265,11 @@ func TestWithdrawAmountError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := withdraw(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).withdraw, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
-	assert.Equal(t, "balance operation amount can't be negative", err.Error())
+	assert.Equal(t, "amount: must be greater than or equal to 1", err.Error())
 }
 
 func TestWithdrawNotFoundError(t *testing.T) {
@@ -237,7 +283,7 @@ func TestWithdrawNotFoundError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 
@@ -245,11 +291,12 @@ func TestWithdrawNotFoundError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnError(sql.ErrNoRows)
 	mock.ExpectRollback()
 
-	ok, err := withdraw(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).withdraw, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
 	assert.Equal(t, "account id 1 is not found", err.Error())
+	assert.Equal(t, problem.AccountNotFound, problem.CodeOf(err))
 }
 
 func TestWithdrawServerError(t *testing.T) {
@@ -263,7 +310,7 @@ func TestWithdrawServerError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=\\$1;"
+	selectQuery := "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=\\$1 FOR UPDATE;"
 
 	accId := 1
 
@@ -271,7 +318,7 @@ func TestWithdrawServerError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(accId).WillReturnError(errors.New("test"))
 	mock.ExpectRollback()
 
-	ok, err := withdraw(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).withdraw, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Nil(t, err)
@@ -290,7 +337,7 @@ func TestTransfer(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 
 	from := 1
 	to := 2
@@ -301,7 +348,7 @@ func TestTransfer(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(selectQuery).WithArgs(from, to).WillReturnRows(rows)
 
-	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at FROM " +
+	updateQuery := "UPDATE accounts as a SET balance_in_decimal = a2.balance_in_decimal, modified_at = a2.modified_at, version = a.version \\+ 1 FROM " +
 		"\\(values \\(\\$1::integer, \\$2::decimal, \\$3::timestamp\\), \\(\\$4::integer, \\$5::decimal, \\$6::timestamp\\)\\) " +
 		"as a2\\(id, balance_in_decimal, modified_at\\) WHERE a2.id = a.id;"
 
@@ -316,7 +363,11 @@ func TestTransfer(t *testing.T) {
 	mock.ExpectPrepare(auditQuery).ExpectQuery().WithArgs(from, to, "transfer", true, sqlmock.AnyArg()).WillReturnRows(row)
 	mock.ExpectCommit()
 
-	ok, err := transfer(d, db, NewConn(), redis)
+	webhookQuery := "INSERT INTO webhook_deliveries\\(webhook_id, event_id, event_type, payload, next_attempt_at, created_at\\) SELECT"
+	mock.ExpectExec(webhookQuery).WithArgs(sqlmock.AnyArg(), "transfer.completed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ok, err := handle((*TransactionConsumer).transfer, d, db, redis)
 
 	if !ok || err != nil {
 		t.Errorf("test handle transfer failed, ok true and err nil were expected got: %v and %v", ok, err)
@@ -354,7 +405,7 @@ func TestTransferPayloadError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := transfer(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).transfer, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
@@ -372,11 +423,11 @@ func TestTransferAmountError(t *testing.T) {
 		Body:        msg,
 	}
 
-	ok, err := transfer(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).transfer, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
-	assert.Equal(t, "balance operation amount can't be negative", err.Error())
+	assert.Equal(t, "amount: must be greater than or equal to 1", err.Error())
 }
 
 func TestTransferAccountNotFoundError(t *testing.T) {
@@ -390,7 +441,7 @@ func TestTransferAccountNotFoundError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 
 	from := 1
 	to := 2
@@ -399,7 +450,7 @@ func TestTransferAccountNotFoundError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(from, to).WillReturnError(account.InvalidAccountsError)
 	mock.ExpectRollback()
 
-	ok, err := transfer(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).transfer, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Error(t, err)
@@ -417,7 +468,7 @@ func TestTransferServerError(t *testing.T) {
 		Body:        msg,
 	}
 
-	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2"
+	selectQuery := "SELECT id, balance_in_decimal, currency FROM accounts WHERE id=\\$1 OR id=\\$2 ORDER BY id FOR UPDATE;"
 
 	from := 1
 	to := 2
@@ -426,7 +477,7 @@ func TestTransferServerError(t *testing.T) {
 	mock.ExpectQuery(selectQuery).WithArgs(from, to).WillReturnError(errors.New("test"))
 	mock.ExpectRollback()
 
-	ok, err := transfer(d, db, NewConn(), NewCache())
+	ok, err := handle((*TransactionConsumer).transfer, d, db, NewCache())
 
 	assert.False(t, ok)
 	assert.Nil(t, err)
@@ -459,3 +510,13 @@ func NewCache() *cache.Redis {
 
 	return redis
 }
+
+// handle runs the consumer function with the db backed service, like the consumers do.
+func handle(f fn, d amqp.Delivery, db *sqlx.DB, redis *cache.Redis) (bool, error) {
+	conn := NewConn()
+	svc := service.New(db, redis, nil, conn)
+	svc.KYCThreshold = kycThreshold
+	tc := &TransactionConsumer{Service: svc, Broker: conn, Events: stream.Publisher{Client: redis.Client}}
+
+	return f(tc, context.Background(), d)
+}
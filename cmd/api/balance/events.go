@@ -0,0 +1,57 @@
+package balance
+
+import (
+	"context"
+
+	"github.com/Rhymond/go-money"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
+)
+
+type BalanceEvent struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Display  string `json:"display"`
+}
+
+// TransactionEvent is sent to every account of the transaction, the message id is the one of the
+// balance operation.
+type TransactionEvent struct {
+	MessageID string `json:"messageId,omitempty"`
+	Type      string `json:"type"`
+	FromID    int    `json:"fromId,omitempty"`
+	ToID      int    `json:"toId,omitempty"`
+	Amount    int64  `json:"amount"`
+}
+
+// publishEvents streams the transaction and the new balance to the subscribers of the account, a failure
+// doesn't affect the already applied operation.
+func (tc *TransactionConsumer) publishEvents(ctx context.Context, accountId int, balance *money.Money, tx TransactionEvent) {
+	if tc.Events == nil {
+		return
+	}
+
+	if err := tc.Events.Publish(ctx, accountId, stream.TypeTransaction, tx); err != nil {
+		log.Errorf("error publishing transaction event of account id %d: %v", accountId, err)
+		return
+	}
+
+	b := BalanceEvent{Amount: balance.Amount(), Currency: balance.Currency().Code, Display: balance.Display()}
+	if err := tc.Events.Publish(ctx, accountId, stream.TypeBalance, b); err != nil {
+		log.Errorf("error publishing balance event of account id %d: %v", accountId, err)
+	}
+}
+
+// RejectedEvent is sent to the webhooks when a transaction can never be processed.
+type RejectedEvent struct {
+	MessageID string `json:"messageId"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+}
+
+// enqueueWebhook stores the webhook deliveries of the event, a failure doesn't affect the already applied operation.
+func (tc *TransactionConsumer) enqueueWebhook(ctx context.Context, eventType string, data interface{}, accountIds ...int) {
+	if err := tc.Service.EnqueueWebhooks(ctx, eventType, accountIds, data); err != nil {
+		log.Errorf("error enqueueing %s webhooks for accounts %v: %v", eventType, accountIds, err)
+	}
+}
@@ -1,5 +1,23 @@
 package balance
 
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+// defaultSchemaVersion is assumed for messages without a schema version header, they were published
+// before the header was introduced.
+const defaultSchemaVersion = "1"
+
 type BalanceMessage struct {
 	AccountID int   `json:"id"`
 	Amount    int64 `json:"amount"`
@@ -10,3 +28,72 @@ type TransferMessage struct {
 	ToID   int   `json:"to"`
 	Amount int64 `json:"amount"`
 }
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// schemas of the messages by schema version, a new version is added next to the old ones until every
+// publisher is migrated.
+var (
+	balanceSchemas = map[string]*openapi.Schema{
+		"1": mustLoadSchema("schemas/balance-message.v1.json"),
+	}
+	transferSchemas = map[string]*openapi.Schema{
+		"1": mustLoadSchema("schemas/transfer-message.v1.json"),
+	}
+)
+
+func mustLoadSchema(name string) *openapi.Schema {
+	b, err := schemaFiles.ReadFile(name)
+	if err != nil {
+		log.Fatalf("unable to read message schema %s: %v", name, err)
+	}
+
+	s, err := openapi.ParseSchema(b)
+	if err != nil {
+		log.Fatalf("invalid message schema %s: %v", name, err)
+	}
+
+	return s
+}
+
+// decode validates the body against the schema of its version before decoding it into v, so missing and
+// unknown fields are refused instead of being zero values. The data of CloudEvents is decoded in any mode.
+func decode(d amqp.Delivery, schemas map[string]*openapi.Schema, v interface{}) error {
+	version := schemaVersion(d)
+	schema, ok := schemas[version]
+	if !ok {
+		return problem.Newf(problem.MalformedRequest, "unsupported message schema version %s", version)
+	}
+
+	_, data, err := cloudevents.Decode(d)
+	if err != nil {
+		return problem.New(problem.MalformedRequest, err.Error())
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return invalidPayloadError
+	}
+
+	if err := problem.Validation(schema.Validate(raw)...); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalidPayloadError
+	}
+
+	return nil
+}
+
+func schemaVersion(d amqp.Delivery) string {
+	v, ok := d.Headers[mq.SchemaVersionHeader]
+	if !ok || v == nil {
+		return defaultSchemaVersion
+	}
+
+	return fmt.Sprint(v)
+}
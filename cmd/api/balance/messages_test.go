@@ -0,0 +1,72 @@
+package balance
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+func TestDecode(t *testing.T) {
+	var m BalanceMessage
+	err := decode(amqp.Delivery{Body: []byte(`{"id":1,"amount":10}`)}, balanceSchemas, &m)
+	assert.NoError(t, err)
+	assert.Equal(t, BalanceMessage{AccountID: 1, Amount: 10}, m)
+
+	var tm TransferMessage
+	err = decode(amqp.Delivery{
+		Headers: amqp.Table{mq.SchemaVersionHeader: "1"},
+		Body:    []byte(`{"from":1,"to":2,"amount":10}`),
+	}, transferSchemas, &tm)
+	assert.NoError(t, err)
+	assert.Equal(t, TransferMessage{FromID: 1, ToID: 2, Amount: 10}, tm)
+
+	var cm BalanceMessage
+	err = decode(amqp.Delivery{
+		ContentType: cloudevents.ContentType,
+		Body:        []byte(`{"specversion":"1.0","id":"1","source":"payments-api","type":"payments.deposit.requested","data":{"id":1,"amount":10}}`),
+	}, balanceSchemas, &cm)
+	assert.NoError(t, err)
+	assert.Equal(t, BalanceMessage{AccountID: 1, Amount: 10}, cm)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for body, expected := range map[string]string{
+		`{"id":1}`:                              "amount: is required",
+		`{"id":1,"amount":10,"currency":"GBP"}`: "currency: is not allowed",
+		`{"id":"1","amount":0.5}`:               "amount: must be an integer, id: must be an integer",
+		`invalid`:                               "invalid message payload, unable to parse",
+	} {
+		var m BalanceMessage
+		err := decode(amqp.Delivery{Body: []byte(body)}, balanceSchemas, &m)
+		assert.EqualError(t, err, expected, body)
+	}
+
+	var m BalanceMessage
+	err := decode(amqp.Delivery{
+		Headers: amqp.Table{mq.SchemaVersionHeader: int32(2)},
+		Body:    []byte(`{"id":1,"amount":10}`),
+	}, balanceSchemas, &m)
+	assert.EqualError(t, err, "unsupported message schema version 2")
+	assert.Equal(t, problem.MalformedRequest, problem.CodeOf(err))
+}
+
+func TestSubmitInvalidMessage(t *testing.T) {
+	// refused before publishing, so no connection is needed
+	_, err := SubmitDeposit(context.Background(), nil, BalanceMessage{AccountID: 1})
+	assert.EqualError(t, err, "amount: must be greater than or equal to 1")
+	assert.Equal(t, problem.ValidationFailed, problem.CodeOf(err))
+
+	_, err = SubmitTransfer(context.Background(), nil, TransferMessage{FromID: 1, Amount: 10})
+	assert.EqualError(t, err, "to: must be greater than or equal to 1")
+}
+
+func TestAccountKey(t *testing.T) {
+	assert.Equal(t, "1", accountKey(amqp.Delivery{Body: []byte(`{"id":1,"amount":10}`)}))
+	assert.Equal(t, "2", accountKey(amqp.Delivery{Body: []byte(`{"from":2,"to":3,"amount":10}`)}))
+	assert.Equal(t, "", accountKey(amqp.Delivery{Body: []byte(`invalid`)}))
+}
@@ -0,0 +1,89 @@
+package balance
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
+)
+
+const (
+	contentType = "application/json"
+
+	// publishedSchemaVersion is the schema version the messages are published with.
+	publishedSchemaVersion = "1"
+
+	// CloudEvents attributes of the balance operations
+	eventSource          = "payments-api"
+	depositRequested     = "payments.deposit.requested"
+	withdrawRequested    = "payments.withdraw.requested"
+	transferRequested    = "payments.transfer.requested"
+	balanceMessageSchema = "urn:payments-api:schema:balance-message:1"
+	transferSchema       = "urn:payments-api:schema:transfer-message:1"
+)
+
+func SubmitDeposit(ctx context.Context, conn *mq.Conn, m BalanceMessage) (string, error) {
+	e := cloudevents.Event{Type: depositRequested, Subject: accountSubject(m.AccountID), DataSchema: balanceMessageSchema}
+	return submit(ctx, conn, mq.DepositRouteKey, balanceSchemas, e, m)
+}
+
+func SubmitWithdraw(ctx context.Context, conn *mq.Conn, m BalanceMessage) (string, error) {
+	e := cloudevents.Event{Type: withdrawRequested, Subject: accountSubject(m.AccountID), DataSchema: balanceMessageSchema}
+	return submit(ctx, conn, mq.WithdrawRouteKey, balanceSchemas, e, m)
+}
+
+// SubmitTransfer publishes a transfer, the subject of the event is the account the funds are taken from.
+func SubmitTransfer(ctx context.Context, conn *mq.Conn, m TransferMessage) (string, error) {
+	e := cloudevents.Event{Type: transferRequested, Subject: accountSubject(m.FromID), DataSchema: transferSchema}
+	return submit(ctx, conn, mq.TransferRouteKey, transferSchemas, e, m)
+}
+
+// submit publishes the message with the current schema version and returns its message id. The message is
+// validated against the same schema the consumers use, so an invalid one is refused before it is published.
+func submit(ctx context.Context, conn *mq.Conn, routeKey string, schemas map[string]*openapi.Schema, e cloudevents.Event, m interface{}) (string, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	var raw interface{}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return "", err
+	}
+	if err = problem.Validation(schemas[publishedSchemaVersion].Validate(raw)...); err != nil {
+		return "", err
+	}
+
+	tc := tracecontext.Outgoing(ctx)
+	e.ID = uuid.New().String()
+	e.Source = eventSource
+	e.Time = time.Now().UTC()
+	e.TraceParent = tc.TraceParent
+	e.TraceState = tc.TraceState
+
+	err = conn.PublishPayment(routeKey, e, amqp.Publishing{
+		Headers:      amqp.Table{mq.SchemaVersionHeader: publishedSchemaVersion},
+		ContentType:  contentType,
+		MessageId:    e.ID,
+		Timestamp:    e.Time,
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return e.ID, nil
+}
+
+func accountSubject(id int) string {
+	return "accounts/" + strconv.Itoa(id)
+}
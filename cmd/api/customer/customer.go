@@ -1,32 +1,59 @@
 package customer
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	database "github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const MaxFieldLength = 25
+
+var (
+	EmailTakenError = problem.New(problem.EmailTaken, "email is taken")
+	ErasedError     = problem.New(problem.CustomerErased, "customer data is erased")
 )
 
 type Customer struct {
-	ID         int       `json:"id" db:"id"`
-	FirstName  string    `json:"firstName" db:"first_name"`
-	LastName   string    `json:"lastName" db:"last_name"`
-	Email      string    `json:"email" db:"email"`
-	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
-	ModifiedAt time.Time `json:"modifiedAt" db:"modified_at"`
+	ID                 int               `json:"id" db:"id"`
+	FirstName          string            `json:"firstName" db:"first_name"`
+	LastName           string            `json:"lastName" db:"last_name"`
+	Email              string            `json:"email" db:"email"`
+	KeyID              *string           `json:"-" db:"pii_key_id"`
+	KYCStatus          KYCStatus         `json:"kycStatus" db:"kyc_status"`
+	KYCExpiresAt       *time.Time        `json:"kycExpiresAt,omitempty" db:"kyc_expires_at"`
+	KYCRejectionReason *string           `json:"kycRejectionReason,omitempty" db:"kyc_rejection_reason"`
+	ErasedAt           *time.Time        `json:"erasedAt,omitempty" db:"erased_at"`
+	CreatedAt          time.Time         `json:"createdAt" db:"created_at"`
+	ModifiedAt         time.Time         `json:"modifiedAt" db:"modified_at"`
+	Metadata           metadata.Metadata `json:"metadata" db:"metadata"`
 }
 
-func Create(db *sqlx.DB, ar account.AccCreationRequest) (*Customer, error) {
+func Create(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, ar account.AccCreationRequest) (*Customer, error) {
 	c := &Customer{
 		FirstName:  ar.FirstName,
 		LastName:   ar.LastName,
 		Email:      ar.Email,
+		KYCStatus:  KYCUnverified,
 		CreatedAt:  time.Now().UTC(),
 		ModifiedAt: time.Now().UTC(),
 	}
 
-	stmt, err := db.Prepare(insert)
+	pii, err := SealPII(cipher, c.FirstName, c.LastName, c.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := db.PrepareContext(ctx, insert)
 	if err != nil {
 		return nil, err
 	}
@@ -37,13 +64,91 @@ func Create(db *sqlx.DB, ar account.AccCreationRequest) (*Customer, error) {
 		}
 	}()
 
-	row := stmt.QueryRow(c.FirstName, c.LastName, c.Email, c.CreatedAt, c.ModifiedAt)
+	row := stmt.QueryRowContext(ctx, pii.FirstName, pii.LastName, pii.Email, pii.EmailIndex, pii.KeyID, c.CreatedAt, c.ModifiedAt)
 
 	if err = row.Scan(&c.ID); err != nil {
+		if pgErr, ok := err.(*pq.Error); ok && string(pgErr.Code) == database.PSQLErrUniqueConstraint {
+			return nil, EmailTakenError
+		}
 		return nil, err
 	}
 
-	log.Infof("successfully created customer with email %s and id %d", c.Email, c.ID)
+	c.KeyID = &pii.KeyID
+
+	log.Infof("successfully created customer with id %d", c.ID)
 
 	return c, nil
 }
+
+func SelectById(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int) (*Customer, error) {
+	var c Customer
+
+	if err := db.GetContext(ctx, &c, selectById, id); err != nil {
+		return nil, err
+	}
+
+	if err := c.DecryptPII(cipher); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Update applies the patch to the customer, which is locked until the update is committed. The data of erased
+// customers can't be changed.
+func Update(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int, p Patch) (*Customer, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+
+	var c Customer
+	if err = tx.GetContext(ctx, &c, selectByIdForUpdate, id); err != nil {
+		_ = tx.Rollback()
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if err = c.DecryptPII(cipher); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = p.apply(&c); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	c.ModifiedAt = time.Now().UTC()
+
+	if _, err = tx.ExecContext(ctx, updateMetadata, c.Metadata, c.ModifiedAt, id); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("update of customer id %d was rolled back, error: %v", id, err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("failed to commit update of customer id %d, error: %v", id, err)
+		return nil, err
+	}
+
+	log.Infof("successfully updated customer id %d", id)
+
+	return &c, nil
+}
+
+func SelectByEmail(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, email string) (*Customer, error) {
+	var c Customer
+
+	if err := db.GetContext(ctx, &c, selectByEmailIndex, cipher.BlindIndex(email)); err != nil {
+		return nil, err
+	}
+
+	if err := c.DecryptPII(cipher); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
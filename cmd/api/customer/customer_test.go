@@ -1,20 +1,29 @@
 package customer
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
 )
 
 var (
+	testKey          = generateKey()
+	oldKey           = generateKey()
+	testIndexKey     = generateKey()
+	cipher           = newCipher("test")
 	id               = int(uuid.New().ID())
 	createdAt        = time.Now().UTC()
 	expectedCustomer = &Customer{
@@ -31,8 +40,6 @@ func TestCreate(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "INSERT INTO customers\\(first_name, last_name, email, created_at, modified_at\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5\\) RETURNING id;"
-
 	rows := sqlmock.NewRows([]string{"id"}).AddRow(id)
 
 	request := account.AccCreationRequest{
@@ -41,10 +48,12 @@ func TestCreate(t *testing.T) {
 		Email:     "first@last.com",
 	}
 
-	mock.ExpectPrepare(query).ExpectQuery().WithArgs(request.FirstName, request.LastName, request.Email, sqlmock.AnyArg(), sqlmock.AnyArg()).
+	mock.ExpectPrepare(insertQuery).ExpectQuery().
+		WithArgs(encrypted(request.FirstName), encrypted(request.LastName), encrypted(request.Email),
+			cipher.BlindIndex(request.Email), "test", sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnRows(rows)
 
-	actualCustomer, err := Create(db, request)
+	actualCustomer, err := Create(context.Background(), db, cipher, request)
 
 	assert.NoError(t, err)
 
@@ -61,9 +70,7 @@ func TestCreateCustomerError(t *testing.T) {
 	db, mock := NewMockDb()
 	defer db.Close()
 
-	query := "INSERT INTO customers\\(first_name, last_name, email, created_at, modified_at\\) VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5\\) RETURNING id;"
-
-	mock.ExpectPrepare(query).WillReturnError(sql.ErrConnDone)
+	mock.ExpectPrepare(insertQuery).WillReturnError(sql.ErrConnDone)
 
 	request := account.AccCreationRequest{
 		FirstName: "first",
@@ -71,12 +78,361 @@ func TestCreateCustomerError(t *testing.T) {
 		Email:     "first@last.com",
 	}
 
-	_, err := Create(db, request)
+	_, err := Create(context.Background(), db, cipher, request)
 	if errors.Cause(err) != sql.ErrConnDone {
 		t.Errorf("account deletion test failed err expected sql.ErrConnDone but got: %v:", err)
 	}
 }
 
+func TestCreateCustomerEmailTaken(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectPrepare(insertQuery).ExpectQuery().WillReturnError(&pq.Error{Code: "23505"})
+
+	_, err := Create(context.Background(), db, cipher, account.AccCreationRequest{Email: "first@last.com"})
+	assert.Equal(t, EmailTakenError, err)
+}
+
+func TestSelectById(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectQuery(selectQuery + ";").WithArgs(id).WillReturnRows(customerRows("unverified", nil, nil))
+
+	actualCustomer, err := SelectById(context.Background(), db, cipher, id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, id, actualCustomer.ID)
+	assert.Equal(t, "first", actualCustomer.FirstName)
+	assert.Equal(t, "last", actualCustomer.LastName)
+	assert.Equal(t, "first@last.com", actualCustomer.Email)
+	assert.Equal(t, KYCUnverified, actualCustomer.KYCStatus)
+	assert.Nil(t, actualCustomer.KYCExpiresAt)
+	assert.False(t, actualCustomer.Verified(time.Now().UTC()))
+}
+
+func TestSelectByIdLegacyPlaintext(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id", "kyc_status", "kyc_expires_at", "kyc_rejection_reason", "erased_at", "created_at", "modified_at"}).
+		AddRow(id, "first", "last", "first@last.com", nil, "unverified", nil, nil, nil, createdAt, createdAt)
+
+	mock.ExpectQuery(selectQuery + ";").WithArgs(id).WillReturnRows(rows)
+
+	actualCustomer, err := SelectById(context.Background(), db, cipher, id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "first@last.com", actualCustomer.Email)
+}
+
+func TestSelectByEmail(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	query := "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE email_index=\\$1;"
+
+	mock.ExpectQuery(query).WithArgs(cipher.BlindIndex("first@last.com")).WillReturnRows(customerRows("unverified", nil, nil))
+
+	actualCustomer, err := SelectByEmail(context.Background(), db, cipher, "First@Last.com")
+
+	assert.NoError(t, err)
+	assert.Equal(t, id, actualCustomer.ID)
+	assert.Equal(t, "first@last.com", actualCustomer.Email)
+}
+
+func TestReencryptPII(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	query := "SELECT id, first_name, last_name, email, pii_key_id FROM customers WHERE pii_key_id IS DISTINCT FROM \\$1 " +
+		"ORDER BY id LIMIT \\$2 FOR UPDATE SKIP LOCKED;"
+	updateQuery := "UPDATE customers SET first_name=\\$1, last_name=\\$2, email=\\$3, email_index=\\$4, pii_key_id=\\$5 WHERE id=\\$6;"
+
+	oldCipher := newCipher("old")
+	oldFirst, _ := oldCipher.Encrypt("first")
+	oldLast, _ := oldCipher.Encrypt("last")
+	oldEmail, _ := oldCipher.Encrypt("first@last.com")
+
+	rotated, err := encryption.NewLocalKeyProvider("test", map[string][]byte{"test": testKey, "old": oldKey}, testIndexKey)
+	assert.NoError(t, err)
+	rotatedCipher := encryption.NewCipher(rotated)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs("test", 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id"}).
+			AddRow(1, oldFirst, oldLast, oldEmail, "old").
+			AddRow(2, "second", "last", "second@last.com", nil))
+	mock.ExpectExec(updateQuery).WithArgs(encrypted("first"), encrypted("last"), encrypted("first@last.com"),
+		cipher.BlindIndex("first@last.com"), "test", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(updateQuery).WithArgs(encrypted("second"), encrypted("last"), encrypted("second@last.com"),
+		cipher.BlindIndex("second@last.com"), "test", 2).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs("test", 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id"}))
+	mock.ExpectCommit()
+
+	n, err := ReencryptPII(context.Background(), db, rotatedCipher, 2)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSubmitKYC(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	expiresAt := time.Now().UTC().AddDate(1, 0, 0)
+	request := KYCSubmissionRequest{
+		Documents: []KYCDocument{{Type: "passport", Reference: "doc-1", ExpiresAt: expiresAt}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(customerRows("rejected", nil, "blurry"))
+	mock.ExpectPrepare(insertDocumentQuery).ExpectQuery().WithArgs(id, "passport", "doc-1", expiresAt, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(updateKYCStatusQuery).WithArgs(KYCPending, nil, nil, sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	actualCustomer, err := SubmitKYC(context.Background(), db, cipher, id, request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, KYCPending, actualCustomer.KYCStatus)
+	assert.Nil(t, actualCustomer.KYCRejectionReason)
+}
+
+func TestSubmitKYCAlreadyPending(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(customerRows("pending", nil, nil))
+	mock.ExpectRollback()
+
+	_, err := SubmitKYC(context.Background(), db, cipher, id, KYCSubmissionRequest{})
+
+	_, ok := err.(*KYCTransitionError)
+	assert.True(t, ok)
+	assert.Equal(t, "kyc status can't change from pending to pending", err.Error())
+}
+
+func TestSubmitKYCErased(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(erasedCustomerRows("rejected"))
+	mock.ExpectRollback()
+
+	_, err := SubmitKYC(context.Background(), db, cipher, id, KYCSubmissionRequest{})
+
+	assert.Equal(t, ErasedError, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestApproveKYC(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	expiresAt := time.Now().UTC().AddDate(1, 0, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(customerRows("pending", nil, nil))
+	mock.ExpectQuery(selectDocumentsExpiryQuery).WithArgs(id, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(expiresAt))
+	mock.ExpectExec(updateKYCStatusQuery).WithArgs(KYCVerified, expiresAt, nil, sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	actualCustomer, err := ApproveKYC(context.Background(), db, cipher, id)
+
+	assert.NoError(t, err)
+	assert.Equal(t, KYCVerified, actualCustomer.KYCStatus)
+	assert.Equal(t, expiresAt, *actualCustomer.KYCExpiresAt)
+	assert.True(t, actualCustomer.Verified(time.Now().UTC()))
+}
+
+func TestApproveKYCNoValidDocuments(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(customerRows("pending", nil, nil))
+	mock.ExpectQuery(selectDocumentsExpiryQuery).WithArgs(id, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(nil))
+	mock.ExpectRollback()
+
+	_, err := ApproveKYC(context.Background(), db, cipher, id)
+
+	assert.True(t, errors.Cause(err) == NoValidDocumentsError)
+}
+
+func TestApproveKYCResubmitted(t *testing.T) {
+	r := NewMemoryRepository()
+	c, _ := r.Create(context.Background(), account.AccCreationRequest{Email: "first@last.com"})
+
+	rejected := KYCSubmissionRequest{Documents: []KYCDocument{{Type: "passport", Reference: "doc-1", ExpiresAt: time.Now().UTC().AddDate(0, 1, 0)}}}
+	_, _ = r.SubmitKYC(context.Background(), c.ID, rejected)
+	_, _ = r.RejectKYC(context.Background(), c.ID, "blurry")
+
+	expiresAt := time.Now().UTC().AddDate(1, 0, 0)
+	_, _ = r.SubmitKYC(context.Background(), c.ID, KYCSubmissionRequest{Documents: []KYCDocument{{Type: "passport", Reference: "doc-2", ExpiresAt: expiresAt}}})
+
+	// the document of the rejected submission doesn't shorten the verification
+	actualCustomer, err := r.ApproveKYC(context.Background(), c.ID)
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, expiresAt, *actualCustomer.KYCExpiresAt)
+	}
+}
+
+func TestApproveKYCErased(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(erasedCustomerRows("pending"))
+	mock.ExpectRollback()
+
+	_, err := ApproveKYC(context.Background(), db, cipher, id)
+
+	assert.Equal(t, ErasedError, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRejectKYCErased(t *testing.T) {
+	r := NewMemoryRepository()
+	c, _ := r.Create(context.Background(), account.AccCreationRequest{Email: "first@last.com"})
+	_, _ = r.SubmitKYC(context.Background(), c.ID, KYCSubmissionRequest{})
+
+	erasedAt := time.Now()
+	erased := r.customers[c.ID]
+	erased.ErasedAt = &erasedAt
+	r.customers[c.ID] = erased
+
+	_, err := r.RejectKYC(context.Background(), c.ID, "blurry")
+
+	assert.Equal(t, ErasedError, err)
+	assert.Equal(t, KYCPending, r.customers[c.ID].KYCStatus)
+}
+
+func TestRejectKYCNotFound(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	_, err := RejectKYC(context.Background(), db, cipher, id, "blurry")
+
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestUpdate(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectForUpdateQuery).WithArgs(id).WillReturnRows(customerRows("verified", nil, nil))
+	mock.ExpectExec(updateMetadataQuery).WithArgs(`{"costCenter":"42","externalId":"c-1"}`, sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	costCenter := "42"
+	c, err := Update(context.Background(), db, cipher, id, Patch{Metadata: metadata.Patch{Values: map[string]*string{"costCenter": &costCenter}}})
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, metadata.Metadata{"externalId": "c-1", "costCenter": "42"}, c.Metadata)
+		assert.Equal(t, "first@last.com", c.Email)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateErased(t *testing.T) {
+	r := NewMemoryRepository()
+	c, _ := r.Create(context.Background(), account.AccCreationRequest{Email: "first@last.com"})
+
+	erasedAt := time.Now()
+	erased := r.customers[c.ID]
+	erased.ErasedAt = &erasedAt
+	r.customers[c.ID] = erased
+
+	_, err := r.Update(context.Background(), c.ID, Patch{})
+
+	assert.Equal(t, ErasedError, err)
+}
+
+const (
+	insertQuery = "INSERT INTO customers\\(first_name, last_name, email, email_index, pii_key_id, created_at, modified_at\\) " +
+		"VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5,\\$6,\\$7\\) RETURNING id;"
+	selectQuery = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=\\$1"
+	selectForUpdateQuery = selectQuery + " FOR UPDATE;"
+	insertDocumentQuery  = "INSERT INTO kyc_documents\\(customer_id, document_type, reference, expires_at, created_at\\) " +
+		"VALUES\\(\\$1,\\$2,\\$3,\\$4,\\$5\\) RETURNING id;"
+	selectDocumentsExpiryQuery = "SELECT MIN\\(expires_at\\) FROM kyc_documents WHERE customer_id=\\$1 AND expires_at > \\$2 " +
+		"AND created_at = \\(SELECT MAX\\(created_at\\) FROM kyc_documents WHERE customer_id=\\$1\\);"
+	updateKYCStatusQuery = "UPDATE customers SET kyc_status=\\$1, kyc_expires_at=\\$2, kyc_rejection_reason=\\$3, modified_at=\\$4 WHERE id=\\$5;"
+	updateMetadataQuery  = "UPDATE customers SET metadata=\\$1, modified_at=\\$2 WHERE id=\\$3;"
+)
+
+func customerRows(status string, expiresAt, reason interface{}) *sqlmock.Rows {
+	pii, err := SealPII(cipher, "first", "last", "first@last.com")
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when encrypting test customer", err)
+	}
+
+	return sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id", "kyc_status", "kyc_expires_at", "kyc_rejection_reason", "erased_at", "created_at", "modified_at", "metadata"}).
+		AddRow(id, pii.FirstName, pii.LastName, pii.Email, pii.KeyID, status, expiresAt, reason, nil, createdAt, createdAt, []byte(`{"externalId": "c-1"}`))
+}
+
+// encryptedArg matches an encrypted query argument by decrypting it with the test cipher.
+type encryptedArg string
+
+func encrypted(plaintext string) encryptedArg {
+	return encryptedArg(plaintext)
+}
+
+func (e encryptedArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+
+	plaintext, err := cipher.Decrypt(s)
+
+	return err == nil && plaintext == string(e)
+}
+
+func newCipher(keyId string) *encryption.Cipher {
+	key := testKey
+	if keyId != "test" {
+		key = oldKey
+	}
+
+	keys, err := encryption.NewLocalKeyProvider(keyId, map[string][]byte{keyId: key}, testIndexKey)
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when creating key provider", err)
+	}
+
+	return encryption.NewCipher(keys)
+}
+
+func generateKey() []byte {
+	k, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when generating key", err)
+	}
+
+	return k
+}
+
 func NewMockDb() (*sqlx.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -86,3 +442,13 @@ func NewMockDb() (*sqlx.DB, sqlmock.Sqlmock) {
 
 	return sqlxDB, mock
 }
+
+func erasedCustomerRows(status string) *sqlmock.Rows {
+	pii, err := SealPII(cipher, "erased", "erased", "erased@invalid")
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when encrypting test customer", err)
+	}
+
+	return sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id", "kyc_status", "kyc_expires_at", "kyc_rejection_reason", "erased_at", "created_at", "modified_at", "metadata"}).
+		AddRow(id, pii.FirstName, pii.LastName, pii.Email, pii.KeyID, status, nil, nil, createdAt, createdAt, createdAt, []byte(`{}`))
+}
@@ -0,0 +1,221 @@
+package customer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+type KYCStatus string
+
+const (
+	KYCUnverified KYCStatus = "unverified"
+	KYCPending    KYCStatus = "pending"
+	KYCVerified   KYCStatus = "verified"
+	KYCRejected   KYCStatus = "rejected"
+)
+
+var NoValidDocumentsError = problem.New(problem.KYCNoValidDocuments, "kyc approval requires at least one unexpired document")
+
+type KYCTransitionError struct {
+	From KYCStatus
+	To   KYCStatus
+}
+
+func (te *KYCTransitionError) Error() string {
+	return fmt.Sprintf("kyc status can't change from %s to %s", te.From, te.To)
+}
+
+func (te *KYCTransitionError) ErrorCode() problem.Code {
+	return problem.KYCTransitionNotAllowed
+}
+
+type KYCRequiredError struct {
+	CustomerID int
+}
+
+func (re *KYCRequiredError) Error() string {
+	return fmt.Sprintf("customer id %d has no valid kyc verification", re.CustomerID)
+}
+
+func (re *KYCRequiredError) ErrorCode() problem.Code {
+	return problem.KYCRequired
+}
+
+// Verification is the KYC state of a customer without any personal data.
+type Verification struct {
+	CustomerID int        `db:"id"`
+	Status     KYCStatus  `db:"kyc_status"`
+	ExpiresAt  *time.Time `db:"kyc_expires_at"`
+}
+
+// Verified reports whether the customer passed KYC and the verification has not expired yet.
+func (c *Customer) Verified(now time.Time) bool {
+	return verified(c.KYCStatus, c.KYCExpiresAt, now)
+}
+
+func (v *Verification) Verified(now time.Time) bool {
+	return verified(v.Status, v.ExpiresAt, now)
+}
+
+func verified(status KYCStatus, expiresAt *time.Time, now time.Time) bool {
+	return status == KYCVerified && expiresAt != nil && expiresAt.After(now)
+}
+
+func SelectVerificationByAccountId(ctx context.Context, db *sqlx.DB, accountId int) (*Verification, error) {
+	var v Verification
+
+	if err := db.GetContext(ctx, &v, selectVerificationByAccountId, accountId); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func SubmitKYC(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int, r KYCSubmissionRequest) (*Customer, error) {
+	return changeKYCStatus(ctx, db, cipher, id, KYCPending, func(tx *sqlx.Tx, c *Customer, now time.Time) error {
+		if err := checkSubmission(c, now); err != nil {
+			return err
+		}
+
+		stmt, err := tx.PrepareContext(ctx, insertDocument)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := stmt.Close(); err != nil {
+				log.WithError(err).Info("insert kyc document")
+			}
+		}()
+
+		for _, d := range r.Documents {
+			var docId int
+			if err = stmt.QueryRowContext(ctx, c.ID, d.Type, d.Reference, d.ExpiresAt, now).Scan(&docId); err != nil {
+				return err
+			}
+		}
+
+		c.KYCExpiresAt = nil
+		c.KYCRejectionReason = nil
+
+		return nil
+	})
+}
+
+func ApproveKYC(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int) (*Customer, error) {
+	return changeKYCStatus(ctx, db, cipher, id, KYCVerified, func(tx *sqlx.Tx, c *Customer, now time.Time) error {
+		if err := checkReview(c, KYCVerified); err != nil {
+			return err
+		}
+
+		// the verification is only valid until the first of the submitted documents expires, the documents of a
+		// submission share their creation time and earlier, rejected submissions are not considered
+		var expiresAt sql.NullTime
+		if err := tx.QueryRowContext(ctx, selectDocumentsExpiry, c.ID, now).Scan(&expiresAt); err != nil {
+			return err
+		}
+
+		if !expiresAt.Valid {
+			return NoValidDocumentsError
+		}
+
+		c.KYCExpiresAt = &expiresAt.Time
+		c.KYCRejectionReason = nil
+
+		return nil
+	})
+}
+
+func RejectKYC(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int, reason string) (*Customer, error) {
+	return changeKYCStatus(ctx, db, cipher, id, KYCRejected, func(_ *sqlx.Tx, c *Customer, _ time.Time) error {
+		if err := checkReview(c, KYCRejected); err != nil {
+			return err
+		}
+
+		c.KYCExpiresAt = nil
+		c.KYCRejectionReason = &reason
+
+		return nil
+	})
+}
+
+// checkSubmission allows documents to be submitted unless they are under review, the customer is verified or erased.
+func checkSubmission(c *Customer, now time.Time) error {
+	if c.ErasedAt != nil {
+		return ErasedError
+	}
+
+	if c.KYCStatus == KYCPending || c.Verified(now) {
+		return &KYCTransitionError{From: c.KYCStatus, To: KYCPending}
+	}
+
+	return nil
+}
+
+// checkReview allows only pending submissions of customers who are not erased to be approved or rejected.
+func checkReview(c *Customer, to KYCStatus) error {
+	if c.ErasedAt != nil {
+		return ErasedError
+	}
+
+	if c.KYCStatus != KYCPending {
+		return &KYCTransitionError{From: c.KYCStatus, To: to}
+	}
+
+	return nil
+}
+
+func changeKYCStatus(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int, to KYCStatus, apply func(tx *sqlx.Tx, c *Customer, now time.Time) error) (*Customer, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+
+	var c Customer
+	if err = tx.GetContext(ctx, &c, selectByIdForUpdate, id); err != nil {
+		_ = tx.Rollback()
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if err = c.DecryptPII(cipher); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if err = apply(tx, &c, now); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("kyc status change to %s for customer id %d was rolled back, error: %v", to, id, err)
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, updateKYCStatus, to, c.KYCExpiresAt, c.KYCRejectionReason, now, id); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("kyc status change to %s for customer id %d was rolled back, error: %v", to, id, err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("failed to commit kyc status change to %s for customer id %d, error: %v", to, id, err)
+		return nil, err
+	}
+
+	c.KYCStatus = to
+	c.ModifiedAt = now
+
+	log.Infof("successfully changed kyc status of customer id %d to %s", id, to)
+
+	return &c, nil
+}
@@ -0,0 +1,132 @@
+package customer
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+// SealedPII holds the encrypted personal data of a customer as it is stored in the database.
+type SealedPII struct {
+	FirstName  string
+	LastName   string
+	Email      string
+	EmailIndex string
+	KeyID      string
+}
+
+type storedPII struct {
+	ID        int     `db:"id"`
+	FirstName string  `db:"first_name"`
+	LastName  string  `db:"last_name"`
+	Email     string  `db:"email"`
+	KeyID     *string `db:"pii_key_id"`
+}
+
+func SealPII(cipher *encryption.Cipher, firstName, lastName, email string) (*SealedPII, error) {
+	var err error
+	pii := SealedPII{
+		EmailIndex: cipher.BlindIndex(email),
+		KeyID:      cipher.KeyID(),
+	}
+
+	if pii.FirstName, err = cipher.Encrypt(firstName); err != nil {
+		return nil, err
+	}
+
+	if pii.LastName, err = cipher.Encrypt(lastName); err != nil {
+		return nil, err
+	}
+
+	if pii.Email, err = cipher.Encrypt(email); err != nil {
+		return nil, err
+	}
+
+	return &pii, nil
+}
+
+// DecryptPII replaces the encrypted fields with their plaintext. Customers without key id were stored
+// before encryption was introduced, they stay in plaintext until ReencryptPII picks them up.
+func (c *Customer) DecryptPII(cipher *encryption.Cipher) error {
+	if c.KeyID == nil {
+		return nil
+	}
+
+	for _, f := range []*string{&c.FirstName, &c.LastName, &c.Email} {
+		plaintext, err := cipher.Decrypt(*f)
+		if err != nil {
+			return err
+		}
+		*f = plaintext
+	}
+
+	return nil
+}
+
+// ReencryptPII encrypts every customer with the current key of the cipher in batches, and returns
+// the number of re-encrypted customers. Locked rows are skipped, so replicas can run it concurrently.
+func ReencryptPII(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, batchSize int) (int, error) {
+	total := 0
+
+	for {
+		n, err := reencryptBatch(ctx, db, cipher, batchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if n < batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Infof("successfully re-encrypted %d customers with key id %s", total, cipher.KeyID())
+	}
+
+	return total, nil
+}
+
+func reencryptBatch(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, batchSize int) (int, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return 0, err
+	}
+
+	stale := make([]storedPII, 0)
+	if err = tx.SelectContext(ctx, &stale, selectStalePII, cipher.KeyID(), batchSize); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	for _, s := range stale {
+		c := Customer{FirstName: s.FirstName, LastName: s.LastName, Email: s.Email, KeyID: s.KeyID}
+		if err = c.DecryptPII(cipher); err != nil {
+			_ = tx.Rollback()
+			log.Errorf("unable to decrypt customer id %d for re-encryption, error: %v", s.ID, err)
+			return 0, err
+		}
+
+		pii, err := SealPII(cipher, c.FirstName, c.LastName, c.Email)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		if _, err = tx.ExecContext(ctx, updatePII, pii.FirstName, pii.LastName, pii.Email, pii.EmailIndex, pii.KeyID, s.ID); err != nil {
+			_ = tx.Rollback()
+			log.Warnf("re-encryption of customer id %d was rolled back, error: %v", s.ID, err)
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("failed to commit re-encryption batch, error: %v", err)
+		return 0, err
+	}
+
+	return len(stale), nil
+}
@@ -1,5 +1,23 @@
 package customer
 
 const (
-	insert = "INSERT INTO customers(first_name, last_name, email, created_at, modified_at) VALUES($1,$2,$3,$4,$5) RETURNING id;"
+	insert = "INSERT INTO customers(first_name, last_name, email, email_index, pii_key_id, created_at, modified_at) " +
+		"VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id;"
+	selectById = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=$1;"
+	selectByEmailIndex = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE email_index=$1;"
+	selectByIdForUpdate = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=$1 FOR UPDATE;"
+	selectVerificationByAccountId = "SELECT c.id, c.kyc_status, c.kyc_expires_at FROM customers c " +
+		"JOIN accounts a ON a.customer_id = c.id WHERE a.id=$1;"
+	insertDocument = "INSERT INTO kyc_documents(customer_id, document_type, reference, expires_at, created_at) " +
+		"VALUES($1,$2,$3,$4,$5) RETURNING id;"
+	selectDocumentsExpiry = "SELECT MIN(expires_at) FROM kyc_documents WHERE customer_id=$1 AND expires_at > $2 " +
+		"AND created_at = (SELECT MAX(created_at) FROM kyc_documents WHERE customer_id=$1);"
+	updateKYCStatus = "UPDATE customers SET kyc_status=$1, kyc_expires_at=$2, kyc_rejection_reason=$3, modified_at=$4 WHERE id=$5;"
+	selectStalePII  = "SELECT id, first_name, last_name, email, pii_key_id FROM customers " +
+		"WHERE pii_key_id IS DISTINCT FROM $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED;"
+	updateMetadata = "UPDATE customers SET metadata=$1, modified_at=$2 WHERE id=$3;"
+	updatePII      = "UPDATE customers SET first_name=$1, last_name=$2, email=$3, email_index=$4, pii_key_id=$5 WHERE id=$6;"
 )
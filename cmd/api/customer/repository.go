@@ -0,0 +1,211 @@
+package customer
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+// PostgresRepository stores the customers in the db with their personal data encrypted.
+type PostgresRepository struct {
+	DB     *sqlx.DB
+	Cipher *encryption.Cipher
+}
+
+func (r *PostgresRepository) Create(ctx context.Context, ar account.AccCreationRequest) (*Customer, error) {
+	return Create(ctx, r.DB, r.Cipher, ar)
+}
+
+func (r *PostgresRepository) SelectById(ctx context.Context, id int) (*Customer, error) {
+	return SelectById(ctx, r.DB, r.Cipher, id)
+}
+
+func (r *PostgresRepository) Update(ctx context.Context, id int, p Patch) (*Customer, error) {
+	return Update(ctx, r.DB, r.Cipher, id, p)
+}
+
+func (r *PostgresRepository) SelectVerificationByAccountId(ctx context.Context, accountId int) (*Verification, error) {
+	return SelectVerificationByAccountId(ctx, r.DB, accountId)
+}
+
+func (r *PostgresRepository) SubmitKYC(ctx context.Context, id int, kr KYCSubmissionRequest) (*Customer, error) {
+	return SubmitKYC(ctx, r.DB, r.Cipher, id, kr)
+}
+
+func (r *PostgresRepository) ApproveKYC(ctx context.Context, id int) (*Customer, error) {
+	return ApproveKYC(ctx, r.DB, r.Cipher, id)
+}
+
+func (r *PostgresRepository) RejectKYC(ctx context.Context, id int, reason string) (*Customer, error) {
+	return RejectKYC(ctx, r.DB, r.Cipher, id, reason)
+}
+
+// MemoryRepository keeps the customers in memory with the same errors as the db, it is meant for tests.
+type MemoryRepository struct {
+	// AccountOwner returns the customer of an account, the verification of accounts is only found with it
+	AccountOwner func(accountId int) (int, bool)
+	mu           sync.Mutex
+	customers    map[int]Customer
+	// documents are the documents of the last submission of each customer
+	documents map[int][]KYCDocument
+	lastId    int
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{customers: make(map[int]Customer), documents: make(map[int][]KYCDocument)}
+}
+
+func (r *MemoryRepository) Create(_ context.Context, ar account.AccCreationRequest) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.customers {
+		if c.Email == ar.Email {
+			return nil, EmailTakenError
+		}
+	}
+
+	r.lastId++
+	c := Customer{
+		ID:         r.lastId,
+		FirstName:  ar.FirstName,
+		LastName:   ar.LastName,
+		Email:      ar.Email,
+		KYCStatus:  KYCUnverified,
+		CreatedAt:  time.Now().UTC(),
+		ModifiedAt: time.Now().UTC(),
+	}
+	r.customers[c.ID] = c
+
+	return &c, nil
+}
+
+func (r *MemoryRepository) SelectById(_ context.Context, id int) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.customers[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &c, nil
+}
+
+func (r *MemoryRepository) Update(_ context.Context, id int, p Patch) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.customers[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	if err := p.apply(&c); err != nil {
+		return nil, err
+	}
+	c.ModifiedAt = time.Now().UTC()
+	r.customers[id] = c
+
+	return &c, nil
+}
+
+func (r *MemoryRepository) SelectVerificationByAccountId(_ context.Context, accountId int) (*Verification, error) {
+	if r.AccountOwner == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	customerId, ok := r.AccountOwner(accountId)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.customers[customerId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &Verification{CustomerID: c.ID, Status: c.KYCStatus, ExpiresAt: c.KYCExpiresAt}, nil
+}
+
+func (r *MemoryRepository) SubmitKYC(_ context.Context, id int, kr KYCSubmissionRequest) (*Customer, error) {
+	return r.changeKYCStatus(id, KYCPending, func(c *Customer, now time.Time) error {
+		if err := checkSubmission(c, now); err != nil {
+			return err
+		}
+
+		r.documents[id] = kr.Documents
+		c.KYCExpiresAt = nil
+		c.KYCRejectionReason = nil
+
+		return nil
+	})
+}
+
+func (r *MemoryRepository) ApproveKYC(_ context.Context, id int) (*Customer, error) {
+	return r.changeKYCStatus(id, KYCVerified, func(c *Customer, now time.Time) error {
+		if err := checkReview(c, KYCVerified); err != nil {
+			return err
+		}
+
+		// the verification is only valid until the first of the submitted documents expires
+		var expiresAt *time.Time
+		for _, d := range r.documents[id] {
+			if d.ExpiresAt.After(now) && (expiresAt == nil || d.ExpiresAt.Before(*expiresAt)) {
+				e := d.ExpiresAt
+				expiresAt = &e
+			}
+		}
+
+		if expiresAt == nil {
+			return NoValidDocumentsError
+		}
+
+		c.KYCExpiresAt = expiresAt
+		c.KYCRejectionReason = nil
+
+		return nil
+	})
+}
+
+func (r *MemoryRepository) RejectKYC(_ context.Context, id int, reason string) (*Customer, error) {
+	return r.changeKYCStatus(id, KYCRejected, func(c *Customer, _ time.Time) error {
+		if err := checkReview(c, KYCRejected); err != nil {
+			return err
+		}
+
+		c.KYCExpiresAt = nil
+		c.KYCRejectionReason = &reason
+
+		return nil
+	})
+}
+
+func (r *MemoryRepository) changeKYCStatus(id int, to KYCStatus, apply func(c *Customer, now time.Time) error) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.customers[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	now := time.Now().UTC()
+	if err := apply(&c, now); err != nil {
+		return nil, err
+	}
+
+	c.KYCStatus = to
+	c.ModifiedAt = now
+	r.customers[id] = c
+
+	return &c, nil
+}
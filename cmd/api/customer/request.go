@@ -0,0 +1,42 @@
+package customer
+
+import (
+	"time"
+
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+type KYCDocument struct {
+	Type      string    `json:"type"`
+	Reference string    `json:"reference"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type KYCSubmissionRequest struct {
+	Documents []KYCDocument `json:"documents"`
+}
+
+type KYCRejectionRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ErasureRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Patch is a JSON merge patch (RFC 7396) of the mutable fields of a customer, the absent fields are not changed.
+type Patch struct {
+	Metadata metadata.Patch `json:"metadata"`
+}
+
+// apply changes the customer and validates the result.
+func (p Patch) apply(c *Customer) error {
+	if c.ErasedAt != nil {
+		return ErasedError
+	}
+
+	c.Metadata = c.Metadata.Apply(p.Metadata)
+
+	return problem.Validation(c.Metadata.Validate("metadata")...)
+}
@@ -0,0 +1,162 @@
+package gdpr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const pseudonym = "erased"
+
+var AlreadyErasedError = problem.New(problem.CustomerErased, "customer data is already erased")
+
+type Document struct {
+	ID        int       `json:"id" db:"id"`
+	Type      string    `json:"type" db:"document_type"`
+	Reference string    `json:"reference" db:"reference"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+type Transaction struct {
+	ID        int       `json:"id" db:"id"`
+	FromID    int       `json:"fromId" db:"from_id"`
+	ToID      int       `json:"toId" db:"to_id"`
+	Type      string    `json:"type" db:"transaction_type"`
+	Ack       bool      `json:"ack" db:"ack"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// Archive holds every record stored about a customer.
+type Archive struct {
+	Customer     customer.Customer `json:"customer"`
+	Documents    []Document        `json:"kycDocuments"`
+	Accounts     []account.Account `json:"accounts"`
+	Transactions []Transaction     `json:"transactions"`
+	ExportedAt   time.Time         `json:"exportedAt"`
+}
+
+func Export(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int) (*Archive, error) {
+	// a single read only snapshot, so the accounts and transactions are consistent with each other
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	archive := Archive{
+		Documents:    make([]Document, 0),
+		Accounts:     make([]account.Account, 0),
+		Transactions: make([]Transaction, 0),
+		ExportedAt:   time.Now().UTC(),
+	}
+
+	if err = tx.GetContext(ctx, &archive.Customer, selectCustomer, id); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if err = archive.Customer.DecryptPII(cipher); err != nil {
+		return nil, err
+	}
+
+	if err = tx.SelectContext(ctx, &archive.Documents, selectDocuments, id); err != nil {
+		return nil, err
+	}
+
+	if err = tx.SelectContext(ctx, &archive.Accounts, selectAccounts, id); err != nil {
+		return nil, err
+	}
+
+	if err = tx.SelectContext(ctx, &archive.Transactions, selectTransactions, id); err != nil {
+		return nil, err
+	}
+
+	log.Infof("exported data of customer id %d", id)
+
+	return &archive, nil
+}
+
+// Erase pseudonymizes the personal data of a customer and removes its metadata. Accounts and transactions are kept untouched,
+// so the ledger and the audit trail stay intact.
+func Erase(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, id int, reason string) (*customer.Customer, error) {
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+
+	var c customer.Customer
+	if err = tx.GetContext(ctx, &c, selectCustomerForUpdate, id); err != nil {
+		_ = tx.Rollback()
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if c.ErasedAt != nil {
+		_ = tx.Rollback()
+		return nil, AlreadyErasedError
+	}
+
+	erasedAt := time.Now().UTC()
+	email := fmt.Sprintf("%s-%d@invalid", pseudonym, id)
+
+	pii, err := customer.SealPII(cipher, pseudonym, pseudonym, email)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, pseudonymizeCustomer, pii.FirstName, pii.LastName, pii.Email, pii.EmailIndex, pii.KeyID, erasedAt, id); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("erasure of customer id %d was rolled back, error: %v", id, err)
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, redactDocuments, pseudonym, id); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("erasure of customer id %d was rolled back, error: %v", id, err)
+		return nil, err
+	}
+
+	var erasureId int
+	if err = tx.QueryRowContext(ctx, insertErasure, id, reason, erasedAt).Scan(&erasureId); err != nil {
+		_ = tx.Rollback()
+		log.Warnf("erasure of customer id %d was rolled back, error: %v", id, err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("failed to commit erasure of customer id %d, error: %v", id, err)
+		return nil, err
+	}
+
+	c.FirstName = pseudonym
+	c.LastName = pseudonym
+	c.Email = email
+	c.KeyID = &pii.KeyID
+	c.KYCRejectionReason = nil
+	c.Metadata = metadata.Metadata{}
+	c.ErasedAt = &erasedAt
+	c.ModifiedAt = erasedAt
+
+	log.Infof("successfully erased customer id %d, erasure id %d", id, erasureId)
+
+	return &c, nil
+}
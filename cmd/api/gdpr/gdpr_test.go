@@ -0,0 +1,155 @@
+package gdpr
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+var cipher = newCipher()
+
+const (
+	customerQuery = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=\\$1"
+	documentsQuery    = "SELECT id, document_type, reference, expires_at, created_at FROM kyc_documents WHERE customer_id=\\$1 ORDER BY id;"
+	accountsQuery     = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata FROM accounts WHERE customer_id=\\$1 ORDER BY id;"
+	transactionsQuery = "SELECT t.id, t.from_id, t.to_id, t.transaction_type, t.ack, t.created_at FROM transactions t"
+	pseudonymizeQuery = "UPDATE customers SET first_name=\\$1, last_name=\\$2, email=\\$3, email_index=\\$4, pii_key_id=\\$5, " +
+		"kyc_rejection_reason=NULL, metadata='{}', erased_at=\\$6, modified_at=\\$6 WHERE id=\\$7;"
+	redactQuery   = "UPDATE kyc_documents SET reference=\\$1 WHERE customer_id=\\$2;"
+	erasureQuery  = "INSERT INTO customer_erasures\\(customer_id, reason, created_at\\) VALUES\\(\\$1,\\$2,\\$3\\) RETURNING id;"
+	forUpdateTail = " FOR UPDATE;"
+)
+
+func TestExport(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(customerQuery).WithArgs(7).WillReturnRows(customerRows(utc, nil))
+	mock.ExpectQuery(documentsQuery).WithArgs(7).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "document_type", "reference", "expires_at", "created_at"}).
+			AddRow(1, "passport", "passport-1", utc.AddDate(1, 0, 0), utc))
+	mock.ExpectQuery(accountsQuery).WithArgs(7).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "customer_id", "balance_in_decimal", "currency", "product", "created_at", "modified_at", "frozen"}).
+			AddRow(3, 7, 1500, "EUR", "basic", utc, utc, false))
+	mock.ExpectQuery(transactionsQuery).WithArgs(7).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "from_id", "to_id", "transaction_type", "ack", "created_at"}).
+			AddRow(10, 3, 0, "deposit", true, utc).
+			AddRow(11, 3, 4, "transfer", true, utc))
+	mock.ExpectRollback()
+
+	archive, err := Export(context.Background(), db, cipher, 7)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 7, archive.Customer.ID)
+	assert.Equal(t, "first@last.com", archive.Customer.Email)
+	assert.Len(t, archive.Documents, 1)
+	assert.Len(t, archive.Accounts, 1)
+	assert.Equal(t, "basic", archive.Accounts[0].Product)
+	assert.Len(t, archive.Transactions, 2)
+	assert.Equal(t, "transfer", archive.Transactions[1].Type)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExportNotFound(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(customerQuery).WithArgs(7).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	archive, err := Export(context.Background(), db, cipher, 7)
+
+	assert.Nil(t, archive)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestErase(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(customerQuery + forUpdateTail).WithArgs(7).WillReturnRows(customerRows(utc, nil))
+	mock.ExpectExec(pseudonymizeQuery).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		cipher.BlindIndex("erased-7@invalid"), "test", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(redactQuery).WithArgs("erased", 7).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(erasureQuery).WithArgs(7, "customer request", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	c, err := Erase(context.Background(), db, cipher, 7, "customer request")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "erased", c.FirstName)
+	assert.Equal(t, "erased", c.LastName)
+	assert.Equal(t, "erased-7@invalid", c.Email)
+	assert.NotNil(t, c.ErasedAt)
+	assert.Equal(t, customer.KYCVerified, c.KYCStatus)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEraseAlreadyErased(t *testing.T) {
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	utc := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(customerQuery + forUpdateTail).WithArgs(7).WillReturnRows(customerRows(utc, utc))
+	mock.ExpectRollback()
+
+	c, err := Erase(context.Background(), db, cipher, 7, "customer request")
+
+	assert.Nil(t, c)
+	assert.True(t, errors.Cause(err) == AlreadyErasedError)
+}
+
+func customerRows(utc time.Time, erasedAt interface{}) *sqlmock.Rows {
+	pii, err := customer.SealPII(cipher, "first", "last", "first@last.com")
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when encrypting test customer", err)
+	}
+
+	return sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "pii_key_id", "kyc_status", "kyc_expires_at", "kyc_rejection_reason", "erased_at", "created_at", "modified_at"}).
+		AddRow(7, pii.FirstName, pii.LastName, pii.Email, pii.KeyID, "verified", utc.AddDate(1, 0, 0), nil, erasedAt, utc, utc)
+}
+
+func newCipher() *encryption.Cipher {
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when generating key", err)
+	}
+
+	keys, err := encryption.NewLocalKeyProvider("test", map[string][]byte{"test": key}, key)
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when creating key provider", err)
+	}
+
+	return encryption.NewCipher(keys)
+}
+
+func NewMockDb() (*sqlx.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(db, "sqlmock")
+
+	return sqlxDB, mock
+}
@@ -0,0 +1,18 @@
+package gdpr
+
+const (
+	selectCustomer = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=$1;"
+	selectCustomerForUpdate = "SELECT id, first_name, last_name, email, pii_key_id, kyc_status, kyc_expires_at, kyc_rejection_reason, erased_at, " +
+		"created_at, modified_at, metadata FROM customers WHERE id=$1 FOR UPDATE;"
+	selectDocuments = "SELECT id, document_type, reference, expires_at, created_at FROM kyc_documents WHERE customer_id=$1 ORDER BY id;"
+	selectAccounts  = "SELECT id, customer_id, balance_in_decimal, currency, product, created_at, modified_at, frozen, version, metadata " +
+		"FROM accounts WHERE customer_id=$1 ORDER BY id;"
+	selectTransactions = "SELECT t.id, t.from_id, t.to_id, t.transaction_type, t.ack, t.created_at FROM transactions t " +
+		"WHERE t.from_id IN (SELECT id FROM accounts WHERE customer_id=$1) " +
+		"OR t.to_id IN (SELECT id FROM accounts WHERE customer_id=$1) ORDER BY t.id;"
+	pseudonymizeCustomer = "UPDATE customers SET first_name=$1, last_name=$2, email=$3, email_index=$4, pii_key_id=$5, " +
+		"kyc_rejection_reason=NULL, metadata='{}', erased_at=$6, modified_at=$6 WHERE id=$7;"
+	redactDocuments = "UPDATE kyc_documents SET reference=$1 WHERE customer_id=$2;"
+	insertErasure   = "INSERT INTO customer_erasures(customer_id, reason, created_at) VALUES($1,$2,$3) RETURNING id;"
+)
@@ -0,0 +1,23 @@
+package gdpr
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+// PostgresRepository exports and erases the data of the customers stored in the db.
+type PostgresRepository struct {
+	DB     *sqlx.DB
+	Cipher *encryption.Cipher
+}
+
+func (r *PostgresRepository) Export(ctx context.Context, id int) (*Archive, error) {
+	return Export(ctx, r.DB, r.Cipher, id)
+}
+
+func (r *PostgresRepository) Erase(ctx context.Context, id int, reason string) (*customer.Customer, error) {
+	return Erase(ctx, r.DB, r.Cipher, id, reason)
+}
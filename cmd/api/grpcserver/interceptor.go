@@ -0,0 +1,81 @@
+package grpcserver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
+	paymentsv1 "github.com/tamasbrandstadter/payments-api/proto/payments/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadata keys of the credentials, gRPC lower cases the header names
+const (
+	apiKeyKey        = "x-api-key"
+	authorizationKey = "authorization"
+)
+
+// authenticate resolves the caller of the payments service from the same credentials as the REST API, the
+// principal is stored in the context like in the REST handlers.
+func authenticate(a *auth.Authenticator) grpc.UnaryServerInterceptor {
+	prefix := "/" + paymentsv1.Payments_ServiceDesc.ServiceName + "/"
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, prefix) {
+			return handler(ctx, req)
+		}
+
+		if a == nil {
+			return nil, toStatus(problem.New(problem.Unauthenticated, "authentication is not configured"))
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		p, err := a.AuthenticateCredentials(first(md, apiKeyKey), first(md, authorizationKey))
+		if err != nil {
+			log.Infof("authentication of %s failed: %v", info.FullMethod, err)
+			return nil, toStatus(problem.New(problem.Unauthenticated, "missing or invalid credentials"))
+		}
+
+		return handler(auth.NewContext(ctx, p), req)
+	}
+}
+
+// timeout cancels the context of the call after d unless the caller set an earlier deadline, like the REST API
+// does. A d of 0 leaves the deadline to the caller.
+func timeout(d time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if d <= 0 {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		return handler(ctx, req)
+	}
+}
+
+// traceContext continues the W3C trace of the caller from the traceparent metadata, or starts a new one, like
+// the REST API does.
+func traceContext(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tc, ok := tracecontext.Parse(first(md, tracecontext.TraceParentHeader), first(md, tracecontext.TraceStateHeader))
+	if !ok {
+		tc = tracecontext.New()
+	}
+
+	return handler(tracecontext.NewContext(ctx, tc), req)
+}
+
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+
+	return ""
+}
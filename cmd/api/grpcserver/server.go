@@ -0,0 +1,210 @@
+package grpcserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/balance"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	paymentsv1 "github.com/tamasbrandstadter/payments-api/proto/payments/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var transactionTypes = map[string]paymentsv1.TransactionType{
+	"deposit":  paymentsv1.TransactionType_TRANSACTION_TYPE_DEPOSIT,
+	"withdraw": paymentsv1.TransactionType_TRANSACTION_TYPE_WITHDRAW,
+	"transfer": paymentsv1.TransactionType_TRANSACTION_TYPE_TRANSFER,
+}
+
+// Server implements the gRPC API with the same service the REST handlers use.
+type Server struct {
+	paymentsv1.UnimplementedPaymentsServer
+	Service *service.Service
+	MQ      *mq.Conn
+}
+
+// NewServer registers the payments service next to the health and reflection services. Only the payments
+// service requires credentials, so probes and tooling work without them. The health server is returned to report
+// NOT_SERVING on shutdown.
+func NewServer(svc *service.Service, conn *mq.Conn, authenticator *auth.Authenticator, requestTimeout time.Duration) (*grpc.Server, *health.Server) {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(timeout(requestTimeout), traceContext, authenticate(authenticator)))
+
+	paymentsv1.RegisterPaymentsServer(s, &Server{Service: svc, MQ: conn})
+
+	hs := health.NewServer()
+	hs.SetServingStatus(paymentsv1.Payments_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
+
+	reflection.Register(s)
+
+	return s, hs
+}
+
+func (s *Server) GetAccount(ctx context.Context, r *paymentsv1.GetAccountRequest) (*paymentsv1.Account, error) {
+	acc, err := s.authorizeAccount(ctx, r.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	return &paymentsv1.Account{
+		Id:               int64(acc.ID),
+		CustomerId:       int64(acc.CustomerID),
+		BalanceInDecimal: acc.BalanceInDecimal,
+		Currency:         acc.Currency,
+		Product:          acc.Product,
+		Frozen:           acc.Frozen,
+		CreatedAt:        timestamppb.New(acc.CreatedAt),
+		ModifiedAt:       timestamppb.New(acc.ModifiedAt),
+	}, nil
+}
+
+func (s *Server) GetBalance(ctx context.Context, r *paymentsv1.GetBalanceRequest) (*paymentsv1.Balance, error) {
+	if _, err := s.authorizeAccount(ctx, r.GetAccountId()); err != nil {
+		return nil, err
+	}
+
+	m, err := s.Service.GetBalance(ctx, int(r.GetAccountId()))
+	if err != nil {
+		return nil, accountError(err, r.GetAccountId())
+	}
+
+	return &paymentsv1.Balance{
+		AccountId: r.GetAccountId(),
+		Amount:    m.Amount(),
+		Currency:  m.Currency().Code,
+		Display:   m.Display(),
+	}, nil
+}
+
+func (s *Server) SubmitTransaction(ctx context.Context, r *paymentsv1.SubmitTransactionRequest) (*paymentsv1.SubmitTransactionResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.HasRole(auth.RoleOperator, auth.RoleAdmin) {
+		return nil, toStatus(problem.New(problem.Forbidden, "insufficient permissions"))
+	}
+
+	var id string
+	switch t := r.GetTransaction().(type) {
+	case *paymentsv1.SubmitTransactionRequest_Deposit:
+		id, err = balance.SubmitDeposit(ctx, s.MQ, balance.BalanceMessage{AccountID: int(t.Deposit.GetAccountId()), Amount: t.Deposit.GetAmount()})
+	case *paymentsv1.SubmitTransactionRequest_Withdraw:
+		id, err = balance.SubmitWithdraw(ctx, s.MQ, balance.BalanceMessage{AccountID: int(t.Withdraw.GetAccountId()), Amount: t.Withdraw.GetAmount()})
+	case *paymentsv1.SubmitTransactionRequest_Transfer:
+		id, err = balance.SubmitTransfer(ctx, s.MQ, balance.TransferMessage{
+			FromID: int(t.Transfer.GetFromAccountId()),
+			ToID:   int(t.Transfer.GetToAccountId()),
+			Amount: t.Transfer.GetAmount(),
+		})
+	default:
+		err = problem.Validation(problem.Field("transaction", "is required"))
+	}
+	if err != nil {
+		return nil, toStatus(errors.Wrap(err, "unable to submit transaction"))
+	}
+
+	return &paymentsv1.SubmitTransactionResponse{MessageId: id}, nil
+}
+
+func (s *Server) ListTransactions(ctx context.Context, r *paymentsv1.ListTransactionsRequest) (*paymentsv1.ListTransactionsResponse, error) {
+	var fields []problem.FieldError
+	if r.GetPageSize() < 0 || r.GetPageSize() > maxPageSize {
+		fields = append(fields, problem.Field("page_size", fmt.Sprintf("must be between 0 and %d", maxPageSize)))
+	}
+	if r.GetBeforeId() < 0 {
+		fields = append(fields, problem.Field("before_id", "can't be negative"))
+	}
+	if err := problem.Validation(fields...); err != nil {
+		return nil, toStatus(err)
+	}
+
+	if _, err := s.authorizeAccount(ctx, r.GetAccountId()); err != nil {
+		return nil, err
+	}
+
+	size := int(r.GetPageSize())
+	if size == 0 {
+		size = defaultPageSize
+	}
+
+	txs, err := s.Service.ListTransactions(ctx, int(r.GetAccountId()), int(r.GetBeforeId()), size)
+	if err != nil {
+		return nil, toStatus(errors.Wrap(err, "unable to list transactions"))
+	}
+
+	resp := &paymentsv1.ListTransactionsResponse{Transactions: make([]*paymentsv1.Transaction, len(txs))}
+	for i, tx := range txs {
+		resp.Transactions[i] = &paymentsv1.Transaction{
+			Id:            int64(tx.ID),
+			FromAccountId: int64(tx.FromID),
+			ToAccountId:   int64(tx.ToID),
+			Type:          transactionTypes[tx.Type],
+			Ack:           tx.Ack,
+			CreatedAt:     timestamppb.New(tx.CreatedAt),
+		}
+	}
+	if len(txs) == size {
+		resp.NextBeforeId = int64(txs[len(txs)-1].ID)
+	}
+
+	return resp, nil
+}
+
+// authorizeAccount loads the account and lets customers only access their own ones, a missing account is
+// reported as permission denied to them like in the REST API.
+func (s *Server) authorizeAccount(ctx context.Context, id int64) (*account.Account, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acc, err := s.Service.GetAccount(ctx, int(id))
+	if err != nil {
+		if p.Role == auth.RoleCustomer && errors.Cause(err) == sql.ErrNoRows {
+			return nil, toStatus(problem.New(problem.Forbidden, "insufficient permissions"))
+		}
+		return nil, accountError(err, id)
+	}
+
+	if p.Role == auth.RoleCustomer && acc.CustomerID != p.CustomerID {
+		return nil, toStatus(problem.New(problem.Forbidden, "insufficient permissions"))
+	}
+
+	return acc, nil
+}
+
+// principal returns the caller resolved by the authenticate interceptor, calls which didn't pass it are rejected
+// instead of being served anonymously.
+func principal(ctx context.Context) (*auth.Principal, error) {
+	p, ok := auth.FromContext(ctx)
+	if !ok || p == nil {
+		return nil, toStatus(problem.New(problem.Unauthenticated, "missing or invalid credentials"))
+	}
+
+	return p, nil
+}
+
+func accountError(err error, id int64) error {
+	if errors.Cause(err) == sql.ErrNoRows {
+		return toStatus(problem.Newf(problem.AccountNotFound, "account id %d is not found", id))
+	}
+
+	return toStatus(errors.Wrap(err, "unable to find account"))
+}
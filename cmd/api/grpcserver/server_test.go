@@ -0,0 +1,176 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/audit"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	paymentsv1 "github.com/tamasbrandstadter/payments-api/proto/payments/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGetAccount(t *testing.T) {
+	client, svc := newClient(t)
+
+	acc, _ := svc.Accounts.Create(context.Background(), 7, account.AccCreationRequest{InitialBalance: 1000, Currency: "EUR"})
+
+	resp, err := client.GetAccount(withKey("operator-key"), &paymentsv1.GetAccountRequest{Id: int64(acc.ID)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(7), resp.GetCustomerId())
+		assert.Equal(t, int64(1000), resp.GetBalanceInDecimal())
+		assert.Equal(t, acc.CreatedAt, resp.GetCreatedAt().AsTime())
+	}
+}
+
+func TestGetAccountErrors(t *testing.T) {
+	client, svc := newClient(t)
+
+	_, err := client.GetAccount(context.Background(), &paymentsv1.GetAccountRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.GetAccount(withKey("operator-key"), &paymentsv1.GetAccountRequest{Id: 2})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "ACCOUNT_NOT_FOUND", reason(err))
+
+	// customers can only access their own accounts
+	acc, _ := svc.Accounts.Create(context.Background(), 8, account.AccCreationRequest{InitialBalance: 1000, Currency: "EUR"})
+	_, err = client.GetAccount(withKey("customer-key"), &paymentsv1.GetAccountRequest{Id: int64(acc.ID)})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, "FORBIDDEN", reason(err))
+}
+
+func TestSubmitTransactionErrors(t *testing.T) {
+	client, _ := newClient(t)
+
+	_, err := client.SubmitTransaction(withKey("customer-key"), &paymentsv1.SubmitTransactionRequest{
+		Transaction: &paymentsv1.SubmitTransactionRequest_Deposit{Deposit: &paymentsv1.Deposit{AccountId: 1, Amount: 10}},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.SubmitTransaction(withKey("operator-key"), &paymentsv1.SubmitTransactionRequest{
+		Transaction: &paymentsv1.SubmitTransactionRequest_Deposit{Deposit: &paymentsv1.Deposit{AccountId: 1, Amount: 0}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "VALIDATION_FAILED", reason(err))
+
+	violations := details(err).fields
+	if assert.Len(t, violations, 1) {
+		assert.Equal(t, "amount", violations[0].GetField())
+	}
+}
+
+func TestListTransactions(t *testing.T) {
+	client, svc := newClient(t)
+
+	ctx := context.Background()
+	acc, _ := svc.Accounts.Create(ctx, 7, account.AccCreationRequest{InitialBalance: 1000, Currency: "EUR"})
+	for _, tt := range []audit.TransactionType{audit.Withdraw, audit.Deposit, audit.Transfer} {
+		_, _ = svc.SaveTransaction(ctx, acc.ID, 2, tt)
+	}
+
+	resp, err := client.ListTransactions(withKey("customer-key"), &paymentsv1.ListTransactionsRequest{AccountId: int64(acc.ID), PageSize: 2})
+	if assert.NoError(t, err) {
+		assert.Len(t, resp.GetTransactions(), 2)
+		assert.Equal(t, paymentsv1.TransactionType_TRANSACTION_TYPE_TRANSFER, resp.GetTransactions()[0].GetType())
+		assert.Equal(t, int64(2), resp.GetNextBeforeId())
+	}
+
+	_, err = client.ListTransactions(withKey("customer-key"), &paymentsv1.ListTransactionsRequest{AccountId: int64(acc.ID), PageSize: 1000})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMissingPrincipal(t *testing.T) {
+	s := &Server{Service: service.NewMemory()}
+
+	_, err := s.SubmitTransaction(context.Background(), &paymentsv1.SubmitTransactionRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = s.GetAccount(context.Background(), &paymentsv1.GetAccountRequest{Id: 1})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestHealth(t *testing.T) {
+	s, hs := NewServer(nil, nil, nil, 0)
+	conn := dial(t, s)
+
+	// the health service doesn't require credentials
+	req := &healthpb.HealthCheckRequest{Service: paymentsv1.Payments_ServiceDesc.ServiceName}
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+	}
+
+	hs.Shutdown()
+	resp, err = healthpb.NewHealthClient(conn).Check(context.Background(), req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	}
+}
+
+func newClient(t *testing.T) (paymentsv1.PaymentsClient, *service.Service) {
+	authenticator := auth.NewAuthenticator(nil, []auth.APIKey{
+		{Name: "backoffice", Hash: auth.HashAPIKey("operator-key"), Role: auth.RoleOperator},
+		{Name: "customer", Hash: auth.HashAPIKey("customer-key"), Role: auth.RoleCustomer, CustomerID: 7},
+	})
+
+	svc := service.NewMemory()
+	s, _ := NewServer(svc, nil, authenticator, time.Second)
+	conn := dial(t, s)
+
+	return paymentsv1.NewPaymentsClient(conn), svc
+}
+
+func dial(t *testing.T, s *grpc.Server) *grpc.ClientConn {
+	l := bufconn.Listen(1 << 20)
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("unable to dial grpc server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), apiKeyKey, key)
+}
+
+type statusDetails struct {
+	reason string
+	fields []*errdetails.BadRequest_FieldViolation
+}
+
+func details(err error) statusDetails {
+	var d statusDetails
+	for _, detail := range status.Convert(err).Details() {
+		switch v := detail.(type) {
+		case *errdetails.ErrorInfo:
+			d.reason = v.GetReason()
+		case *errdetails.BadRequest:
+			d.fields = v.GetFieldViolations()
+		}
+	}
+
+	return d
+}
+
+func reason(err error) string {
+	return details(err).reason
+}
@@ -0,0 +1,73 @@
+package grpcserver
+
+import (
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo details, their reason is the error code of the REST API.
+const errorDomain = "payments-api"
+
+var statusCodes = map[problem.Code]codes.Code{
+	problem.MalformedRequest:        codes.InvalidArgument,
+	problem.ValidationFailed:        codes.InvalidArgument,
+	problem.InvalidCursor:           codes.InvalidArgument,
+	problem.Unauthenticated:         codes.Unauthenticated,
+	problem.Forbidden:               codes.PermissionDenied,
+	problem.RouteNotFound:           codes.Unimplemented,
+	problem.MethodNotAllowed:        codes.Unimplemented,
+	problem.AccountNotFound:         codes.NotFound,
+	problem.CustomerNotFound:        codes.NotFound,
+	problem.WebhookNotFound:         codes.NotFound,
+	problem.DeliveryNotFound:        codes.NotFound,
+	problem.EmailTaken:              codes.AlreadyExists,
+	problem.CustomerErased:          codes.FailedPrecondition,
+	problem.KYCRequired:             codes.FailedPrecondition,
+	problem.KYCTransitionNotAllowed: codes.FailedPrecondition,
+	problem.KYCNoValidDocuments:     codes.FailedPrecondition,
+	problem.InsufficientFunds:       codes.FailedPrecondition,
+	problem.AccountFrozen:           codes.FailedPrecondition,
+	problem.VersionMismatch:         codes.Aborted,
+	problem.PayloadTooLarge:         codes.ResourceExhausted,
+	problem.RateLimited:             codes.ResourceExhausted,
+	problem.Internal:                codes.Internal,
+	problem.ServiceUnavailable:      codes.Unavailable,
+}
+
+// toStatus converts the error to a gRPC status with the same code and field errors the REST API returns
+// in its problem documents. Like there, the detail of internal errors is only logged.
+func toStatus(err error) error {
+	p := problem.FromError(err)
+	log.Infof("grpc request failed, code: %s, error: %v", p.Code, err)
+
+	c, ok := statusCodes[p.Code]
+	if !ok {
+		c = codes.Unknown
+	}
+
+	message := p.Detail
+	if c == codes.Internal {
+		message = p.Title
+	}
+
+	s := status.New(c, message)
+
+	details := []proto.Message{&errdetails.ErrorInfo{Reason: string(p.Code), Domain: errorDomain}}
+	if len(p.Errors) > 0 {
+		br := &errdetails.BadRequest{}
+		for _, f := range p.Errors {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+		}
+		details = append(details, br)
+	}
+
+	if ds, err := s.WithDetails(details...); err == nil {
+		s = ds
+	}
+
+	return s.Err()
+}
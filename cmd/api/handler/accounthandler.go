@@ -8,11 +8,11 @@ import (
 	"strconv"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
-	"github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
 	"github.com/tamasbrandstadter/payments-api/internal/web"
 )
 
@@ -20,76 +20,122 @@ func (a *Application) GetAccountById(w http.ResponseWriter, r *http.Request) {
 	// request validation
 	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
 	if err != nil {
-		web.RespondError(w, http.StatusBadRequest, "unable to parse account id")
+		web.RespondError(w, problem.MalformedRequest, "unable to parse account id")
 		return
 	}
 
-	acc, err := account.SelectById(a.DB, id)
+	acc, err := a.Service.GetAccount(r.Context(), id)
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			web.RespondError(w, http.StatusNotFound, fmt.Sprintf("account id %d is not found", id))
+			web.RespondError(w, problem.AccountNotFound, fmt.Sprintf("account id %d is not found", id))
 			return
 		}
 
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to find account: %s", err.Error()))
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find account: %s", err.Error()))
+		return
+	}
+
+	etag := web.ETag(acc.Version)
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && web.MatchETag(match, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	web.Respond(w, http.StatusOK, acc)
 }
 
-func (a *Application) FindAllAccounts(w http.ResponseWriter, _ *http.Request) {
-	accounts, err := account.SelectAll(a.DB)
+func (a *Application) FindAllAccounts(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	lr, err := parseListRequest(r.URL.Query())
 	if err != nil {
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to retrieve accounts: %s", err.Error()))
+		web.RespondProblem(w, err)
 		return
 	}
 
-	if len(*accounts) == 0 {
-		*accounts = make([]account.Account, 0)
+	page, err := a.Service.ListAccounts(r.Context(), *lr)
+	if err != nil {
+		if errors.Cause(err) == account.InvalidCursorError {
+			web.RespondProblem(w, err)
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to retrieve accounts: %s", err.Error()))
+		return
 	}
 
-	web.Respond(w, http.StatusOK, accounts)
+	if page.Next != nil {
+		next := r.URL.Query()
+		next.Set("cursor", page.Next.Encode())
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+	}
+	if page.Total != nil {
+		w.Header().Set("X-Total-Count", strconv.Itoa(*page.Total))
+	}
+
+	web.Respond(w, http.StatusOK, page.Accounts)
 }
 
 func (a *Application) CreateAccountForCustomer(w http.ResponseWriter, r *http.Request) {
 	// request validation
 	var payload account.AccCreationRequest
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		web.RespondError(w, http.StatusBadRequest, "invalid request payload, unable to parse")
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
 		return
 	}
 	defer r.Body.Close()
 
 	// custom validation
-	if payload.FirstName == "" || payload.LastName == "" {
-		web.RespondError(w, http.StatusBadRequest, "firstname and lastname are required fields")
+	var fields []problem.FieldError
+	if payload.FirstName == "" {
+		fields = append(fields, problem.Field("firstName", "is required"))
+	}
+	if payload.LastName == "" {
+		fields = append(fields, problem.Field("lastName", "is required"))
+	}
+	tooLong := fmt.Sprintf("can't be longer than %d characters", customer.MaxFieldLength)
+	if len(payload.FirstName) > customer.MaxFieldLength {
+		fields = append(fields, problem.Field("firstName", tooLong))
+	}
+	if len(payload.LastName) > customer.MaxFieldLength {
+		fields = append(fields, problem.Field("lastName", tooLong))
+	}
+	if len(payload.Email) > customer.MaxFieldLength {
+		fields = append(fields, problem.Field("email", tooLong))
+	}
+	fields = append(fields, validateAccountRequest(payload)...)
+	if err := problem.Validation(fields...); err != nil {
+		web.RespondProblem(w, err)
 		return
 	}
-	if payload.InitialBalance < 0 {
-		web.RespondError(w, http.StatusBadRequest, "initial deposit can't be negative")
+
+	// new customers are unverified, so they can only open restricted products
+	if account.RequiresKYC(payload.Product) {
+		web.RespondError(w, problem.KYCRequired, fmt.Sprintf("kyc verification is required for %s accounts", payload.Product))
 		return
 	}
 
 	// customer creation
-	c, err := customer.Create(a.DB, payload)
+	c, err := a.Service.CreateCustomer(r.Context(), payload)
 	if err != nil {
-		if pgErr, ok := errors.Cause(err).(*pq.Error); ok {
-			if string(pgErr.Code) == db.PSQLErrUniqueConstraint {
-				web.RespondError(w, http.StatusConflict, fmt.Sprintf("%s is taken, specify another one", payload.Email))
-				return
-			}
+		if errors.Cause(err) == customer.EmailTakenError {
+			web.RespondError(w, problem.EmailTaken, fmt.Sprintf("%s is taken, specify another one", payload.Email))
+			return
 		}
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to insert customer: %s", err.Error()))
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to insert customer: %s", err.Error()))
 		return
 	}
 
 	// account creation
-	acc, err := account.Create(a.DB, c.ID, payload)
+	acc, err := a.Service.CreateAccount(r.Context(), c.ID, payload)
 	if err != nil {
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to insert account: %s", err.Error()))
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to insert account: %s", err.Error()))
+		return
 	}
 
+	notification.PublishAccountEvent(r.Context(), a.MQ, notification.AccountOpened, accountData(acc))
+
 	web.Respond(w, http.StatusCreated, acc)
 }
 
@@ -97,20 +143,32 @@ func (a *Application) DeleteAccountById(w http.ResponseWriter, r *http.Request)
 	// request validation
 	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
 	if err != nil {
-		web.RespondError(w, http.StatusBadRequest, "unable to parse account id")
+		web.RespondError(w, problem.MalformedRequest, "unable to parse account id")
+		return
+	}
+
+	version, ok := a.ifMatch(w, r, id)
+	if !ok {
 		return
 	}
 
-	if err = account.Delete(a.DB, id); err != nil {
+	acc, err := a.Service.DeleteAccount(r.Context(), id, version)
+	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			web.RespondError(w, http.StatusNotFound, fmt.Sprintf("account id %d is not found", id))
+			web.RespondError(w, problem.AccountNotFound, fmt.Sprintf("account id %d is not found", id))
+			return
+		}
+		if _, ok := errors.Cause(err).(*account.VersionMismatchError); ok {
+			web.RespondProblem(w, err)
 			return
 		}
 
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to delete account: %s", err.Error()))
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to delete account: %s", err.Error()))
 		return
 	}
 
+	notification.PublishAccountEvent(r.Context(), a.MQ, notification.AccountClosed, accountData(acc))
+
 	web.Respond(w, http.StatusNoContent, nil)
 }
 
@@ -118,20 +176,126 @@ func (a *Application) Freeze(w http.ResponseWriter, r *http.Request) {
 	// request validation
 	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
 	if err != nil {
-		web.RespondError(w, http.StatusBadRequest, "unable to parse account id")
+		web.RespondError(w, problem.MalformedRequest, "unable to parse account id")
+		return
+	}
+
+	version, ok := a.ifMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	acc, err := a.Service.FreezeAccount(r.Context(), id, version)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.AccountNotFound, fmt.Sprintf("account id %d is not found", id))
+			return
+		}
+		if _, ok := errors.Cause(err).(*account.VersionMismatchError); ok {
+			web.RespondProblem(w, err)
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to freeze account: %s", err.Error()))
+		return
+	}
+
+	notification.PublishAccountEvent(r.Context(), a.MQ, notification.AccountFrozen, accountData(acc))
+
+	w.Header().Set("ETag", web.ETag(acc.Version))
+	web.Respond(w, http.StatusOK, acc)
+}
+
+// UpdateAccount applies a JSON merge patch of the product and the metadata to the account.
+func (a *Application) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse account id")
 		return
 	}
 
-	acc, err := account.Freeze(a.DB, id)
+	var payload account.Patch
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	version, ok := a.ifMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	acc, err := a.Service.UpdateAccount(r.Context(), id, version, payload)
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			web.RespondError(w, http.StatusNotFound, fmt.Sprintf("account id %d is not found", id))
+			web.RespondError(w, problem.AccountNotFound, fmt.Sprintf("account id %d is not found", id))
+			return
+		}
+		if problem.CodeOf(err) != problem.Internal {
+			web.RespondProblem(w, err)
 			return
 		}
 
-		web.RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to freeze account: %s", err.Error()))
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to update account: %s", err.Error()))
 		return
 	}
 
+	w.Header().Set("ETag", web.ETag(acc.Version))
 	web.Respond(w, http.StatusOK, acc)
 }
+
+// ifMatch checks the If-Match header against the current version of the account. It returns the version the write
+// has to be conditional on, so a write between the check and the write fails as well, or zero without the header.
+// It responds with 412 and returns false if the account is at another version or doesn't exist, even "*" only
+// matches an existing account.
+func (a *Application) ifMatch(w http.ResponseWriter, r *http.Request, id int) (int, bool) {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return 0, true
+	}
+
+	acc, err := a.Service.GetAccount(r.Context(), id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.VersionMismatch, fmt.Sprintf("account id %d does not exist", id))
+			return 0, false
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find account: %s", err.Error()))
+		return 0, false
+	}
+
+	if !web.MatchETag(match, web.ETag(acc.Version), false) {
+		web.RespondError(w, problem.VersionMismatch, fmt.Sprintf("account id %d is at version %d", id, acc.Version))
+		return 0, false
+	}
+
+	return acc.Version, true
+}
+
+func accountData(acc *account.Account) notification.AccountData {
+	return notification.AccountData{
+		AccountID:  acc.ID,
+		CustomerID: acc.CustomerID,
+		Currency:   acc.Currency,
+		Product:    acc.Product,
+		Balance:    acc.BalanceInDecimal,
+		Frozen:     acc.Frozen,
+		CreatedAt:  acc.CreatedAt,
+	}
+}
+
+func validateAccountRequest(payload account.AccCreationRequest) []problem.FieldError {
+	var fields []problem.FieldError
+	if payload.InitialBalance < 0 {
+		fields = append(fields, problem.Field("balance", "initial deposit can't be negative"))
+	}
+	if !account.ValidProduct(payload.Product) {
+		fields = append(fields, problem.Field("product", fmt.Sprintf("unknown account product %s", payload.Product)))
+	}
+	fields = append(fields, payload.Metadata.Validate("metadata")...)
+
+	return fields
+}
@@ -13,6 +13,8 @@ import (
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/testauth"
 	"github.com/tamasbrandstadter/payments-api/internal/testdb"
 )
 
@@ -35,6 +37,8 @@ func TestGetAccountById(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -47,6 +51,7 @@ func TestGetAccountById(t *testing.T) {
 		CustomerID:       1,
 		BalanceInDecimal: 999,
 		Currency:         "EUR",
+		Product:          account.BasicProduct,
 		CreatedAt:        testdb.TestTime,
 		ModifiedAt:       testdb.TestTime,
 		Frozen:           false,
@@ -68,6 +73,8 @@ func TestGetAccountByIdNotFound(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -75,12 +82,13 @@ func TestGetAccountByIdNotFound(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "account id 2 is not found", response["error"])
+	assert.Equal(t, problem.AccountNotFound, response.Code)
+	assert.Equal(t, "account id 2 is not found", response.Detail)
 }
 
 func TestGetAccountByIdWithInvalidId(t *testing.T) {
@@ -89,6 +97,8 @@ func TestGetAccountByIdWithInvalidId(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -96,12 +106,12 @@ func TestGetAccountByIdWithInvalidId(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "unable to parse account id", response["error"])
+	assert.Equal(t, "unable to parse account id", response.Detail)
 }
 
 func TestFindAllAccounts(t *testing.T) {
@@ -110,6 +120,8 @@ func TestFindAllAccounts(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -144,6 +156,8 @@ func TestCreateAccountForCustomer(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -186,6 +200,8 @@ func TestCreateAccountForCustomerInvalidPayload(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -193,12 +209,12 @@ func TestCreateAccountForCustomerInvalidPayload(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "invalid request payload, unable to parse", response["error"])
+	assert.Equal(t, "invalid request payload, unable to parse", response.Detail)
 }
 
 func TestCreateAccountForCustomerErrorInName(t *testing.T) {
@@ -218,6 +234,8 @@ func TestCreateAccountForCustomerErrorInName(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -225,12 +243,16 @@ func TestCreateAccountForCustomerErrorInName(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "firstname and lastname are required fields", response["error"])
+	assert.Equal(t, problem.ValidationFailed, response.Code)
+	assert.Equal(t, []problem.FieldError{
+		{Field: "firstName", Message: "is required"},
+		{Field: "lastName", Message: "is required"},
+	}, response.Errors)
 }
 
 func TestCreateAccountForCustomerDuplicateEmail(t *testing.T) {
@@ -252,6 +274,8 @@ func TestCreateAccountForCustomerDuplicateEmail(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -259,12 +283,12 @@ func TestCreateAccountForCustomerDuplicateEmail(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "first@last.com is taken, specify another one", response["error"])
+	assert.Equal(t, "first@last.com is taken, specify another one", response.Detail)
 }
 
 func TestCreateAccountForCustomerWithNegativeInitialBalance(t *testing.T) {
@@ -286,6 +310,8 @@ func TestCreateAccountForCustomerWithNegativeInitialBalance(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -293,12 +319,12 @@ func TestCreateAccountForCustomerWithNegativeInitialBalance(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "initial deposit can't be negative", response["error"])
+	assert.Equal(t, "balance: must be greater than or equal to 0", response.Detail)
 }
 
 func TestFindAllAccountsAfterCreation(t *testing.T) {
@@ -307,6 +333,8 @@ func TestFindAllAccountsAfterCreation(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -330,6 +358,8 @@ func TestFreezeAccount(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -365,6 +395,8 @@ func TestFreezeAccountNotFound(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -372,12 +404,12 @@ func TestFreezeAccountNotFound(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "account id 77 is not found", response["error"])
+	assert.Equal(t, "account id 77 is not found", response.Detail)
 }
 
 func TestFreezeAccountInvalidId(t *testing.T) {
@@ -386,6 +418,8 @@ func TestFreezeAccountInvalidId(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -393,12 +427,12 @@ func TestFreezeAccountInvalidId(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "unable to parse account id", response["error"])
+	assert.Equal(t, "unable to parse account id", response.Detail)
 }
 
 func TestDeleteAccount(t *testing.T) {
@@ -407,6 +441,8 @@ func TestDeleteAccount(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -421,6 +457,8 @@ func TestDeleteAccountNotFond(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -428,12 +466,12 @@ func TestDeleteAccountNotFond(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "account id 77 is not found", response["error"])
+	assert.Equal(t, "account id 77 is not found", response.Detail)
 }
 
 func TestDeleteAccountInvalidId(t *testing.T) {
@@ -442,6 +480,8 @@ func TestDeleteAccountInvalidId(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -449,12 +489,12 @@ func TestDeleteAccountInvalidId(t *testing.T) {
 		t.Errorf("expected status code: %v, got status code: %v", e, a)
 	}
 
-	var response map[string]string
+	var response problem.Problem
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("error decoding response body: %v", err)
 	}
 
-	assert.Equal(t, "unable to parse account id", response["error"])
+	assert.Equal(t, "unable to parse account id", response.Detail)
 }
 
 func TestFindAllAccountsEmpty(t *testing.T) {
@@ -463,6 +503,8 @@ func TestFindAllAccountsEmpty(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
@@ -493,15 +535,14 @@ func TestDeposit(t *testing.T) {
 	}
 
 	msg := []byte("{\"id\":3,\"amount\":1}")
-	err = a.Conn.Channel.Publish("payments", "dep", false, false, amqp.Publishing{
+	err = a.Ch.Publish("payments", "dep", false, false, amqp.Publishing{
 		Body:         msg,
 		ContentType:  "application/json",
 		DeliveryMode: amqp.Persistent,
 	})
 
-	go func() {
-		a.Tc.StartConsuming(a.Conn, a.DB, a.Handler.Cache)
-	}()
+	err = a.Tc.StartConsuming()
+	assert.NoError(t, err)
 
 	time.Sleep(time.Second / 2)
 
@@ -514,7 +555,7 @@ func TestDeposit(t *testing.T) {
 
 func TestWithdraw(t *testing.T) {
 	msg := []byte("{\"id\":3,\"amount\":2}")
-	err := a.Conn.Channel.Publish("payments", "wit", false, false, amqp.Publishing{
+	err := a.Ch.Publish("payments", "wit", false, false, amqp.Publishing{
 		Body:         msg,
 		ContentType:  "application/json",
 		DeliveryMode: amqp.Persistent,
@@ -545,7 +586,7 @@ func TestTransfer(t *testing.T) {
 
 	msg := []byte("{\"from\":3,\"to\":4,\"amount\":100}")
 
-	_ = a.Conn.Channel.Publish("payments", "trnsfr", false, false, amqp.Publishing{
+	_ = a.Ch.Publish("payments", "trnsfr", false, false, amqp.Publishing{
 		Body:         msg,
 		ContentType:  "application/json",
 		DeliveryMode: amqp.Persistent,
@@ -572,6 +613,8 @@ func TestGetBalance(t *testing.T) {
 		t.Errorf("error creating request: %v", err)
 	}
 
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+
 	w := httptest.NewRecorder()
 	a.Handler.ServeHTTP(w, req)
 
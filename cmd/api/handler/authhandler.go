@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+var (
+	staff    = []auth.Role{auth.RoleOperator, auth.RoleAdmin}
+	admins   = []auth.Role{auth.RoleAdmin}
+	everyone = []auth.Role{auth.RoleCustomer, auth.RoleOperator, auth.RoleAdmin}
+)
+
+// ownerFunc resolves the customer owning the resource of the request.
+type ownerFunc func(a *Application, r *http.Request) (int, error)
+
+// authorize only lets the request through if the caller has one of the roles. Customers are
+// further restricted to their own resources, routes without an owner are closed to them.
+// The rate limit of the route is applied right after authentication, before any database lookup.
+func (a *Application) authorize(route string, roles []auth.Role, owner ownerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Auth == nil {
+			web.RespondError(w, problem.Unauthenticated, "authentication is not configured")
+			return
+		}
+
+		p, err := a.Auth.Authenticate(r)
+		if err != nil {
+			// failed attempts are limited by ip, so credentials can't be guessed at full speed
+			if !a.allow(w, r, route, nil) {
+				return
+			}
+
+			log.Infof("authentication of %s %s failed: %v", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="payments-api"`)
+			web.RespondError(w, problem.Unauthenticated, "missing or invalid credentials")
+			return
+		}
+
+		if !a.allow(w, r, route, p) {
+			return
+		}
+
+		if !p.HasRole(roles...) {
+			web.RespondError(w, problem.Forbidden, "insufficient permissions")
+			return
+		}
+
+		if p.Role == auth.RoleCustomer {
+			if owner == nil {
+				web.RespondError(w, problem.Forbidden, "insufficient permissions")
+				return
+			}
+
+			customerId, err := owner(a, r)
+			if err != nil && errors.Cause(err) != sql.ErrNoRows {
+				// invalid ids are reported like to the other callers
+				if problem.CodeOf(err) != problem.Internal {
+					web.RespondProblem(w, err)
+					return
+				}
+
+				web.RespondError(w, problem.Internal, fmt.Sprintf("unable to authorize request: %s", err.Error()))
+				return
+			}
+
+			// a missing resource is reported as forbidden, so customers can't probe for other ids
+			if err != nil || customerId != p.CustomerID {
+				web.RespondError(w, problem.Forbidden, "insufficient permissions")
+				return
+			}
+		}
+
+		next(w, r.WithContext(auth.NewContext(r.Context(), p)))
+	}
+}
+
+func customerOwner(_ *Application, r *http.Request) (int, error) {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		return 0, problem.New(problem.MalformedRequest, "unable to parse customer id")
+	}
+
+	return id, nil
+}
+
+func accountOwner(a *Application, r *http.Request) (int, error) {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		return 0, problem.New(problem.MalformedRequest, "unable to parse account id")
+	}
+
+	acc, err := a.Service.GetAccount(r.Context(), id)
+	if err != nil {
+		return 0, err
+	}
+
+	return acc.CustomerID, nil
+}
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/gdpr"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+func (a *Application) GetCustomerById(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	c, err := a.Service.GetCustomer(r.Context(), id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find customer: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+// UpdateCustomer applies a JSON merge patch of the metadata to the customer.
+func (a *Application) UpdateCustomer(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	var payload customer.Patch
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	c, err := a.Service.UpdateCustomer(r.Context(), id, payload)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+			return
+		}
+		if problem.CodeOf(err) != problem.Internal {
+			web.RespondProblem(w, err)
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to update customer: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+func (a *Application) CreateAccountForExistingCustomer(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	var payload account.AccCreationRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	// custom validation
+	if err := problem.Validation(validateAccountRequest(payload)...); err != nil {
+		web.RespondProblem(w, err)
+		return
+	}
+
+	c, err := a.Service.GetCustomer(r.Context(), id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find customer: %s", err.Error()))
+		return
+	}
+
+	if account.RequiresKYC(payload.Product) && !c.Verified(time.Now().UTC()) {
+		web.RespondError(w, problem.KYCRequired, fmt.Sprintf("kyc verification is required for %s accounts", payload.Product))
+		return
+	}
+
+	acc, err := a.Service.CreateAccount(r.Context(), c.ID, payload)
+	if err != nil {
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to insert account: %s", err.Error()))
+		return
+	}
+
+	notification.PublishAccountEvent(r.Context(), a.MQ, notification.AccountOpened, accountData(acc))
+
+	web.Respond(w, http.StatusCreated, acc)
+}
+
+func (a *Application) SubmitKYC(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	var payload customer.KYCSubmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	// custom validation
+	var fields []problem.FieldError
+	if len(payload.Documents) == 0 {
+		fields = append(fields, problem.Field("documents", "at least one kyc document is required"))
+	}
+	now := time.Now().UTC()
+	for i, d := range payload.Documents {
+		if d.Type == "" {
+			fields = append(fields, problem.Field(fmt.Sprintf("documents[%d].type", i), "is required"))
+		}
+		if d.Reference == "" {
+			fields = append(fields, problem.Field(fmt.Sprintf("documents[%d].reference", i), "is required"))
+		}
+		if !d.ExpiresAt.After(now) {
+			fields = append(fields, problem.Field(fmt.Sprintf("documents[%d].expiresAt", i), "document is expired"))
+		}
+	}
+	if err := problem.Validation(fields...); err != nil {
+		web.RespondProblem(w, err)
+		return
+	}
+
+	c, err := a.Service.SubmitKYC(r.Context(), id, payload)
+	if err != nil {
+		respondKYCError(w, id, err)
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+func (a *Application) ApproveKYC(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	c, err := a.Service.ApproveKYC(r.Context(), id)
+	if err != nil {
+		respondKYCError(w, id, err)
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+func (a *Application) RejectKYC(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	var payload customer.KYCRejectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	if payload.Reason == "" {
+		web.RespondProblem(w, problem.Validation(problem.Field("reason", "is required")))
+		return
+	}
+
+	c, err := a.Service.RejectKYC(r.Context(), id, payload.Reason)
+	if err != nil {
+		respondKYCError(w, id, err)
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+func (a *Application) ExportCustomer(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	archive, err := a.Service.ExportCustomer(r.Context(), id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to export customer: %s", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"customer-%d.json\"", id))
+	web.Respond(w, http.StatusOK, archive)
+}
+
+func (a *Application) EraseCustomer(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse customer id")
+		return
+	}
+
+	var payload customer.ErasureRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	c, err := a.Service.EraseCustomer(r.Context(), id, payload.Reason)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+			return
+		}
+
+		if errors.Cause(err) == gdpr.AlreadyErasedError {
+			web.RespondError(w, problem.CustomerErased, fmt.Sprintf("customer id %d is already erased", id))
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to erase customer: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusOK, c)
+}
+
+func respondKYCError(w http.ResponseWriter, id int, err error) {
+	if errors.Cause(err) == sql.ErrNoRows {
+		web.RespondError(w, problem.CustomerNotFound, fmt.Sprintf("customer id %d is not found", id))
+		return
+	}
+
+	if problem.CodeOf(err) != problem.Internal {
+		web.RespondProblem(w, err)
+		return
+	}
+
+	web.RespondError(w, problem.Internal, fmt.Sprintf("unable to update kyc status: %s", err.Error()))
+}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/gdpr"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/testauth"
+)
+
+func TestKYCWorkflow(t *testing.T) {
+	acc := createAccount(t, account.AccCreationRequest{
+		FirstName:      "kyc",
+		LastName:       "customer",
+		Email:          "kyc@test.com",
+		InitialBalance: 100,
+		Currency:       "EUR",
+	})
+	assert.Equal(t, account.BasicProduct, acc.Product)
+
+	standard := account.AccCreationRequest{InitialBalance: 100, Currency: "EUR", Product: account.StandardProduct}
+
+	w := serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/accounts", acc.CustomerID), standard)
+	if e, a := http.StatusForbidden, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	submission := customer.KYCSubmissionRequest{
+		Documents: []customer.KYCDocument{
+			{Type: "passport", Reference: "passport-1", ExpiresAt: time.Now().UTC().AddDate(1, 0, 0)},
+		},
+	}
+
+	w = serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/kyc", acc.CustomerID), submission)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var c customer.Customer
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Equal(t, customer.KYCPending, c.KYCStatus)
+
+	w = serve(t, http.MethodPut, fmt.Sprintf("/customers/%d/kyc/approve", acc.CustomerID), nil)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Equal(t, customer.KYCVerified, c.KYCStatus)
+	assert.NotNil(t, c.KYCExpiresAt)
+
+	w = serve(t, http.MethodPut, fmt.Sprintf("/customers/%d/kyc/reject", acc.CustomerID), customer.KYCRejectionRequest{Reason: "late"})
+	if e, a := http.StatusConflict, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	w = serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/accounts", acc.CustomerID), standard)
+	if e, a := http.StatusCreated, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var actualAcc account.Account
+	if err := json.NewDecoder(w.Body).Decode(&actualAcc); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Equal(t, acc.CustomerID, actualAcc.CustomerID)
+	assert.Equal(t, account.StandardProduct, actualAcc.Product)
+}
+
+func TestExportAndEraseCustomer(t *testing.T) {
+	acc := createAccount(t, account.AccCreationRequest{
+		FirstName:      "gdpr",
+		LastName:       "customer",
+		Email:          "gdpr@test.com",
+		InitialBalance: 100,
+		Currency:       "EUR",
+	})
+
+	w := serve(t, http.MethodGet, fmt.Sprintf("/customers/%d/export", acc.CustomerID), nil)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var archive gdpr.Archive
+	if err := json.NewDecoder(w.Body).Decode(&archive); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Equal(t, "gdpr@test.com", archive.Customer.Email)
+	assert.Len(t, archive.Accounts, 1)
+	assert.Equal(t, acc.ID, archive.Accounts[0].ID)
+
+	w = serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/erasure", acc.CustomerID), customer.ErasureRequest{Reason: "customer request"})
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var c customer.Customer
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Equal(t, "erased", c.FirstName)
+	assert.Equal(t, fmt.Sprintf("erased-%d@invalid", acc.CustomerID), c.Email)
+	assert.NotNil(t, c.ErasedAt)
+
+	w = serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/erasure", acc.CustomerID), customer.ErasureRequest{})
+	if e, a := http.StatusConflict, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	submission := customer.KYCSubmissionRequest{
+		Documents: []customer.KYCDocument{
+			{Type: "passport", Reference: "passport-1", ExpiresAt: time.Now().UTC().AddDate(1, 0, 0)},
+		},
+	}
+
+	w = serve(t, http.MethodPost, fmt.Sprintf("/customers/%d/kyc", acc.CustomerID), submission)
+	if e, a := http.StatusConflict, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+	assert.Contains(t, w.Body.String(), string(problem.CustomerErased))
+
+	w = serve(t, http.MethodGet, fmt.Sprintf("/accounts/%d", acc.ID), nil)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	own := createAccount(t, account.AccCreationRequest{
+		FirstName:      "auth",
+		LastName:       "owner",
+		Email:          "owner@test.com",
+		InitialBalance: 100,
+		Currency:       "EUR",
+	})
+	other := createAccount(t, account.AccCreationRequest{
+		FirstName:      "auth",
+		LastName:       "other",
+		Email:          "other@test.com",
+		InitialBalance: 100,
+		Currency:       "EUR",
+	})
+
+	customerToken := "Bearer " + testauth.Token(auth.RoleCustomer, own.CustomerID)
+
+	tests := []struct {
+		name          string
+		header, value string
+		method, url   string
+		expected      int
+	}{
+		{"no credentials", "", "", http.MethodGet, "/accounts", http.StatusUnauthorized},
+		{"unknown api key", "X-API-Key", "unknown", http.MethodGet, "/accounts", http.StatusUnauthorized},
+		{"invalid token", "Authorization", "Bearer invalid", http.MethodGet, "/accounts", http.StatusUnauthorized},
+		{"customer lists accounts", "Authorization", customerToken, http.MethodGet, "/accounts", http.StatusForbidden},
+		{"customer reads own account", "Authorization", customerToken, http.MethodGet, fmt.Sprintf("/accounts/%d", own.ID), http.StatusOK},
+		{"customer reads own balance", "Authorization", customerToken, http.MethodGet, fmt.Sprintf("/accounts/%d/balance", own.ID), http.StatusOK},
+		{"customer reads other account", "Authorization", customerToken, http.MethodGet, fmt.Sprintf("/accounts/%d", other.ID), http.StatusForbidden},
+		{"customer reads missing account", "Authorization", customerToken, http.MethodGet, "/accounts/777", http.StatusForbidden},
+		{"customer reads itself", "Authorization", customerToken, http.MethodGet, fmt.Sprintf("/customers/%d", own.CustomerID), http.StatusOK},
+		{"customer reads other customer", "Authorization", customerToken, http.MethodGet, fmt.Sprintf("/customers/%d", other.CustomerID), http.StatusForbidden},
+		{"customer approves kyc", "Authorization", customerToken, http.MethodPut, fmt.Sprintf("/customers/%d/kyc/approve", own.CustomerID), http.StatusForbidden},
+		{"operator deletes account", "X-API-Key", testauth.OperatorKey, http.MethodDelete, fmt.Sprintf("/accounts/%d", other.ID), http.StatusForbidden},
+		{"operator token reads account", "Authorization", "Bearer " + testauth.Token(auth.RoleOperator, 0), http.MethodGet, fmt.Sprintf("/accounts/%d", other.ID), http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveAs(t, tc.header, tc.value, tc.method, tc.url, nil)
+
+			if e, a := tc.expected, w.Code; e != a {
+				t.Errorf("expected status code: %v, got status code: %v", e, a)
+			}
+		})
+	}
+}
+
+func TestFindAllAccountsPagination(t *testing.T) {
+	first := createAccount(t, account.AccCreationRequest{FirstName: "page", LastName: "one", Email: "page1@test.com", Currency: "HUF"})
+	second := createAccount(t, account.AccCreationRequest{FirstName: "page", LastName: "two", Email: "page2@test.com", Currency: "HUF"})
+
+	w := serve(t, http.MethodGet, "/accounts?currency=HUF&sort=-id&limit=1&count=true", nil)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+	assert.Equal(t, "2", w.Header().Get("X-Total-Count"))
+
+	var accounts []account.Account
+	if err := json.NewDecoder(w.Body).Decode(&accounts); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, second.ID, accounts[0].ID)
+
+	link := w.Header().Get("Link")
+	assert.True(t, strings.HasSuffix(link, `>; rel="next"`))
+
+	w = serve(t, http.MethodGet, strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), nil)
+	if e, a := http.StatusOK, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+	assert.Empty(t, w.Header().Get("Link"))
+
+	if err := json.NewDecoder(w.Body).Decode(&accounts); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, first.ID, accounts[0].ID)
+
+	for _, query := range []string{"sort=name", "limit=0", "cursor=invalid", "frozen=maybe", "createdFrom=yesterday"} {
+		w = serve(t, http.MethodGet, "/accounts?"+query, nil)
+		if e, a := http.StatusBadRequest, w.Code; e != a {
+			t.Errorf("%s: expected status code: %v, got status code: %v", query, e, a)
+		}
+	}
+}
+
+func TestGetCustomerByIdNotFound(t *testing.T) {
+	w := serve(t, http.MethodGet, "/customers/777", nil)
+
+	if e, a := http.StatusNotFound, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var response problem.Problem
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+
+	assert.Equal(t, problem.CustomerNotFound, response.Code)
+	assert.Equal(t, "customer id 777 is not found", response.Detail)
+}
+
+func createAccount(t *testing.T, payload account.AccCreationRequest) account.Account {
+	w := serve(t, http.MethodPost, "/accounts", payload)
+	if e, a := http.StatusCreated, w.Code; e != a {
+		t.Errorf("expected status code: %v, got status code: %v", e, a)
+	}
+
+	var acc account.Account
+	if err := json.NewDecoder(w.Body).Decode(&acc); err != nil {
+		t.Errorf("error decoding response body: %v", err)
+	}
+
+	return acc
+}
+
+func serve(t *testing.T, method, url string, payload interface{}) *httptest.ResponseRecorder {
+	return serveAs(t, "X-API-Key", testauth.AdminKey, method, url, payload)
+}
+
+func serveAs(t *testing.T, header, value, method, url string, payload interface{}) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			t.Errorf("error encoding request body: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		t.Errorf("error creating request: %v", err)
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+
+	w := httptest.NewRecorder()
+	a.Handler.ServeHTTP(w, req)
+
+	return w
+}
@@ -1,11 +1,23 @@
 package handler
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
-	"github.com/tamasbrandstadter/payments-api/internal/cache"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/ratelimit"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
 )
 
 const (
@@ -13,52 +25,196 @@ const (
 	accountById        = "/accounts/:id"
 	freezeAccount      = "/accounts/:id/freeze"
 	balanceByAccountId = "/accounts/:id/balance"
+	customerById       = "/customers/:id"
+	customerAccounts   = "/customers/:id/accounts"
+	customerExport     = "/customers/:id/export"
+	customerErasure    = "/customers/:id/erasure"
+	customerKYC        = "/customers/:id/kyc"
+	approveKYC         = "/customers/:id/kyc/approve"
+	rejectKYC          = "/customers/:id/kyc/reject"
+	events             = "/events"
+	webhooks           = "/webhooks"
+	webhookById        = "/webhooks/:id"
+	testWebhook        = "/webhooks/:id/test"
+	webhookDeliveries  = "/webhooks/:id/deliveries"
+	redeliverWebhook   = "/webhooks/:id/deliveries/:deliveryId/redeliver"
 	health             = "/health"
+	openAPI            = "/openapi.json"
 )
 
+type route struct {
+	method  string
+	path    string
+	name    string
+	roles   []auth.Role
+	owner   ownerFunc
+	handler func(a *Application, w http.ResponseWriter, r *http.Request)
+}
+
+// routes are the API routes, every one of them needs an operation in openapi.json with the route name as
+// operation id. The names are also the keys of the rate limit policies.
+var routes = []route{
+	{http.MethodGet, accountById, "getAccount", everyone, accountOwner, (*Application).GetAccountById},
+	{http.MethodGet, accounts, "listAccounts", staff, nil, (*Application).FindAllAccounts},
+	{http.MethodPost, accounts, "createAccount", staff, nil, (*Application).CreateAccountForCustomer},
+	{http.MethodPatch, accountById, "updateAccount", staff, nil, (*Application).UpdateAccount},
+	{http.MethodDelete, accountById, "deleteAccount", admins, nil, (*Application).DeleteAccountById},
+	{http.MethodPut, freezeAccount, "freezeAccount", staff, nil, (*Application).Freeze},
+	{http.MethodGet, balanceByAccountId, "getBalance", everyone, accountOwner, (*Application).GetBalance},
+	{http.MethodGet, customerById, "getCustomer", everyone, customerOwner, (*Application).GetCustomerById},
+	{http.MethodPatch, customerById, "updateCustomer", staff, nil, (*Application).UpdateCustomer},
+	{http.MethodPost, customerAccounts, "createCustomerAccount", everyone, customerOwner, (*Application).CreateAccountForExistingCustomer},
+	{http.MethodGet, customerExport, "exportCustomer", everyone, customerOwner, (*Application).ExportCustomer},
+	{http.MethodPost, customerErasure, "eraseCustomer", admins, nil, (*Application).EraseCustomer},
+	{http.MethodPost, customerKYC, "submitKYC", everyone, customerOwner, (*Application).SubmitKYC},
+	{http.MethodPut, approveKYC, "approveKYC", staff, nil, (*Application).ApproveKYC},
+	{http.MethodPut, rejectKYC, "rejectKYC", staff, nil, (*Application).RejectKYC},
+	{http.MethodGet, events, "streamEvents", everyone, streamOwner, (*Application).StreamEvents},
+	{http.MethodGet, webhooks, "listWebhooks", staff, nil, (*Application).FindAllWebhooks},
+	{http.MethodPost, webhooks, "createWebhook", staff, nil, (*Application).CreateWebhook},
+	{http.MethodGet, webhookById, "getWebhook", staff, nil, (*Application).GetWebhookById},
+	{http.MethodDelete, webhookById, "deleteWebhook", staff, nil, (*Application).DeleteWebhookById},
+	{http.MethodPost, testWebhook, "testWebhook", staff, nil, (*Application).TestWebhook},
+	{http.MethodGet, webhookDeliveries, "listWebhookDeliveries", staff, nil, (*Application).FindWebhookDeliveries},
+	{http.MethodPost, redeliverWebhook, "redeliverWebhook", staff, nil, (*Application).RedeliverWebhook},
+}
+
+// HealthChecker checks a dependency of the replica, the replica is unhealthy while it fails.
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// Broker publishes the domain events, the state of its connection is reported by the health endpoint.
+type Broker interface {
+	notification.Publisher
+	State() mq.State
+}
+
 type Application struct {
-	DB      *sqlx.DB
-	Cache   *cache.Redis
-	handler http.Handler
+	Service *service.Service
+	// Database is checked by the health endpoint
+	Database HealthChecker
+	Auth     *auth.Authenticator
+	Limiter  *ratelimit.Limiter
+	// MQ publishes the domain events, they are not published when it is nil
+	MQ Broker
+	// Events is nil without Redis, event streams are closed after StreamTimeout unless it is 0
+	Events        *stream.Broker
+	StreamTimeout time.Duration
+	// RequestTimeout cancels the context of every request except event streams unless it is 0
+	RequestTimeout time.Duration
+	// Webhooks is nil when webhook delivery is disabled
+	Webhooks *webhook.Worker
+	handler  http.Handler
+	// draining is set when the replica is shutting down
+	draining int32
+	// closing is closed by CloseStreams
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func (a *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.handler.ServeHTTP(w, r)
 }
 
-func NewApplication(db *sqlx.DB, r *cache.Redis) *Application {
+// NewApplication creates the API handler. Every request gets a request id, an access log entry and panic
+// recovery, the middlewares are applied after these in the given order.
+func NewApplication(svc *service.Service, database HealthChecker, authenticator *auth.Authenticator,
+	limiter *ratelimit.Limiter, middlewares ...web.Middleware) *Application {
 	app := Application{
-		DB:    db,
-		Cache: r,
+		Service:  svc,
+		Database: database,
+		Auth:     authenticator,
+		Limiter:  limiter,
+		closing:  make(chan struct{}),
 	}
 
 	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web.RespondError(w, problem.RouteNotFound, fmt.Sprintf("no route for %s", r.URL.Path))
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web.RespondError(w, problem.MethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+	})
 
-	// API routes
-	router.HandlerFunc(http.MethodGet, accountById, app.GetAccountById)
-	router.HandlerFunc(http.MethodGet, accounts, app.FindAllAccounts)
-	router.HandlerFunc(http.MethodPost, accounts, app.CreateAccountForCustomer)
-	router.HandlerFunc(http.MethodDelete, accountById, app.DeleteAccountById)
-	router.HandlerFunc(http.MethodPut, freezeAccount, app.Freeze)
-	router.HandlerFunc(http.MethodGet, balanceByAccountId, app.GetBalance)
+	// API routes, the request bodies are validated against the specification after authorization
+	for _, rt := range routes {
+		rt := rt
+		handler := func(w http.ResponseWriter, r *http.Request) { rt.handler(&app, w, r) }
+		handler = app.authorize(rt.name, rt.roles, rt.owner, spec.ValidateRequest(rt.method, rt.path, handler))
+		if rt.path != events {
+			handler = app.withTimeout(handler)
+		}
+		router.HandlerFunc(rt.method, rt.path, handler)
+	}
+	router.HandlerFunc(http.MethodGet, openAPI, serveSpec)
 
 	// K8s probes
 	router.HandlerFunc(http.MethodGet, health, app.health)
 
-	app.handler = router
+	app.handler = web.Chain(router, append([]web.Middleware{web.RequestID, web.TraceContext, web.AccessLog, web.Recover}, middlewares...)...)
 	return &app
 }
 
-func (a *Application) health(w http.ResponseWriter, _ *http.Request) {
-	if err := a.DB.Ping(); err == nil {
-		// Ping by itself is un-reliable, the connections are cached. This
-		// ensures that the database is still running by executing a harmless
-		// dummy query against it.
-		if _, err = a.DB.Exec("SELECT true"); err == nil {
-			w.WriteHeader(http.StatusOK)
+// withTimeout cancels the context of the request after RequestTimeout, so the queries of a request that takes
+// too long or is abandoned by the client are cancelled.
+func (a *Application) withTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.RequestTimeout <= 0 {
+			next(w, r)
 			return
 		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), a.RequestTimeout)
+		defer cancel()
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// healthStatus is the state of the dependencies, the replica is only healthy if all of them are available.
+type healthStatus struct {
+	DB       string `json:"db,omitempty"`
+	MQ       string `json:"mq,omitempty"`
+	Draining bool   `json:"draining,omitempty"`
+}
+
+// Drain marks the replica as not ready, so it gets no new traffic while it is shutting down.
+func (a *Application) Drain() {
+	atomic.StoreInt32(&a.draining, 1)
+}
+
+// CloseStreams ends the open event streams, the server doesn't wait for them on shutdown otherwise. Clients
+// reconnect to another replica with the id of the last event they received.
+func (a *Application) CloseStreams() {
+	a.closeOnce.Do(func() { close(a.closing) })
+}
+
+func (a *Application) health(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&a.draining) == 1 {
+		web.Respond(w, http.StatusServiceUnavailable, healthStatus{Draining: true})
+		return
+	}
+
+	status := healthStatus{DB: "down"}
+	healthy := false
+
+	if err := a.Database.Check(r.Context()); err == nil {
+		status.DB = "up"
+		healthy = true
+	}
+
+	// the connection is re-established in the background, the replica gets no traffic until then
+	if a.MQ != nil {
+		state := a.MQ.State()
+		status.MQ = state.String()
+		healthy = healthy && state == mq.Connected
+	}
+
+	if !healthy {
+		web.Respond(w, http.StatusInternalServerError, status)
+		return
 	}
 
-	w.WriteHeader(http.StatusInternalServerError)
+	web.Respond(w, http.StatusOK, status)
 }
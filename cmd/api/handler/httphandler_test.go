@@ -1,32 +1,383 @@
 package handler
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
-	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	idb "github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/ratelimit"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
+	"github.com/tamasbrandstadter/payments-api/internal/testauth"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
 )
 
 func TestNewApplication(t *testing.T) {
-	app := NewApplication(NewMockDb(), nil)
+	app := NewApplication(service.NewMemory(), NewMockDb(), nil, nil)
 
 	assert.NotNil(t, app.handler)
 
-	router, ok := app.handler.(*httprouter.Router)
-	if !ok {
-		t.Errorf("router expected type httprouter.Router, got %v", router)
+	req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotEmpty(t, w.Header().Get(web.RequestIDHeader))
+}
+
+func TestHealth(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	app := NewApplication(service.NewMemory(), idb.Health{DB: sqlx.NewDb(db, "sqlmock")}, nil, nil)
+
+	mock.ExpectExec("SELECT true").WillReturnResult(sqlmock.NewResult(0, 0))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"db":"up"}`, w.Body.String())
+
+	mock.ExpectExec("SELECT true").WillReturnError(sql.ErrConnDone)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"db":"down"}`, w.Body.String())
+
+	app.Drain()
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"draining":true}`, w.Body.String())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	app := &Application{RequestTimeout: time.Second}
+
+	var deadline time.Time
+	var ok bool
+	handler := app.withTimeout(func(_ http.ResponseWriter, r *http.Request) { deadline, ok = r.Context().Deadline() })
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/accounts", nil))
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+
+	app.RequestTimeout = 0
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/accounts", nil))
+	assert.False(t, ok)
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.NewLimiter(nil, ratelimit.NewMemoryStore(),
+		map[string]ratelimit.Limit{ratelimit.DefaultPolicy: {Rate: 1, Period: time.Minute}})
+	app := NewApplication(service.NewMemory(), NewMockDb(), testauth.Authenticator, limiter)
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts", nil))
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	operations := make(map[string]bool)
+	for path, item := range spec.Paths {
+		for method := range item {
+			operations[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for _, rt := range routes {
+		op := spec.Operation(rt.method, openapi.Template(rt.path))
+		if assert.NotNil(t, op, "%s %s has no openapi operation", rt.method, rt.path) {
+			assert.Equal(t, rt.name, op.OperationID)
+		}
+		delete(operations, rt.method+" "+openapi.Template(rt.path))
+	}
+	delete(operations, http.MethodGet+" "+health)
+	delete(operations, http.MethodGet+" "+openAPI)
+
+	assert.Empty(t, operations, "openapi operations without a route")
+
+	var codes []string
+	for _, c := range problem.Codes() {
+		codes = append(codes, string(c))
+	}
+	var documented []string
+	for _, c := range spec.Components.Schemas["Problem"].Properties["code"].Enum {
+		documented = append(documented, c.(string))
+	}
+	assert.ElementsMatch(t, codes, documented)
+}
+
+func TestRequestValidation(t *testing.T) {
+	app := NewApplication(service.NewMemory(), NewMockDb(), testauth.Authenticator, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/accounts", strings.NewReader(`{"firstName": 7, "balance": 1.5, "product": "gold"}`))
+	req.Header.Set("X-API-Key", testauth.AdminKey)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response problem.Problem
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, problem.ValidationFailed, response.Code)
+	assert.Equal(t, []problem.FieldError{
+		{Field: "lastName", Message: "is required"},
+		{Field: "balance", Message: "must be an integer"},
+		{Field: "firstName", Message: "must be a string"},
+		{Field: "product", Message: "must be one of [basic standard]"},
+	}, response.Errors)
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, openAPIDocument, w.Body.Bytes())
+}
+
+func TestStreamEvents(t *testing.T) {
+	app := NewApplication(service.NewMemory(), NewMockDb(), testauth.Authenticator, nil)
+
+	request := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-API-Key", testauth.AdminKey)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, request("/events?accountId=1").Code)
+
+	app.Events = stream.NewBroker(nil)
+	app.StreamTimeout = 10 * time.Millisecond
+
+	assert.Equal(t, http.StatusBadRequest, request("/events").Code)
+	assert.Equal(t, http.StatusBadRequest, request("/events?accountId=x").Code)
+	assert.Equal(t, http.StatusBadRequest, request("/events?accountId=1&lastEventId=x").Code)
+
+	// customers get the same errors for ids which can't be parsed
+	req := httptest.NewRequest(http.MethodGet, "/events?accountId=x", nil)
+	req.Header.Set("Authorization", "Bearer "+testauth.Token(auth.RoleCustomer, 7))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request("/events?accountId=1&accountId=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "retry: 1000\n\n", w.Body.String())
+	assert.True(t, w.Flushed)
+
+	// open streams end when the server shuts down
+	app.StreamTimeout = 0
+	app.CloseStreams()
+	app.CloseStreams()
+	w = request("/events?accountId=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "retry: 1000\n\n", w.Body.String())
+}
+
+func TestWebhookValidation(t *testing.T) {
+	app := NewApplication(service.NewMemory(), NewMockDb(), testauth.Authenticator, nil)
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", testauth.AdminKey)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/webhooks", `{"url": "ftp://partner.example", "secret": "short", "eventTypes": ["deposit.completed"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response problem.Problem
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, []problem.FieldError{{Field: "secret", Message: "must be at least 16 characters long"}}, response.Errors)
+
+	w = request(http.MethodPost, "/webhooks", `{"url": "ftp://partner.example", "eventTypes": ["deposit.completed"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, []problem.FieldError{{Field: "url", Message: "must be an absolute https url of a public host"}}, response.Errors)
+
+	w = request(http.MethodPost, "/webhooks", `{"url": "https://169.254.169.254/latest", "eventTypes": ["deposit.completed"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, http.StatusServiceUnavailable, request(http.MethodPost, "/webhooks/1/test", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/webhooks/1/deliveries?limit=500", "").Code)
+}
+
+func TestAccountsWithMemoryService(t *testing.T) {
+	app := NewApplication(service.NewMemory(), NewMockDb(), testauth.Authenticator, nil)
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", testauth.AdminKey)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"firstName": "first", "lastName": "last", "email": "first@last.com", "balance": 1000, "currency": "EUR"}`
+	w := request(http.MethodPost, "/accounts", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var acc account.Account
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&acc))
+	assert.Equal(t, account.BasicProduct, acc.Product)
+
+	w = request(http.MethodPost, "/accounts", body)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = request(http.MethodGet, fmt.Sprintf("/accounts/%d/balance", acc.ID), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"balance": "€10.00"}`, w.Body.String())
+
+	w = request(http.MethodPut, fmt.Sprintf("/accounts/%d/freeze", acc.ID), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodGet, "/accounts?frozen=true&count=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Total-Count"))
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, fmt.Sprintf("/accounts/%d", acc.ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, fmt.Sprintf("/accounts/%d", acc.ID), "").Code)
+}
+
+func TestAccountPreconditions(t *testing.T) {
+	svc := service.NewMemory()
+	app := NewApplication(svc, NewMockDb(), testauth.Authenticator, nil)
+
+	acc, _ := svc.CreateAccount(context.Background(), 1, account.AccCreationRequest{Currency: "EUR"})
+	target := fmt.Sprintf("/accounts/%d", acc.ID)
+
+	request := func(method, target, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-API-Key", testauth.AdminKey)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
 	}
+
+	w := request(http.MethodGet, target, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	w = request(http.MethodGet, target, "If-None-Match", `W/"1"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = request(http.MethodPut, target+"/freeze", "If-Match", `"2"`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+
+	w = request(http.MethodPut, target+"/freeze", "If-Match", `"1"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	w = request(http.MethodGet, target, "If-None-Match", `"1"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodDelete, target, "If-Match", `"1"`).Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, target, "If-Match", "*").Code)
+
+	// a missing account matches no entity tag, not even "*"
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodDelete, target, "If-Match", "*").Code)
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPut, target+"/freeze", "If-Match", `"2"`).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, target, "", "").Code)
+}
+
+func TestMergePatch(t *testing.T) {
+	svc := service.NewMemory()
+	app := NewApplication(svc, NewMockDb(), testauth.Authenticator, nil)
+
+	c, _ := svc.CreateCustomer(context.Background(), account.AccCreationRequest{Email: "first@last.com"})
+	acc, _ := svc.CreateAccount(context.Background(), c.ID, account.AccCreationRequest{Currency: "EUR", Metadata: metadata.Metadata{"costCenter": "42"}})
+	_, _ = svc.CreateAccount(context.Background(), c.ID, account.AccCreationRequest{Currency: "EUR"})
+
+	request := func(method, target, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", testauth.AdminKey)
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	target := fmt.Sprintf("/accounts/%d", acc.ID)
+
+	w := request(http.MethodPatch, target, `"1"`, `{"metadata": {"costCenter": null, "team": "payments"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+	var updated account.Account
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated)) {
+		assert.Equal(t, metadata.Metadata{"team": "payments"}, updated.Metadata)
+		assert.Equal(t, account.BasicProduct, updated.Product)
+	}
+
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPatch, target, `"1"`, `{"metadata": null}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPatch, target, "", `{"frozen": true}`).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPatch, target, "", `{"product": "standard"}`).Code)
+
+	w = request(http.MethodPatch, target, "", `{"product": null}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response problem.Problem
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response)) && assert.Len(t, response.Errors, 1) {
+		assert.Equal(t, "product", response.Errors[0].Field)
+	}
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPatch, "/accounts/99", "", `{}`).Code)
+
+	w = request(http.MethodGet, "/accounts?metadata[team]=payments", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var accounts []account.Account
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &accounts)) && assert.Len(t, accounts, 1) {
+		assert.Equal(t, acc.ID, accounts[0].ID)
+	}
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/accounts?metadata[]=payments", "", "").Code)
+
+	w = request(http.MethodPatch, fmt.Sprintf("/customers/%d", c.ID), "", `{"metadata": {"segment": "retail"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"metadata":{"segment":"retail"}`)
 }
 
-func NewMockDb() *sqlx.DB {
+func NewMockDb() idb.Health {
 	db, _, err := sqlmock.New()
 	if err != nil {
 		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
-	sqlxDB := sqlx.NewDb(db, "sqlmock")
 
-	return sqlxDB
+	return idb.Health{DB: sqlx.NewDb(db, "sqlmock")}
 }
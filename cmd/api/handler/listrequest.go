@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/internal/metadata"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+// parseListRequest reads the pagination, sorting and filter parameters of GET /accounts.
+func parseListRequest(q url.Values) (*account.ListRequest, error) {
+	var lr account.ListRequest
+	var err error
+
+	if sort := q.Get("sort"); sort != "" {
+		lr.Desc = strings.HasPrefix(sort, "-")
+		lr.Sort = strings.TrimPrefix(sort, "-")
+		if !account.ValidSort(lr.Sort) {
+			return nil, invalidParam("sort", "unknown sort field %s", lr.Sort)
+		}
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		if lr.Limit, err = strconv.Atoi(limit); err != nil || lr.Limit < 1 || lr.Limit > account.MaxPageSize {
+			return nil, invalidParam("limit", "must be between 1 and %d", account.MaxPageSize)
+		}
+	}
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		if lr.Cursor, err = account.DecodeCursor(cursor); err != nil {
+			return nil, err
+		}
+		// without an explicit sort the cursor continues its own order
+		if q.Get("sort") == "" {
+			lr.Sort, lr.Desc = lr.Cursor.Sort, lr.Cursor.Desc
+		}
+	}
+
+	if count := q.Get("count"); count != "" {
+		if lr.Count, err = strconv.ParseBool(count); err != nil {
+			return nil, invalidParam("count", "must be true or false")
+		}
+	}
+
+	f := &lr.Filter
+
+	if v := q.Get("customerId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, invalidParam("customerId", "must be a number")
+		}
+		f.CustomerID = &id
+	}
+
+	f.Currency = strings.ToUpper(q.Get("currency"))
+
+	if v := q.Get("frozen"); v != "" {
+		frozen, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, invalidParam("frozen", "must be true or false")
+		}
+		f.Frozen = &frozen
+	}
+
+	if f.CreatedFrom, err = parseTime(q, "createdFrom"); err != nil {
+		return nil, err
+	}
+	if f.CreatedTo, err = parseTime(q, "createdTo"); err != nil {
+		return nil, err
+	}
+	if f.MinBalance, err = parseInt64(q, "minBalance"); err != nil {
+		return nil, err
+	}
+	if f.MaxBalance, err = parseInt64(q, "maxBalance"); err != nil {
+		return nil, err
+	}
+
+	if f.Metadata, err = parseMetadata(q); err != nil {
+		return nil, err
+	}
+
+	return &lr, nil
+}
+
+// parseMetadata reads the metadata[key]=value parameters, the filter matches the accounts having all of them.
+func parseMetadata(q url.Values) (metadata.Metadata, error) {
+	var m metadata.Metadata
+	for name := range q {
+		if !strings.HasPrefix(name, "metadata[") || !strings.HasSuffix(name, "]") {
+			continue
+		}
+
+		key := strings.TrimSuffix(strings.TrimPrefix(name, "metadata["), "]")
+		if key == "" || len(key) > metadata.MaxKeyLength {
+			return nil, invalidParam(name, "key must be between 1 and %d characters long", metadata.MaxKeyLength)
+		}
+
+		if m == nil {
+			m = metadata.Metadata{}
+		}
+		m[key] = q.Get(name)
+	}
+
+	return m, nil
+}
+
+func parseTime(q url.Values, name string) (*time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, invalidParam(name, "must be an RFC 3339 timestamp")
+	}
+	t = t.UTC()
+
+	return &t, nil
+}
+
+func parseInt64(q url.Values, name string) (*int64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, invalidParam(name, "must be a number")
+	}
+
+	return &n, nil
+}
+
+func invalidParam(name, format string, args ...interface{}) error {
+	return problem.Validation(problem.Field(name, fmt.Sprintf(format, args...)))
+}
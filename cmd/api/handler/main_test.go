@@ -6,8 +6,14 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/balance"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/internal/cache"
+	idb "github.com/tamasbrandstadter/payments-api/internal/db"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
+	"github.com/tamasbrandstadter/payments-api/internal/testauth"
 	"github.com/tamasbrandstadter/payments-api/internal/testcache"
 	"github.com/tamasbrandstadter/payments-api/internal/testdb"
 	"github.com/tamasbrandstadter/payments-api/internal/testmq"
@@ -17,7 +23,9 @@ type TestApp struct {
 	Handler *Application
 	DB      *sqlx.DB
 	Conn    *mq.Conn
+	Ch      *amqp.Channel
 	Tc      *balance.TransactionConsumer
+	Redis   *cache.Redis
 }
 
 var a *TestApp
@@ -40,13 +48,17 @@ func testMain(m *testing.M) int {
 		return 1
 	}
 
-	deposit, withdraw, transfer, err := conn.DeclareQueues(5)
-	tc := &balance.TransactionConsumer{
-		Deposit:     deposit,
-		Withdraw:    withdraw,
-		Transfer:    transfer,
-		Concurrency: 5,
+	if err = conn.DeclareQueues(); err != nil {
+		log.WithError(err).Info("declare test queues")
+		return 1
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		log.WithError(err).Info("open test mq channel")
+		return 1
 	}
+	defer ch.Close()
 
 	redis, err := testcache.OpenConnection()
 	if err != nil {
@@ -54,11 +66,23 @@ func testMain(m *testing.M) int {
 		return 1
 	}
 
+	svc := service.New(db, redis, testdb.Cipher, conn)
+	svc.KYCThreshold = 100000
+
+	tc := &balance.TransactionConsumer{
+		Concurrency: 5,
+		Service:     svc,
+		Broker:      conn,
+		Events:      stream.Publisher{Client: redis.Client},
+	}
+
 	a = &TestApp{
-		Handler: NewApplication(db, redis),
+		Handler: NewApplication(svc, idb.Health{DB: db}, testauth.Authenticator, nil),
 		DB:      db,
 		Conn:    conn,
+		Ch:      ch,
 		Tc:      tc,
+		Redis:   redis,
 	}
 
 	code := m.Run()
@@ -75,6 +99,12 @@ func deleteRecords() {
 	a.DB.Exec("DELETE FROM accounts")
 	a.DB.Exec("ALTER SEQUENCE accounts_id_seq RESTART WITH 1")
 
+	a.DB.Exec("DELETE FROM customer_erasures")
+	a.DB.Exec("ALTER SEQUENCE customer_erasures_id_seq RESTART WITH 1")
+
+	a.DB.Exec("DELETE FROM kyc_documents")
+	a.DB.Exec("ALTER SEQUENCE kyc_documents_id_seq RESTART WITH 1")
+
 	a.DB.Exec("DELETE FROM customers")
 	a.DB.Exec("ALTER SEQUENCE customers_id_seq RESTART WITH 1")
 }
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// spec is parsed once, an invalid document is a build error caught by the tests.
+var spec = func() *openapi.Document {
+	d, err := openapi.Parse(openAPIDocument)
+	if err != nil {
+		log.Fatalf("invalid openapi document: %v", err)
+	}
+
+	return d
+}()
+
+func serveSpec(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openAPIDocument); err != nil {
+		log.Error("could not write response: ", err)
+	}
+}
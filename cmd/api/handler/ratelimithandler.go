@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+// allow applies the rate limit of the route to the caller, it writes the 429 response if the limit is exceeded.
+func (a *Application) allow(w http.ResponseWriter, r *http.Request, route string, p *auth.Principal) bool {
+	if a.Limiter == nil {
+		return true
+	}
+
+	res, err := a.Limiter.Allow(r.Context(), route, clientKey(r, p))
+	if err != nil {
+		// the limiter must not take the API down with it
+		log.Errorf("unable to check rate limit of %s: %v", route, err)
+		return true
+	}
+	if res == nil {
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", seconds(res.ResetAfter))
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", seconds(res.RetryAfter))
+		web.RespondError(w, problem.RateLimited, fmt.Sprintf("rate limit exceeded, retry in %s seconds", seconds(res.RetryAfter)))
+		return false
+	}
+
+	return true
+}
+
+// clientKey identifies the caller by its API key or token subject, unauthenticated callers by their IP.
+func clientKey(r *http.Request, p *auth.Principal) string {
+	if p != nil {
+		return fmt.Sprintf("%s:%s", p.Method, p.Subject)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
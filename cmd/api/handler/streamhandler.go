@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+const (
+	maxStreamAccounts = 50
+	keepAlive         = 15 * time.Second
+	// retryAfter is the reconnection delay sent to the clients, in milliseconds.
+	retryAfter = 1000
+)
+
+// StreamEvents streams the balance and transaction events of the accounts as server-sent events. The stream
+// is closed before the write timeout of the server, clients reconnect with the Last-Event-ID header (or the
+// lastEventId parameter) and continue where they left off.
+func (a *Application) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if a.Events == nil {
+		web.RespondError(w, problem.ServiceUnavailable, "event streaming is not available")
+		return
+	}
+
+	// request validation
+	ids, err := parseAccountIds(r.URL.Query())
+	if err != nil {
+		web.RespondProblem(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		web.RespondError(w, problem.Internal, "streaming is not supported by the response writer")
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	sub, err := a.Events.Subscribe(r.Context(), ids, lastEventID)
+	if err != nil {
+		web.RespondProblem(w, err)
+		return
+	}
+	defer a.Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err = fmt.Fprintf(w, "retry: %d\n\n", retryAfter); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	var timeout <-chan time.Time
+	if a.StreamTimeout > 0 {
+		timer := time.NewTimer(a.StreamTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-sub.Events():
+			var data []byte
+			if data, err = json.Marshal(e); err == nil {
+				_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			}
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-sub.Done():
+			return
+		case <-timeout:
+			return
+		case <-a.closing:
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			log.Infof("closed event stream: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func parseAccountIds(q url.Values) ([]int, error) {
+	values := q["accountId"]
+	if len(values) == 0 {
+		return nil, invalidParam("accountId", "is required")
+	}
+	if len(values) > maxStreamAccounts {
+		return nil, invalidParam("accountId", "at most %d accounts can be streamed at once", maxStreamAccounts)
+	}
+
+	ids := make([]int, len(values))
+	for i, v := range values {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return nil, invalidParam("accountId", "must be a positive number")
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+// streamOwner resolves the customer owning every streamed account, accounts of different customers
+// can't be streamed together by a customer.
+func streamOwner(a *Application, r *http.Request) (int, error) {
+	ids, err := parseAccountIds(r.URL.Query())
+	if err != nil {
+		return 0, err
+	}
+
+	owner := 0
+	for _, id := range ids {
+		acc, err := a.Service.GetAccount(r.Context(), id)
+		if err != nil {
+			return 0, err
+		}
+		if owner != 0 && acc.CustomerID != owner {
+			return 0, sql.ErrNoRows
+		}
+		owner = acc.CustomerID
+	}
+
+	return owner, nil
+}
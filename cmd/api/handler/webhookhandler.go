@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+const (
+	defaultDeliveries = 20
+	maxDeliveries     = 100
+)
+
+func (a *Application) FindAllWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := a.Service.ListWebhooks(r.Context())
+	if err != nil {
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find webhooks: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusOK, webhooks)
+}
+
+func (a *Application) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	var payload webhook.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+		return
+	}
+	defer r.Body.Close()
+
+	// custom validation
+	if err := problem.Validation(validateWebhookRequest(payload)...); err != nil {
+		web.RespondProblem(w, err)
+		return
+	}
+
+	wh, err := a.Service.CreateWebhook(r.Context(), payload)
+	if err != nil {
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to insert webhook: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusCreated, wh)
+}
+
+func (a *Application) GetWebhookById(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse webhook id")
+		return
+	}
+
+	wh, err := a.Service.GetWebhook(r.Context(), id)
+	if err != nil {
+		respondWebhookError(w, id, "find", err)
+		return
+	}
+
+	web.Respond(w, http.StatusOK, wh)
+}
+
+func (a *Application) DeleteWebhookById(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse webhook id")
+		return
+	}
+
+	if err = a.Service.DeleteWebhook(r.Context(), id); err != nil {
+		respondWebhookError(w, id, "delete", err)
+		return
+	}
+
+	web.Respond(w, http.StatusNoContent, nil)
+}
+
+// TestWebhook posts a test event to the webhook right away, the delivery is returned whatever its outcome.
+func (a *Application) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	if a.Webhooks == nil {
+		web.RespondError(w, problem.ServiceUnavailable, "webhook delivery is not available")
+		return
+	}
+
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse webhook id")
+		return
+	}
+
+	d, err := a.Webhooks.Test(r.Context(), id)
+	if err != nil {
+		respondWebhookError(w, id, "test", err)
+		return
+	}
+
+	web.Respond(w, http.StatusOK, d)
+}
+
+func (a *Application) FindWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse webhook id")
+		return
+	}
+
+	limit := defaultDeliveries
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxDeliveries {
+			web.RespondProblem(w, invalidParam("limit", "must be a number between 1 and %d", maxDeliveries))
+			return
+		}
+	}
+
+	if _, err = a.Service.GetWebhook(r.Context(), id); err != nil {
+		respondWebhookError(w, id, "find", err)
+		return
+	}
+
+	deliveries, err := a.Service.ListWebhookDeliveries(r.Context(), id, limit)
+	if err != nil {
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to find webhook deliveries: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusOK, deliveries)
+}
+
+func (a *Application) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	// request validation
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse webhook id")
+		return
+	}
+	deliveryId, err := strconv.Atoi(params.ByName("deliveryId"))
+	if err != nil {
+		web.RespondError(w, problem.MalformedRequest, "unable to parse delivery id")
+		return
+	}
+
+	d, err := a.Service.RedeliverWebhook(r.Context(), id, deliveryId)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			web.RespondError(w, problem.DeliveryNotFound, fmt.Sprintf("delivery id %d of webhook id %d is not found", deliveryId, id))
+			return
+		}
+
+		web.RespondError(w, problem.Internal, fmt.Sprintf("unable to redeliver webhook: %s", err.Error()))
+		return
+	}
+
+	web.Respond(w, http.StatusAccepted, d)
+}
+
+func respondWebhookError(w http.ResponseWriter, id int, action string, err error) {
+	if errors.Cause(err) == sql.ErrNoRows {
+		web.RespondError(w, problem.WebhookNotFound, fmt.Sprintf("webhook id %d is not found", id))
+		return
+	}
+
+	web.RespondError(w, problem.Internal, fmt.Sprintf("unable to %s webhook: %s", action, err.Error()))
+}
+
+func validateWebhookRequest(payload webhook.WebhookRequest) []problem.FieldError {
+	var fields []problem.FieldError
+	if !webhook.ValidURL(payload.URL) {
+		fields = append(fields, problem.Field("url", "must be an absolute https url of a public host"))
+	}
+	if len(payload.EventTypes) == 0 {
+		fields = append(fields, problem.Field("eventTypes", "at least one event type is required"))
+	}
+	for i, t := range payload.EventTypes {
+		if !webhook.ValidEventType(t) {
+			fields = append(fields, problem.Field(fmt.Sprintf("eventTypes[%d]", i), fmt.Sprintf("unknown event type %s", t)))
+		}
+	}
+	for i, id := range payload.AccountIDs {
+		if id < 1 {
+			fields = append(fields, problem.Field(fmt.Sprintf("accountIds[%d]", i), "must be a positive number"))
+		}
+	}
+
+	return fields
+}
@@ -3,20 +3,33 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/balance"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/grpcserver"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/handler"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/notification"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/service"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
 	"github.com/tamasbrandstadter/payments-api/internal/cache"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
 	"github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
 	"github.com/tamasbrandstadter/payments-api/internal/env"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/ratelimit"
+	"github.com/tamasbrandstadter/payments-api/internal/stream"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
 )
 
 func main() {
@@ -46,13 +59,39 @@ func main() {
 		}
 	}()
 
+	// the migrate subcommand only runs the migrations, e.g. from an init container
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(dbc, os.Args[2:]); err != nil {
+			log.Errorf("error migrating db: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// replicas starting at the same time wait for each other, only one of them applies the migrations
+	if envCfg.DBMigrate {
+		if err := migrate(dbc, nil); err != nil {
+			log.Errorf("error migrating db: %v", err)
+			return
+		}
+	}
+
+	modes, err := cloudevents.ParseModes(envCfg.CloudEventsModes)
+	if err != nil {
+		log.Errorf("error parsing cloudevents modes: %v", err)
+		return
+	}
+
 	mqCfg := mq.Config{
-		User:         envCfg.MQUser,
-		Pass:         envCfg.MQPass,
-		Host:         envCfg.MQHost,
-		Port:         envCfg.MQPort,
-		Concurrency:  envCfg.MQConcurrency,
-		MaxReconnect: envCfg.MQMaxReconnect,
+		User:              envCfg.MQUser,
+		Pass:              envCfg.MQPass,
+		Host:              envCfg.MQHost,
+		Port:              envCfg.MQPort,
+		Concurrency:       envCfg.MQConcurrency,
+		MaxReconnect:      envCfg.MQMaxReconnect,
+		PublisherChannels: envCfg.MQPublisherChannels,
+		ConfirmTimeout:    envCfg.MQConfirmTimeout,
+		CloudEvents:       modes,
 	}
 	conn, err := mq.NewConnection(mqCfg)
 	if err != nil {
@@ -61,8 +100,8 @@ func main() {
 	}
 
 	defer func() {
-		if err := conn.Channel.Close(); err != nil {
-			log.Errorf("error closing mq channel: %v", err)
+		if err := conn.Close(); err != nil {
+			log.Errorf("error closing mq connection: %v", err)
 		}
 	}()
 
@@ -75,30 +114,113 @@ func main() {
 	redis := cache.NewConnection(redisCfg)
 
 	defer func() {
+		if redis == nil {
+			return
+		}
 		if err := redis.Client.Close(); err != nil {
 			log.Errorf("error closing redis client: %v", err)
 		}
 	}()
 
-	deposit, withdraw, transfer, err := conn.DeclareQueues(mqCfg.Concurrency)
+	keys, err := encryption.LoadKeyFile(envCfg.PIIKeyFile)
+	if err != nil {
+		log.Errorf("error loading pii encryption keys from %s, make keys generates local ones: %v", envCfg.PIIKeyFile, err)
+		return
+	}
+
+	cipher := encryption.NewCipher(keys)
+
+	// customers encrypted with a retired key (or not encrypted at all) are moved to the current key
+	reencryptCtx, stopReencrypt := context.WithCancel(context.Background())
+	defer stopReencrypt()
+	go func() {
+		if _, err := customer.ReencryptPII(reencryptCtx, dbc, cipher, envCfg.PIIReencryptBatch); err != nil {
+			log.Errorf("error re-encrypting customer pii: %v", err)
+		}
+	}()
+
+	authenticator, err := newAuthenticator(envCfg)
+	if err != nil {
+		log.Errorf("error loading authentication config: %v", err)
+		return
+	}
+
+	limits, err := ratelimit.ParsePolicies(envCfg.RateLimits)
 	if err != nil {
+		log.Errorf("error parsing rate limits: %v", err)
+		return
+	}
+
+	// the limits are shared between replicas in redis, each replica limits locally while redis is unavailable
+	var limitStore ratelimit.Store
+	if redis != nil {
+		limitStore = ratelimit.NewRedisStore(redis.Client)
+	}
+	limiter := ratelimit.NewLimiter(limitStore, ratelimit.NewMemoryStore(), limits)
+
+	if err = conn.DeclareQueues(); err != nil {
 		log.Errorf("error declaring queues: %v", err)
 		return
 	}
+	if err = notification.DeclareExchange(conn); err != nil {
+		log.Errorf("error declaring exchange for notifications: %v", err)
+		return
+	}
+	svc := service.New(dbc, redis, cipher, conn)
+	svc.KYCThreshold = envCfg.KYCThreshold
+
 	tc := balance.TransactionConsumer{
-		Deposit:     deposit,
-		Withdraw:    withdraw,
-		Transfer:    transfer,
 		Concurrency: mqCfg.Concurrency,
+		Service:     svc,
+		Broker:      conn,
+		Timeout:     envCfg.MQDeliveryTimeout,
+	}
+	if redis != nil {
+		tc.Events = stream.Publisher{Client: redis.Client}
+	}
+
+	app := handler.NewApplication(svc, db.Health{DB: dbc}, authenticator, limiter, middlewares(envCfg)...)
+	app.MQ = conn
+	app.RequestTimeout = envCfg.RequestTimeout
+
+	// events of the consumers of every replica reach the streams through redis
+	stopBroker := func() {}
+	if redis != nil {
+		broker := stream.NewBroker(redis.Client)
+		var brokerCtx context.Context
+		brokerCtx, stopBroker = context.WithCancel(context.Background())
+		defer stopBroker()
+		go broker.Run(brokerCtx)
+
+		app.Events = broker
+		app.StreamTimeout = streamTimeout(envCfg.WriteTimeout)
+	}
+
+	// every replica delivers webhooks, the deliveries are claimed in the db
+	app.Webhooks = &webhook.Worker{
+		DB:           dbc,
+		Cipher:       cipher,
+		Client:       webhook.NewClient(envCfg.WebhookTimeout),
+		MaxAttempts:  envCfg.WebhookMaxAttempts,
+		PollInterval: envCfg.WebhookPollInterval,
 	}
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	webhooksStopped := make(chan struct{})
+	go func() {
+		app.Webhooks.Run(webhookCtx)
+		close(webhooksStopped)
+	}()
 
 	server := http.Server{
 		Addr:           fmt.Sprintf(":%d", 8080),
-		Handler:        handler.NewApplication(dbc, redis),
+		Handler:        app,
 		ReadTimeout:    envCfg.ReadTimeout,
 		WriteTimeout:   envCfg.WriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
+	// event streams never finish on their own
+	server.RegisterOnShutdown(app.CloseStreams)
 
 	serverErrors := make(chan error, 1)
 	go func() {
@@ -106,8 +228,22 @@ func main() {
 		serverErrors <- server.ListenAndServe()
 	}()
 
-	tc.StartConsuming(conn, dbc, redis)
-	go tc.ClosedConnectionListener(mqCfg, dbc, conn.Channel.NotifyClose(make(chan *amqp.Error)), redis)
+	grpcServer, grpcHealth := grpcserver.NewServer(svc, conn, authenticator, envCfg.RequestTimeout)
+	grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%d", envCfg.GRPCPort))
+	if err != nil {
+		log.Errorf("error listening on grpc port: %v", err)
+		return
+	}
+
+	go func() {
+		log.Infof("grpc server started successfully, listening on %s", grpcListener.Addr())
+		serverErrors <- grpcServer.Serve(grpcListener)
+	}()
+
+	if err = tc.StartConsuming(); err != nil {
+		log.Errorf("error starting consumers: %v", err)
+		return
+	}
 
 	// Blocking main and waiting for shutdown of the daemon.
 	osSignals := make(chan os.Signal, 1)
@@ -122,14 +258,129 @@ func main() {
 	case <-osSignals:
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), envCfg.ShutdownTimeout)
-	defer cancel()
+	// the replica is taken out of the load balancer first, then the servers, the consumers and the webhook worker
+	// finish what they started side by side and at last the connections they use are closed
+	log.Info("shutdown: draining")
+	app.Drain()
+	grpcHealth.Shutdown()
+	time.Sleep(envCfg.ShutdownDelay)
+
+	var wg sync.WaitGroup
+	within := func(name string, step func(ctx context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), envCfg.ShutdownTimeout)
+			defer cancel()
+			if err := step(ctx); err != nil {
+				log.Warnf("shutdown: %s did not complete in %v : %v", name, envCfg.ShutdownTimeout, err)
+			}
+		}()
+	}
+
+	within("http server", func(ctx context.Context) error {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			if err := server.Close(); err != nil {
+				log.Warnf("shutdown: Error killing server : %v", err)
+			}
+		}
+		return err
+	})
+	within("grpc server", func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			return ctx.Err()
+		}
+	})
+	// unacked deliveries are requeued by the broker when the channels are closed
+	within("mq consumers", conn.Drain)
+	within("webhook deliveries", func(ctx context.Context) error {
+		stopWebhooks()
+		select {
+		case <-webhooksStopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	wg.Wait()
+
+	// the handlers and the consumers publish until they are done
+	if err := conn.Close(); err != nil {
+		log.Warnf("shutdown: Error closing mq connection : %v", err)
+	}
+	stopBroker()
+	stopReencrypt()
+
+	if err := dbc.Close(); err != nil {
+		log.Errorf("shutdown: Error closing db : %v", err)
+	}
+	if redis != nil {
+		if err := redis.Client.Close(); err != nil {
+			log.Errorf("shutdown: Error closing redis client : %v", err)
+		}
+	}
+
+	log.Info("shutdown: completed")
+}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Warnf("shutdown: Graceful shutdown did not complete in %v : %v", envCfg.ShutdownTimeout, err)
+func newAuthenticator(cfg *env.Cfg) (*auth.Authenticator, error) {
+	var verifier *auth.JWTVerifier
+	if cfg.AuthJWKSFile != "" {
+		keys, err := auth.LoadJWKS(cfg.AuthJWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		verifier = auth.NewJWTVerifier(keys, cfg.AuthIssuer, cfg.AuthAudience)
+	}
 
-		if err := server.Close(); err != nil {
-			log.Warnf("shutdown: Error killing server : %v", err)
+	var apiKeys []auth.APIKey
+	if cfg.AuthAPIKeysFile != "" {
+		keys, err := auth.LoadAPIKeys(cfg.AuthAPIKeysFile)
+		if err != nil {
+			return nil, err
 		}
+		apiKeys = keys
+	}
+
+	if verifier == nil && len(apiKeys) == 0 {
+		log.Warn("neither AUTH_JWKS_FILE nor AUTH_API_KEYS_FILE is set, every API request will be rejected")
 	}
+
+	return auth.NewAuthenticator(verifier, apiKeys), nil
+}
+
+// streamTimeout ends the event streams before the write timeout of the server would cut them off, the
+// clients reconnect and resume from their last event.
+func streamTimeout(writeTimeout time.Duration) time.Duration {
+	if writeTimeout > 2*time.Second {
+		return writeTimeout - time.Second
+	}
+
+	return writeTimeout / 2
+}
+
+func middlewares(cfg *env.Cfg) []web.Middleware {
+	m := []web.Middleware{web.MaxBodySize(cfg.MaxBodyBytes)}
+
+	// without allowed origins the API is only reachable from the same origin
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		m = append([]web.Middleware{web.CORS(web.CORSConfig{
+			AllowedOrigins: cfg.CORSAllowedOrigins,
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", "Last-Event-ID", "If-Match", "If-None-Match", web.RequestIDHeader, tracecontext.TraceParentHeader, tracecontext.TraceStateHeader},
+			MaxAge:         cfg.CORSMaxAge,
+		})}, m...)
+	}
+
+	return m
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/db"
+)
+
+// migrate runs the migrations embedded in the binary. up (the default) applies the pending ones, down reverts
+// the last one or the given number of them and status lists them.
+func migrate(dbc *sqlx.DB, args []string) error {
+	m, err := db.NewMigrator(dbc)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		count, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Infof("applied %d migrations", count)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to revert: %s", args[1])
+			}
+		}
+
+		count, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		log.Infof("reverted %d migrations", count)
+
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate command %s, use up, down [n] or status", command)
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+)
+
+// Domain events published to the balance-notifications topic. The routing key is the event type and the
+// account id, e.g. funds.deposited.42, so consumers can bind to event types (funds.#) or accounts (*.*.42).
+const (
+	AccountOpened       = "account.opened"
+	AccountFrozen       = "account.frozen"
+	AccountClosed       = "account.closed"
+	FundsDeposited      = "funds.deposited"
+	FundsWithdrawn      = "funds.withdrawn"
+	TransferCompleted   = "transfer.completed"
+	TransactionRejected = "transaction.rejected"
+
+	// eventSchemaVersion is the version of the schemas/*-event.v1.json schemas.
+	eventSchemaVersion = "1"
+	eventSource        = "payments-api"
+
+	// unknownAccount is the account part of the routing key of rejected messages without a parsable account.
+	unknownAccount = "unknown"
+	// ccHeader lists the additional routing keys of a message, RabbitMQ routes it with every one of them
+	// but delivers it once per queue.
+	ccHeader = "CC"
+)
+
+// eventSchemas are the CloudEvents dataschema of the event types, the $id of their schemas.
+var eventSchemas = map[string]string{
+	AccountOpened:       "urn:payments-api:schema:account-event:1",
+	AccountFrozen:       "urn:payments-api:schema:account-event:1",
+	AccountClosed:       "urn:payments-api:schema:account-event:1",
+	FundsDeposited:      "urn:payments-api:schema:funds-event:1",
+	FundsWithdrawn:      "urn:payments-api:schema:funds-event:1",
+	TransferCompleted:   "urn:payments-api:schema:transfer-event:1",
+	TransactionRejected: "urn:payments-api:schema:rejected-event:1",
+}
+
+// Event is the envelope of every domain event, the same metadata is set in the AMQP properties.
+type Event struct {
+	ID            string      `json:"id"`
+	Type          string      `json:"type"`
+	Source        string      `json:"source"`
+	SchemaVersion string      `json:"schemaVersion"`
+	OccurredAt    time.Time   `json:"occurredAt"`
+	AccountIDs    []int       `json:"accountIds"`
+	CorrelationID string      `json:"correlationId,omitempty"`
+	Data          interface{} `json:"data"`
+}
+
+// AccountData is the state of the account after the event, closed accounts as they were before the deletion.
+type AccountData struct {
+	AccountID  int       `json:"accountId"`
+	CustomerID int       `json:"customerId"`
+	Currency   string    `json:"currency"`
+	Product    string    `json:"product"`
+	Balance    int64     `json:"balance"`
+	Frozen     bool      `json:"frozen"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// FundsData is a deposit or a withdraw with the new balance, the transaction id is missing if the audit
+// record couldn't be saved.
+type FundsData struct {
+	AccountID     int    `json:"accountId"`
+	TransactionID int    `json:"transactionId,omitempty"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	Balance       int64  `json:"balance"`
+}
+
+type TransferData struct {
+	TransactionID int    `json:"transactionId,omitempty"`
+	FromID        int    `json:"fromId"`
+	ToID          int    `json:"toId"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	FromBalance   int64  `json:"fromBalance"`
+	ToBalance     int64  `json:"toBalance"`
+}
+
+// RejectedData is a balance operation which can never succeed, the event has no accounts if the message
+// couldn't be parsed.
+type RejectedData struct {
+	Operation string `json:"operation"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+}
+
+// PublishAccountEvent publishes an account opened, frozen or closed event.
+func PublishAccountEvent(ctx context.Context, conn Publisher, eventType string, data AccountData) {
+	publishEvent(ctx, conn, eventType, "", data, data.AccountID)
+}
+
+// PublishFundsEvent publishes a funds deposited or withdrawn event, the correlation id is the message id
+// of the balance operation.
+func PublishFundsEvent(ctx context.Context, conn Publisher, eventType, correlationId string, data FundsData) {
+	publishEvent(ctx, conn, eventType, correlationId, data, data.AccountID)
+}
+
+// PublishTransferCompleted publishes a single event routed to both accounts.
+func PublishTransferCompleted(ctx context.Context, conn Publisher, correlationId string, data TransferData) {
+	publishEvent(ctx, conn, TransferCompleted, correlationId, data, data.FromID, data.ToID)
+}
+
+func PublishTransactionRejected(ctx context.Context, conn Publisher, correlationId string, data RejectedData, accountIds ...int) {
+	publishEvent(ctx, conn, TransactionRejected, correlationId, data, accountIds...)
+}
+
+// RoutingKeys returns the routing key of the event for every account, the first one is the routing key of
+// the message and the rest are sent in the CC header.
+func RoutingKeys(eventType string, accountIds ...int) []string {
+	if len(accountIds) == 0 {
+		return []string{eventType + "." + unknownAccount}
+	}
+
+	keys := make([]string, len(accountIds))
+	for i, id := range accountIds {
+		keys[i] = eventType + "." + strconv.Itoa(id)
+	}
+
+	return keys
+}
+
+// eventSubject is the first account of the event, rejected messages without a parsable account have none.
+func eventSubject(accountIds ...int) string {
+	if len(accountIds) == 0 {
+		return ""
+	}
+
+	return "accounts/" + strconv.Itoa(accountIds[0])
+}
+
+func newEvent(eventType, correlationId string, data interface{}, accountIds ...int) Event {
+	if accountIds == nil {
+		accountIds = []int{}
+	}
+
+	return Event{
+		ID:            uuid.New().String(),
+		Type:          eventType,
+		Source:        eventSource,
+		SchemaVersion: eventSchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		AccountIDs:    accountIds,
+		CorrelationID: correlationId,
+		Data:          data,
+	}
+}
+
+// publishEvent is a no-op without a connection, e.g. in the tests of the handlers.
+func publishEvent(ctx context.Context, conn Publisher, eventType, correlationId string, data interface{}, accountIds ...int) {
+	if conn == nil {
+		return
+	}
+
+	e := newEvent(eventType, correlationId, data, accountIds...)
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Warnf("failed to marshal %s event: %v", eventType, err)
+		return
+	}
+
+	keys := RoutingKeys(eventType, accountIds...)
+	headers := amqp.Table{mq.SchemaVersionHeader: eventSchemaVersion}
+	if len(keys) > 1 {
+		cc := make([]interface{}, len(keys)-1)
+		for i, k := range keys[1:] {
+			cc[i] = k
+		}
+		headers[ccHeader] = cc
+	}
+
+	publishing := amqp.Publishing{
+		Headers:       headers,
+		ContentType:   contentType,
+		MessageId:     e.ID,
+		CorrelationId: correlationId,
+		Type:          eventType,
+		AppId:         eventSource,
+		Timestamp:     e.OccurredAt,
+		Body:          body,
+		DeliveryMode:  amqp.Persistent,
+	}
+	ce := newCloudEvent(ctx, e.ID, eventTypePrefix+eventType, eventSubject(accountIds...), eventSchemas[eventType], e.OccurredAt)
+	if err = send(conn, keys[0], ce, publishing); err != nil {
+		return
+	}
+
+	log.Infof("successfully sent %s event %s for accounts %v", eventType, e.ID, accountIds)
+}
@@ -0,0 +1,85 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
+)
+
+func TestRoutingKeys(t *testing.T) {
+	assert.Equal(t, []string{"funds.deposited.42"}, RoutingKeys(FundsDeposited, 42))
+	assert.Equal(t, []string{"transfer.completed.1", "transfer.completed.2"}, RoutingKeys(TransferCompleted, 1, 2))
+	assert.Equal(t, []string{"transaction.rejected.unknown"}, RoutingKeys(TransactionRejected))
+}
+
+func TestEventSchemas(t *testing.T) {
+	utc := time.Now().UTC()
+
+	for schema, events := range map[string][]Event{
+		"account-event": {
+			newEvent(AccountOpened, "", AccountData{AccountID: 1, CustomerID: 2, Currency: "EUR", Product: "basic", Balance: 100, CreatedAt: utc}, 1),
+			newEvent(AccountClosed, "", AccountData{AccountID: 1, CustomerID: 2, Currency: "EUR", Product: "basic", Frozen: true, CreatedAt: utc}, 1),
+		},
+		"funds-event": {
+			newEvent(FundsDeposited, "message-id", FundsData{AccountID: 1, TransactionID: 5, Amount: 10, Currency: "EUR", Balance: 110}, 1),
+			newEvent(FundsWithdrawn, "message-id", FundsData{AccountID: 1, Amount: 10, Currency: "EUR", Balance: 0}, 1),
+		},
+		"transfer-event": {
+			newEvent(TransferCompleted, "message-id", TransferData{TransactionID: 5, FromID: 1, ToID: 2, Amount: 10, Currency: "EUR", FromBalance: 90, ToBalance: 10}, 1, 2),
+		},
+		"rejected-event": {
+			newEvent(TransactionRejected, "message-id", RejectedData{Operation: "withdraw", Code: "INSUFFICIENT_FUNDS", Detail: "insufficient funds, balance: 1.00"}, 1),
+			newEvent(TransactionRejected, "message-id", RejectedData{Operation: "unknown", Code: "MALFORMED_REQUEST", Detail: "invalid message payload"}),
+		},
+	} {
+		b, err := ioutil.ReadFile("schemas/" + schema + ".v" + eventSchemaVersion + ".json")
+		assert.NoError(t, err)
+
+		s, err := openapi.ParseSchema(b)
+		assert.NoError(t, err)
+
+		for _, e := range events {
+			body, err := json.Marshal(e)
+			assert.NoError(t, err)
+
+			var v interface{}
+			assert.NoError(t, json.Unmarshal(body, &v))
+			assert.Empty(t, s.Validate(v), string(body))
+		}
+	}
+}
+
+func TestPublishTransferCompleted(t *testing.T) {
+	conn := NewConn()
+
+	ch, err := conn.Channel()
+	assert.NoError(t, err)
+	defer ch.Close()
+
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind(q.Name, "*.*.2", exchangeName, false, nil))
+
+	PublishTransferCompleted(context.Background(), conn, "message-id", TransferData{FromID: 1, ToID: 2, Amount: 10, Currency: "EUR"})
+
+	messages, err := ch.Consume(q.Name, "test-events-consumer", true, false, false, false, nil)
+	assert.NoError(t, err)
+
+	m := <-messages
+
+	var e Event
+	assert.NoError(t, json.Unmarshal(m.Body, &e))
+	assert.Equal(t, TransferCompleted, e.Type)
+	assert.Equal(t, []int{1, 2}, e.AccountIDs)
+	assert.Equal(t, "transfer.completed.1", m.RoutingKey)
+	assert.Equal(t, e.ID, m.MessageId)
+	assert.Equal(t, "message-id", m.CorrelationId)
+	assert.Equal(t, TransferCompleted, m.Type)
+	assert.Equal(t, eventSchemaVersion, m.Headers[mq.SchemaVersionHeader])
+}
@@ -1,14 +1,19 @@
 package notification
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"strconv"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
 )
 
 const (
@@ -16,61 +21,135 @@ const (
 	routeKey     = "notif"
 	kind         = "topic"
 	contentType  = "application/json"
+
+	// schemaVersion is the version of schemas/notification.v1.json, it is sent in the schema version header.
+	schemaVersion = "1"
+
+	// CloudEvents type and dataschema of the notifications, the type of the domain events is prefixed by
+	// eventTypePrefix.
+	notificationType   = "payments.notification"
+	notificationSchema = "urn:payments-api:schema:notification:1"
+	eventTypePrefix    = "payments."
 )
 
+// Publisher publishes the messages in their CloudEvents mode, it is implemented by mq.Conn.
+type Publisher interface {
+	Publish(exchange, key string, e cloudevents.Event, p amqp.Publishing) error
+}
+
 type notification struct {
-	TransactionId int       `json:"txId"`
+	TransactionId int       `json:"txId,omitempty"`
 	CreatedAt     time.Time `json:"createdAt"`
 	Ack           bool      `json:"ack"`
+	// MessageId, Code and Detail are only set for failed transactions, the message id is the one
+	// of the refused balance operation.
+	MessageId string `json:"messageId,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Detail    string `json:"detail,omitempty"`
 }
 
-func PublishSuccessfulTxNotification(conn *mq.Conn, txId int, createdAt time.Time) {
-	n := &notification{
+func PublishSuccessfulTxNotification(ctx context.Context, conn Publisher, txId int, createdAt time.Time) {
+	publish(ctx, conn, "transactions/"+strconv.Itoa(txId), &notification{
 		TransactionId: txId,
 		CreatedAt:     createdAt,
 		Ack:           true,
-	}
+	})
+}
+
+func PublishFailedTxNotification(ctx context.Context, conn Publisher, messageId, code, detail string) {
+	publish(ctx, conn, "messages/"+messageId, &notification{
+		CreatedAt: time.Now().UTC(),
+		MessageId: messageId,
+		Code:      code,
+		Detail:    detail,
+	})
+}
 
+func publish(ctx context.Context, conn Publisher, subject string, n *notification) {
 	body, err := json.Marshal(n)
 	if err != nil {
 		log.Warnf("failed to marshal notification: %v", err)
 		return
 	}
 
-	err = conn.Channel.ExchangeDeclare(exchangeName, kind, true, false, false, false, nil)
-	if err != nil {
-		log.Errorf("error declaring exchange for notifications: %v", err)
-		return
-	}
-
 	id := uuid.New().String()
-	err = conn.Channel.Publish(exchangeName, routeKey, false, false, amqp.Publishing{
+	e := newCloudEvent(ctx, id, notificationType, subject, notificationSchema, n.CreatedAt)
+	publishing := amqp.Publishing{
+		Headers:      amqp.Table{mq.SchemaVersionHeader: schemaVersion},
 		ContentType:  contentType,
 		MessageId:    id,
 		Body:         body,
 		DeliveryMode: amqp.Transient,
+	}
+	if err = send(conn, routeKey, e, publishing); err != nil {
+		return
+	}
+
+	if n.Ack {
+		log.Infof("successfully sent notification for tx id %d with message id %s", n.TransactionId, id)
+	} else {
+		log.Infof("successfully sent failure notification %s for message id %s with message id %s", n.Code, n.MessageId, id)
+	}
+
+}
+
+// DeclareExchange declares the balance-notifications topic, again after every reconnect.
+func DeclareExchange(conn *mq.Conn) error {
+	return conn.Declare(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(exchangeName, kind, true, false, false, false, nil)
 	})
+}
+
+// newCloudEvent returns the CloudEvents attributes of a message, the trace context is a child of the one
+// of ctx.
+func newCloudEvent(ctx context.Context, id, eventType, subject, schema string, t time.Time) cloudevents.Event {
+	tc := tracecontext.Outgoing(ctx)
+
+	return cloudevents.Event{
+		ID:          id,
+		Source:      eventSource,
+		Type:        eventType,
+		Subject:     subject,
+		Time:        t,
+		DataSchema:  schema,
+		TraceParent: tc.TraceParent,
+		TraceState:  tc.TraceState,
+	}
+}
+
+// send publishes to the balance-notifications topic in its CloudEvents mode, retrying a few times before
+// giving up. Messages without a bound queue are not retried, nobody subscribed to them.
+func send(conn Publisher, key string, e cloudevents.Event, publishing amqp.Publishing) error {
+	err := conn.Publish(exchangeName, key, e, publishing)
+	if unroutable(err) {
+		log.Warnf("notification with message id %s was not routed to any queue: %v", publishing.MessageId, err)
+		return err
+	}
+
 	if err != nil {
 		log.Errorf("error sending notification to balance-notifications topic: %v", err)
 		attempt := 0
 		err = retry.Do(
 			func() error {
 				log.Infof("retrying to send notification, attempt %b", attempt)
-				err = conn.Channel.Publish(exchangeName, routeKey, false, false, amqp.Publishing{
-					ContentType:  contentType,
-					MessageId:    id,
-					Body:         body,
-					DeliveryMode: amqp.Transient,
-				})
+				err = conn.Publish(exchangeName, key, e, publishing)
 				if err != nil {
 					return err
 				}
 				return nil
 			},
 			retry.Attempts(3), retry.Delay(1*time.Second),
+			retry.RetryIf(func(err error) bool { return !unroutable(err) }),
 		)
+		if err != nil {
+			log.Errorf("gave up sending notification with message id %s: %v", publishing.MessageId, err)
+		}
 	}
 
-	log.Infof("successfully sent notification for tx id %d with message id %s", n.TransactionId, id)
+	return err
+}
 
+func unroutable(err error) bool {
+	var returned *mq.ReturnedError
+	return errors.As(err, &returned)
 }
@@ -2,13 +2,16 @@ package notification
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"log"
 	"testing"
 	"time"
 
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/openapi"
 	"github.com/tamasbrandstadter/payments-api/internal/testmq"
 )
 
@@ -18,9 +21,15 @@ func TestPublishSuccessfulTxNotification(t *testing.T) {
 	utc := time.Now().UTC()
 	txId := 55345
 
-	PublishSuccessfulTxNotification(conn, txId, utc)
+	PublishSuccessfulTxNotification(context.Background(), conn, txId, utc)
 
-	messages, err := conn.Channel.Consume("test-queue", "test-consumer", false, false, false, false, nil)
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Errorf("test publish successfull tx notification failed, err nil expected, got: %v", err)
+	}
+	defer ch.Close()
+
+	messages, err := ch.Consume("test-queue", "test-consumer", false, false, false, false, nil)
 	if err != nil {
 		t.Errorf("test publish successfull tx notification failed, err nil expected, got: %v", err)
 	}
@@ -37,6 +46,27 @@ func TestPublishSuccessfulTxNotification(t *testing.T) {
 	assert.NotNil(t, txId, n.TransactionId)
 	assert.NotNil(t, utc, n.CreatedAt)
 	assert.True(t, n.Ack)
+	assert.Equal(t, schemaVersion, m.Headers[mq.SchemaVersionHeader])
+}
+
+func TestNotificationSchema(t *testing.T) {
+	b, err := ioutil.ReadFile("schemas/notification.v" + schemaVersion + ".json")
+	assert.NoError(t, err)
+
+	schema, err := openapi.ParseSchema(b)
+	assert.NoError(t, err)
+
+	for _, n := range []notification{
+		{TransactionId: 1, CreatedAt: time.Now().UTC(), Ack: true},
+		{CreatedAt: time.Now().UTC(), MessageId: "id", Code: "INSUFFICIENT_FUNDS", Detail: "insufficient funds, balance: 1.00"},
+	} {
+		body, err := json.Marshal(n)
+		assert.NoError(t, err)
+
+		var v interface{}
+		assert.NoError(t, json.Unmarshal(body, &v))
+		assert.Empty(t, schema.Validate(v), string(body))
+	}
 }
 
 func NewConn() *mq.Conn {
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Rhymond/go-money"
+	"github.com/go-redis/cache/v8"
+	"github.com/pkg/errors"
+	c "github.com/tamasbrandstadter/payments-api/internal/cache"
+)
+
+const balanceTTL = time.Hour
+
+var NotCachedError = errors.New("balance is not cached")
+
+// RedisBalances caches the balances in redis, so every replica sees them. Nothing is cached without redis.
+type RedisBalances struct {
+	Redis *c.Redis
+}
+
+func (b *RedisBalances) Get(ctx context.Context, id int) (*money.Money, error) {
+	if b.Redis == nil {
+		return nil, NotCachedError
+	}
+
+	var value []byte
+	if err := b.Redis.Balances.Get(ctx, strconv.Itoa(id), &value); err != nil {
+		if err == cache.ErrCacheMiss {
+			return nil, NotCachedError
+		}
+		return nil, err
+	}
+
+	var m money.Money
+	if err := m.UnmarshalJSON(value); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (b *RedisBalances) Set(ctx context.Context, id int, balance *money.Money) error {
+	if b.Redis == nil {
+		return nil
+	}
+
+	value, err := balance.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return b.Redis.Balances.Set(&cache.Item{
+		Ctx:   ctx,
+		Key:   strconv.Itoa(id),
+		Value: value,
+		TTL:   balanceTTL,
+	})
+}
+
+// MemoryBalances caches the balances in memory without expiry, it is meant for tests.
+type MemoryBalances struct {
+	mu       sync.Mutex
+	balances map[int]money.Money
+}
+
+func NewMemoryBalances() *MemoryBalances {
+	return &MemoryBalances{balances: make(map[int]money.Money)}
+}
+
+func (b *MemoryBalances) Get(_ context.Context, id int) (*money.Money, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.balances[id]
+	if !ok {
+		return nil, NotCachedError
+	}
+
+	return &m, nil
+}
+
+func (b *MemoryBalances) Set(_ context.Context, id int, balance *money.Money) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balances[id] = *balance
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+
+	"github.com/Rhymond/go-money"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/audit"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/gdpr"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+)
+
+// AccountRepository stores the accounts, a missing account is reported as sql.ErrNoRows.
+type AccountRepository interface {
+	SelectById(ctx context.Context, id int) (*account.Account, error)
+	List(ctx context.Context, r account.ListRequest) (*account.Page, error)
+	Create(ctx context.Context, customerId int, r account.AccCreationRequest) (*account.Account, error)
+	// Delete and Freeze fail with account.VersionMismatchError if the version isn't zero and the account is at
+	// another one.
+	Delete(ctx context.Context, id int, version int) (*account.Account, error)
+	Freeze(ctx context.Context, id int, version int) (*account.Account, error)
+	Update(ctx context.Context, id int, version int, p account.Patch) (*account.Account, error)
+	Deposit(ctx context.Context, id int, amount int64) (*money.Money, error)
+	Withdraw(ctx context.Context, id int, amount int64) (*money.Money, error)
+	Transfer(ctx context.Context, fromId int, toId int, amount int64) (*money.Money, *money.Money, error)
+}
+
+// CustomerRepository stores the customers, a missing customer is reported as sql.ErrNoRows.
+type CustomerRepository interface {
+	Create(ctx context.Context, r account.AccCreationRequest) (*customer.Customer, error)
+	SelectById(ctx context.Context, id int) (*customer.Customer, error)
+	SelectVerificationByAccountId(ctx context.Context, accountId int) (*customer.Verification, error)
+	SubmitKYC(ctx context.Context, id int, r customer.KYCSubmissionRequest) (*customer.Customer, error)
+	ApproveKYC(ctx context.Context, id int) (*customer.Customer, error)
+	RejectKYC(ctx context.Context, id int, reason string) (*customer.Customer, error)
+	Update(ctx context.Context, id int, p customer.Patch) (*customer.Customer, error)
+}
+
+// TransactionRepository stores the audit records of the balance operations.
+type TransactionRepository interface {
+	Save(ctx context.Context, fromId, toId int, tt audit.TransactionType) (int, error)
+	SelectByAccountId(ctx context.Context, accountId, beforeId, limit int) ([]audit.Transaction, error)
+}
+
+// GDPRRepository exports and erases the personal data of the customers, a missing customer is reported as
+// sql.ErrNoRows.
+type GDPRRepository interface {
+	Export(ctx context.Context, id int) (*gdpr.Archive, error)
+	// Erase fails with gdpr.AlreadyErasedError if the customer is already erased.
+	Erase(ctx context.Context, id int, reason string) (*customer.Customer, error)
+}
+
+// WebhookRepository stores the webhooks and their deliveries, a missing webhook or delivery is reported as
+// sql.ErrNoRows.
+type WebhookRepository interface {
+	Create(ctx context.Context, r webhook.WebhookRequest) (*webhook.Webhook, error)
+	SelectAll(ctx context.Context) ([]webhook.Webhook, error)
+	SelectById(ctx context.Context, id int) (*webhook.Webhook, error)
+	Delete(ctx context.Context, id int) error
+	// Enqueue stores a delivery of the event for every webhook subscribed to it.
+	Enqueue(ctx context.Context, eventType string, accountIds []int, data interface{}) error
+	SelectDeliveries(ctx context.Context, webhookId, limit int) ([]webhook.Delivery, error)
+	Redeliver(ctx context.Context, webhookId, deliveryId int) (*webhook.Delivery, error)
+}
+
+// BalanceCache keeps the balances of the accounts after the balance operations.
+type BalanceCache interface {
+	Get(ctx context.Context, id int) (*money.Money, error)
+	Set(ctx context.Context, id int, balance *money.Money) error
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Rhymond/go-money"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/audit"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/gdpr"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/webhook"
+	"github.com/tamasbrandstadter/payments-api/internal/cache"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+	"github.com/tamasbrandstadter/payments-api/internal/mq"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+// Service holds the operations on accounts, customers and transactions shared by the HTTP and gRPC handlers
+// and the AMQP consumers. Missing accounts and customers are reported as sql.ErrNoRows, except by the balance
+// operations which report them with the same error code the REST API uses.
+type Service struct {
+	Accounts     AccountRepository
+	Customers    CustomerRepository
+	Transactions TransactionRepository
+	Balances     BalanceCache
+	// GDPR and Webhooks have no in-memory implementation, they are nil in the service of NewMemory
+	GDPR     GDPRRepository
+	Webhooks WebhookRepository
+	// KYCThreshold is the largest amount balance operations can move without a verified customer
+	KYCThreshold int64
+}
+
+// New creates the service on top of the db and the redis cache, the cache can be nil.
+func New(db *sqlx.DB, redis *cache.Redis, cipher *encryption.Cipher, conn *mq.Conn) *Service {
+	return &Service{
+		Accounts:     &account.PostgresRepository{DB: db},
+		Customers:    &customer.PostgresRepository{DB: db, Cipher: cipher},
+		Transactions: &audit.PostgresRepository{DB: db, MQ: conn},
+		Balances:     &RedisBalances{Redis: redis},
+		GDPR:         &gdpr.PostgresRepository{DB: db, Cipher: cipher},
+		Webhooks:     &webhook.PostgresRepository{DB: db, Cipher: cipher},
+	}
+}
+
+// NewMemory creates the service with in-memory repositories, it is meant for tests.
+func NewMemory() *Service {
+	accounts := account.NewMemoryRepository()
+	customers := customer.NewMemoryRepository()
+	customers.AccountOwner = accounts.Owner
+
+	return &Service{
+		Accounts:     accounts,
+		Customers:    customers,
+		Transactions: audit.NewMemoryRepository(),
+		Balances:     NewMemoryBalances(),
+	}
+}
+
+func (s *Service) GetAccount(ctx context.Context, id int) (*account.Account, error) {
+	return s.Accounts.SelectById(ctx, id)
+}
+
+func (s *Service) ListAccounts(ctx context.Context, r account.ListRequest) (*account.Page, error) {
+	return s.Accounts.List(ctx, r)
+}
+
+func (s *Service) CreateAccount(ctx context.Context, customerId int, r account.AccCreationRequest) (*account.Account, error) {
+	return s.Accounts.Create(ctx, customerId, r)
+}
+
+func (s *Service) DeleteAccount(ctx context.Context, id int, version int) (*account.Account, error) {
+	return s.Accounts.Delete(ctx, id, version)
+}
+
+func (s *Service) FreezeAccount(ctx context.Context, id int, version int) (*account.Account, error) {
+	return s.Accounts.Freeze(ctx, id, version)
+}
+
+// UpdateAccount applies the merge patch to the account, switching to a product which requires KYC needs a
+// verified customer.
+func (s *Service) UpdateAccount(ctx context.Context, id int, version int, p account.Patch) (*account.Account, error) {
+	if p.Product != nil && account.RequiresKYC(*p.Product) {
+		v, err := s.Customers.SelectVerificationByAccountId(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !v.Verified(time.Now().UTC()) {
+			return nil, &customer.KYCRequiredError{CustomerID: v.CustomerID}
+		}
+	}
+
+	return s.Accounts.Update(ctx, id, version, p)
+}
+
+// GetBalance returns the balance of the account from the cache, or from the repository if it isn't cached.
+func (s *Service) GetBalance(ctx context.Context, id int) (*money.Money, error) {
+	m, err := s.Balances.Get(ctx, id)
+	if err == nil {
+		return m, nil
+	}
+	if err != NotCachedError {
+		log.Warnf("failed to get balance from cache for account id %d, error: %v", id, err)
+	}
+
+	acc, err := s.Accounts.SelectById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return money.New(acc.BalanceInDecimal, acc.Currency), nil
+}
+
+func (s *Service) GetCustomer(ctx context.Context, id int) (*customer.Customer, error) {
+	return s.Customers.SelectById(ctx, id)
+}
+
+// CreateCustomer reports a customer with the same email with customer.EmailTakenError.
+func (s *Service) CreateCustomer(ctx context.Context, r account.AccCreationRequest) (*customer.Customer, error) {
+	return s.Customers.Create(ctx, r)
+}
+
+func (s *Service) SubmitKYC(ctx context.Context, id int, r customer.KYCSubmissionRequest) (*customer.Customer, error) {
+	return s.Customers.SubmitKYC(ctx, id, r)
+}
+
+func (s *Service) ApproveKYC(ctx context.Context, id int) (*customer.Customer, error) {
+	return s.Customers.ApproveKYC(ctx, id)
+}
+
+func (s *Service) RejectKYC(ctx context.Context, id int, reason string) (*customer.Customer, error) {
+	return s.Customers.RejectKYC(ctx, id, reason)
+}
+
+// UpdateCustomer applies the merge patch to the customer, erased customers fail with customer.ErasedError.
+func (s *Service) UpdateCustomer(ctx context.Context, id int, p customer.Patch) (*customer.Customer, error) {
+	return s.Customers.Update(ctx, id, p)
+}
+
+// SaveTransaction stores the audit record of a balance operation and returns its id.
+func (s *Service) SaveTransaction(ctx context.Context, fromId, toId int, tt audit.TransactionType) (int, error) {
+	return s.Transactions.Save(ctx, fromId, toId, tt)
+}
+
+// ListTransactions returns the transactions of the account newest first, only the ones older than beforeId
+// unless it is 0.
+func (s *Service) ListTransactions(ctx context.Context, accountId, beforeId, limit int) ([]audit.Transaction, error) {
+	return s.Transactions.SelectByAccountId(ctx, accountId, beforeId, limit)
+}
+
+// ExportCustomer returns every record stored about the customer.
+func (s *Service) ExportCustomer(ctx context.Context, id int) (*gdpr.Archive, error) {
+	return s.GDPR.Export(ctx, id)
+}
+
+// EraseCustomer pseudonymizes the personal data of the customer, the accounts and transactions are kept.
+func (s *Service) EraseCustomer(ctx context.Context, id int, reason string) (*customer.Customer, error) {
+	return s.GDPR.Erase(ctx, id, reason)
+}
+
+func (s *Service) CreateWebhook(ctx context.Context, r webhook.WebhookRequest) (*webhook.Webhook, error) {
+	return s.Webhooks.Create(ctx, r)
+}
+
+func (s *Service) ListWebhooks(ctx context.Context) ([]webhook.Webhook, error) {
+	return s.Webhooks.SelectAll(ctx)
+}
+
+func (s *Service) GetWebhook(ctx context.Context, id int) (*webhook.Webhook, error) {
+	return s.Webhooks.SelectById(ctx, id)
+}
+
+func (s *Service) DeleteWebhook(ctx context.Context, id int) error {
+	return s.Webhooks.Delete(ctx, id)
+}
+
+// EnqueueWebhooks stores the deliveries of the event to the webhooks subscribed to it, the worker posts them.
+func (s *Service) EnqueueWebhooks(ctx context.Context, eventType string, accountIds []int, data interface{}) error {
+	return s.Webhooks.Enqueue(ctx, eventType, accountIds, data)
+}
+
+func (s *Service) ListWebhookDeliveries(ctx context.Context, webhookId, limit int) ([]webhook.Delivery, error) {
+	return s.Webhooks.SelectDeliveries(ctx, webhookId, limit)
+}
+
+// RedeliverWebhook schedules the delivery again with a fresh set of attempts.
+func (s *Service) RedeliverWebhook(ctx context.Context, webhookId, deliveryId int) (*webhook.Delivery, error) {
+	return s.Webhooks.Redeliver(ctx, webhookId, deliveryId)
+}
+
+// Deposit adds the amount to the balance of the account once its customer is verified for the amount, the new
+// balance is cached.
+func (s *Service) Deposit(ctx context.Context, id int, amount int64) (*money.Money, error) {
+	if err := s.checkKYC(ctx, id, amount); err != nil {
+		return nil, err
+	}
+
+	balance, err := s.Accounts.Deposit(ctx, id, amount)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, accountNotFound(id)
+		}
+		return nil, err
+	}
+
+	s.cacheBalance(ctx, id, balance)
+
+	return balance, nil
+}
+
+// Withdraw subtracts the amount from the balance of the account once its customer is verified for the amount,
+// the new balance is cached.
+func (s *Service) Withdraw(ctx context.Context, id int, amount int64) (*money.Money, error) {
+	if err := s.checkKYC(ctx, id, amount); err != nil {
+		return nil, err
+	}
+
+	balance, err := s.Accounts.Withdraw(ctx, id, amount)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, accountNotFound(id)
+		}
+		return nil, err
+	}
+
+	s.cacheBalance(ctx, id, balance)
+
+	return balance, nil
+}
+
+// Transfer moves the amount between the accounts once both customers are verified for the amount, the new
+// balances are cached.
+func (s *Service) Transfer(ctx context.Context, fromId int, toId int, amount int64) (*money.Money, *money.Money, error) {
+	for _, id := range []int{fromId, toId} {
+		if err := s.checkKYC(ctx, id, amount); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fromBalance, toBalance, err := s.Accounts.Transfer(ctx, fromId, toId, amount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.cacheBalance(ctx, fromId, fromBalance)
+	s.cacheBalance(ctx, toId, toBalance)
+
+	return fromBalance, toBalance, nil
+}
+
+func (s *Service) checkKYC(ctx context.Context, accountId int, amount int64) error {
+	if amount <= s.KYCThreshold {
+		return nil
+	}
+
+	v, err := s.Customers.SelectVerificationByAccountId(ctx, accountId)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return accountNotFound(accountId)
+		}
+		return err
+	}
+
+	if !v.Verified(time.Now().UTC()) {
+		log.Warnf("refused balance operation of %d on account id %d, customer id %d is not verified", amount, accountId, v.CustomerID)
+		return &customer.KYCRequiredError{CustomerID: v.CustomerID}
+	}
+
+	return nil
+}
+
+// cacheBalance caches the new balance, a failure doesn't affect the already applied operation.
+func (s *Service) cacheBalance(ctx context.Context, id int, balance *money.Money) {
+	if err := s.Balances.Set(ctx, id, balance); err != nil {
+		log.Errorf("error setting new balance in cache for account id %d, error: %v", id, err)
+	}
+}
+
+func accountNotFound(id int) error {
+	return problem.Newf(problem.AccountNotFound, "account id %d is not found", id)
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+func TestBalanceOperationsRequireKYCAboveThreshold(t *testing.T) {
+	s := NewMemory()
+	s.KYCThreshold = 100
+	ctx := context.Background()
+
+	c, _ := s.CreateCustomer(ctx, account.AccCreationRequest{Email: "first@last.com"})
+	acc, _ := s.CreateAccount(ctx, c.ID, account.AccCreationRequest{Currency: "EUR"})
+
+	balance, err := s.Deposit(ctx, acc.ID, 100)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(100), balance.Amount())
+	}
+
+	_, err = s.Deposit(ctx, acc.ID, 101)
+	assert.Equal(t, &customer.KYCRequiredError{CustomerID: c.ID}, err)
+
+	_, err = s.Deposit(ctx, 99, 101)
+	assert.Equal(t, problem.AccountNotFound, problem.CodeOf(err))
+
+	_, err = s.SubmitKYC(ctx, c.ID, customer.KYCSubmissionRequest{Documents: []customer.KYCDocument{
+		{Type: "passport", Reference: "P1", ExpiresAt: time.Now().Add(time.Hour)},
+	}})
+	assert.NoError(t, err)
+	_, err = s.ApproveKYC(ctx, c.ID)
+	assert.NoError(t, err)
+
+	_, err = s.Withdraw(ctx, acc.ID, 101)
+	assert.Equal(t, problem.InsufficientFunds, problem.CodeOf(err))
+
+	balance, err = s.Deposit(ctx, acc.ID, 101)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(201), balance.Amount())
+	}
+}
+
+func TestGetBalanceFromCache(t *testing.T) {
+	s := NewMemory()
+	s.KYCThreshold = 100
+	ctx := context.Background()
+
+	acc, _ := s.CreateAccount(ctx, 1, account.AccCreationRequest{InitialBalance: 50, Currency: "EUR"})
+
+	balance, err := s.GetBalance(ctx, acc.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(50), balance.Amount())
+	}
+
+	_, err = s.Deposit(ctx, acc.ID, 25)
+	assert.NoError(t, err)
+
+	cached, err := s.Balances.Get(ctx, acc.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(75), cached.Amount())
+	}
+
+	_, err = s.GetBalance(ctx, 99)
+	assert.Error(t, err)
+}
+
+func TestUpdateAccountRequiresKYCForRestrictedProducts(t *testing.T) {
+	s := NewMemory()
+	ctx := context.Background()
+
+	c, _ := s.CreateCustomer(ctx, account.AccCreationRequest{Email: "first@last.com"})
+	acc, _ := s.CreateAccount(ctx, c.ID, account.AccCreationRequest{Currency: "EUR"})
+
+	standard := account.StandardProduct
+	_, err := s.UpdateAccount(ctx, acc.ID, 0, account.Patch{Product: &standard})
+	assert.Equal(t, &customer.KYCRequiredError{CustomerID: c.ID}, err)
+
+	_, err = s.SubmitKYC(ctx, c.ID, customer.KYCSubmissionRequest{Documents: []customer.KYCDocument{
+		{Type: "passport", Reference: "P1", ExpiresAt: time.Now().Add(time.Hour)},
+	}})
+	assert.NoError(t, err)
+	_, err = s.ApproveKYC(ctx, c.ID)
+	assert.NoError(t, err)
+
+	updated, err := s.UpdateAccount(ctx, acc.ID, acc.Version, account.Patch{Product: &standard})
+	if assert.NoError(t, err) {
+		assert.Equal(t, account.StandardProduct, updated.Product)
+		assert.Equal(t, acc.Version+1, updated.Version)
+	}
+}
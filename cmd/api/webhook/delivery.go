@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+
+	contentType = "application/json"
+	userAgent   = "payments-api-webhooks/1.0"
+
+	batchSize   = 20
+	baseBackoff = 10 * time.Second
+	maxBackoff  = time.Hour
+	maxError    = 255
+)
+
+// Worker posts the pending deliveries. Every replica runs one, a delivery is only claimed by one of them.
+type Worker struct {
+	DB           *sqlx.DB
+	Cipher       *encryption.Cipher
+	Client       *http.Client
+	MaxAttempts  int
+	PollInterval time.Duration
+}
+
+// target is a claimed delivery with the webhook it is sent to.
+type target struct {
+	Delivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// Run delivers the due deliveries until the context is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.deliverDue(ctx); err != nil {
+				log.Errorf("error delivering webhooks: %v", err)
+			}
+		}
+	}
+}
+
+func (w *Worker) deliverDue(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	var targets []target
+	if err := w.DB.SelectContext(ctx, &targets, claimDue, w.lease(now), now, batchSize); err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		if _, err := w.attempt(ctx, t, w.MaxAttempts); err != nil {
+			log.Errorf("error recording webhook delivery id %d: %v", t.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// Test sends a test event to the webhook right away and returns its delivery, failed tests are not retried.
+func (w *Worker) Test(ctx context.Context, webhookId int) (*Delivery, error) {
+	var t target
+	if err := w.DB.GetContext(ctx, &t, selectTarget, webhookId); err != nil {
+		return nil, err
+	}
+
+	p := newPayload(TestEvent, map[string]int{"webhookId": webhookId})
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	t.WebhookID = webhookId
+	t.EventID = p.ID
+	t.EventType = TestEvent
+	t.Payload = body
+	t.Status = StatusPending
+	t.CreatedAt = p.CreatedAt
+
+	// leased right away, the worker must not claim it meanwhile
+	row := w.DB.QueryRowContext(ctx, insertDelivery, webhookId, p.ID, TestEvent, string(body), w.lease(p.CreatedAt), p.CreatedAt)
+	if err = row.Scan(&t.ID); err != nil {
+		return nil, err
+	}
+
+	return w.attempt(ctx, t, 1)
+}
+
+// lease is when a claimed delivery is attempted again if the replica dies while posting it.
+func (w *Worker) lease(now time.Time) time.Time {
+	return now.Add(w.Client.Timeout + time.Minute)
+}
+
+// attempt posts the delivery and records the outcome, failures are retried with exponential backoff until
+// the attempts run out.
+func (w *Worker) attempt(ctx context.Context, t target, maxAttempts int) (*Delivery, error) {
+	d := t.Delivery
+	d.Attempts++
+
+	statusCode, err := w.post(ctx, t)
+	now := time.Now().UTC()
+
+	var lastError *string
+	switch {
+	case err == nil:
+		d.Status = StatusSucceeded
+		d.NextAttemptAt = nil
+		d.DeliveredAt = &now
+	case d.Attempts >= maxAttempts:
+		d.Status = StatusFailed
+		d.NextAttemptAt = nil
+	default:
+		next := now.Add(Backoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+
+	if err != nil {
+		msg := err.Error()
+		if len(msg) > maxError {
+			msg = msg[:maxError]
+		}
+		lastError = &msg
+		log.Warnf("webhook delivery id %d to webhook id %d failed, attempt %d: %v", d.ID, d.WebhookID, d.Attempts, err)
+	}
+	d.LastError = lastError
+	if statusCode != 0 {
+		d.LastStatusCode = &statusCode
+	}
+
+	_, dbErr := w.DB.ExecContext(ctx, updateAttempt, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError,
+		d.DeliveredAt, d.ID)
+
+	return &d, dbErr
+}
+
+func (w *Worker) post(ctx context.Context, t target) (int, error) {
+	secret, err := w.Cipher.Decrypt(t.Secret)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decrypt webhook secret: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(t.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(EventHeader, t.EventType)
+	req.Header.Set(DeliveryHeader, t.EventID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, t.Payload))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header value, the HMAC-SHA256 of the timestamp and the body joined by a dot. The
+// timestamp is signed too, so receivers can refuse replayed deliveries.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff is the delay after the attempt, doubled with every failed attempt.
+func Backoff(attempt int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxBackoff {
+		return maxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,32 @@
+package webhook
+
+const (
+	insert     = "INSERT INTO webhooks(url, secret, event_types, account_ids, created_at) VALUES($1,$2,$3,$4,$5) RETURNING id;"
+	selectAll  = "SELECT id, url, event_types, COALESCE(account_ids, '{}') AS account_ids, created_at FROM webhooks ORDER BY id;"
+	selectById = "SELECT id, url, event_types, COALESCE(account_ids, '{}') AS account_ids, created_at FROM webhooks WHERE id=$1;"
+	deleteById = "DELETE FROM webhooks WHERE id=$1;"
+
+	// every webhook subscribed to the event type gets a delivery, webhooks with an account filter only for
+	// events of those accounts
+	insertDeliveries = "INSERT INTO webhook_deliveries(webhook_id, event_id, event_type, payload, next_attempt_at, created_at) " +
+		"SELECT id, $1, $2, $3, $4, $4 FROM webhooks WHERE $2 = ANY(event_types) " +
+		"AND (account_ids IS NULL OR cardinality(account_ids) = 0 OR account_ids && $5::INTEGER[]);"
+	insertDelivery = "INSERT INTO webhook_deliveries(webhook_id, event_id, event_type, payload, next_attempt_at, created_at) " +
+		"VALUES($1,$2,$3,$4,$5,$6) RETURNING id;"
+	selectDeliveries = "SELECT id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, " +
+		"last_error, created_at, delivered_at FROM webhook_deliveries WHERE webhook_id=$1 ORDER BY id DESC LIMIT $2;"
+	selectDelivery = "SELECT id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, " +
+		"last_error, created_at, delivered_at FROM webhook_deliveries WHERE webhook_id=$1 AND id=$2;"
+	redeliver = "UPDATE webhook_deliveries SET status='pending', attempts=0, next_attempt_at=$1 WHERE webhook_id=$2 AND id=$3;"
+
+	// claimDue leases the due deliveries to one replica by moving their next attempt past the delivery timeout
+	claimDue = "WITH claimed AS (UPDATE webhook_deliveries SET next_attempt_at=$1 WHERE id IN (" +
+		"SELECT id FROM webhook_deliveries WHERE status='pending' AND next_attempt_at <= $2 " +
+		"ORDER BY next_attempt_at LIMIT $3 FOR UPDATE SKIP LOCKED) RETURNING *) " +
+		"SELECT c.id, c.webhook_id, c.event_id, c.event_type, c.payload, c.status, c.attempts, c.next_attempt_at, " +
+		"c.last_status_code, c.last_error, c.created_at, c.delivered_at, w.url, w.secret " +
+		"FROM claimed c JOIN webhooks w ON w.id = c.webhook_id;"
+	selectTarget  = "SELECT url, secret FROM webhooks WHERE id=$1;"
+	updateAttempt = "UPDATE webhook_deliveries SET status=$1, attempts=$2, next_attempt_at=$3, last_status_code=$4, last_error=$5, " +
+		"delivered_at=$6 WHERE id=$7;"
+)
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+// PostgresRepository stores the webhooks and their deliveries in the db, the secrets are encrypted with the cipher.
+type PostgresRepository struct {
+	DB     *sqlx.DB
+	Cipher *encryption.Cipher
+}
+
+func (r *PostgresRepository) Create(ctx context.Context, wr WebhookRequest) (*Webhook, error) {
+	return Create(ctx, r.DB, r.Cipher, wr)
+}
+
+func (r *PostgresRepository) SelectAll(ctx context.Context) ([]Webhook, error) {
+	return SelectAll(ctx, r.DB)
+}
+
+func (r *PostgresRepository) SelectById(ctx context.Context, id int) (*Webhook, error) {
+	return SelectById(ctx, r.DB, id)
+}
+
+func (r *PostgresRepository) Delete(ctx context.Context, id int) error {
+	return Delete(ctx, r.DB, id)
+}
+
+func (r *PostgresRepository) Enqueue(ctx context.Context, eventType string, accountIds []int, data interface{}) error {
+	return Enqueue(ctx, r.DB, eventType, accountIds, data)
+}
+
+func (r *PostgresRepository) SelectDeliveries(ctx context.Context, webhookId, limit int) ([]Delivery, error) {
+	return SelectDeliveries(ctx, r.DB, webhookId, limit)
+}
+
+func (r *PostgresRepository) Redeliver(ctx context.Context, webhookId, deliveryId int) (*Delivery, error) {
+	return Redeliver(ctx, r.DB, webhookId, deliveryId)
+}
@@ -0,0 +1,8 @@
+package webhook
+
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"eventTypes"`
+	AccountIDs []int    `json:"accountIds"`
+}
@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+// event types partners can subscribe to
+const (
+	DepositCompleted    = "deposit.completed"
+	WithdrawCompleted   = "withdraw.completed"
+	TransferCompleted   = "transfer.completed"
+	TransactionRejected = "transaction.rejected"
+
+	// TestEvent is only sent by the test endpoint, it can't be subscribed to.
+	TestEvent = "webhook.test"
+
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	secretSize = 32
+)
+
+var EventTypes = []string{DepositCompleted, WithdrawCompleted, TransferCompleted, TransactionRejected}
+
+type Webhook struct {
+	ID         int            `json:"id" db:"id"`
+	URL        string         `json:"url" db:"url"`
+	EventTypes pq.StringArray `json:"eventTypes" db:"event_types"`
+	AccountIDs pq.Int64Array  `json:"accountIds" db:"account_ids"`
+	CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+	// Secret is only returned when the webhook is created, it is stored encrypted
+	Secret string `json:"secret,omitempty" db:"-"`
+}
+
+type Delivery struct {
+	ID             int             `json:"id" db:"id"`
+	WebhookID      int             `json:"webhookId" db:"webhook_id"`
+	EventID        string          `json:"eventId" db:"event_id"`
+	EventType      string          `json:"eventType" db:"event_type"`
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Status         string          `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	LastStatusCode *int            `json:"lastStatusCode,omitempty" db:"last_status_code"`
+	LastError      *string         `json:"lastError,omitempty" db:"last_error"`
+	CreatedAt      time.Time       `json:"createdAt" db:"created_at"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty" db:"delivered_at"`
+}
+
+// Payload is the body posted to the webhooks.
+type Payload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+func ValidEventType(t string) bool {
+	for _, et := range EventTypes {
+		if et == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Create stores the webhook with its secret encrypted, a secret is generated if the request has none.
+func Create(ctx context.Context, db *sqlx.DB, cipher *encryption.Cipher, wr WebhookRequest) (*Webhook, error) {
+	secret := wr.Secret
+	if secret == "" {
+		b := make([]byte, secretSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	encrypted, err := cipher.Encrypt(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encrypt webhook secret")
+	}
+
+	w := Webhook{
+		URL:        wr.URL,
+		EventTypes: wr.EventTypes,
+		AccountIDs: make(pq.Int64Array, len(wr.AccountIDs)),
+		CreatedAt:  time.Now().UTC(),
+		Secret:     secret,
+	}
+	for i, id := range wr.AccountIDs {
+		w.AccountIDs[i] = int64(id)
+	}
+
+	row := db.QueryRowContext(ctx, insert, w.URL, encrypted, w.EventTypes, w.AccountIDs, w.CreatedAt)
+	if err = row.Scan(&w.ID); err != nil {
+		return nil, err
+	}
+
+	log.Infof("created webhook id %d for %v", w.ID, w.EventTypes)
+
+	return &w, nil
+}
+
+func SelectAll(ctx context.Context, db *sqlx.DB) ([]Webhook, error) {
+	webhooks := make([]Webhook, 0)
+	if err := db.SelectContext(ctx, &webhooks, selectAll); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func SelectById(ctx context.Context, db *sqlx.DB, id int) (*Webhook, error) {
+	var w Webhook
+	if err := db.GetContext(ctx, &w, selectById, id); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// Delete removes the webhook with its delivery log.
+func Delete(ctx context.Context, db *sqlx.DB, id int) error {
+	res, err := db.ExecContext(ctx, deleteById, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Enqueue stores a delivery of the event for every subscribed webhook, the worker posts them. The deliveries
+// are stored in the db first, so no event is lost while a partner is down.
+func Enqueue(ctx context.Context, db *sqlx.DB, eventType string, accountIds []int, data interface{}) error {
+	p := newPayload(eventType, data)
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	ids := make(pq.Int64Array, len(accountIds))
+	for i, id := range accountIds {
+		ids[i] = int64(id)
+	}
+
+	res, err := db.ExecContext(ctx, insertDeliveries, p.ID, eventType, string(body), p.CreatedAt, ids)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Infof("enqueued %d webhook deliveries of %s event %s", n, eventType, p.ID)
+	}
+
+	return nil
+}
+
+func SelectDeliveries(ctx context.Context, db *sqlx.DB, webhookId, limit int) ([]Delivery, error) {
+	deliveries := make([]Delivery, 0)
+	if err := db.SelectContext(ctx, &deliveries, selectDeliveries, webhookId, limit); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// Redeliver schedules the delivery again with a fresh set of attempts, regardless of its status.
+func Redeliver(ctx context.Context, db *sqlx.DB, webhookId, deliveryId int) (*Delivery, error) {
+	res, err := db.ExecContext(ctx, redeliver, time.Now().UTC(), webhookId, deliveryId)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	var d Delivery
+	if err = db.GetContext(ctx, &d, selectDelivery, webhookId, deliveryId); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func newPayload(eventType string, data interface{}) *Payload {
+	return &Payload{ID: uuid.New().String(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+}
@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
+)
+
+var cipher = newCipher()
+
+const (
+	claimQuery    = "WITH claimed AS \\(UPDATE webhook_deliveries SET next_attempt_at=\\$1"
+	attemptQuery  = "UPDATE webhook_deliveries SET status=\\$1, attempts=\\$2, next_attempt_at=\\$3, last_status_code=\\$4, last_error=\\$5, delivered_at=\\$6 WHERE id=\\$7;"
+	targetQuery   = "SELECT url, secret FROM webhooks WHERE id=\\$1;"
+	deliveryQuery = "INSERT INTO webhook_deliveries\\(webhook_id, event_id, event_type, payload, next_attempt_at, created_at\\) VALUES"
+	secret        = "0123456789abcdef0123456789abcdef"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+
+	s := Sign(secret, 1600000000, body)
+
+	assert.Equal(t, "sha256=", s[:7])
+	assert.Len(t, s, 7+64)
+	assert.Equal(t, s, Sign(secret, 1600000000, body))
+	assert.NotEqual(t, s, Sign(secret, 1600000001, body))
+	assert.NotEqual(t, s, Sign("other", 1600000000, body))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, Backoff(1))
+	assert.Equal(t, 20*time.Second, Backoff(2))
+	assert.Equal(t, 80*time.Second, Backoff(4))
+	assert.Equal(t, time.Hour, Backoff(10))
+	assert.Equal(t, time.Hour, Backoff(100))
+}
+
+func TestDeliverDue(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectQuery(claimQuery).WillReturnRows(targetRows(srv.URL, 0))
+	mock.ExpectExec(attemptQuery).WithArgs(StatusSucceeded, 1, nil, http.StatusNoContent, nil, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := newWorker(db)
+	err := w.deliverDue(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, DepositCompleted, received.Header.Get(EventHeader))
+	assert.Equal(t, "ev-1", received.Header.Get(DeliveryHeader))
+	assert.Equal(t, contentType, received.Header.Get("Content-Type"))
+
+	ts, _ := strconv.ParseInt(received.Header.Get(TimestampHeader), 10, 64)
+	assert.Equal(t, Sign(secret, ts, body), received.Header.Get(SignatureHeader))
+}
+
+func TestDeliverDueRetry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectQuery(claimQuery).WillReturnRows(targetRows(srv.URL, 2))
+	mock.ExpectExec(attemptQuery).
+		WithArgs(StatusPending, 3, sqlmock.AnyArg(), http.StatusServiceUnavailable, "unexpected status 503", nil, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := newWorker(db)
+	err := w.deliverDue(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeliverDueFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	mock.ExpectQuery(claimQuery).WillReturnRows(targetRows(srv.URL, 2))
+	mock.ExpectExec(attemptQuery).
+		WithArgs(StatusFailed, 3, nil, http.StatusInternalServerError, "unexpected status 500", nil, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := newWorker(db)
+	w.MaxAttempts = 3
+	err := w.deliverDue(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTestWebhook(t *testing.T) {
+	var payload Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	db, mock := NewMockDb()
+	defer db.Close()
+
+	encrypted, _ := cipher.Encrypt(secret)
+	mock.ExpectQuery(targetQuery).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"url", "secret"}).AddRow(srv.URL, encrypted))
+	mock.ExpectQuery(deliveryQuery).WithArgs(3, sqlmock.AnyArg(), TestEvent, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectExec(attemptQuery).
+		WithArgs(StatusFailed, 1, nil, http.StatusBadGateway, "unexpected status 502", nil, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	d, err := newWorker(db).Test(context.Background(), 3)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, 9, d.ID)
+	assert.Equal(t, StatusFailed, d.Status)
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, http.StatusBadGateway, *d.LastStatusCode)
+	assert.Equal(t, TestEvent, payload.Type)
+	assert.Equal(t, d.EventID, payload.ID)
+}
+
+func targetRows(url string, attempts int) *sqlmock.Rows {
+	encrypted, err := cipher.Encrypt(secret)
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when encrypting test secret", err)
+	}
+
+	utc := time.Now().UTC()
+	return sqlmock.NewRows([]string{"id", "webhook_id", "event_id", "event_type", "payload", "status", "attempts", "next_attempt_at",
+		"last_status_code", "last_error", "created_at", "delivered_at", "url", "secret"}).
+		AddRow(5, 1, "ev-1", DepositCompleted, []byte(`{"id":"ev-1","type":"deposit.completed"}`), StatusPending, attempts, utc,
+			nil, nil, utc, nil, url, encrypted)
+}
+
+func TestValidURL(t *testing.T) {
+	assert.True(t, ValidURL("https://partner.example/hooks"))
+	assert.True(t, ValidURL("https://203.0.113.7:8443/hooks"))
+
+	for _, u := range []string{"http://partner.example/hooks", "ftp://partner.example", "https://", "https://localhost/hooks",
+		"https://127.0.0.1/hooks", "https://10.0.0.5/hooks", "https://169.254.169.254/latest", "https://[::1]/hooks",
+		"https://[::ffff:192.168.0.1]/hooks"} {
+		assert.False(t, ValidURL(u), u)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	client := NewClient(time.Second)
+
+	// the test server listens on a loopback address
+	_, err := client.Get(srv.URL)
+	assert.Error(t, err)
+
+	// redirects are returned instead of followed
+	client.Transport = srv.Client().Transport
+	resp, err := client.Get(srv.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+}
+
+func newWorker(db *sqlx.DB) *Worker {
+	return &Worker{
+		DB:           db,
+		Cipher:       cipher,
+		Client:       &http.Client{Timeout: time.Second},
+		MaxAttempts:  8,
+		PollInterval: time.Second,
+	}
+}
+
+func newCipher() *encryption.Cipher {
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when generating key", err)
+	}
+
+	keys, err := encryption.NewLocalKeyProvider("test", map[string][]byte{"test": key}, key)
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when creating key provider", err)
+	}
+
+	return encryption.NewCipher(keys)
+}
+
+func NewMockDb() (*sqlx.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	return sqlx.NewDb(db, "sqlmock"), mock
+}
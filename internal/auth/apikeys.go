@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// APIKey is a static credential. Only the hex encoded SHA-256 hash of the key is configured.
+type APIKey struct {
+	Name       string `json:"name"`
+	Hash       string `json:"hash"`
+	Role       Role   `json:"role"`
+	CustomerID int    `json:"customerId,omitempty"`
+}
+
+// LoadAPIKeys reads the API keys from a JSON file, for example:
+// [{"name": "backoffice", "hash": "<sha256 hex>", "role": "operator"}]
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if len(k.Hash) != 64 {
+			return nil, fmt.Errorf("api key %s must have a sha256 hex hash", k.Name)
+		}
+		if !ValidRole(k.Role) {
+			return nil, fmt.Errorf("api key %s has unknown role %q", k.Name, k.Role)
+		}
+		if k.Role == RoleCustomer && k.CustomerID <= 0 {
+			return nil, fmt.Errorf("api key %s has customer role without customer id", k.Name)
+		}
+	}
+
+	return keys, nil
+}
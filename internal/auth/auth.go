@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	bearerPrefix = "Bearer "
+
+	MethodAPIKey = "apikey"
+	MethodBearer = "bearer"
+)
+
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var (
+	MissingCredentialsError = errors.New("missing credentials")
+	InvalidCredentialsError = errors.New("invalid credentials")
+)
+
+func ValidRole(r Role) bool {
+	return r == RoleCustomer || r == RoleOperator || r == RoleAdmin
+}
+
+// Principal is the authenticated caller. CustomerID is only set for the customer role.
+type Principal struct {
+	Subject    string
+	Role       Role
+	CustomerID int
+	Method     string
+}
+
+func (p *Principal) HasRole(roles ...Role) bool {
+	for _, r := range roles {
+		if p.Role == r {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator accepts either a JWT bearer token or a static API key.
+type Authenticator struct {
+	verifier *JWTVerifier
+	apiKeys  map[string]Principal
+}
+
+func NewAuthenticator(verifier *JWTVerifier, keys []APIKey) *Authenticator {
+	apiKeys := make(map[string]Principal, len(keys))
+	for _, k := range keys {
+		apiKeys[strings.ToLower(k.Hash)] = Principal{Subject: k.Name, Role: k.Role, CustomerID: k.CustomerID, Method: MethodAPIKey}
+	}
+
+	return &Authenticator{verifier: verifier, apiKeys: apiKeys}
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	return a.AuthenticateCredentials(r.Header.Get(apiKeyHeader), r.Header.Get("Authorization"))
+}
+
+// AuthenticateCredentials checks the values of the API key and the authorization header, callers which
+// don't use HTTP requests pass them from their own headers.
+func (a *Authenticator) AuthenticateCredentials(key, authorization string) (*Principal, error) {
+	if key != "" {
+		// only the hashes are configured, a lookup by hash doesn't leak timing about the key itself
+		p, ok := a.apiKeys[HashAPIKey(key)]
+		if !ok {
+			return nil, InvalidCredentialsError
+		}
+
+		return &p, nil
+	}
+
+	if authorization == "" {
+		return nil, MissingCredentialsError
+	}
+
+	if !strings.HasPrefix(authorization, bearerPrefix) || a.verifier == nil {
+		return nil, InvalidCredentialsError
+	}
+
+	claims, err := a.verifier.Verify(strings.TrimPrefix(authorization, bearerPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	return claims.Principal()
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const secret = "0123456789abcdef0123456789abcdef"
+
+func TestVerifyHMAC(t *testing.T) {
+	v := NewJWTVerifier(keySet(t, octJWK("hs", secret)), "", "")
+
+	token := signHMAC(t, "hs", claims(RoleCustomer, 7, time.Hour))
+
+	c, err := v.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleCustomer, c.Role)
+	assert.Equal(t, 7, c.CustomerID)
+
+	_, err = v.Verify(token[:len(token)-2] + "xx")
+	assert.True(t, errors.Cause(err) == InvalidCredentialsError)
+}
+
+func TestVerifyRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	jwk := fmt.Sprintf(`{"kty": "RSA", "kid": "rs", "n": "%s", "e": "%s"}`,
+		b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes()))
+	v := NewJWTVerifier(keySet(t, jwk), "", "")
+
+	token := sign(t, "RS256", "rs", claims(RoleOperator, 0, time.Hour), func(digest []byte) []byte {
+		s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+		assert.NoError(t, err)
+		return s
+	})
+
+	c, err := v.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleOperator, c.Role)
+}
+
+func TestVerifyECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	jwk := fmt.Sprintf(`{"kty": "EC", "kid": "es", "crv": "P-256", "x": "%s", "y": "%s"}`,
+		b64(key.X.FillBytes(make([]byte, 32))), b64(key.Y.FillBytes(make([]byte, 32))))
+	v := NewJWTVerifier(keySet(t, jwk), "", "")
+
+	token := sign(t, "ES256", "es", claims(RoleAdmin, 0, time.Hour), func(digest []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		assert.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+
+	c, err := v.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleAdmin, c.Role)
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	rsaJWK := fmt.Sprintf(`{"kty": "RSA", "kid": "rs", "n": "%s", "e": "AQAB"}`, b64(key.N.Bytes()))
+	v := NewJWTVerifier(keySet(t, octJWK("hs", secret), rsaJWK), "payments", "payments-api")
+
+	valid := claims(RoleOperator, 0, time.Hour)
+	valid["iss"] = "payments"
+	valid["aud"] = []string{"payments-api"}
+
+	_, err = v.Verify(signHMAC(t, "hs", valid))
+	assert.NoError(t, err)
+
+	expired := claims(RoleOperator, 0, -time.Hour)
+	expired["iss"] = "payments"
+	expired["aud"] = "payments-api"
+
+	wrongAudience := claims(RoleOperator, 0, time.Hour)
+	wrongAudience["iss"] = "payments"
+	wrongAudience["aud"] = "other"
+
+	// the public RSA modulus must not be accepted as an HMAC secret
+	confused := sign(t, "HS256", "rs", valid, func(digest []byte) []byte {
+		mac := hmac.New(crypto.SHA256.New, key.N.Bytes())
+		mac.Write(digest)
+		return mac.Sum(nil)
+	})
+
+	unsigned := b64([]byte(`{"alg":"none","kid":"hs"}`)) + "." + b64(marshal(t, valid)) + "."
+
+	for name, token := range map[string]string{
+		"expired":        signHMAC(t, "hs", expired),
+		"wrong audience": signHMAC(t, "hs", wrongAudience),
+		"unknown kid":    signHMAC(t, "other", valid),
+		"alg confusion":  confused,
+		"alg none":       unsigned,
+		"malformed":      "not-a-token",
+	} {
+		_, err := v.Verify(token)
+		assert.True(t, errors.Cause(err) == InvalidCredentialsError, name)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := NewAuthenticator(NewJWTVerifier(keySet(t, octJWK("hs", secret)), "", ""), []APIKey{
+		{Name: "backoffice", Hash: HashAPIKey("secret-key"), Role: RoleOperator},
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "/accounts", nil)
+	_, err := a.Authenticate(r)
+	assert.Equal(t, MissingCredentialsError, err)
+
+	r.Header.Set("X-API-Key", "secret-key")
+	p, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "backoffice", Role: RoleOperator, Method: MethodAPIKey}, p)
+
+	r.Header.Set("X-API-Key", "other-key")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, InvalidCredentialsError, err)
+
+	r.Header.Del("X-API-Key")
+	r.Header.Set("Authorization", "Bearer "+signHMAC(t, "hs", claims(RoleCustomer, 3, time.Hour)))
+	p, err = a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, p.CustomerID)
+
+	r.Header.Set("Authorization", "Bearer "+signHMAC(t, "hs", claims(RoleCustomer, 0, time.Hour)))
+	_, err = a.Authenticate(r)
+	assert.True(t, errors.Cause(err) == InvalidCredentialsError)
+
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, InvalidCredentialsError, err)
+}
+
+func TestParseJWKSErrors(t *testing.T) {
+	_, err := ParseJWKS([]byte(fmt.Sprintf(`{"keys": [%s]}`, octJWK("hs", "short"))))
+	assert.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "es", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseJWKS([]byte(fmt.Sprintf(`{"keys": [%s, %s]}`, octJWK("hs", secret), octJWK("hs", secret))))
+	assert.Error(t, err)
+}
+
+func claims(role Role, customerId int, validFor time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":         "subject",
+		"role":        role,
+		"customer_id": customerId,
+		"exp":         time.Now().Add(validFor).Unix(),
+	}
+}
+
+func signHMAC(t *testing.T, kid string, c map[string]interface{}) string {
+	return sign(t, "HS256", kid, c, func(input []byte) []byte {
+		mac := hmac.New(crypto.SHA256.New, []byte(secret))
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+}
+
+// sign passes the signing input to HMAC signers and its SHA-256 digest to the others.
+func sign(t *testing.T, alg, kid string, c map[string]interface{}, signer func([]byte) []byte) string {
+	input := b64(marshal(t, map[string]string{"alg": alg, "kid": kid})) + "." + b64(marshal(t, c))
+
+	payload := []byte(input)
+	if alg[:2] != "HS" {
+		h := crypto.SHA256.New()
+		h.Write(payload)
+		payload = h.Sum(nil)
+	}
+
+	return input + "." + b64(signer(payload))
+}
+
+func keySet(t *testing.T, jwks ...string) *KeySet {
+	doc := `{"keys": [`
+	for i, k := range jwks {
+		if i > 0 {
+			doc += ","
+		}
+		doc += k
+	}
+
+	ks, err := ParseJWKS([]byte(doc + "]}"))
+	if err != nil {
+		t.Fatalf("unable to parse jwks: %v", err)
+	}
+
+	return ks
+}
+
+func octJWK(kid, k string) string {
+	return fmt.Sprintf(`{"kty": "oct", "kid": "%s", "k": "%s"}`, kid, b64([]byte(k)))
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("unable to marshal: %v", err)
+	}
+
+	return b
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// minHMACKeySize follows RFC 7518, the HMAC key must be at least as long as the hash output of HS256.
+const minHMACKeySize = 32
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkEntry struct {
+	kty string
+	alg string
+	key interface{}
+}
+
+// KeySet holds the verification keys of a JWKS document. Besides RSA and EC public keys
+// it accepts symmetric "oct" keys for HMAC signed tokens.
+type KeySet struct {
+	keys map[string]jwkEntry
+}
+
+// LoadJWKS reads a JWKS document, for example:
+// {"keys": [{"kty": "oct", "kid": "hs-1", "k": "<base64url secret>"}, {"kty": "RSA", "kid": "rs-1", "n": "...", "e": "AQAB"}]}
+func LoadJWKS(path string) (*KeySet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(b)
+}
+
+func ParseJWKS(b []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	ks := KeySet{keys: make(map[string]jwkEntry, len(doc.Keys))}
+	for _, k := range doc.Keys {
+		if _, ok := ks.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("duplicate jwk kid %q", k.Kid)
+		}
+
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %v", k.Kid, err)
+		}
+
+		ks.keys[k.Kid] = jwkEntry{kty: k.Kty, alg: k.Alg, key: key}
+	}
+
+	return &ks, nil
+}
+
+// key returns the key for a token header. The key type must match the algorithm family,
+// so a public RSA key can never be used as an HMAC secret.
+func (ks *KeySet) key(kid, alg string) (interface{}, error) {
+	e, ok := ks.keys[kid]
+	if !ok && kid == "" && len(ks.keys) == 1 {
+		for _, only := range ks.keys {
+			e, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, errors.Wrapf(InvalidCredentialsError, "unknown key id %q", kid)
+	}
+
+	if e.alg != "" && e.alg != alg {
+		return nil, errors.Wrapf(InvalidCredentialsError, "key %q is not allowed for %s", kid, alg)
+	}
+
+	families := map[string]string{"oct": "HS", "RSA": "RS", "EC": "ES"}
+	if alg[:2] != families[e.kty] {
+		return nil, errors.Wrapf(InvalidCredentialsError, "key %q is not allowed for %s", kid, alg)
+	}
+
+	return e.key, nil
+}
+
+func (k *jwk) parse() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) < minHMACKeySize {
+			return nil, fmt.Errorf("hmac key must be at least %d bytes long", minHMACKeySize)
+		}
+		return secret, nil
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty key parameter")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
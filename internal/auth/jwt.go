@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockSkew is tolerated between the token issuer and this service when checking exp and nbf.
+const clockSkew = 30 * time.Second
+
+var algorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type Claims struct {
+	Subject    string   `json:"sub"`
+	Role       Role     `json:"role"`
+	CustomerID int      `json:"customer_id"`
+	Issuer     string   `json:"iss"`
+	Audience   audience `json:"aud"`
+	ExpiresAt  int64    `json:"exp"`
+	NotBefore  int64    `json:"nbf"`
+}
+
+func (c *Claims) Principal() (*Principal, error) {
+	if !ValidRole(c.Role) {
+		return nil, errors.Wrapf(InvalidCredentialsError, "unknown role %q", c.Role)
+	}
+	if c.Role == RoleCustomer && c.CustomerID <= 0 {
+		return nil, errors.Wrap(InvalidCredentialsError, "customer token without customer id")
+	}
+
+	return &Principal{Subject: c.Subject, Role: c.Role, CustomerID: c.CustomerID, Method: MethodBearer}, nil
+}
+
+// audience accepts both the single string and the array form of the aud claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+
+	return false
+}
+
+// JWTVerifier checks signed tokens against a locally configured key set. Issuer and audience
+// are only checked when they are set.
+type JWTVerifier struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func NewJWTVerifier(keys *KeySet, issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{keys: keys, issuer: issuer, audience: audience, now: time.Now}
+}
+
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(InvalidCredentialsError, "malformed token")
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(InvalidCredentialsError, "malformed token header")
+	}
+
+	hash, ok := algorithms[h.Alg]
+	if !ok {
+		return nil, errors.Wrapf(InvalidCredentialsError, "unsupported algorithm %q", h.Alg)
+	}
+
+	key, err := v.keys.key(h.Kid, h.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(InvalidCredentialsError, "malformed token signature")
+	}
+
+	if !verifySignature(key, hash, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.Wrap(InvalidCredentialsError, "invalid token signature")
+	}
+
+	var c Claims
+	if err = decodeSegment(parts[1], &c); err != nil {
+		return nil, errors.Wrap(InvalidCredentialsError, "malformed token claims")
+	}
+
+	now := v.now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) {
+		return nil, errors.Wrap(InvalidCredentialsError, "token is expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return nil, errors.Wrap(InvalidCredentialsError, "token is not valid yet")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return nil, errors.Wrap(InvalidCredentialsError, "unexpected token issuer")
+	}
+	if v.audience != "" && !c.Audience.contains(v.audience) {
+		return nil, errors.Wrap(InvalidCredentialsError, "unexpected token audience")
+	}
+
+	return &c, nil
+}
+
+func verifySignature(key interface{}, hash crypto.Hash, input, signature []byte) bool {
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		h := hash.New()
+		h.Write(input)
+		return rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+
+		h := hash.New()
+		h.Write(input)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, h.Sum(nil), r, s)
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
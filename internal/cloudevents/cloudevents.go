@@ -0,0 +1,240 @@
+package cloudevents
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/tracecontext"
+)
+
+// Mode is the CloudEvents content mode of the messages published to an exchange.
+type Mode string
+
+const (
+	// None publishes the messages as before, only the trace context is added to the headers.
+	None Mode = "none"
+	// Structured publishes the event with its attributes and data as the JSON body.
+	Structured Mode = "structured"
+	// Binary publishes the data as the body and the attributes as headers prefixed by cloudEvents:.
+	Binary Mode = "binary"
+
+	SpecVersion = "1.0"
+
+	// ContentType is the content type of the messages in structured mode.
+	ContentType = "application/cloudevents+json"
+
+	headerPrefix = "cloudEvents:"
+)
+
+// Event holds the context attributes of a CloudEvent, the data is the body of the publishing.
+type Event struct {
+	ID          string
+	Source      string
+	Type        string
+	Subject     string
+	Time        time.Time
+	DataSchema  string
+	TraceParent string
+	TraceState  string
+}
+
+// structured is the JSON format of an event, https://github.com/cloudevents/spec/blob/v1.0/json-format.md.
+type structured struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	TraceParent     string          `json:"traceparent,omitempty"`
+	TraceState      string          `json:"tracestate,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// ParseModes parses the content mode of the exchanges, exchanges which are not listed use None.
+func ParseModes(modes map[string]string) (map[string]Mode, error) {
+	parsed := make(map[string]Mode, len(modes))
+	for exchange, m := range modes {
+		switch mode := Mode(strings.ToLower(strings.TrimSpace(m))); mode {
+		case None, Structured, Binary:
+			parsed[exchange] = mode
+		default:
+			return nil, fmt.Errorf("invalid cloudevents mode %q of exchange %s, expected none, structured or binary", m, exchange)
+		}
+	}
+
+	return parsed, nil
+}
+
+// Encode turns the publishing into a CloudEvent of the mode, the body of the publishing is the data and
+// its content type is the datacontenttype. The other headers and properties of the publishing are kept.
+func Encode(mode Mode, e Event, p *amqp.Publishing) error {
+	headers := amqp.Table{}
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	p.Headers = headers
+
+	switch mode {
+	case Structured:
+		body, err := json.Marshal(structuredOf(e, p.ContentType, p.Body))
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal cloudevent")
+		}
+
+		p.ContentType = ContentType
+		p.Body = body
+	case Binary:
+		headers[headerPrefix+"specversion"] = SpecVersion
+		headers[headerPrefix+"id"] = e.ID
+		headers[headerPrefix+"source"] = e.Source
+		headers[headerPrefix+"type"] = e.Type
+		for name, v := range map[string]string{
+			"subject":     e.Subject,
+			"dataschema":  e.DataSchema,
+			"traceparent": e.TraceParent,
+			"tracestate":  e.TraceState,
+		} {
+			if v != "" {
+				headers[headerPrefix+name] = v
+			}
+		}
+		if !e.Time.IsZero() {
+			headers[headerPrefix+"time"] = e.Time.UTC().Format(time.RFC3339Nano)
+		}
+	default:
+		setTraceHeaders(headers, e)
+	}
+
+	return nil
+}
+
+// Decode returns the attributes and the data of a message in any mode. Messages which are not CloudEvents
+// get the message id, timestamp and trace context headers as attributes and their body as data.
+func Decode(d amqp.Delivery) (Event, []byte, error) {
+	if strings.HasPrefix(d.ContentType, ContentType) {
+		return decodeStructured(d.Body)
+	}
+
+	if _, ok := d.Headers[headerPrefix+"specversion"]; ok {
+		return decodeBinary(d)
+	}
+
+	return Event{
+		ID:          d.MessageId,
+		Type:        d.Type,
+		Time:        d.Timestamp,
+		TraceParent: header(d.Headers, tracecontext.TraceParentHeader),
+		TraceState:  header(d.Headers, tracecontext.TraceStateHeader),
+	}, d.Body, nil
+}
+
+func structuredOf(e Event, contentType string, data []byte) structured {
+	s := structured{
+		SpecVersion:     SpecVersion,
+		ID:              e.ID,
+		Source:          e.Source,
+		Type:            e.Type,
+		Subject:         e.Subject,
+		DataContentType: contentType,
+		DataSchema:      e.DataSchema,
+		TraceParent:     e.TraceParent,
+		TraceState:      e.TraceState,
+	}
+	if !e.Time.IsZero() {
+		t := e.Time.UTC()
+		s.Time = &t
+	}
+
+	if json.Valid(data) && (contentType == "" || strings.HasSuffix(contentType, "json")) {
+		s.Data = data
+	} else {
+		s.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return s
+}
+
+func decodeStructured(body []byte) (Event, []byte, error) {
+	var s structured
+	if err := json.Unmarshal(body, &s); err != nil {
+		return Event{}, nil, errors.Wrap(err, "invalid structured cloudevent")
+	}
+	if s.SpecVersion != SpecVersion {
+		return Event{}, nil, fmt.Errorf("unsupported cloudevents specversion %q", s.SpecVersion)
+	}
+
+	e := Event{
+		ID:          s.ID,
+		Source:      s.Source,
+		Type:        s.Type,
+		Subject:     s.Subject,
+		DataSchema:  s.DataSchema,
+		TraceParent: s.TraceParent,
+		TraceState:  s.TraceState,
+	}
+	if s.Time != nil {
+		e.Time = *s.Time
+	}
+
+	if s.DataBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(s.DataBase64)
+		if err != nil {
+			return Event{}, nil, errors.Wrap(err, "invalid cloudevent data_base64")
+		}
+		return e, data, nil
+	}
+
+	return e, s.Data, nil
+}
+
+func decodeBinary(d amqp.Delivery) (Event, []byte, error) {
+	if v := header(d.Headers, headerPrefix+"specversion"); v != SpecVersion {
+		return Event{}, nil, fmt.Errorf("unsupported cloudevents specversion %q", v)
+	}
+
+	e := Event{
+		ID:          header(d.Headers, headerPrefix+"id"),
+		Source:      header(d.Headers, headerPrefix+"source"),
+		Type:        header(d.Headers, headerPrefix+"type"),
+		Subject:     header(d.Headers, headerPrefix+"subject"),
+		DataSchema:  header(d.Headers, headerPrefix+"dataschema"),
+		TraceParent: header(d.Headers, headerPrefix+"traceparent"),
+		TraceState:  header(d.Headers, headerPrefix+"tracestate"),
+	}
+	if v := header(d.Headers, headerPrefix+"time"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return Event{}, nil, errors.Wrap(err, "invalid cloudevent time")
+		}
+		e.Time = t
+	}
+
+	return e, d.Body, nil
+}
+
+func setTraceHeaders(headers amqp.Table, e Event) {
+	if e.TraceParent != "" {
+		headers[tracecontext.TraceParentHeader] = e.TraceParent
+	}
+	if e.TraceState != "" {
+		headers[tracecontext.TraceStateHeader] = e.TraceState
+	}
+}
+
+func header(headers amqp.Table, name string) string {
+	v, ok := headers[name]
+	if !ok || v == nil {
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
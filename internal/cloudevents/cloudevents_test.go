@@ -0,0 +1,108 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+var event = Event{
+	ID:          "4b3f0c0e-3c8c-4c2c-9a55-8a4f1b0d7a11",
+	Source:      "payments-api",
+	Type:        "payments.funds.deposited",
+	Subject:     "accounts/42",
+	Time:        time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	DataSchema:  "urn:payments-api:schema:funds-event:1",
+	TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+}
+
+func TestParseModes(t *testing.T) {
+	modes, err := ParseModes(map[string]string{"payments": "Binary", "balance-notifications": "structured"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Mode{"payments": Binary, "balance-notifications": Structured}, modes)
+
+	_, err = ParseModes(map[string]string{"payments": "batched"})
+	assert.EqualError(t, err, `invalid cloudevents mode "batched" of exchange payments, expected none, structured or binary`)
+}
+
+func TestEncodeStructured(t *testing.T) {
+	p := publishing()
+	assert.NoError(t, Encode(Structured, event, &p))
+
+	assert.Equal(t, ContentType, p.ContentType)
+	assert.Equal(t, "1", p.Headers["x-schema-version"])
+
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(p.Body, &body))
+	assert.Equal(t, "1.0", body["specversion"])
+	assert.Equal(t, event.ID, body["id"])
+	assert.Equal(t, "accounts/42", body["subject"])
+	assert.Equal(t, "2021-03-04T05:06:07Z", body["time"])
+	assert.Equal(t, "application/json", body["datacontenttype"])
+	assert.Equal(t, event.TraceParent, body["traceparent"])
+	assert.Equal(t, map[string]interface{}{"id": float64(42)}, body["data"])
+
+	e, data, err := Decode(delivery(p))
+	assert.NoError(t, err)
+	assert.Equal(t, event, e)
+	assert.JSONEq(t, `{"id":42}`, string(data))
+}
+
+func TestEncodeBinary(t *testing.T) {
+	p := publishing()
+	assert.NoError(t, Encode(Binary, event, &p))
+
+	assert.Equal(t, "application/json", p.ContentType)
+	assert.Equal(t, `{"id":42}`, string(p.Body))
+	assert.Equal(t, "1.0", p.Headers["cloudEvents:specversion"])
+	assert.Equal(t, "payments.funds.deposited", p.Headers["cloudEvents:type"])
+	assert.Equal(t, "2021-03-04T05:06:07Z", p.Headers["cloudEvents:time"])
+	assert.Equal(t, event.TraceParent, p.Headers["cloudEvents:traceparent"])
+	assert.NotContains(t, p.Headers, "cloudEvents:tracestate")
+
+	e, data, err := Decode(delivery(p))
+	assert.NoError(t, err)
+	assert.Equal(t, event, e)
+	assert.Equal(t, `{"id":42}`, string(data))
+}
+
+func TestEncodeNone(t *testing.T) {
+	p := publishing()
+	assert.NoError(t, Encode(None, event, &p))
+
+	assert.Equal(t, `{"id":42}`, string(p.Body))
+	assert.Equal(t, event.TraceParent, p.Headers["traceparent"])
+	assert.NotContains(t, p.Headers, "cloudEvents:specversion")
+
+	e, data, err := Decode(delivery(p))
+	assert.NoError(t, err)
+	assert.Equal(t, event.TraceParent, e.TraceParent)
+	assert.Equal(t, `{"id":42}`, string(data))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, _, err := Decode(amqp.Delivery{ContentType: ContentType, Body: []byte(`{"specversion":"0.3","id":"1"}`)})
+	assert.EqualError(t, err, `unsupported cloudevents specversion "0.3"`)
+
+	_, _, err = Decode(amqp.Delivery{ContentType: ContentType, Body: []byte(`invalid`)})
+	assert.Error(t, err)
+
+	_, _, err = Decode(amqp.Delivery{Headers: amqp.Table{"cloudEvents:specversion": "1.0", "cloudEvents:time": "yesterday"}})
+	assert.Error(t, err)
+}
+
+func publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Headers:     amqp.Table{"x-schema-version": "1"},
+		ContentType: "application/json",
+		MessageId:   event.ID,
+		Body:        []byte(`{"id":42}`),
+	}
+}
+
+func delivery(p amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{Headers: p.Headers, ContentType: p.ContentType, MessageId: p.MessageId, Body: p.Body}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
@@ -20,6 +21,22 @@ type Config struct {
 	Port int
 }
 
+// Health checks the database for the health endpoint.
+type Health struct {
+	DB *sqlx.DB
+}
+
+// Check runs a harmless query against the database, a ping by itself is unreliable since the connections are
+// cached.
+func (h Health) Check(ctx context.Context) error {
+	if err := h.DB.PingContext(ctx); err != nil {
+		return err
+	}
+
+	_, err := h.DB.ExecContext(ctx, "SELECT true")
+	return err
+}
+
 func NewConnection(cfg Config) (*sqlx.DB, error) {
 	var db *sqlx.DB
 	var err error
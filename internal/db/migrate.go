@@ -0,0 +1,377 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock held while migrating, so replicas starting at the same time
+// apply every migration only once.
+const migrationLock = 7279013
+
+const (
+	createMigrationsTable = "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, " +
+		"name VARCHAR(255) NOT NULL, checksum VARCHAR(64) NOT NULL, " +
+		"applied_at TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc'));"
+	selectMigrations = "SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version;"
+	insertMigration  = "INSERT INTO schema_migrations(version, name, checksum) VALUES($1,$2,$3);"
+	deleteMigration  = "DELETE FROM schema_migrations WHERE version=$1;"
+	selectSchema     = "SELECT to_regclass('public.customers') IS NOT NULL;"
+	selectVersioned  = "SELECT to_regclass('public.schema_migrations') IS NOT NULL;"
+	selectColumns    = "SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = 'public';"
+	lockMigrations   = "SELECT pg_advisory_lock($1);"
+	unlockMigrations = "SELECT pg_advisory_unlock($1);"
+)
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// initColumns are the tables and columns created by 0001_init, the schema of databases created before the
+// migrations. Columns added later belong to their own migrations and must not be listed here.
+var initColumns = map[string][]string{
+	"customers":    {"id", "first_name", "last_name", "email", "created_at", "modified_at"},
+	"accounts":     {"id", "customer_id", "currency", "balance_in_decimal", "frozen", "created_at", "modified_at"},
+	"transactions": {"id", "from_id", "to_id", "transaction_type", "ack", "created_at"},
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	// Down is empty if the migration can't be reverted
+	Down     string
+	Checksum string
+}
+
+// AppliedMigration is a row of the version table.
+type AppliedMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is nil for pending migrations
+	AppliedAt *time.Time
+}
+
+// Migrator applies the migrations in version order, each one in its own transaction.
+type Migrator struct {
+	DB         *sqlx.DB
+	Migrations []Migration
+	// Baseline are the tables and columns of the first migration, an existing schema without a version table is
+	// only recorded as the first migration if it has all of them. Without a baseline the first migration is
+	// always applied.
+	Baseline map[string][]string
+}
+
+// NewMigrator creates a migrator with the migrations embedded in the binary.
+func NewMigrator(db *sqlx.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations, Baseline: initColumns}, nil
+}
+
+// LoadMigrations reads the migrations of the directory, they are named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. The checksum covers the up script.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		parts := migrationName.FindStringSubmatch(e.Name())
+		if e.IsDir() || parts == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(parts[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, parts[2])
+		}
+
+		script, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(script)
+			sum := sha256.Sum256(script)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Up applies the pending migrations and returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	var count int
+	err := m.locked(ctx, func(conn *sqlx.Conn, applied map[int]AppliedMigration) error {
+		for _, migration := range m.Migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, insertMigration, migration.Version, migration.Name, migration.Checksum)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "migration %d_%s failed", migration.Version, migration.Name)
+			}
+
+			log.Infof("applied migration %d_%s", migration.Version, migration.Name)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Down reverts the given number of the last applied migrations and returns how many were reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	var count int
+	err := m.locked(ctx, func(conn *sqlx.Conn, applied map[int]AppliedMigration) error {
+		for i := len(m.Migrations) - 1; i >= 0 && count < steps; i-- {
+			migration := m.Migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted", migration.Version, migration.Name)
+			}
+
+			err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, deleteMigration, migration.Version)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "reverting migration %d_%s failed", migration.Version, migration.Name)
+			}
+
+			log.Infof("reverted migration %d_%s", migration.Version, migration.Name)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Status lists every migration with the time it was applied. It doesn't write to the database, without a version
+// table every migration is pending, the existing schema is only recorded by Up.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var versioned bool
+	if err := m.DB.GetContext(ctx, &versioned, selectVersioned); err != nil {
+		return nil, err
+	}
+
+	rows := make([]AppliedMigration, 0)
+	if versioned {
+		if err := m.DB.SelectContext(ctx, &rows, selectMigrations); err != nil {
+			return nil, err
+		}
+	}
+
+	applied, err := m.verify(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		s := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			appliedAt := a.AppliedAt
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// locked runs f holding the migration lock on a single connection, with the applied migrations verified
+// against their checksums.
+func (m *Migrator) locked(ctx context.Context, f func(conn *sqlx.Conn, applied map[int]AppliedMigration) error) error {
+	conn, err := m.DB.Connx(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.WithError(err).Info("close migration connection")
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, lockMigrations, migrationLock); err != nil {
+		return err
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), unlockMigrations, migrationLock); err != nil {
+			log.Errorf("failed to release the migration lock, error: %v", err)
+		}
+	}()
+
+	if _, err = conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return f(conn, applied)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sqlx.Conn) (map[int]AppliedMigration, error) {
+	rows := make([]AppliedMigration, 0)
+	if err := conn.SelectContext(ctx, &rows, selectMigrations); err != nil {
+		return nil, err
+	}
+
+	// databases created before the migrations already have the schema of the first one
+	if len(rows) == 0 && len(m.Migrations) > 0 && m.Migrations[0].Version == 1 && len(m.Baseline) > 0 {
+		var exists bool
+		if err := conn.GetContext(ctx, &exists, selectSchema); err != nil {
+			return nil, err
+		}
+
+		if exists {
+			first := m.Migrations[0]
+			if err := m.checkBaseline(ctx, conn, first); err != nil {
+				return nil, err
+			}
+			if _, err := conn.ExecContext(ctx, insertMigration, first.Version, first.Name, first.Checksum); err != nil {
+				return nil, err
+			}
+			log.Infof("recorded the existing schema as migration %d_%s", first.Version, first.Name)
+			return m.applied(ctx, conn)
+		}
+	}
+
+	return m.verify(rows)
+}
+
+// verify fails if an applied migration was changed since, the applied migrations are returned by version.
+func (m *Migrator) verify(rows []AppliedMigration) (map[int]AppliedMigration, error) {
+	known := make(map[int]Migration, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		known[migration.Version] = migration
+	}
+
+	applied := make(map[int]AppliedMigration, len(rows))
+	for _, a := range rows {
+		migration, ok := known[a.Version]
+		if !ok {
+			log.Warnf("migration %d_%s is applied, but unknown to this version", a.Version, a.Name)
+		} else if migration.Checksum != a.Checksum {
+			return nil, fmt.Errorf("migration %d_%s was changed after it was applied", a.Version, a.Name)
+		}
+		applied[a.Version] = a
+	}
+
+	return applied, nil
+}
+
+// checkBaseline fails if the existing schema lacks a table or column of the baseline, it wasn't created by the
+// first migration then and recording it as applied would leave it incomplete.
+func (m *Migrator) checkBaseline(ctx context.Context, conn *sqlx.Conn, first Migration) error {
+	columns := make([]struct {
+		Table  string `db:"table_name"`
+		Column string `db:"column_name"`
+	}, 0)
+	if err := conn.SelectContext(ctx, &columns, selectColumns); err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		existing[c.Table+"."+c.Column] = true
+	}
+
+	missing := make([]string, 0)
+	for table, names := range m.Baseline {
+		for _, name := range names {
+			if !existing[table+"."+name] {
+				missing = append(missing, table+"."+name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("the existing schema can't be recorded as migration %d_%s, it has no %s", first.Version,
+			first.Name, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func inTx(ctx context.Context, conn *sqlx.Conn, f func(tx *sqlx.Tx) error) error {
+	tx, err := conn.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelDefault})
+	if err != nil {
+		return err
+	}
+
+	if err = f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
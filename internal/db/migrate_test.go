@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMigrations = fstest.MapFS{
+	"migrations/0002_frozen_index.up.sql":   {Data: []byte("CREATE INDEX accounts_frozen_idx ON accounts (frozen);")},
+	"migrations/0002_frozen_index.down.sql": {Data: []byte("DROP INDEX accounts_frozen_idx;")},
+	"migrations/0001_init.up.sql":           {Data: []byte("CREATE TABLE customers (id SERIAL PRIMARY KEY);")},
+	"migrations/README.md":                  {Data: []byte("not a migration")},
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(testMigrations, "migrations")
+	if assert.NoError(t, err) && assert.Len(t, migrations, 2) {
+		assert.Equal(t, 1, migrations[0].Version)
+		assert.Equal(t, "init", migrations[0].Name)
+		assert.Empty(t, migrations[0].Down)
+		assert.Len(t, migrations[0].Checksum, 64)
+		assert.Equal(t, "frozen_index", migrations[1].Name)
+		assert.Equal(t, "DROP INDEX accounts_frozen_idx;", migrations[1].Down)
+	}
+
+	_, err = LoadMigrations(fstest.MapFS{"migrations/0001_init.down.sql": {}}, "migrations")
+	assert.EqualError(t, err, "migration 1 has no up script")
+
+	// the embedded migrations are valid
+	_, err = NewMigrator(nil)
+	assert.NoError(t, err)
+}
+
+func TestMigrateUp(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", m.Migrations[0].Checksum, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE INDEX accounts_frozen_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(insertMigration)).WithArgs(2, "frozen_index", m.Migrations[1].Checksum).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	count, err := m.Up(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpRecordsExistingSchema(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta(selectSchema)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(selectColumns)).WillReturnRows(sqlmock.NewRows([]string{"table_name", "column_name"}).
+		AddRow("customers", "id").AddRow("customers", "first_name"))
+	mock.ExpectExec(regexp.QuoteMeta(insertMigration)).WithArgs(1, "init", m.Migrations[0].Checksum).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(selectMigrations)).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", m.Migrations[0].Checksum, time.Now()).AddRow(2, "frozen_index", m.Migrations[1].Checksum, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	count, err := m.Up(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpRefusesIncompleteSchema(t *testing.T) {
+	m, mock := newMigrator(t)
+	m.Baseline["customers"] = []string{"id", "first_name"}
+
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}))
+	mock.ExpectQuery(regexp.QuoteMeta(selectSchema)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(selectColumns)).WillReturnRows(sqlmock.NewRows([]string{"table_name", "column_name"}).
+		AddRow("customers", "id"))
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	count, err := m.Up(context.Background())
+
+	assert.EqualError(t, err, "the existing schema can't be recorded as migration 1_init, it has no customers.first_name")
+	assert.Equal(t, 0, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateChecksumMismatch(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", "changed", time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := m.Up(context.Background())
+
+	assert.EqualError(t, err, "migration 1_init was changed after it was applied")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateDown(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", m.Migrations[0].Checksum, time.Now()).AddRow(2, "frozen_index", m.Migrations[1].Checksum, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP INDEX accounts_frozen_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(deleteMigration)).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(unlockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// the first migration has no down script
+	count, err := m.Down(context.Background(), 2)
+
+	assert.EqualError(t, err, "migration 1_init can't be reverted")
+	assert.Equal(t, 1, count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateStatus(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	appliedAt := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(selectVersioned)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta(selectMigrations)).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", m.Migrations[0].Checksum, appliedAt))
+
+	status, err := m.Status(context.Background())
+
+	if assert.NoError(t, err) && assert.Len(t, status, 2) {
+		assert.Equal(t, appliedAt, *status[0].AppliedAt)
+		assert.Equal(t, "frozen_index", status[1].Name)
+		assert.Nil(t, status[1].AppliedAt)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateStatusWithoutVersionTable(t *testing.T) {
+	m, mock := newMigrator(t)
+
+	// neither the version table is created nor the existing schema recorded
+	mock.ExpectQuery(regexp.QuoteMeta(selectVersioned)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	status, err := m.Status(context.Background())
+
+	if assert.NoError(t, err) && assert.Len(t, status, 2) {
+		assert.Nil(t, status[0].AppliedAt)
+		assert.Nil(t, status[1].AppliedAt)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func newMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	migrations, err := LoadMigrations(testMigrations, "migrations")
+	if err != nil {
+		t.Fatalf("unable to load test migrations: %v", err)
+	}
+
+	baseline := map[string][]string{"customers": {"id"}}
+
+	return &Migrator{DB: sqlx.NewDb(db, "sqlmock"), Migrations: migrations, Baseline: baseline}, mock
+}
+
+func expectLocked(mock sqlmock.Sqlmock, applied *sqlmock.Rows) {
+	mock.ExpectExec(regexp.QuoteMeta(lockMigrations)).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(createMigrationsTable)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(selectMigrations)).WillReturnRows(applied)
+}
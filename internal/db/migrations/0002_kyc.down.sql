@@ -0,0 +1,9 @@
+ALTER TABLE accounts DROP COLUMN product;
+
+DROP TABLE IF EXISTS kyc_documents;
+
+ALTER TABLE customers DROP COLUMN kyc_rejection_reason;
+ALTER TABLE customers DROP COLUMN kyc_expires_at;
+ALTER TABLE customers DROP COLUMN kyc_status;
+
+DROP TYPE IF EXISTS kycstatus;
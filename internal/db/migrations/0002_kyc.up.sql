@@ -0,0 +1,20 @@
+CREATE TYPE kycstatus AS ENUM ('unverified', 'pending', 'verified', 'rejected');
+
+ALTER TABLE customers ADD COLUMN kyc_status kycstatus NOT NULL DEFAULT 'unverified';
+ALTER TABLE customers ADD COLUMN kyc_expires_at TIMESTAMP WITHOUT TIME ZONE;
+ALTER TABLE customers ADD COLUMN kyc_rejection_reason VARCHAR(255);
+
+CREATE TABLE kyc_documents
+(
+    id            SERIAL PRIMARY KEY,
+    customer_id   INTEGER      NOT NULL,
+    CONSTRAINT fk_customer
+        FOREIGN KEY (customer_id)
+            REFERENCES customers (id),
+    document_type VARCHAR(25)  NOT NULL,
+    reference     VARCHAR(255) NOT NULL,
+    expires_at    TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    created_at    TIMESTAMP WITHOUT TIME ZONE DEFAULT (now() at time zone 'utc')
+);
+
+ALTER TABLE accounts ADD COLUMN product VARCHAR(10) NOT NULL DEFAULT 'basic';
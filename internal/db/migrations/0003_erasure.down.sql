@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS customer_erasures;
+
+ALTER TABLE customers DROP COLUMN erased_at;
@@ -0,0 +1,12 @@
+ALTER TABLE customers ADD COLUMN erased_at TIMESTAMP WITHOUT TIME ZONE;
+
+CREATE TABLE customer_erasures
+(
+    id          SERIAL PRIMARY KEY,
+    customer_id INTEGER NOT NULL,
+    CONSTRAINT fk_customer
+        FOREIGN KEY (customer_id)
+            REFERENCES customers (id),
+    reason      VARCHAR(255),
+    created_at  TIMESTAMP WITHOUT TIME ZONE DEFAULT (now() at time zone 'utc')
+);
@@ -0,0 +1,9 @@
+-- there is no down script, the encrypted names and emails don't fit the columns of 0001_init
+
+ALTER TABLE customers ALTER COLUMN first_name TYPE TEXT;
+ALTER TABLE customers ALTER COLUMN last_name TYPE TEXT;
+ALTER TABLE customers ALTER COLUMN email TYPE TEXT;
+ALTER TABLE customers DROP CONSTRAINT IF EXISTS customers_email_key;
+
+ALTER TABLE customers ADD COLUMN email_index VARCHAR(64) UNIQUE;
+ALTER TABLE customers ADD COLUMN pii_key_id VARCHAR(36);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS accounts_balance_idx;
+DROP INDEX IF EXISTS accounts_created_at_idx;
+DROP INDEX IF EXISTS accounts_customer_id_idx;
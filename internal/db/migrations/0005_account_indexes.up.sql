@@ -0,0 +1,3 @@
+CREATE INDEX accounts_customer_id_idx ON accounts (customer_id);
+CREATE INDEX accounts_created_at_idx ON accounts (created_at, id);
+CREATE INDEX accounts_balance_idx ON accounts (balance_in_decimal, id);
@@ -0,0 +1,33 @@
+CREATE TYPE deliverystatus AS ENUM ('pending', 'succeeded', 'failed');
+
+CREATE TABLE webhooks
+(
+    id          SERIAL PRIMARY KEY,
+    url         TEXT    NOT NULL,
+    secret      TEXT    NOT NULL,
+    event_types TEXT[]  NOT NULL,
+    account_ids INTEGER[],
+    created_at  TIMESTAMP WITHOUT TIME ZONE DEFAULT (now() at time zone 'utc')
+);
+
+CREATE TABLE webhook_deliveries
+(
+    id               SERIAL PRIMARY KEY,
+    webhook_id       INTEGER        NOT NULL,
+    CONSTRAINT fk_webhook
+        FOREIGN KEY (webhook_id)
+            REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id         VARCHAR(36)    NOT NULL,
+    event_type       VARCHAR(50)    NOT NULL,
+    payload          JSONB          NOT NULL,
+    status           deliverystatus NOT NULL     DEFAULT 'pending',
+    attempts         INTEGER        NOT NULL     DEFAULT 0,
+    next_attempt_at  TIMESTAMP WITHOUT TIME ZONE,
+    last_status_code INTEGER,
+    last_error       TEXT,
+    created_at       TIMESTAMP WITHOUT TIME ZONE DEFAULT (now() at time zone 'utc'),
+    delivered_at     TIMESTAMP WITHOUT TIME ZONE
+);
+
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS accounts_metadata_idx;
+
+ALTER TABLE customers DROP COLUMN metadata;
+ALTER TABLE accounts DROP COLUMN metadata;
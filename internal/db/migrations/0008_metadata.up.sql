@@ -0,0 +1,4 @@
+ALTER TABLE accounts ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE customers ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX accounts_metadata_idx ON accounts USING GIN (metadata jsonb_path_ops);
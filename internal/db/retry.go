@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PSQLErrSerializationFailure = "40001"
+	PSQLErrDeadlockDetected     = "40P01"
+)
+
+// maxTxAttempts is how many times a transaction is run before its serialization failure is returned
+const maxTxAttempts = 5
+
+// Retryable reports whether the transaction failed only because of a concurrent transaction, so running it
+// again can succeed.
+func Retryable(err error) bool {
+	pgErr, ok := errors.Cause(err).(*pq.Error)
+	if !ok {
+		return false
+	}
+
+	return pgErr.Code == PSQLErrSerializationFailure || pgErr.Code == PSQLErrDeadlockDetected
+}
+
+// Retry runs the transaction again after serialization failures and deadlocks with a growing delay until ctx
+// is done, any other error is returned right away.
+func Retry(ctx context.Context, name string, tx func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		if err = tx(); err == nil || !Retryable(err) {
+			return err
+		}
+
+		log.Warnf("%s failed due to a concurrent transaction, attempt %d: %v", name, attempt, err)
+
+		select {
+		case <-time.After(time.Duration(attempt*attempt) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, Retryable(&pq.Error{Code: PSQLErrSerializationFailure}))
+	assert.True(t, Retryable(errors.Wrap(&pq.Error{Code: PSQLErrDeadlockDetected}, "transfer")))
+	assert.False(t, Retryable(&pq.Error{Code: pq.ErrorCode(PSQLErrUniqueConstraint)}))
+	assert.False(t, Retryable(sql.ErrNoRows))
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := Retry(context.Background(), "deposit", func() error {
+		attempts++
+		if attempts < 3 {
+			return &pq.Error{Code: PSQLErrSerializationFailure}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = Retry(context.Background(), "deposit", func() error {
+		attempts++
+		return sql.ErrConnDone
+	})
+	assert.Equal(t, sql.ErrConnDone, err)
+	assert.Equal(t, 1, attempts)
+
+	attempts = 0
+	err = Retry(context.Background(), "deposit", func() error {
+		attempts++
+		return &pq.Error{Code: PSQLErrDeadlockDetected}
+	})
+	assert.True(t, Retryable(err))
+	assert.Equal(t, maxTxAttempts, attempts)
+}
+
+func TestRetryUntilDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := Retry(ctx, "deposit", func() error {
+		attempts++
+		return &pq.Error{Code: PSQLErrSerializationFailure}
+	})
+	assert.True(t, Retryable(err))
+	assert.Equal(t, 1, attempts)
+}
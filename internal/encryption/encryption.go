@@ -0,0 +1,169 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	envelopeVersion = "v1"
+	keySize         = 32
+)
+
+var InvalidCiphertextError = errors.New("invalid ciphertext")
+
+type UnknownKeyError struct {
+	KeyID string
+}
+
+func (ke *UnknownKeyError) Error() string {
+	return fmt.Sprintf("unknown encryption key id %s", ke.KeyID)
+}
+
+// KeyProvider supplies the key encryption keys and the key of the blind index.
+type KeyProvider interface {
+	CurrentKeyID() string
+	Key(id string) ([]byte, error)
+	IndexKey() []byte
+}
+
+// Cipher implements envelope encryption: every value is encrypted with a fresh data key,
+// and the data key is wrapped with the current key of the provider.
+type Cipher struct {
+	keys KeyProvider
+}
+
+func NewCipher(keys KeyProvider) *Cipher {
+	return &Cipher{keys: keys}
+}
+
+func (c *Cipher) KeyID() string {
+	return c.keys.CurrentKeyID()
+}
+
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	keyId := c.keys.CurrentKeyID()
+
+	kek, err := c.keys.Key(keyId)
+	if err != nil {
+		return "", err
+	}
+
+	dek := make([]byte, keySize)
+	if _, err = io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(kek, dek, []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dek, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		envelopeVersion,
+		keyId,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+func (c *Cipher) Decrypt(envelope string) (string, error) {
+	parts := strings.Split(envelope, ":")
+	if len(parts) != 4 || parts[0] != envelopeVersion {
+		return "", InvalidCiphertextError
+	}
+
+	kek, err := c.keys.Key(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", InvalidCiphertextError
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", InvalidCiphertextError
+	}
+
+	dek, err := open(kek, wrapped, []byte(parts[1]))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dek, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// BlindIndex returns a deterministic keyed hash of the value, so encrypted columns can still be
+// looked up and constrained to be unique.
+func (c *Cipher) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, c.keys.IndexKey())
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, InvalidCiphertextError
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, InvalidCiphertextError
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,130 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	c := NewCipher(newProvider(t, "k1", "k1"))
+
+	envelope, err := c.Encrypt("first@last.com")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(envelope, "v1:k1:"))
+	assert.NotContains(t, envelope, "first@last.com")
+
+	other, err := c.Encrypt("first@last.com")
+	assert.NoError(t, err)
+	assert.NotEqual(t, envelope, other)
+
+	plaintext, err := c.Decrypt(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "first@last.com", plaintext)
+}
+
+func TestDecryptWithRotatedKey(t *testing.T) {
+	old := newProvider(t, "k1", "k1")
+	envelope, err := NewCipher(old).Encrypt("first")
+	assert.NoError(t, err)
+
+	rotated, err := NewLocalKeyProvider("k2", map[string][]byte{"k1": old.keys["k1"], "k2": key(t)}, old.index)
+	assert.NoError(t, err)
+
+	c := NewCipher(rotated)
+	assert.Equal(t, "k2", c.KeyID())
+
+	plaintext, err := c.Decrypt(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", plaintext)
+
+	reencrypted, err := c.Encrypt(plaintext)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(reencrypted, "v1:k2:"))
+}
+
+func TestDecryptErrors(t *testing.T) {
+	c := NewCipher(newProvider(t, "k1", "k1"))
+
+	envelope, err := c.Encrypt("first")
+	assert.NoError(t, err)
+
+	_, err = c.Decrypt("first")
+	assert.Equal(t, InvalidCiphertextError, err)
+
+	parts := strings.Split(envelope, ":")
+	_, err = c.Decrypt(strings.Join([]string{parts[0], "k9", parts[2], parts[3]}, ":"))
+	assert.Equal(t, "unknown encryption key id k9", err.Error())
+
+	tampered := []byte(parts[3])
+	tampered[len(tampered)-1] ^= 'A' ^ 'B'
+	_, err = c.Decrypt(strings.Join([]string{parts[0], parts[1], parts[2], string(tampered)}, ":"))
+	assert.Equal(t, InvalidCiphertextError, err)
+}
+
+func TestBlindIndex(t *testing.T) {
+	c := NewCipher(newProvider(t, "k1", "k1"))
+
+	assert.Equal(t, c.BlindIndex("first@last.com"), c.BlindIndex(" First@Last.com "))
+	assert.NotEqual(t, c.BlindIndex("first@last.com"), c.BlindIndex("second@last.com"))
+	assert.Len(t, c.BlindIndex("first@last.com"), 64)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := fmt.Sprintf(`{"current": "k2", "keys": {"k1": "%s", "k2": "%s"}, "index": "%s"}`,
+		base64.StdEncoding.EncodeToString(key(t)), base64.StdEncoding.EncodeToString(key(t)), base64.StdEncoding.EncodeToString(key(t)))
+
+	path := filepath.Join(dir, "keys.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	p, err := LoadKeyFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", p.CurrentKeyID())
+
+	_, err = p.Key("k1")
+	assert.NoError(t, err)
+}
+
+func TestNewLocalKeyProviderErrors(t *testing.T) {
+	_, err := NewLocalKeyProvider("k2", map[string][]byte{"k1": key(t)}, key(t))
+	assert.Error(t, err)
+
+	_, err = NewLocalKeyProvider("k1", map[string][]byte{"k1": []byte("short")}, key(t))
+	assert.Error(t, err)
+
+	_, err = NewLocalKeyProvider("k:1", map[string][]byte{"k:1": key(t)}, key(t))
+	assert.Error(t, err)
+}
+
+func newProvider(t *testing.T, current string, ids ...string) *LocalKeyProvider {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		keys[id] = key(t)
+	}
+
+	p, err := NewLocalKeyProvider(current, keys, key(t))
+	if err != nil {
+		t.Fatalf("unable to create key provider: %v", err)
+	}
+
+	return p
+}
+
+func key(t *testing.T) []byte {
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	return k
+}
@@ -0,0 +1,99 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+	Index   string            `json:"index"`
+}
+
+// LocalKeyProvider keeps the keys in memory, it is meant for development and testing.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string][]byte
+	index   []byte
+}
+
+func NewLocalKeyProvider(current string, keys map[string][]byte, index []byte) (*LocalKeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, &UnknownKeyError{KeyID: current}
+	}
+
+	for id, k := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key id %q", id)
+		}
+		if len(k) != keySize {
+			return nil, fmt.Errorf("encryption key %s must be %d bytes long", id, keySize)
+		}
+	}
+
+	if len(index) != keySize {
+		return nil, fmt.Errorf("index key must be %d bytes long", keySize)
+	}
+
+	return &LocalKeyProvider{current: current, keys: keys, index: index}, nil
+}
+
+// LoadKeyFile reads a JSON keyfile with base64 encoded keys, for example:
+// {"current": "k2", "keys": {"k1": "...", "k2": "..."}, "index": "..."}
+func LoadKeyFile(path string) (*LocalKeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kf keyFile
+	if err = json.Unmarshal(b, &kf); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, encoded := range kf.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("unable to decode encryption key %s: %v", id, err)
+		}
+	}
+
+	index, err := base64.StdEncoding.DecodeString(kf.Index)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode index key: %v", err)
+	}
+
+	return NewLocalKeyProvider(kf.Current, keys, index)
+}
+
+func GenerateKey() ([]byte, error) {
+	k := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, k); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (p *LocalKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *LocalKeyProvider) Key(id string) ([]byte, error) {
+	k, ok := p.keys[id]
+	if !ok {
+		return nil, &UnknownKeyError{KeyID: id}
+	}
+
+	return k, nil
+}
+
+func (p *LocalKeyProvider) IndexKey() []byte {
+	return p.index
+}
@@ -13,6 +13,9 @@ type Cfg struct {
 	DBHost string `envconfig:"DB_HOST"`
 	DBPort int    `envconfig:"DB_PORT" default:"5432"`
 
+	// the pending migrations are applied at startup unless it is false, they can be run with the migrate subcommand
+	DBMigrate bool `envconfig:"DB_MIGRATE" default:"true"`
+
 	MQUser         string `envconfig:"MQ_USER"`
 	MQPass         string `envconfig:"MQ_PASSWORD"`
 	MQHost         string `envconfig:"MQ_HOST"`
@@ -20,13 +23,49 @@ type Cfg struct {
 	MQConcurrency  int    `envconfig:"MQ_CONCURRENCY" default:"5"`
 	MQMaxReconnect int    `envconfig:"MQ_MAXRECONNECT" default:"5"`
 
+	// idle publisher channels kept open, more are opened under load
+	MQPublisherChannels int           `envconfig:"MQ_PUBLISHER_CHANNELS" default:"4"`
+	MQConfirmTimeout    time.Duration `envconfig:"MQ_CONFIRM_TIMEOUT" default:"5s"`
+	MQDeliveryTimeout   time.Duration `envconfig:"MQ_DELIVERY_TIMEOUT" default:"10s"`
+
+	// CloudEvents content mode per exchange as exchange:mode, none, structured or binary, exchanges without
+	// a mode publish plain messages
+	CloudEventsModes map[string]string `envconfig:"CLOUDEVENTS_MODES"`
+
 	CacheHost string `envconfig:"CACHE_HOST"`
 	CachePass string `envconfig:"CACHE_PASSWORD"`
 	CachePort int    `envconfig:"CACHE_PORT" default:"6379"`
 
+	KYCThreshold int64 `envconfig:"KYC_THRESHOLD" default:"100000"`
+
+	// generated for local runs by make keys
+	PIIKeyFile        string `envconfig:"PII_KEYFILE" default:"keys.json"`
+	PIIReencryptBatch int    `envconfig:"PII_REENCRYPT_BATCH" default:"100"`
+
+	AuthJWKSFile    string `envconfig:"AUTH_JWKS_FILE"`
+	AuthAPIKeysFile string `envconfig:"AUTH_API_KEYS_FILE"`
+	AuthIssuer      string `envconfig:"AUTH_ISSUER"`
+	AuthAudience    string `envconfig:"AUTH_AUDIENCE"`
+
+	CORSAllowedOrigins []string      `envconfig:"CORS_ALLOWED_ORIGINS"`
+	CORSMaxAge         time.Duration `envconfig:"CORS_MAX_AGE" default:"10m"`
+	MaxBodyBytes       int64         `envconfig:"MAX_BODY_BYTES" default:"1048576"`
+
+	// per route limits as route:rate/period, routes without a limit use the default one
+	RateLimits map[string]string `envconfig:"RATE_LIMITS" default:"default:300/1m,listAccounts:30/1m"`
+
+	GRPCPort int `envconfig:"GRPC_PORT" default:"9090"`
+
+	WebhookTimeout      time.Duration `envconfig:"WEBHOOK_TIMEOUT" default:"5s"`
+	WebhookMaxAttempts  int           `envconfig:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+	WebhookPollInterval time.Duration `envconfig:"WEBHOOK_POLL_INTERVAL" default:"1s"`
+
 	ReadTimeout     time.Duration `envconfig:"READ_TIMEOUT" default:"5s"`
 	WriteTimeout    time.Duration `envconfig:"WRITE_TIMEOUT" default:"10s"`
+	RequestTimeout  time.Duration `envconfig:"REQUEST_TIMEOUT" default:"5s"`
 	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"5s"`
+	// ShutdownDelay is the time the load balancers get to take a draining replica out before its listeners close
+	ShutdownDelay time.Duration `envconfig:"SHUTDOWN_DELAY" default:"5s"`
 }
 
 func GetEnvCfg() (*Cfg, error) {
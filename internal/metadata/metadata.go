@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const (
+	MaxKeys        = 50
+	MaxKeyLength   = 40
+	MaxValueLength = 500
+)
+
+// Metadata are the references of the API clients attached to accounts and customers, like an external id or a
+// cost center. It is stored as a JSONB object.
+type Metadata map[string]string
+
+// MarshalJSON encodes missing metadata as an empty object.
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(map[string]string(m))
+}
+
+func (m Metadata) Value() (driver.Value, error) {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("unsupported metadata type %T", src)
+	}
+
+	return json.Unmarshal(b, (*map[string]string)(m))
+}
+
+// Contains reports whether the metadata has every key of the filter with the same value, like the @> operator.
+func (m Metadata) Contains(filter Metadata) bool {
+	for k, v := range filter {
+		if value, ok := m[k]; !ok || value != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate checks the limits of the metadata, the errors are reported for the keys of the field.
+func (m Metadata) Validate(field string) []problem.FieldError {
+	var fields []problem.FieldError
+	if len(m) > MaxKeys {
+		fields = append(fields, problem.Field(field, fmt.Sprintf("can't have more than %d keys", MaxKeys)))
+	}
+
+	// sorted, so the errors are always reported in the same order
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch {
+		case k == "":
+			fields = append(fields, problem.Field(field, "keys can't be empty"))
+		case len([]rune(k)) > MaxKeyLength:
+			fields = append(fields, problem.Field(field+"."+k, fmt.Sprintf("key can't be longer than %d characters", MaxKeyLength)))
+		case len([]rune(m[k])) > MaxValueLength:
+			fields = append(fields, problem.Field(field+"."+k, fmt.Sprintf("can't be longer than %d characters", MaxValueLength)))
+		}
+	}
+
+	return fields
+}
+
+// Patch is a JSON merge patch (RFC 7396) of the metadata. Keys with a null value are removed, a null patch
+// removes every key.
+type Patch struct {
+	Clear  bool
+	Values map[string]*string
+}
+
+func (p *Patch) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(bytes.TrimSpace(b), []byte("null")) {
+		*p = Patch{Clear: true}
+		return nil
+	}
+
+	*p = Patch{}
+	return json.Unmarshal(b, &p.Values)
+}
+
+// Apply returns the patched copy of the metadata.
+func (m Metadata) Apply(p Patch) Metadata {
+	patched := make(Metadata, len(m))
+	if !p.Clear {
+		for k, v := range m {
+			patched[k] = v
+		}
+	}
+
+	for k, v := range p.Values {
+		if v == nil {
+			delete(patched, k)
+		} else {
+			patched[k] = *v
+		}
+	}
+
+	return patched
+}
@@ -0,0 +1,71 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+func TestApplyPatch(t *testing.T) {
+	m := Metadata{"costCenter": "42", "nickname": "savings"}
+
+	var r struct {
+		Metadata Patch `json:"metadata"`
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"metadata": {"nickname": null, "externalId": "c-1"}}`), &r))
+	assert.Equal(t, Metadata{"costCenter": "42", "externalId": "c-1"}, m.Apply(r.Metadata))
+	assert.Equal(t, Metadata{"costCenter": "42", "nickname": "savings"}, m, "the metadata is not modified")
+
+	r.Metadata = Patch{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"metadata": null}`), &r))
+	assert.Equal(t, Metadata{}, m.Apply(r.Metadata))
+
+	r.Metadata = Patch{}
+	assert.NoError(t, json.Unmarshal([]byte(`{}`), &r))
+	assert.Equal(t, m, m.Apply(r.Metadata))
+}
+
+func TestScanAndValue(t *testing.T) {
+	var m Metadata
+	assert.NoError(t, m.Scan([]byte(`{"costCenter": "42"}`)))
+	assert.Equal(t, Metadata{"costCenter": "42"}, m)
+
+	v, err := Metadata(nil).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", v)
+
+	b, err := json.Marshal(struct{ M Metadata }{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"M": {}}`, string(b))
+}
+
+func TestValidate(t *testing.T) {
+	assert.Empty(t, Metadata{"costCenter": "42"}.Validate("metadata"))
+
+	long := strings.Repeat("x", MaxKeyLength+1)
+	assert.Equal(t, []problem.FieldError{
+		problem.Field("metadata", "keys can't be empty"),
+		problem.Field("metadata.nickname", "can't be longer than 500 characters"),
+		problem.Field("metadata."+long, "key can't be longer than 40 characters"),
+	}, Metadata{"": "x", "nickname": strings.Repeat("x", MaxValueLength+1), long: "x"}.Validate("metadata"))
+
+	m := make(Metadata)
+	for i := 0; i <= MaxKeys; i++ {
+		m[fmt.Sprintf("key%d", i)] = "v"
+	}
+	assert.Contains(t, m.Validate("metadata"), problem.Field("metadata", "can't have more than 50 keys"))
+}
+
+func TestContains(t *testing.T) {
+	m := Metadata{"costCenter": "42", "nickname": "savings"}
+
+	assert.True(t, m.Contains(nil))
+	assert.True(t, m.Contains(Metadata{"costCenter": "42"}))
+	assert.False(t, m.Contains(Metadata{"costCenter": "43"}))
+	assert.False(t, m.Contains(Metadata{"externalId": "42"}))
+}
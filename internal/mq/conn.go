@@ -1,10 +1,24 @@
 package mq
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
+)
+
+// ErrNotConnected is returned by the publishers while the connection is being re-established.
+var ErrNotConnected = errors.New("not connected to mq")
+
+const (
+	defaultPublisherChannels = 4
+	maxReconnectDelay        = 30 * time.Second
 )
 
 type Config struct {
@@ -14,29 +28,465 @@ type Config struct {
 	Port         int
 	Concurrency  int
 	MaxReconnect int
+	// PublisherChannels is the number of idle publisher channels kept open, more are opened on demand
+	PublisherChannels int
+	// ConfirmTimeout is how long a publish waits for the confirm of the broker
+	ConfirmTimeout time.Duration
+	// CloudEvents is the content mode of the messages published to each exchange
+	CloudEvents map[string]cloudevents.Mode
+}
+
+// State of the connection to the broker.
+type State int32
+
+const (
+	Connecting State = iota
+	Connected
+	Reconnecting
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+
+	return "closed"
 }
 
+// Topology declares exchanges, queues and bindings on the channel.
+type Topology func(ch *amqp.Channel) error
+
+// Handler processes a delivery, it has to ack or nack it.
+type Handler func(d amqp.Delivery)
+
+// Partition returns the key of a delivery, the deliveries of a consumer with the same key are handled by the same
+// worker in the order the consumer received them. Other consumers of the queue, e.g. in other replicas, and
+// requeued deliveries are not ordered with them.
+type Partition func(d amqp.Delivery) string
+
+type consumer struct {
+	queue       string
+	tag         string
+	concurrency int
+	partition   Partition
+	handle      Handler
+	// ch is the current channel of the consumer, stopped consumers are not restarted
+	ch      *amqp.Channel
+	stopped bool
+}
+
+// Conn owns the connection to the broker. Consumers get a dedicated channel each and publishers share a pool
+// of channels, after the connection or a channel is lost the topology is declared again and the consumers
+// are restarted.
 type Conn struct {
-	Channel *amqp.Channel
+	cfg   Config
+	modes map[string]cloudevents.Mode
+
+	mu         sync.Mutex
+	connection *amqp.Connection
+	state      State
+	topology   []Topology
+	consumers  []*consumer
+	publishers chan *publisher
+	// workers are the goroutines handling deliveries
+	workers sync.WaitGroup
 }
 
 func NewConnection(cfg Config) (*Conn, error) {
-	url := fmt.Sprintf("amqp://%s:%s@%s:%d", cfg.User, cfg.Pass, cfg.Host, cfg.Port)
+	conn := &Conn{cfg: cfg, modes: cfg.CloudEvents, state: Connecting}
+	if err := conn.connect(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// State returns the state of the connection, only connected connections publish and consume.
+func (conn *Conn) State() State {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.state
+}
+
+// Declare declares the topology now and again after every reconnect.
+func (conn *Conn) Declare(t Topology) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.state != Connected {
+		return ErrNotConnected
+	}
+
+	if err := declare(conn.connection, t); err != nil {
+		return err
+	}
+	conn.topology = append(conn.topology, t)
+
+	return nil
+}
+
+// Consume consumes the queue on a dedicated channel with concurrency workers. The consumer is restarted after
+// its channel or the connection is lost, the prefetch count is four messages per worker. Without a partition
+// the workers take the next delivery in turn, otherwise the deliveries are sharded by their key.
+func (conn *Conn) Consume(queue, tag string, concurrency int, partition Partition, handle Handler) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.state != Connected {
+		return ErrNotConnected
+	}
+
+	c := &consumer{queue: queue, tag: tag, concurrency: concurrency, partition: partition, handle: handle}
+	if err := conn.startConsumer(conn.connection, c); err != nil {
+		return err
+	}
+	conn.consumers = append(conn.consumers, c)
+
+	return nil
+}
+
+// Channel opens a dedicated channel, the caller has to close it.
+func (conn *Conn) Channel() (*amqp.Channel, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.state != Connected {
+		return nil, ErrNotConnected
+	}
+
+	return conn.connection.Channel()
+}
+
+// Publish publishes the event in the content mode configured for the exchange. It returns after the broker
+// confirmed the message, with a *ReturnedError if it couldn't be routed to any queue.
+func (conn *Conn) Publish(exchange, key string, e cloudevents.Event, p amqp.Publishing) error {
+	if err := cloudevents.Encode(conn.modes[exchange], e, &p); err != nil {
+		return err
+	}
+
+	return conn.publish(exchange, key, p)
+}
+
+// Drain cancels the consumers and waits until the workers handled the deliveries they already received, then
+// closes their channels. Publishing works until the connection is closed, so the deliveries can be completed.
+// Deliveries which are not acked when ctx is done are requeued by the broker.
+func (conn *Conn) Drain(ctx context.Context) error {
+	conn.mu.Lock()
+	consumers := conn.consumers
+	conn.consumers = nil
+	for _, c := range consumers {
+		c.stopped = true
+		if c.ch == nil {
+			continue
+		}
+		if err := c.ch.Cancel(c.tag, false); err != nil {
+			log.Warnf("error cancelling consumer %s: %v", c.tag, err)
+		}
+	}
+	conn.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		conn.workers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		log.Info("drained mq consumers")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, c := range consumers {
+		if c.ch != nil {
+			_ = c.ch.Close()
+		}
+	}
+
+	return err
+}
+
+func (conn *Conn) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.state == Closed {
+		return nil
+	}
+	conn.state = Closed
+
+	// publishers in use are closed with the connection
+	for idle := true; idle; {
+		select {
+		case pub := <-conn.publishers:
+			pub.close()
+		default:
+			idle = false
+		}
+	}
+
+	if conn.connection.IsClosed() {
+		return nil
+	}
+
+	return conn.connection.Close()
+}
+
+// publish publishes on a pooled channel. A channel closed by the broker, e.g. after publishing to a missing
+// exchange, is dropped from the pool and the message is published once more on a new one if it wasn't sent.
+func (conn *Conn) publish(exchange, key string, p amqp.Publishing) error {
+	err := conn.publishOnce(exchange, key, p)
+	if err == amqp.ErrClosed {
+		err = conn.publishOnce(exchange, key, p)
+	}
+
+	return err
+}
+
+func (conn *Conn) publishOnce(exchange, key string, p amqp.Publishing) error {
+	conn.mu.Lock()
+	connection, pool, state := conn.connection, conn.publishers, conn.state
+	conn.mu.Unlock()
+
+	if state != Connected {
+		return ErrNotConnected
+	}
+
+	var pub *publisher
+	select {
+	case pub = <-pool:
+	default:
+		var err error
+		if pub, err = newPublisher(connection, conn.cfg.ConfirmTimeout); err != nil {
+			return err
+		}
+	}
+
+	// returned, nacked and timed out messages leave the channel usable
+	err := pub.publish(exchange, key, p)
+	if pub.isClosed() {
+		pub.close()
+		return err
+	}
+
+	select {
+	case pool <- pub:
+	default:
+		pub.close()
+	}
+
+	return err
+}
+
+// connect dials the broker, declares the topology and starts the consumers.
+func (conn *Conn) connect() error {
+	url := fmt.Sprintf("amqp://%s:%s@%s:%d", conn.cfg.User, conn.cfg.Pass, conn.cfg.Host, conn.cfg.Port)
 
 	log.Info("connecting to mq")
 
-	conn, err := amqp.Dial(url)
+	connection, err := amqp.Dial(url)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.state == Closed {
+		_ = connection.Close()
+		return ErrNotConnected
+	}
+
+	for _, t := range conn.topology {
+		if err = declare(connection, t); err != nil {
+			_ = connection.Close()
+			return err
+		}
+	}
+
+	size := conn.cfg.PublisherChannels
+	if size <= 0 {
+		size = defaultPublisherChannels
+	}
+	conn.connection = connection
+	conn.publishers = make(chan *publisher, size)
+	conn.state = Connected
+
+	for _, c := range conn.consumers {
+		if err = conn.startConsumer(connection, c); err != nil {
+			log.Errorf("error restarting consumer %s: %v", c.tag, err)
+			go conn.restartConsumer(connection, c)
+		}
 	}
 
-	log.Info("connected to mq, opening channel")
+	go conn.reconnectOnClose(connection.NotifyClose(make(chan *amqp.Error, 1)))
 
-	ch, err := conn.Channel()
+	log.Info("connected to mq")
+	return nil
+}
+
+// reconnectOnClose reconnects after the connection is lost, up to MaxReconnect attempts with a growing delay.
+func (conn *Conn) reconnectOnClose(closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	if !ok || err == nil {
+		log.Info("mq connection closed normally, will not reconnect")
+		return
+	}
+
+	log.Errorf("closed mq connection: %v", err)
+
+	conn.mu.Lock()
+	if conn.state == Closed {
+		conn.mu.Unlock()
+		return
+	}
+	conn.state = Reconnecting
+	conn.mu.Unlock()
+
+	for attempt := 1; attempt <= conn.cfg.MaxReconnect; attempt++ {
+		time.Sleep(reconnectDelay(attempt))
+		if conn.State() == Closed {
+			return
+		}
+
+		log.Infof("attempting to reconnect to mq, attempt %d", attempt)
+		if err := conn.connect(); err != nil {
+			log.Errorf("error reconnecting to mq: %v", err)
+			continue
+		}
+
+		log.Info("reconnected to mq")
+		return
+	}
+
+	log.Error("reached max attempts, unable to reconnect to mq")
+
+	conn.mu.Lock()
+	conn.state = Closed
+	conn.mu.Unlock()
+}
+
+// startConsumer opens the channel of the consumer and starts its workers, the caller holds the lock.
+func (conn *Conn) startConsumer(connection *amqp.Connection, c *consumer) error {
+	ch, err := connection.Channel()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if err = ch.Qos(c.concurrency*4, 0, false); err != nil {
+		_ = ch.Close()
+		return err
+	}
+
+	deliveries, err := ch.Consume(c.queue, c.tag, false, false, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return err
+	}
+
+	c.ch = ch
+	conn.workers.Add(c.concurrency)
+	if c.partition == nil {
+		for i := 0; i < c.concurrency; i++ {
+			go conn.work(deliveries, c.handle)
+		}
+	} else {
+		shards := make([]chan amqp.Delivery, c.concurrency)
+		for i := range shards {
+			shards[i] = make(chan amqp.Delivery, 4)
+			go conn.work(shards[i], c.handle)
+		}
+		go dispatch(deliveries, c.partition, shards)
+	}
+
+	go conn.restartOnClose(connection, c, ch.NotifyClose(make(chan *amqp.Error, 1)))
+
+	return nil
+}
+
+func (conn *Conn) work(deliveries <-chan amqp.Delivery, handle Handler) {
+	defer conn.workers.Done()
+
+	for d := range deliveries {
+		handle(d)
+	}
+}
+
+// dispatch hands each delivery to the shard of its key until the deliveries are closed. A full shard holds
+// back the others, which is bounded by the prefetch count.
+func dispatch(deliveries <-chan amqp.Delivery, partition Partition, shards []chan amqp.Delivery) {
+	for d := range deliveries {
+		shards[shardOf(partition(d), len(shards))] <- d
+	}
+
+	for _, shard := range shards {
+		close(shard)
+	}
+}
+
+func shardOf(key string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(shards))
+}
+
+// restartOnClose restarts the consumer after its channel is closed by the broker. Consumers of a lost
+// connection are restarted by connect.
+func (conn *Conn) restartOnClose(connection *amqp.Connection, c *consumer, closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	if !ok || err == nil || connection.IsClosed() {
+		return
+	}
+
+	log.Errorf("closed channel of consumer %s: %v", c.tag, err)
+	conn.restartConsumer(connection, c)
+}
+
+func (conn *Conn) restartConsumer(connection *amqp.Connection, c *consumer) {
+	for attempt := 1; ; attempt++ {
+		time.Sleep(reconnectDelay(attempt))
+
+		conn.mu.Lock()
+		if c.stopped || conn.connection != connection || connection.IsClosed() {
+			conn.mu.Unlock()
+			return
+		}
+		err := conn.startConsumer(connection, c)
+		conn.mu.Unlock()
+
+		if err == nil {
+			log.Infof("restarted consumer %s", c.tag)
+			return
+		}
+		log.Errorf("error restarting consumer %s, attempt %d: %v", c.tag, attempt, err)
+	}
+}
+
+func declare(connection *amqp.Connection, t Topology) error {
+	ch, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return t(ch)
+}
+
+func reconnectDelay(attempt int) time.Duration {
+	d := time.Duration(attempt) * time.Second
+	if d > maxReconnectDelay {
+		return maxReconnectDelay
 	}
 
-	log.Info("opened channel")
-	return &Conn{Channel: ch}, nil
+	return d
 }
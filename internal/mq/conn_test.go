@@ -0,0 +1,59 @@
+package mq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
+)
+
+func TestNotConnected(t *testing.T) {
+	conn := &Conn{state: Reconnecting}
+
+	assert.Equal(t, "reconnecting", conn.State().String())
+	assert.Equal(t, ErrNotConnected, conn.Publish("payments", DepositRouteKey, cloudevents.Event{}, amqp.Publishing{}))
+	assert.Equal(t, ErrNotConnected, conn.Declare(declarePayments))
+	assert.Equal(t, ErrNotConnected, conn.Consume(DepositQueueName, "deposit-consumer", 1, nil, func(d amqp.Delivery) {}))
+
+	_, err := conn.Channel()
+	assert.Equal(t, ErrNotConnected, err)
+}
+
+func TestReconnectDelay(t *testing.T) {
+	assert.Equal(t, time.Second, reconnectDelay(1))
+	assert.Equal(t, 5*time.Second, reconnectDelay(5))
+	assert.Equal(t, maxReconnectDelay, reconnectDelay(100))
+}
+
+func TestDispatchKeepsOrderOfKey(t *testing.T) {
+	deliveries := make(chan amqp.Delivery)
+	shards := []chan amqp.Delivery{make(chan amqp.Delivery, 10), make(chan amqp.Delivery, 10), make(chan amqp.Delivery, 10)}
+	go func() {
+		for i, key := range []string{"1", "2", "1", "3", "1", "2"} {
+			deliveries <- amqp.Delivery{MessageId: fmt.Sprintf("%s-%d", key, i), RoutingKey: key}
+		}
+		close(deliveries)
+	}()
+
+	dispatch(deliveries, func(d amqp.Delivery) string { return d.RoutingKey }, shards)
+
+	// every shard is closed after the deliveries and the deliveries of a key are in one shard in order
+	byKey := make(map[string][]string)
+	for i, shard := range shards {
+		for d := range shard {
+			assert.Equal(t, shardOf(d.RoutingKey, len(shards)), i)
+			byKey[d.RoutingKey] = append(byKey[d.RoutingKey], d.MessageId)
+		}
+	}
+	assert.Equal(t, []string{"1-0", "1-2", "1-4"}, byKey["1"])
+	assert.Equal(t, []string{"2-1", "2-5"}, byKey["2"])
+}
+
+func TestShardOf(t *testing.T) {
+	assert.Equal(t, shardOf("42", 5), shardOf("42", 5))
+	assert.Equal(t, 0, shardOf("42", 1))
+	assert.Less(t, shardOf("7", 3), 3)
+}
@@ -0,0 +1,195 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrNacked is returned when the broker couldn't take responsibility for a message.
+	ErrNacked = errors.New("message was nacked by the broker")
+	// ErrConfirmTimeout is returned when the broker didn't confirm a message in time, it may still be delivered.
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the message")
+	// ErrNotConfirmed is returned when the channel is closed before the broker confirmed a message.
+	ErrNotConfirmed = errors.New("channel closed before the message was confirmed")
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+// ReturnedError is returned for messages the broker couldn't route to any queue.
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	Code       uint16
+	Reason     string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("message to exchange %s with routing key %s was returned: %d %s", e.Exchange, e.RoutingKey, e.Code, e.Reason)
+}
+
+type confirmation struct {
+	messageId string
+	returned  *ReturnedError
+	done      chan error
+}
+
+// publisher is a channel in confirm mode. Every message is published as mandatory and the publish waits for
+// the confirm of the broker, unroutable messages are returned by the broker before they are confirmed.
+type publisher struct {
+	ch      *amqp.Channel
+	timeout time.Duration
+
+	mu      sync.Mutex
+	tag     uint64
+	pending map[uint64]*confirmation
+	closed  bool
+}
+
+func newPublisher(connection *amqp.Connection, timeout time.Duration) (*publisher, error) {
+	ch, err := connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+
+	p := &publisher{ch: ch, timeout: timeout, pending: make(map[uint64]*confirmation)}
+	// unbuffered, so a return is received before the confirm of the same message
+	go p.listen(ch.NotifyPublish(make(chan amqp.Confirmation)), ch.NotifyReturn(make(chan amqp.Return)))
+
+	return p, nil
+}
+
+// publish returns nil only if the broker confirmed the message and routed it to at least one queue. Messages
+// without an id get one, a return is only matched to its message by the id.
+func (p *publisher) publish(exchange, key string, msg amqp.Publishing) error {
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.NewString()
+	}
+	c := &confirmation{messageId: msg.MessageId, done: make(chan error, 1)}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if err := p.ch.Publish(exchange, key, true, false, msg); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.tag++
+	tag := p.tag
+	p.pending[tag] = c
+	p.mu.Unlock()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-c.done:
+		return err
+	case <-timer.C:
+		p.mu.Lock()
+		delete(p.pending, tag)
+		p.mu.Unlock()
+
+		return ErrConfirmTimeout
+	}
+}
+
+func (p *publisher) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+func (p *publisher) close() {
+	_ = p.ch.Close()
+	p.fail()
+}
+
+func (p *publisher) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.returned(r)
+		case c, ok := <-confirms:
+			if !ok {
+				p.fail()
+				return
+			}
+			p.confirmed(c)
+		}
+	}
+}
+
+// returned marks the pending message with the id of the return as unroutable, the oldest one if the id was
+// published more than once. Returns of messages which are no longer pending, e.g. after a confirm timeout, are
+// dropped.
+func (p *publisher) returned(r amqp.Return) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var oldest uint64
+	for tag, c := range p.pending {
+		if c.returned == nil && c.messageId == r.MessageId && (oldest == 0 || tag < oldest) {
+			oldest = tag
+		}
+	}
+	if r.MessageId == "" || oldest == 0 {
+		return
+	}
+
+	p.pending[oldest].returned = &ReturnedError{Exchange: r.Exchange, RoutingKey: r.RoutingKey, Code: r.ReplyCode, Reason: r.ReplyText}
+}
+
+// confirmed completes the publish of the message, confirms of timed out messages are dropped.
+func (p *publisher) confirmed(confirmation amqp.Confirmation) {
+	p.mu.Lock()
+	c, ok := p.pending[confirmation.DeliveryTag]
+	delete(p.pending, confirmation.DeliveryTag)
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch {
+	case !confirmation.Ack:
+		c.done <- ErrNacked
+	case c.returned != nil:
+		c.done <- c.returned
+	default:
+		c.done <- nil
+	}
+}
+
+// fail completes the pending messages of a closed channel.
+func (p *publisher) fail() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for tag, c := range p.pending {
+		c.done <- ErrNotConfirmed
+		delete(p.pending, tag)
+	}
+}
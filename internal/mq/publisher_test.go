@@ -0,0 +1,59 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmations(t *testing.T) {
+	p := &publisher{pending: make(map[uint64]*confirmation)}
+	acked, returned, nacked := pending(p, 1, "a"), pending(p, 2, "b"), pending(p, 3, "c")
+
+	p.returned(amqp.Return{MessageId: "b", Exchange: "balance-notifications", RoutingKey: "notif", ReplyCode: 312, ReplyText: "NO_ROUTE"})
+	p.confirmed(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	p.confirmed(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+	p.confirmed(amqp.Confirmation{DeliveryTag: 3, Ack: false})
+
+	assert.NoError(t, <-acked.done)
+	assert.EqualError(t, <-returned.done, "message to exchange balance-notifications with routing key notif was returned: 312 NO_ROUTE")
+	assert.Equal(t, ErrNacked, <-nacked.done)
+	assert.Empty(t, p.pending)
+}
+
+func TestReturnedOnlyMatchesMessageId(t *testing.T) {
+	p := &publisher{pending: make(map[uint64]*confirmation)}
+	first, second := pending(p, 4, "d"), pending(p, 5, "e")
+
+	// returns of timed out or unknown messages aren't blamed on another pending one
+	p.returned(amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"})
+	p.returned(amqp.Return{MessageId: "timed-out", ReplyCode: 312, ReplyText: "NO_ROUTE"})
+
+	assert.Nil(t, first.returned)
+	assert.Nil(t, second.returned)
+
+	p.returned(amqp.Return{MessageId: "e", ReplyCode: 312, ReplyText: "NO_ROUTE"})
+
+	assert.Nil(t, first.returned)
+	assert.NotNil(t, second.returned)
+}
+
+func TestClosedBeforeConfirm(t *testing.T) {
+	p := &publisher{pending: make(map[uint64]*confirmation)}
+	c := pending(p, 1, "a")
+
+	p.fail()
+	p.confirmed(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+
+	assert.Equal(t, ErrNotConfirmed, <-c.done)
+	assert.True(t, p.isClosed())
+	assert.Equal(t, amqp.ErrClosed, p.publish("balance-notifications", "notif", amqp.Publishing{}))
+}
+
+func pending(p *publisher, tag uint64, messageId string) *confirmation {
+	c := &confirmation{messageId: messageId, done: make(chan error, 1)}
+	p.pending[tag] = c
+
+	return c
+}
@@ -2,63 +2,111 @@ package mq
 
 import (
 	"github.com/streadway/amqp"
+	"github.com/tamasbrandstadter/payments-api/internal/cloudevents"
 )
 
 const (
 	paymentsExchangeName = "payments"
-	depositQueueName     = "deposits"
-	withdrawQueueName    = "withdraws"
-	transferQueueName    = "transfers"
 	kind                 = "topic"
-	depositRouteKey      = "dep"
-	withdrawRouteKey     = "wit"
-	transferRouteKey     = "trnsfr"
+
+	DepositQueueName  = "deposits"
+	WithdrawQueueName = "withdraws"
+	TransferQueueName = "transfers"
+
+	DepositRouteKey  = "dep"
+	WithdrawRouteKey = "wit"
+	TransferRouteKey = "trnsfr"
+
+	deadLetterExchangeName = "payments-dlx"
+	deadLetterQueueName    = "payments-dead-letters"
+
+	ErrorCodeHeader   = "x-error-code"
+	ErrorDetailHeader = "x-error-detail"
+
+	// SchemaVersionHeader is the version of the JSON schema of a message body, messages without it are version 1.
+	SchemaVersionHeader = "x-schema-version"
 )
 
-func (conn *Conn) DeclareQueues(concurrency int) (*amqp.Queue, *amqp.Queue, *amqp.Queue, error) {
-	err := conn.Channel.ExchangeDeclare(paymentsExchangeName, kind, true, false, false, false, nil)
+// DeclareQueues declares the payments exchange with the queues of the balance operations and the dead
+// letters, again after every reconnect.
+func (conn *Conn) DeclareQueues() error {
+	return conn.Declare(declarePayments)
+}
+
+func declarePayments(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(paymentsExchangeName, kind, true, false, false, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
 	// deposit
-	deposit, err := conn.Channel.QueueDeclare(depositQueueName, true, false, false, false, nil)
+	_, err = ch.QueueDeclare(DepositQueueName, true, false, false, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	err = conn.Channel.QueueBind(depositQueueName, depositRouteKey, paymentsExchangeName, false, nil)
+	err = ch.QueueBind(DepositQueueName, DepositRouteKey, paymentsExchangeName, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
 	// withdraw
-	withdraw, err := conn.Channel.QueueDeclare(withdrawQueueName, true, false, false, false, nil)
+	_, err = ch.QueueDeclare(WithdrawQueueName, true, false, false, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	err = conn.Channel.QueueBind(withdrawQueueName, withdrawRouteKey, paymentsExchangeName, false, nil)
+	err = ch.QueueBind(WithdrawQueueName, WithdrawRouteKey, paymentsExchangeName, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
 	// transfer
-	transfer, err := conn.Channel.QueueDeclare(transferQueueName, true, false, false, false, nil)
+	_, err = ch.QueueDeclare(TransferQueueName, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ch.QueueBind(TransferQueueName, TransferRouteKey, paymentsExchangeName, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	err = conn.Channel.QueueBind(transferQueueName, transferRouteKey, paymentsExchangeName, false, nil)
+	// dead letters, messages which can never be processed
+	err = ch.ExchangeDeclare(deadLetterExchangeName, "fanout", true, false, false, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
 
-	prefetchCount := concurrency * 4
-	err = conn.Channel.Qos(prefetchCount, 0, false)
+	_, err = ch.QueueDeclare(deadLetterQueueName, true, false, false, false, nil)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
+	}
+
+	return ch.QueueBind(deadLetterQueueName, "", deadLetterExchangeName, false, nil)
+}
+
+// DeadLetter republishes the delivery to the dead letter exchange with the error code and detail
+// in the headers, the original routing key is kept so the message can be replayed.
+func (conn *Conn) DeadLetter(d amqp.Delivery, code, detail string) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
 	}
+	headers[ErrorCodeHeader] = code
+	headers[ErrorDetailHeader] = detail
+
+	return conn.publish(deadLetterExchangeName, d.RoutingKey, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+		DeliveryMode: amqp.Persistent,
+	})
+}
 
-	return &deposit, &withdraw, &transfer, nil
+// PublishPayment publishes a balance operation to the payments exchange, the route key selects the queue.
+func (conn *Conn) PublishPayment(routeKey string, e cloudevents.Event, p amqp.Publishing) error {
+	return conn.Publish(paymentsExchangeName, routeKey, e, p)
 }
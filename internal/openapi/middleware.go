@@ -0,0 +1,68 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+	"github.com/tamasbrandstadter/payments-api/internal/web"
+)
+
+// Template converts a router path like /accounts/:id to the OpenAPI path template /accounts/{id}.
+func Template(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// ValidateRequest rejects request bodies which don't match the schema of the operation, before they reach
+// the handler. Routes without a request body schema are passed through.
+func (d *Document) ValidateRequest(method, path string, next http.HandlerFunc) http.HandlerFunc {
+	op := d.Operation(method, Template(path))
+	schema := op.RequestSchema()
+	if schema == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				web.RespondError(w, problem.PayloadTooLarge, err.Error())
+				return
+			}
+			web.RespondError(w, problem.MalformedRequest, "unable to read request payload")
+			return
+		}
+		_ = r.Body.Close()
+
+		if len(bytes.TrimSpace(body)) == 0 {
+			if op.RequestBody.Required {
+				web.RespondProblem(w, problem.Validation(problem.Field("body", "is required")))
+				return
+			}
+		} else {
+			var v interface{}
+			if err = json.Unmarshal(body, &v); err != nil {
+				web.RespondError(w, problem.MalformedRequest, "invalid request payload, unable to parse")
+				return
+			}
+
+			if err = problem.Validation(schema.Validate(v)...); err != nil {
+				web.RespondProblem(w, err)
+				return
+			}
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
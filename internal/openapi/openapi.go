@@ -0,0 +1,153 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const refPrefix = "#/components/schemas/"
+
+// Document is the part of an OpenAPI 3 document the service needs to validate requests, the rest
+// of the specification is only served to clients.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+var methods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true,
+}
+
+// PathItem holds the operations of a path by lower case method, the shared fields of the path are skipped.
+type PathItem map[string]*Operation
+
+func (p *PathItem) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	*p = make(PathItem)
+	for name, raw := range fields {
+		if !methods[name] {
+			continue
+		}
+
+		var op Operation
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return err
+		}
+		(*p)[name] = &op
+	}
+
+	return nil
+}
+
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	RequestBody *RequestBody `json:"requestBody"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Parse reads the document and resolves the references to the component schemas.
+func Parse(b []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(d.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported openapi version %q", d.OpenAPI)
+	}
+
+	resolving := make(map[*Schema]bool)
+	for name, s := range d.Components.Schemas {
+		if err := d.resolve(s, resolving); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+
+	for path, operations := range d.Paths {
+		for method, op := range operations {
+			if op.RequestBody == nil {
+				continue
+			}
+			for _, mt := range op.RequestBody.Content {
+				if err := d.resolve(mt.Schema, resolving); err != nil {
+					return nil, fmt.Errorf("%s %s: %v", method, path, err)
+				}
+			}
+		}
+	}
+
+	return &d, nil
+}
+
+// Operation returns the operation of the method on the path template, e.g. /accounts/{id}.
+func (d *Document) Operation(method, path string) *Operation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// jsonMediaTypes are the request media types validated as JSON, in order of preference.
+var jsonMediaTypes = []string{"application/json", "application/merge-patch+json"}
+
+// RequestSchema returns the JSON schema of the operation's request body, nil if it has none.
+func (o *Operation) RequestSchema() *Schema {
+	if o == nil || o.RequestBody == nil {
+		return nil
+	}
+
+	for _, t := range jsonMediaTypes {
+		if mt, ok := o.RequestBody.Content[t]; ok {
+			return mt.Schema
+		}
+	}
+
+	return nil
+}
+
+// resolve replaces the references with the schemas they point to, recursive schemas keep pointing to the
+// same instance.
+func (d *Document) resolve(s *Schema, resolving map[*Schema]bool) error {
+	if s == nil || resolving[s] {
+		return nil
+	}
+	resolving[s] = true
+
+	if s.Ref != "" {
+		target, ok := d.Components.Schemas[strings.TrimPrefix(s.Ref, refPrefix)]
+		if !ok || !strings.HasPrefix(s.Ref, refPrefix) {
+			return fmt.Errorf("unknown reference %s", s.Ref)
+		}
+		if err := d.resolve(target, resolving); err != nil {
+			return err
+		}
+		s.resolved = target
+	}
+
+	for _, p := range s.Properties {
+		if err := d.resolve(p, resolving); err != nil {
+			return err
+		}
+	}
+
+	if s.AdditionalProperties != nil {
+		if err := d.resolve(s.AdditionalProperties.Schema, resolving); err != nil {
+			return err
+		}
+	}
+
+	return d.resolve(s.Items, resolving)
+}
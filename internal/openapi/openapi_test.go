@@ -0,0 +1,115 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const document = `{
+  "openapi": "3.0.3",
+  "paths": {
+    "/customers/{id}/kyc": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}],
+      "post": {
+        "operationId": "submitKYC",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/KYCSubmission"}}}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "KYCSubmission": {
+        "type": "object",
+        "required": ["documents"],
+        "additionalProperties": false,
+        "properties": {
+          "documents": {"type": "array", "minItems": 1, "items": {"$ref": "#/components/schemas/Document"}},
+          "labels": {"type": "object", "additionalProperties": {"type": "string", "maxLength": 4}}
+        }
+      },
+      "Document": {
+        "type": "object",
+        "required": ["type", "expiresAt"],
+        "properties": {
+          "type": {"type": "string", "enum": ["passport", "id_card"]},
+          "reference": {"type": "string", "maxLength": 4},
+          "expiresAt": {"type": "string", "format": "date-time"}
+        }
+      }
+    }
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	d, err := Parse([]byte(document))
+	assert.NoError(t, err)
+
+	schema := d.Operation(http.MethodPost, Template("/customers/:id/kyc")).RequestSchema()
+	if !assert.NotNil(t, schema) {
+		return
+	}
+
+	for body, expected := range map[string][]problem.FieldError{
+		`{"documents": [{"type": "passport", "expiresAt": "2030-01-02T15:04:05Z"}]}`: nil,
+		`{"documents": []}`: {problem.Field("documents", "must have at least 1 items")},
+		`{"documents": [{"type": "visa", "reference": "12345", "expiresAt": "tomorrow"}]}`: {
+			problem.Field("documents[0].expiresAt", "must be an RFC 3339 timestamp"),
+			problem.Field("documents[0].reference", "can't be longer than 4 characters"),
+			problem.Field("documents[0].type", "must be one of [passport id_card]"),
+		},
+		`{"documents": [{}], "note": "x"}`: {
+			problem.Field("documents[0].type", "is required"),
+			problem.Field("documents[0].expiresAt", "is required"),
+			problem.Field("note", "is not allowed"),
+		},
+		`{"documents": [{"type": "id_card", "expiresAt": "2030-01-02T15:04:05Z"}], "labels": {"a": "x", "b": 1, "c": "12345"}}`: {
+			problem.Field("labels.b", "must be a string"),
+			problem.Field("labels.c", "can't be longer than 4 characters"),
+		},
+		`[]`: {problem.Field("body", "must be an object")},
+	} {
+		var v interface{}
+		assert.NoError(t, json.Unmarshal([]byte(body), &v))
+		assert.Equal(t, expected, schema.Validate(v), body)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte(`{"openapi": "2.0"}`))
+	assert.Error(t, err)
+
+	_, err = Parse([]byte(`{"openapi": "3.0.3", "components": {"schemas": {"A": {"$ref": "#/components/schemas/B"}}}}`))
+	assert.Error(t, err)
+}
+
+func TestValidateRequest(t *testing.T) {
+	d, err := Parse([]byte(document))
+	assert.NoError(t, err)
+
+	var called bool
+	h := d.ValidateRequest(http.MethodPost, "/customers/:id/kyc", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/customers/1/kyc", strings.NewReader(`{"documents": "none"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+	assert.False(t, called)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/customers/1/kyc", strings.NewReader(`{"documents"`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, called)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/customers/1/kyc", strings.NewReader(
+		`{"documents": [{"type": "id_card", "expiresAt": "2030-01-02T15:04:05Z"}]}`)))
+	assert.True(t, called)
+}
@@ -0,0 +1,227 @@
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+// Schema is the subset of JSON schema used by the specification of the service.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Additional        `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	Nullable             bool               `json:"nullable"`
+
+	resolved *Schema
+}
+
+// Additional is the additionalProperties of an object schema, either a boolean or the schema of the properties
+// which are not listed in properties.
+type Additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *Additional) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &a.Allowed); err == nil {
+		return nil
+	}
+
+	a.Allowed = true
+	return json.Unmarshal(b, &a.Schema)
+}
+
+// ParseSchema reads a standalone JSON schema, like the ones of the AMQP messages. References are only
+// supported inside OpenAPI documents.
+func ParseSchema(b []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+
+	if s.hasRef() {
+		return nil, errors.New("references are not supported in standalone schemas")
+	}
+
+	return &s, nil
+}
+
+func (s *Schema) hasRef() bool {
+	if s == nil {
+		return false
+	}
+	if s.Ref != "" || s.Items.hasRef() || (s.AdditionalProperties != nil && s.AdditionalProperties.Schema.hasRef()) {
+		return true
+	}
+	for _, p := range s.Properties {
+		if p.hasRef() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks a decoded JSON value against the schema, the fields of the errors are paths like
+// documents[0].type. The root value itself is reported as body.
+func (s *Schema) Validate(v interface{}) []problem.FieldError {
+	var errs []problem.FieldError
+	s.validate("", v, &errs)
+
+	return errs
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]problem.FieldError) {
+	if s.resolved != nil {
+		s.resolved.validate(path, v, errs)
+		return
+	}
+
+	fail := func(format string, args ...interface{}) {
+		field := path
+		if field == "" {
+			field = "body"
+		}
+		*errs = append(*errs, problem.Field(field, fmt.Sprintf(format, args...)))
+	}
+
+	if v == nil {
+		if !s.Nullable && s.Type != "" {
+			fail("must be %s", article(s.Type))
+		}
+		return
+	}
+
+	if len(s.Enum) > 0 && !contains(s.Enum, v) {
+		fail("must be one of %v", s.Enum)
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		s.validateObject(path, o, errs)
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if s.MinItems != nil && len(a) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range a {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if s.MinLength != nil && len([]rune(str)) < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && len([]rune(str)) > *s.MaxLength {
+			fail("can't be longer than %d characters", *s.MaxLength)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				fail("must be an RFC 3339 timestamp")
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			fail("must be %s", article(s.Type))
+			return
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			fail("must be an integer")
+			return
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("must be greater than or equal to %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("must be less than or equal to %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+		}
+	}
+}
+
+func (s *Schema) validateObject(path string, o map[string]interface{}, errs *[]problem.FieldError) {
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+
+	for _, name := range s.Required {
+		if _, ok := o[name]; !ok {
+			*errs = append(*errs, problem.Field(prefix+name, "is required"))
+		}
+	}
+
+	// sorted, so the errors of a request are always reported in the same order
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p, ok := s.Properties[name]
+		if !ok && s.AdditionalProperties != nil {
+			if !s.AdditionalProperties.Allowed {
+				*errs = append(*errs, problem.Field(prefix+name, "is not allowed"))
+			}
+			p = s.AdditionalProperties.Schema
+		}
+		if p != nil {
+			p.validate(prefix+name, o[name], errs)
+		}
+	}
+}
+
+func contains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func article(t string) string {
+	if t == "integer" || t == "object" || t == "array" {
+		return "an " + t
+	}
+
+	return "a " + t
+}
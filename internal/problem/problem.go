@@ -0,0 +1,214 @@
+package problem
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	ContentType = "application/problem+json"
+
+	typePrefix = "urn:payments-api:problem:"
+)
+
+// Code is a stable, machine readable error code. The codes are shared by the REST API
+// and the messages of the transaction consumers, clients should never parse the details.
+type Code string
+
+const (
+	MalformedRequest        Code = "MALFORMED_REQUEST"
+	ValidationFailed        Code = "VALIDATION_FAILED"
+	InvalidCursor           Code = "INVALID_CURSOR"
+	Unauthenticated         Code = "UNAUTHENTICATED"
+	Forbidden               Code = "FORBIDDEN"
+	RouteNotFound           Code = "ROUTE_NOT_FOUND"
+	MethodNotAllowed        Code = "METHOD_NOT_ALLOWED"
+	AccountNotFound         Code = "ACCOUNT_NOT_FOUND"
+	CustomerNotFound        Code = "CUSTOMER_NOT_FOUND"
+	WebhookNotFound         Code = "WEBHOOK_NOT_FOUND"
+	DeliveryNotFound        Code = "WEBHOOK_DELIVERY_NOT_FOUND"
+	EmailTaken              Code = "EMAIL_TAKEN"
+	CustomerErased          Code = "CUSTOMER_ERASED"
+	KYCRequired             Code = "KYC_REQUIRED"
+	KYCTransitionNotAllowed Code = "KYC_TRANSITION_NOT_ALLOWED"
+	KYCNoValidDocuments     Code = "KYC_NO_VALID_DOCUMENTS"
+	InsufficientFunds       Code = "INSUFFICIENT_FUNDS"
+	AccountFrozen           Code = "ACCOUNT_FROZEN"
+	VersionMismatch         Code = "VERSION_MISMATCH"
+	PayloadTooLarge         Code = "PAYLOAD_TOO_LARGE"
+	RateLimited             Code = "RATE_LIMITED"
+	Internal                Code = "INTERNAL_ERROR"
+	ServiceUnavailable      Code = "SERVICE_UNAVAILABLE"
+)
+
+type entry struct {
+	status int
+	title  string
+}
+
+var catalogue = map[Code]entry{
+	MalformedRequest:        {http.StatusBadRequest, "Malformed request"},
+	ValidationFailed:        {http.StatusBadRequest, "Validation failed"},
+	InvalidCursor:           {http.StatusBadRequest, "Invalid pagination cursor"},
+	Unauthenticated:         {http.StatusUnauthorized, "Authentication required"},
+	Forbidden:               {http.StatusForbidden, "Insufficient permissions"},
+	RouteNotFound:           {http.StatusNotFound, "Route not found"},
+	MethodNotAllowed:        {http.StatusMethodNotAllowed, "Method not allowed"},
+	AccountNotFound:         {http.StatusNotFound, "Account not found"},
+	CustomerNotFound:        {http.StatusNotFound, "Customer not found"},
+	WebhookNotFound:         {http.StatusNotFound, "Webhook not found"},
+	DeliveryNotFound:        {http.StatusNotFound, "Webhook delivery not found"},
+	EmailTaken:              {http.StatusConflict, "Email is taken"},
+	CustomerErased:          {http.StatusConflict, "Customer is erased"},
+	KYCRequired:             {http.StatusForbidden, "KYC verification required"},
+	KYCTransitionNotAllowed: {http.StatusConflict, "KYC status change not allowed"},
+	KYCNoValidDocuments:     {http.StatusUnprocessableEntity, "No valid KYC documents"},
+	InsufficientFunds:       {http.StatusUnprocessableEntity, "Insufficient funds"},
+	AccountFrozen:           {http.StatusConflict, "Account is frozen"},
+	VersionMismatch:         {http.StatusPreconditionFailed, "Precondition failed"},
+	PayloadTooLarge:         {http.StatusRequestEntityTooLarge, "Payload too large"},
+	RateLimited:             {http.StatusTooManyRequests, "Rate limit exceeded"},
+	Internal:                {http.StatusInternalServerError, "Internal server error"},
+	ServiceUnavailable:      {http.StatusServiceUnavailable, "Service unavailable"},
+}
+
+// Codes returns every code of the catalogue.
+func Codes() []Code {
+	codes := make([]Code, 0, len(catalogue))
+	for c := range catalogue {
+		codes = append(codes, c)
+	}
+
+	return codes
+}
+
+func (c Code) Status() int {
+	if e, ok := catalogue[c]; ok {
+		return e.status
+	}
+
+	return http.StatusInternalServerError
+}
+
+func (c Code) Title() string {
+	if e, ok := catalogue[c]; ok {
+		return e.title
+	}
+
+	return catalogue[Internal].title
+}
+
+func (c Code) Type() string {
+	return typePrefix + strings.ToLower(strings.ReplaceAll(string(c), "_", "-"))
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func Field(field, message string) FieldError {
+	return FieldError{Field: field, Message: message}
+}
+
+// Error is an error with a code of the catalogue, domain errors can also implement Coder instead.
+type Error struct {
+	Code   Code
+	Detail string
+	Fields []FieldError
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func (e *Error) ErrorCode() Code {
+	return e.Code
+}
+
+func New(code Code, detail string) *Error {
+	return &Error{Code: code, Detail: detail}
+}
+
+func Newf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Validation returns nil without field errors, so it can be returned right after collecting them.
+func Validation(fields ...FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+
+	return &Error{Code: ValidationFailed, Detail: strings.Join(messages, ", "), Fields: fields}
+}
+
+type Coder interface {
+	ErrorCode() Code
+}
+
+// CodeOf returns the code of the first error in the chain that has one, errors without a code are internal.
+func CodeOf(err error) Code {
+	if c := coded(err); c != nil {
+		return c.ErrorCode()
+	}
+
+	return Internal
+}
+
+func coded(err error) Coder {
+	for err != nil {
+		if c, ok := err.(Coder); ok {
+			return c
+		}
+
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Problem is an RFC 7807 problem details document, extended with the code and the field errors.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      Code         `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+func NewProblem(code Code, detail string) *Problem {
+	return &Problem{Type: code.Type(), Title: code.Title(), Status: code.Status(), Detail: detail, Code: code}
+}
+
+// FromError uses the message of the coded error as detail, so the context added by wrapping it
+// stays in the logs.
+func FromError(err error) *Problem {
+	c := coded(err)
+	if c == nil {
+		return NewProblem(Internal, err.Error())
+	}
+
+	p := NewProblem(c.ErrorCode(), c.(error).Error())
+	if pe, ok := c.(*Error); ok {
+		p.Errors = pe.Fields
+	}
+
+	return p
+}
@@ -0,0 +1,55 @@
+package problem
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fundsError struct{}
+
+func (fundsError) Error() string {
+	return "insufficient funds"
+}
+
+func (fundsError) ErrorCode() Code {
+	return InsufficientFunds
+}
+
+func TestCodeOf(t *testing.T) {
+	notFound := New(AccountNotFound, "account id 1 is not found")
+
+	assert.Equal(t, AccountNotFound, CodeOf(notFound))
+	assert.Equal(t, AccountNotFound, CodeOf(pkgerrors.Wrap(notFound, "select account")))
+	assert.Equal(t, InsufficientFunds, CodeOf(fmt.Errorf("withdraw: %w", fundsError{})))
+	assert.Equal(t, Internal, CodeOf(errors.New("connection refused")))
+	assert.Equal(t, Internal, CodeOf(nil))
+}
+
+func TestCatalogue(t *testing.T) {
+	for _, c := range Codes() {
+		_, ok := catalogue[c]
+		assert.True(t, ok, c)
+		assert.GreaterOrEqual(t, c.Status(), http.StatusBadRequest, c)
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, Code("UNKNOWN").Status())
+	assert.Equal(t, "urn:payments-api:problem:account-frozen", AccountFrozen.Type())
+}
+
+func TestValidation(t *testing.T) {
+	assert.Nil(t, Validation())
+
+	err := Validation(Field("firstName", "is required"), Field("balance", "can't be negative"))
+	assert.Equal(t, "firstName: is required, balance: can't be negative", err.Error())
+
+	p := FromError(pkgerrors.Wrap(err, "create account"))
+	assert.Equal(t, ValidationFailed, p.Code)
+	assert.Equal(t, http.StatusBadRequest, p.Status)
+	assert.Equal(t, err.Error(), p.Detail)
+	assert.Len(t, p.Errors, 2)
+}
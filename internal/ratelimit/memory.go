@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepSize is the number of tracked keys above which expired buckets are dropped.
+const sweepSize = 10000
+
+// MemoryStore keeps the buckets of a single instance, so the limits are not shared between replicas.
+type MemoryStore struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tat: make(map[string]time.Time), now: time.Now}
+}
+
+func (s *MemoryStore) Allow(_ context.Context, key string, l Limit) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if len(s.tat) > sweepSize {
+		for k, t := range s.tat {
+			if t.Before(now) {
+				delete(s.tat, k)
+			}
+		}
+	}
+
+	// tat is the theoretical arrival time, the moment the bucket is full again
+	tat, ok := s.tat[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+
+	interval := l.interval()
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-l.Period)
+
+	if now.Before(allowAt) {
+		return &Result{Allowed: false, Limit: l.Rate, RetryAfter: allowAt.Sub(now), ResetAfter: tat.Sub(now)}, nil
+	}
+
+	s.tat[key] = newTat
+
+	return &Result{
+		Allowed:    true,
+		Limit:      l.Rate,
+		Remaining:  int(now.Sub(allowAt) / interval),
+		ResetAfter: newTat.Sub(now),
+	}, nil
+}
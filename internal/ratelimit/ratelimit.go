@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPolicy is applied to every route without its own limit.
+const DefaultPolicy = "default"
+
+// Limit allows Rate requests per Period. The limiter is a token bucket (implemented as GCRA),
+// so a full bucket allows a burst of Rate requests, then it refills evenly over the period.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+}
+
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+// ParseLimit parses limits in the form of rate/period, for example 100/1m.
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected rate/period", s)
+	}
+
+	rate, err := strconv.Atoi(parts[0])
+	if err != nil || rate <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate in rate limit %q", s)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("invalid period in rate limit %q", s)
+	}
+
+	return Limit{Rate: rate, Period: period}, nil
+}
+
+func ParsePolicies(policies map[string]string) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(policies))
+	for name, s := range policies {
+		l, err := ParseLimit(s)
+		if err != nil {
+			return nil, err
+		}
+		limits[name] = l
+	}
+
+	return limits, nil
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is only set for denied requests.
+	RetryAfter time.Duration
+	// ResetAfter is the time until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+type Store interface {
+	Allow(ctx context.Context, key string, l Limit) (*Result, error)
+}
+
+// Limiter resolves the limit of a route and consults the primary store, falling back to the
+// secondary one (usually in memory) while the primary is unavailable.
+type Limiter struct {
+	primary  Store
+	fallback Store
+	policies map[string]Limit
+}
+
+func NewLimiter(primary, fallback Store, policies map[string]Limit) *Limiter {
+	return &Limiter{primary: primary, fallback: fallback, policies: policies}
+}
+
+// Allow returns nil if the route has no limit at all.
+func (l *Limiter) Allow(ctx context.Context, route, client string) (*Result, error) {
+	limit, ok := l.policies[route]
+	if !ok {
+		if limit, ok = l.policies[DefaultPolicy]; !ok {
+			return nil, nil
+		}
+		route = DefaultPolicy
+	}
+
+	key := fmt.Sprintf("ratelimit:%s:%s", route, client)
+
+	if l.primary != nil {
+		res, err := l.primary.Allow(ctx, key, limit)
+		if err == nil || l.fallback == nil {
+			return res, err
+		}
+		log.Warnf("rate limit store is unavailable, falling back to local limits: %v", err)
+	}
+
+	return l.fallback.Allow(ctx, key, limit)
+}
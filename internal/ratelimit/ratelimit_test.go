@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicies(t *testing.T) {
+	limits, err := ParsePolicies(map[string]string{"default": "100/1m", "listAccounts": "10/1s"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 100, Period: time.Minute}, limits[DefaultPolicy])
+	assert.Equal(t, Limit{Rate: 10, Period: time.Second}, limits["listAccounts"])
+
+	for _, invalid := range []string{"100", "0/1m", "x/1m", "10/0s", "10/minute"} {
+		_, err = ParseLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+
+	l := Limit{Rate: 3, Period: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		res, err := s.Allow(context.Background(), "client", l)
+		assert.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res, err := s.Allow(context.Background(), "client", l)
+	assert.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.ResetAfter)
+
+	res, _ = s.Allow(context.Background(), "other", l)
+	assert.True(t, res.Allowed)
+
+	// the bucket refills one token per interval
+	now = now.Add(time.Second)
+	res, _ = s.Allow(context.Background(), "client", l)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+}
+
+type failingStore struct{}
+
+func (failingStore) Allow(context.Context, string, Limit) (*Result, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLimiterFallback(t *testing.T) {
+	l := NewLimiter(failingStore{}, NewMemoryStore(), map[string]Limit{"listAccounts": {Rate: 1, Period: time.Minute}})
+
+	res, err := l.Allow(context.Background(), "listAccounts", "apikey:test")
+	assert.NoError(t, err)
+	assert.True(t, res.Allowed)
+
+	res, err = l.Allow(context.Background(), "listAccounts", "apikey:test")
+	assert.NoError(t, err)
+	assert.False(t, res.Allowed)
+
+	res, err = l.Allow(context.Background(), "getAccount", "apikey:test")
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = NewLimiter(failingStore{}, nil, map[string]Limit{DefaultPolicy: {Rate: 1, Period: time.Minute}}).
+		Allow(context.Background(), "getAccount", "apikey:test")
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// gcra is the same algorithm as the memory store, run atomically in Redis with the clock of
+// the Redis server, so every replica sees the same time.
+var gcra = redis.NewScript(`
+local period = tonumber(ARGV[1])
+local interval = period / tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - period
+if now < allow_at then
+	return {0, 0, math.ceil(allow_at - now), math.ceil(tat - now)}
+end
+redis.call('SET', KEYS[1], tostring(new_tat), 'PX', math.ceil(new_tat - now))
+return {1, math.floor((now - allow_at) / interval), 0, math.ceil(new_tat - now)}
+`)
+
+type RedisStore struct {
+	client *redis.Ring
+}
+
+func NewRedisStore(client *redis.Ring) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, l Limit) (*Result, error) {
+	reply, err := gcra.Run(ctx, s.client, []string{key}, l.Period.Milliseconds(), l.Rate).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != 4 {
+		return nil, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+
+	values := make([]int64, len(replies))
+	for i, v := range replies {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected rate limit script reply %v", reply)
+		}
+		values[i] = n
+	}
+
+	return &Result{
+		Allowed:    values[0] == 1,
+		Limit:      l.Rate,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,306 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
+)
+
+const (
+	// streamKey holds the recent events of every account, subscribers resume from it after reconnecting.
+	streamKey = "account-events"
+	// channel fans out the new events to every replica.
+	channel = "account-events"
+	// retention is the approximate number of events kept for resuming.
+	retention = 10000
+
+	replayBatch    = 500
+	maxPending     = 1000
+	subscriberSize = 64
+
+	TypeBalance     = "balance"
+	TypeTransaction = "transaction"
+)
+
+var InvalidEventIDError = problem.New(problem.MalformedRequest, "invalid last event id")
+
+// Event is a change of an account. The id is the id of the Redis stream entry, ids of later events are
+// always greater.
+type Event struct {
+	ID        string          `json:"id,omitempty"`
+	AccountID int             `json:"accountId"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Publish stores the event for resuming and sends it to the subscribers of the account on every replica.
+func Publish(ctx context.Context, client *redis.Ring, accountId int, eventType string, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	e := Event{AccountID: accountId, Type: eventType, Data: d}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	e.ID, err = client.XAdd(ctx, &redis.XAddArgs{
+		Stream:       streamKey,
+		MaxLenApprox: retention,
+		Values:       map[string]interface{}{"event": body},
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	if body, err = json.Marshal(e); err != nil {
+		return err
+	}
+
+	return client.Publish(ctx, channel, body).Err()
+}
+
+// Publisher publishes the events to the streams in redis.
+type Publisher struct {
+	Client *redis.Ring
+}
+
+func (p Publisher) Publish(ctx context.Context, accountId int, eventType string, data interface{}) error {
+	return Publish(ctx, p.Client, accountId, eventType, data)
+}
+
+// Broker delivers the events published by any replica to the subscriptions of this one.
+type Broker struct {
+	client *redis.Ring
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+}
+
+func NewBroker(client *redis.Ring) *Broker {
+	return &Broker{client: client, subs: make(map[*Subscription]struct{})}
+}
+
+// Run receives the events until the context is done, the Redis client reconnects by itself.
+func (b *Broker) Run(ctx context.Context) {
+	ps := b.client.Subscribe(ctx, channel)
+	go func() {
+		<-ctx.Done()
+		_ = ps.Close()
+	}()
+
+	for m := range ps.Channel() {
+		var e Event
+		if err := json.Unmarshal([]byte(m.Payload), &e); err != nil {
+			log.Warnf("invalid account event: %v", err)
+			continue
+		}
+		b.dispatch(e)
+	}
+}
+
+// Subscription receives the events of its accounts in order. It is dropped if its receiver falls too far
+// behind, the receiver can resume with the id of the last event it got.
+type Subscription struct {
+	accounts  map[int]bool
+	events    chan Event
+	done      chan struct{}
+	last      string
+	replaying bool
+	pending   []Event
+	closed    bool
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Done is closed when the subscription is dropped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Subscribe starts delivering the events of the accounts. With a last event id the stored events after it
+// are delivered first, the ones published meanwhile follow them without duplicates.
+func (b *Broker) Subscribe(ctx context.Context, accountIds []int, lastEventID string) (*Subscription, error) {
+	if lastEventID != "" {
+		if _, _, ok := parseID(lastEventID); !ok {
+			return nil, InvalidEventIDError
+		}
+	}
+
+	s := &Subscription{
+		accounts:  make(map[int]bool, len(accountIds)),
+		events:    make(chan Event, subscriberSize),
+		done:      make(chan struct{}),
+		last:      lastEventID,
+		replaying: lastEventID != "",
+	}
+	for _, id := range accountIds {
+		s.accounts[id] = true
+	}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	if s.replaying {
+		go b.replay(ctx, s)
+	}
+
+	return s, nil
+}
+
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.drop(s)
+}
+
+func (b *Broker) replay(ctx context.Context, s *Subscription) {
+	start := s.last
+	for {
+		msgs, err := b.client.XRangeN(ctx, streamKey, start, "+", replayBatch).Result()
+		if err != nil {
+			log.Errorf("error replaying account events after %s: %v", start, err)
+			b.Unsubscribe(s)
+			return
+		}
+
+		for _, m := range msgs {
+			e, ok := decodeEntry(m)
+			if !ok || !s.accounts[e.AccountID] || compareIDs(e.ID, s.last) <= 0 {
+				continue
+			}
+
+			select {
+			case s.events <- e:
+				b.mu.Lock()
+				s.last = e.ID
+				b.mu.Unlock()
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				b.Unsubscribe(s)
+				return
+			}
+		}
+
+		if len(msgs) < replayBatch {
+			break
+		}
+		start = msgs[len(msgs)-1].ID
+	}
+
+	// the events published during the replay
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.replaying = false
+	for _, e := range s.pending {
+		b.deliver(s, e)
+	}
+	s.pending = nil
+}
+
+func (b *Broker) dispatch(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		if !s.accounts[e.AccountID] {
+			continue
+		}
+
+		if s.replaying {
+			if len(s.pending) >= maxPending {
+				b.drop(s)
+				continue
+			}
+			s.pending = append(s.pending, e)
+			continue
+		}
+
+		b.deliver(s, e)
+	}
+}
+
+// deliver must be called with the lock held.
+func (b *Broker) deliver(s *Subscription, e Event) {
+	if s.closed || compareIDs(e.ID, s.last) <= 0 {
+		return
+	}
+
+	select {
+	case s.events <- e:
+		s.last = e.ID
+	default:
+		log.Warnf("dropped slow account event subscriber at event id %s", s.last)
+		b.drop(s)
+	}
+}
+
+// drop must be called with the lock held.
+func (b *Broker) drop(s *Subscription) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.done)
+	delete(b.subs, s)
+}
+
+func decodeEntry(m redis.XMessage) (Event, bool) {
+	var e Event
+	body, ok := m.Values["event"].(string)
+	if !ok || json.Unmarshal([]byte(body), &e) != nil {
+		return e, false
+	}
+	e.ID = m.ID
+
+	return e, true
+}
+
+// compareIDs compares Redis stream ids, an empty id is lower than every other one.
+func compareIDs(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	ams, aseq, _ := parseID(a)
+	bms, bseq, _ := parseID(b)
+	switch {
+	case ams < bms || ams == bms && aseq < bseq:
+		return -1
+	case ams == bms && aseq == bseq:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func parseID(id string) (uint64, uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return ms, seq, true
+}
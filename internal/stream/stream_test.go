@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareIDs(t *testing.T) {
+	assert.Equal(t, 0, compareIDs("1-0", "1-0"))
+	assert.Equal(t, -1, compareIDs("1-5", "2-0"))
+	assert.Equal(t, -1, compareIDs("10-1", "10-2"))
+	assert.Equal(t, 1, compareIDs("100-0", "99-9"))
+	assert.Equal(t, 1, compareIDs("1-0", ""))
+}
+
+func TestSubscribe(t *testing.T) {
+	b := NewBroker(nil)
+
+	s, err := b.Subscribe(context.Background(), []int{1, 2}, "")
+	assert.NoError(t, err)
+
+	b.dispatch(Event{ID: "1-0", AccountID: 1, Type: TypeBalance})
+	b.dispatch(Event{ID: "2-0", AccountID: 3, Type: TypeBalance})
+	b.dispatch(Event{ID: "3-0", AccountID: 2, Type: TypeTransaction})
+	// already delivered events are skipped
+	b.dispatch(Event{ID: "3-0", AccountID: 2, Type: TypeTransaction})
+
+	assert.Equal(t, "1-0", (<-s.Events()).ID)
+	assert.Equal(t, "3-0", (<-s.Events()).ID)
+	assert.Len(t, s.Events(), 0)
+
+	b.Unsubscribe(s)
+	<-s.Done()
+	assert.Empty(t, b.subs)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := NewBroker(nil)
+
+	s, err := b.Subscribe(context.Background(), []int{1}, "")
+	assert.NoError(t, err)
+
+	for i := 0; i <= subscriberSize; i++ {
+		b.dispatch(Event{ID: fmt.Sprintf("%d-0", i+1), AccountID: 1})
+	}
+
+	select {
+	case <-s.Done():
+	default:
+		t.Error("expected the subscription to be dropped")
+	}
+	assert.Empty(t, b.subs)
+}
+
+func TestSubscribeInvalidEventID(t *testing.T) {
+	_, err := NewBroker(nil).Subscribe(context.Background(), []int{1}, "abc")
+	assert.Equal(t, InvalidEventIDError, err)
+}
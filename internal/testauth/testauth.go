@@ -0,0 +1,63 @@
+package testauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tamasbrandstadter/payments-api/internal/auth"
+)
+
+const (
+	AdminKey    = "test-admin-key"
+	OperatorKey = "test-operator-key"
+
+	keyId  = "test"
+	secret = "payments-api-test-hmac-secret-32"
+)
+
+var Authenticator = newAuthenticator()
+
+// Token signs a HS256 token for the given role, customerId is only used for the customer role.
+func Token(role auth.Role, customerId int) string {
+	h, err := json.Marshal(map[string]string{"alg": "HS256", "kid": keyId, "typ": "JWT"})
+	if err != nil {
+		log.Fatalf("unable to marshal token header: %v", err)
+	}
+
+	c, err := json.Marshal(map[string]interface{}{
+		"sub":         fmt.Sprintf("%s-%d", role, customerId),
+		"role":        role,
+		"customer_id": customerId,
+		"exp":         time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		log.Fatalf("unable to marshal token claims: %v", err)
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newAuthenticator() *auth.Authenticator {
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "oct", "kid": "%s", "alg": "HS256", "k": "%s"}]}`,
+		keyId, base64.RawURLEncoding.EncodeToString([]byte(secret)))
+
+	keys, err := auth.ParseJWKS([]byte(jwks))
+	if err != nil {
+		log.Fatalf("unable to parse test jwks: %v", err)
+	}
+
+	return auth.NewAuthenticator(auth.NewJWTVerifier(keys, "", ""), []auth.APIKey{
+		{Name: "test-admin", Hash: auth.HashAPIKey(AdminKey), Role: auth.RoleAdmin},
+		{Name: "test-operator", Hash: auth.HashAPIKey(OperatorKey), Role: auth.RoleOperator},
+	})
+}
@@ -1,12 +1,15 @@
 package testdb
 
 import (
+	"context"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"github.com/tamasbrandstadter/payments-api/cmd/api/account"
+	"github.com/tamasbrandstadter/payments-api/cmd/api/customer"
 	"github.com/tamasbrandstadter/payments-api/internal/db"
+	"github.com/tamasbrandstadter/payments-api/internal/encryption"
 )
 
 const (
@@ -17,25 +20,47 @@ const (
 	databasePort = 5432
 )
 
-var TestTime = time.Now().UTC().Truncate(time.Millisecond)
+var (
+	TestTime = time.Now().UTC().Truncate(time.Millisecond)
+	Cipher   = newCipher()
+)
 
+// Open connects to the test database and applies the migrations.
 func Open() (*sqlx.DB, error) {
-	return db.NewConnection(db.Config{
+	dbc, err := db.NewConnection(db.Config{
 		User: databaseUser,
 		Pass: databasePass,
 		Name: databaseName,
 		Host: databaseHost,
 		Port: databasePort,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := db.NewMigrator(dbc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return dbc, nil
 }
 
 func SaveCustomerWithAccount(db *sqlx.DB, r account.AccCreationRequest) error {
-	stmt, err := db.Prepare("INSERT INTO customers(first_name, last_name, email, created_at, modified_at) VALUES($1,$2,$3,$4,$5) RETURNING id;")
+	pii, err := customer.SealPII(Cipher, r.FirstName, r.LastName, r.Email)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare("INSERT INTO customers(first_name, last_name, email, email_index, pii_key_id, created_at, modified_at) VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id;")
 	if err != nil {
 		return err
 	}
 
-	row := stmt.QueryRow(r.FirstName, r.LastName, r.Email, TestTime, TestTime)
+	row := stmt.QueryRow(pii.FirstName, pii.LastName, pii.Email, pii.EmailIndex, pii.KeyID, TestTime, TestTime)
 	err = row.Err()
 	if err := stmt.Close(); err != nil {
 		return err
@@ -64,6 +89,25 @@ func SaveCustomerWithAccount(db *sqlx.DB, r account.AccCreationRequest) error {
 	return nil
 }
 
+func newCipher() *encryption.Cipher {
+	kek, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatalf("unable to generate test encryption key: %v", err)
+	}
+
+	index, err := encryption.GenerateKey()
+	if err != nil {
+		log.Fatalf("unable to generate test index key: %v", err)
+	}
+
+	keys, err := encryption.NewLocalKeyProvider("test", map[string][]byte{"test": kek}, index)
+	if err != nil {
+		log.Fatalf("unable to create test key provider: %v", err)
+	}
+
+	return encryption.NewCipher(keys)
+}
+
 func DeleteTestAccount(db *sqlx.DB, id int) error {
 	stmt, err := db.Prepare("DELETE FROM accounts WHERE id=$1")
 	if err != nil {
@@ -80,7 +124,7 @@ func DeleteTestAccount(db *sqlx.DB, id int) error {
 func SelectById(db *sqlx.DB, id int) (*account.Account, error) {
 	var acc account.Account
 
-	stmt, err := db.Preparex("SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen FROM accounts WHERE id=$1;")
+	stmt, err := db.Preparex("SELECT id, customer_id, balance_in_decimal, currency, created_at, modified_at, frozen, version, metadata FROM accounts WHERE id=$1;")
 	if err != nil {
 		return nil, err
 	}
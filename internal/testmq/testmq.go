@@ -1,6 +1,7 @@
 package testmq
 
 import (
+	"github.com/streadway/amqp"
 	"github.com/tamasbrandstadter/payments-api/internal/mq"
 )
 
@@ -29,17 +30,18 @@ func Open() (*mq.Conn, error) {
 		return nil, err
 	}
 
-	err = conn.Channel.ExchangeDeclare(exchange, topic, true, false, false, false, nil)
-	if err != nil {
-		return nil, err
-	}
+	err = conn.Declare(func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(exchange, topic, true, false, false, false, nil); err != nil {
+			return err
+		}
 
-	q, err := conn.Channel.QueueDeclare(queue, false, false, false, false, nil)
-	if err != nil {
-		return nil, err
-	}
+		q, err := ch.QueueDeclare(queue, false, false, false, false, nil)
+		if err != nil {
+			return err
+		}
 
-	err = conn.Channel.QueueBind(q.Name, "notif", exchange, false, nil)
+		return ch.QueueBind(q.Name, "notif", exchange, false, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,109 @@
+package tracecontext
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// W3C trace context (https://www.w3.org/TR/trace-context/) header names, the same names are used in the
+// AMQP headers and as CloudEvents extensions.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+
+	version = "00"
+	sampled = "01"
+)
+
+type ctxKey struct{}
+
+// TraceContext is the trace a request or message belongs to, TraceParent identifies the trace and the
+// calling span.
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+// New starts a new trace.
+func New() TraceContext {
+	return TraceContext{TraceParent: fmt.Sprintf("%s-%s-%s-%s", version, randomHex(16), randomHex(8), sampled)}
+}
+
+// Parse returns the trace context of the headers, it is false if the traceparent is missing or malformed.
+func Parse(traceParent, traceState string) (TraceContext, bool) {
+	if !valid(traceParent) {
+		return TraceContext{}, false
+	}
+
+	return TraceContext{TraceParent: strings.ToLower(traceParent), TraceState: traceState}, true
+}
+
+// TraceID is the id shared by every span of the trace.
+func (tc TraceContext) TraceID() string {
+	if !valid(tc.TraceParent) {
+		return ""
+	}
+
+	return tc.TraceParent[3:35]
+}
+
+// Child returns the context of a new span in the same trace, it is sent with the outgoing calls and messages.
+func (tc TraceContext) Child() TraceContext {
+	if !valid(tc.TraceParent) {
+		return New()
+	}
+
+	parts := strings.Split(tc.TraceParent, "-")
+	return TraceContext{TraceParent: fmt.Sprintf("%s-%s-%s-%s", version, parts[1], randomHex(8), parts[3]), TraceState: tc.TraceState}
+}
+
+func NewContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, ctxKey{}, tc)
+}
+
+// FromContext returns the trace context of the request or message, the second value is false if it has none.
+func FromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(ctxKey{}).(TraceContext)
+	return tc, ok
+}
+
+// Outgoing returns the trace context of a call or message sent while handling ctx, a new trace is started
+// if ctx has none.
+func Outgoing(ctx context.Context) TraceContext {
+	if tc, ok := FromContext(ctx); ok {
+		return tc.Child()
+	}
+
+	return New()
+}
+
+// valid checks the version 00 format, version-traceid-parentid-flags with all zero ids being invalid.
+func valid(traceParent string) bool {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	if parts[0] == "ff" {
+		return false
+	}
+
+	for _, p := range parts {
+		if _, err := hex.DecodeString(p); err != nil {
+			return false
+		}
+	}
+
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,48 @@
+package tracecontext
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	tc := New()
+
+	_, ok := Parse(tc.TraceParent, "")
+	assert.True(t, ok)
+	assert.Len(t, tc.TraceID(), 32)
+	assert.NotEqual(t, tc.TraceID(), New().TraceID())
+}
+
+func TestParse(t *testing.T) {
+	tc, ok := Parse("00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "congo=t61rcWkgMzE")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceID())
+	assert.Equal(t, "congo=t61rcWkgMzE", tc.TraceState)
+
+	for _, tp := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok = Parse(tp, "")
+		assert.False(t, ok, tp)
+	}
+}
+
+func TestOutgoing(t *testing.T) {
+	parent, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "congo=t61rcWkgMzE")
+
+	child := Outgoing(NewContext(context.Background(), parent))
+
+	assert.Equal(t, parent.TraceID(), child.TraceID())
+	assert.NotEqual(t, parent.TraceParent, child.TraceParent)
+	assert.Equal(t, parent.TraceState, child.TraceState)
+
+	assert.NotEqual(t, parent.TraceID(), Outgoing(context.Background()).TraceID())
+}
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ETag formats the version of a resource as a strong entity tag.
+func ETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// MatchETag reports whether the If-Match or If-None-Match header lists the entity tag, "*" matches every tag.
+// If-Match uses the strong comparison where weak tags never match, If-None-Match the weak one.
+func MatchETag(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
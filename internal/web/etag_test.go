@@ -0,0 +1,31 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchETag(t *testing.T) {
+	etag := ETag(3)
+	assert.Equal(t, `"3"`, etag)
+
+	cases := []struct {
+		header string
+		weak   bool
+		match  bool
+	}{
+		{`"3"`, false, true},
+		{`"2", "3"`, false, true},
+		{`*`, false, true},
+		{`"2"`, false, false},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`"2", W/"3"`, true, true},
+		{``, true, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, MatchETag(c.header, etag, c.weak), c.header)
+	}
+}
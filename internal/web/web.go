@@ -6,17 +6,41 @@ import (
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/tamasbrandstadter/payments-api/internal/problem"
 )
 
-func RespondError(w http.ResponseWriter, code int, message string) {
-	log.Error("error while serving request: ", message)
+// RespondError responds with a problem document of the code, the details of internal errors are
+// only logged, the client gets the code and the request id to report them.
+func RespondError(w http.ResponseWriter, code problem.Code, detail string) {
+	respondProblem(w, problem.NewProblem(code, detail), detail)
+}
+
+// RespondProblem responds with the code of the error, errors without a code are internal errors.
+func RespondProblem(w http.ResponseWriter, err error) {
+	respondProblem(w, problem.FromError(err), err.Error())
+}
+
+func respondProblem(w http.ResponseWriter, p *problem.Problem, message string) {
+	log.Errorf("error while serving request: %s: %s", p.Code, message)
 
-	if code >= http.StatusInternalServerError && code != http.StatusServiceUnavailable && code != http.StatusNotImplemented {
-		code = http.StatusInternalServerError
-		message = http.StatusText(http.StatusInternalServerError)
+	if p.Status >= http.StatusInternalServerError && p.Code != problem.ServiceUnavailable {
+		p.Detail = ""
 	}
+	p.RequestID = w.Header().Get(RequestIDHeader)
 
-	Respond(w, code, map[string]string{"error": message})
+	response, err := json.Marshal(p)
+	if err != nil {
+		log.Error("could not marshal problem: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", problem.ContentType)
+	w.WriteHeader(p.Status)
+	if _, err = w.Write(response); err != nil {
+		log.Error("could not write response: ", err)
+	}
 }
 
 func Respond(w http.ResponseWriter, code int, payload interface{}) {
@@ -28,7 +52,7 @@ func Respond(w http.ResponseWriter, code int, payload interface{}) {
 
 	response, err := json.Marshal(payload)
 	if err != nil {
-		RespondError(w, http.StatusInternalServerError, fmt.Sprintf("unable to marshal response: %s", err.Error()))
+		RespondError(w, problem.Internal, fmt.Sprintf("unable to marshal response: %s", err.Error()))
 		return
 	}
 